@@ -0,0 +1,45 @@
+// Command ssosecret stores the client secret of a hospital's identity provider, sealed
+// with AUTH_SECRET_KEYS like the module does. The secret is read from standard input so
+// it does not end up in the shell history.
+//
+//	echo -n "$SECRET" | go run ./cmd/ssosecret -hospital 1
+package main
+
+import (
+	"bufio"
+	"flag"
+	"os"
+	"strings"
+
+	"eoncohub.com/auth_module/db"
+	"eoncohub.com/auth_module/models"
+	"eoncohub.com/auth_module/secrets"
+	"github.com/joho/godotenv"
+	"github.com/labstack/gommon/log"
+)
+
+func main() {
+	hospitalID := flag.Int64("hospital", 0, "ID_HOSPITAL of the HOSPITAL_IDP row")
+	flag.Parse()
+	if *hospitalID <= 0 {
+		log.Fatalf("-hospital is required")
+	}
+
+	_ = godotenv.Load()
+	if err := secrets.Check(); err != nil {
+		log.Fatalf("Error loading secret keys: %v", err)
+	}
+
+	line, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	secret := strings.TrimSpace(line)
+	if secret == "" {
+		log.Fatalf("No client secret on standard input")
+	}
+
+	db.InitDB()
+	defer db.CloseDB()
+	if err := models.SetClientSecret(*hospitalID, secret); err != nil {
+		log.Fatalf("Error storing client secret: %v", err)
+	}
+	log.Printf("Client secret stored for hospital %d", *hospitalID)
+}
@@ -14,6 +14,7 @@ require (
 )
 
 require (
+	eoncohub.com/shared_module v0.0.0
 	github.com/golang-sql/civil v0.0.0-20220223132316-b832511892a9 // indirect
 	github.com/golang-sql/sqlexp v0.1.0 // indirect
 	github.com/mattn/go-colorable v0.1.13 // indirect
@@ -26,3 +27,5 @@ require (
 	golang.org/x/text v0.17.0 // indirect
 	golang.org/x/time v0.5.0 // indirect
 )
+
+replace eoncohub.com/shared_module => ../Shared_Module
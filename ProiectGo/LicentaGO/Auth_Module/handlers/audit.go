@@ -0,0 +1,13 @@
+package handlers
+
+import (
+	"eoncohub.com/auth_module/models"
+	"github.com/labstack/echo/v4"
+)
+
+// Audit records an event together with the client address and user agent of the request.
+func Audit(c echo.Context, e models.AuditEvent) {
+	e.IP = c.RealIP()
+	e.UserAgent = c.Request().UserAgent()
+	models.RecordAudit(e)
+}
@@ -2,20 +2,25 @@ package handlers
 
 import (
 	"database/sql"
+	"errors"
 	"log"
 	"net/http"
 
 	"eoncohub.com/auth_module/db"
+	"eoncohub.com/auth_module/models"
 	"github.com/labstack/echo/v4"
 )
 
+type ResendConfirmationReq struct {
+	Email string `json:"email"`
+}
+
 func ConfirmEmail(c echo.Context) error {
 	confirmationToken := c.QueryParam("token")
 	if confirmationToken == "" {
 		log.Println("Confirmation token is missing")
 		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Missing confirmation token"})
 	}
-	log.Printf("Received confirmation token: %s", confirmationToken)
 
 	tx, err := db.DB.Begin()
 	if err != nil {
@@ -24,35 +29,37 @@ func ConfirmEmail(c echo.Context) error {
 	}
 	defer tx.Rollback()
 
+	userID, err := models.ConsumeUserToken(tx, confirmationToken, models.TokenPurposeConfirmEmail)
+	if err != nil {
+		if errors.Is(err, models.ErrInvalidUserToken) {
+			Audit(c, models.AuditEvent{Event: models.AuditEmailConfirmation, Outcome: models.AuditFailure, Details: err.Error()})
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid confirmation token"})
+		}
+		log.Printf("Failed to check confirmation token: %v", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to confirm email"})
+	}
+
 	updateUserQuery := `
         UPDATE XXAuth.USERS
         SET EMAIL_CONFIRMED = 1
-        WHERE CONFIRMATION_TOKEN = @token
+        WHERE ID_USER = @id_user
     `
-	result, err := tx.Exec(updateUserQuery, sql.Named("token", confirmationToken))
+	_, err = tx.Exec(updateUserQuery, sql.Named("id_user", userID))
 	if err != nil {
 		log.Printf("Failed to update EMAIL_CONFIRMED: %v", err)
 		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to confirm email"})
 	}
 
-	rowsAffected, err := result.RowsAffected()
-	if err != nil {
-		log.Printf("Failed to retrieve rows affected: %v", err)
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to confirm email"})
-	}
-	if rowsAffected == 0 {
-		log.Println("No rows affected, invalid confirmation token")
-		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid confirmation token"})
-	}
-
 	updateRoleQuery := `
         UPDATE XXAuth.USER_ROLES
-        SET STATUS = 'ACTIVE'
-        WHERE ID_USER = (
-            SELECT ID_USER FROM XXAuth.USERS WHERE CONFIRMATION_TOKEN = @token
-        )
+        SET STATUS = @active
+        WHERE ID_USER = @id_user AND STATUS = @inactive
     `
-	_, err = tx.Exec(updateRoleQuery, sql.Named("token", confirmationToken))
+	_, err = tx.Exec(updateRoleQuery,
+		sql.Named("active", models.StatusActive),
+		sql.Named("id_user", userID),
+		sql.Named("inactive", models.StatusInactive),
+	)
 	if err != nil {
 		log.Printf("Failed to update USER_ROLES: %v", err)
 		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to activate user role"})
@@ -62,9 +69,29 @@ func ConfirmEmail(c echo.Context) error {
 		log.Printf("Failed to commit transaction: %v", err)
 		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to commit transaction"})
 	}
-	log.Println("Transaction committed successfully")
 
-	log.Printf("Email confirmed successfully for token: %s", confirmationToken)
+	log.Printf("Email confirmed successfully for user %d", userID)
+	Audit(c, models.AuditEvent{Event: models.AuditEmailConfirmation, Outcome: models.AuditSuccess, UserID: userID})
 
 	return c.JSON(http.StatusOK, map[string]string{"message": "Email confirmed successfully"})
 }
+
+// ResendConfirmation sends a fresh confirmation link. The response is the same whether
+// or not the email belongs to an account waiting for confirmation.
+func ResendConfirmation(c echo.Context) error {
+	var req ResendConfirmationReq
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request"})
+	}
+	if req.Email == "" {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Email is required"})
+	}
+
+	if err := models.ResendConfirmation(req.Email); err != nil {
+		log.Printf("Failed to resend confirmation: %v", err)
+	}
+
+	return c.JSON(http.StatusOK, map[string]string{
+		"message": "If the account is waiting for confirmation, a new confirmation email has been sent",
+	})
+}
@@ -1,25 +1,22 @@
 package handlers
 
 import (
-	"database/sql"
-	"fmt"
+	"errors"
 	"log"
 	"net/http"
-	"os"
 
 	"eoncohub.com/auth_module/db"
 	"eoncohub.com/auth_module/models"
-	"eoncohub.com/auth_module/utils"
-	"github.com/google/uuid"
+	"eoncohub.com/auth_module/password"
 	"github.com/labstack/echo/v4"
-	"github.com/sendgrid/sendgrid-go"
-	"github.com/sendgrid/sendgrid-go/helpers/mail"
 )
 
 type ForgotPasswordReq struct {
 	Email string `json:"email"`
 }
 
+// RequestPasswordReset emails a reset link to active accounts. It answers the same way
+// for unknown emails and delivery failures so it cannot be used to probe for accounts.
 func RequestPasswordReset(c echo.Context) error {
 	var req ForgotPasswordReq
 	err := c.Bind(&req)
@@ -28,72 +25,26 @@ func RequestPasswordReset(c echo.Context) error {
 	}
 	email := req.Email
 
-	// check if user exists
-
 	if email == "" {
 		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Email is required"})
 	}
 
-	_, err = models.GetUserByEmail(email)
-	if err != nil {
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "User does not exists"})
-	}
-
-	tx, err := db.DB.Begin()
-	if err != nil {
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error"})
-	}
-	defer tx.Rollback()
-
-	resetToken := uuid.New().String()
-	resetLink := fmt.Sprintf("http://localhost:3000/reset-password?token=%s", resetToken)
-
-	query := `
-    UPDATE XXAuth.USERS
-    SET RESET_TOKEN = @reset_token
-    WHERE EMAIL = @user_email
-    `
-	_, err = tx.Exec(query, sql.Named("reset_token", resetToken), sql.Named("user_email", email))
+	event := models.AuditEvent{Event: models.AuditPasswordResetRequest, Outcome: models.AuditSuccess, Username: email}
+	userID, err := models.RequestPasswordReset(email)
+	event.UserID = userID
 	if err != nil {
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to set reset token"})
-	}
-
-	if err := tx.Commit(); err != nil {
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to commit transaction"})
-	}
-
-	err = sendResetEmail(email, resetLink)
-	if err != nil {
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to send reset email"})
-	}
-
-	return c.JSON(http.StatusOK, map[string]string{"message": "Password reset email sent"})
-}
-
-func sendResetEmail(toEmail string, resetLink string) error {
-	sendGridAPIKey := os.Getenv("SENDGRID_API_KEY")
-	if sendGridAPIKey == "" {
-		return fmt.Errorf("SendGrid API key is not set")
-	}
-
-	from := mail.NewEmail("Eoncohub", "serban-timofte@outlook.com")
-	subject := "Password Reset Request"
-	to := mail.NewEmail("", toEmail)
-	plainTextContent := fmt.Sprintf("Please reset your password by clicking the following link: %s", resetLink)
-	htmlContent := fmt.Sprintf("<p>Please reset your password by clicking the following link:</p><a href=\"%s\">Reset Password</a>", resetLink)
-	message := mail.NewSingleEmail(from, subject, to, plainTextContent, htmlContent)
-	client := sendgrid.NewSendClient(sendGridAPIKey)
-	response, err := client.Send(message)
-	if err != nil {
-		log.Printf("Failed to send email: %v", err)
-		return err
-	}
-	if response.StatusCode >= 400 {
-		log.Printf("Failed to send email. Status Code: %d, Body: %s", response.StatusCode, response.Body)
-		return fmt.Errorf("failed to send email, status code: %d", response.StatusCode)
-	}
-	log.Printf("Password reset email sent to %s", toEmail)
-	return nil
+		log.Printf("Password reset request failed: %v", err)
+		event.Outcome = models.AuditFailure
+		event.Details = err.Error()
+	} else if userID == 0 {
+		event.Outcome = models.AuditFailure
+		event.Details = "no active account"
+	}
+	Audit(c, event)
+
+	return c.JSON(http.StatusOK, map[string]string{
+		"message": "If an account exists for this email, a password reset link has been sent",
+	})
 }
 
 func ConfirmPasswordReset(c echo.Context) error {
@@ -109,34 +60,40 @@ func ConfirmPasswordReset(c echo.Context) error {
 	}
 	defer tx.Rollback()
 
-	hashedPassword, err := utils.HashPassword(newPassword)
+	userID, err := models.ConsumeUserToken(tx, resetToken, models.TokenPurposeResetPassword)
 	if err != nil {
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to hash password"})
+		if errors.Is(err, models.ErrInvalidUserToken) {
+			Audit(c, models.AuditEvent{Event: models.AuditPasswordReset, Outcome: models.AuditFailure, Details: err.Error()})
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid reset token"})
+		}
+		log.Printf("Failed to check reset token: %v", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to reset password"})
 	}
 
-	updateQuery := `
-    UPDATE XXAuth.USERS
-    SET PASSWORD = @new_password, RESET_TOKEN = NULL
-    WHERE RESET_TOKEN = @token
-    `
-	result, err := tx.Exec(updateQuery, sql.Named("new_password", hashedPassword), sql.Named("token", resetToken))
-	if err != nil {
+	if err := models.SetPassword(tx, userID, newPassword); err != nil {
+		Audit(c, models.AuditEvent{Event: models.AuditPasswordReset, Outcome: models.AuditFailure, UserID: userID, Details: err.Error()})
+		var policyErr *password.PolicyError
+		if errors.As(err, &policyErr) {
+			return c.JSON(http.StatusBadRequest, map[string]any{"error": "Password does not meet the policy", "problems": policyErr.Problems})
+		}
+		if errors.Is(err, models.ErrPasswordReused) {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Password was used recently"})
+		}
 		log.Printf("Failed to update password: %v", err)
 		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to reset password"})
 	}
 
-	rowsAffected, err := result.RowsAffected()
-	if err != nil {
+	// A reset means the old password may be compromised, so end every open session.
+	if err := models.RevokeUserSessions(tx, userID); err != nil {
+		log.Printf("Failed to revoke sessions: %v", err)
 		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to reset password"})
 	}
-	if rowsAffected == 0 {
-		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid reset token"})
-	}
 
 	if err := tx.Commit(); err != nil {
 		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to commit transaction"})
 	}
 
-	log.Printf("Password reset successfully for token: %s", resetToken)
+	log.Printf("Password reset successfully for user %d", userID)
+	Audit(c, models.AuditEvent{Event: models.AuditPasswordReset, Outcome: models.AuditSuccess, UserID: userID})
 	return c.JSON(http.StatusOK, map[string]string{"message": "Password reset successfully"})
 }
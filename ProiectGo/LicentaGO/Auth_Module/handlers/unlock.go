@@ -0,0 +1,28 @@
+package handlers
+
+import (
+	"errors"
+	"log"
+	"net/http"
+
+	"eoncohub.com/auth_module/models"
+	"github.com/labstack/echo/v4"
+)
+
+// UnlockAccount lifts a login lockout through the link emailed when the account was locked.
+func UnlockAccount(c echo.Context) error {
+	token := c.QueryParam("token")
+	if token == "" {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Missing unlock token"})
+	}
+
+	if err := models.UnlockAccountByToken(token); err != nil {
+		if errors.Is(err, models.ErrInvalidUnlockToken) {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid unlock token"})
+		}
+		log.Printf("Failed to unlock account: %v", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to unlock account"})
+	}
+
+	return c.JSON(http.StatusOK, map[string]string{"message": "Account unlocked successfully"})
+}
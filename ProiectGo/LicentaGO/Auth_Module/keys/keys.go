@@ -0,0 +1,331 @@
+package keys
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"database/sql"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"sort"
+	"sync"
+	"time"
+
+	"eoncohub.com/auth_module/db"
+	"eoncohub.com/auth_module/models"
+	"eoncohub.com/auth_module/secrets"
+	"eoncohub.com/auth_module/utils"
+	"github.com/golang-jwt/jwt"
+	"github.com/google/uuid"
+)
+
+// Tokens are signed with RS256. The private keys live in XXAuth.SIGNING_KEYS, sealed with
+// AUTH_SECRET_KEYS (see the secrets package); the other modules only see the public
+// halves through /.well-known/jwks.json.
+const (
+	algorithm = "RS256"
+	keyBits   = 2048
+
+	rotationCheckInterval = 10 * time.Minute
+)
+
+var ErrUnknownKey = errors.New("unknown signing key")
+
+type signingKey struct {
+	kid       string
+	private   *rsa.PrivateKey
+	createdAt time.Time
+}
+
+type keyRing struct {
+	mu     sync.RWMutex
+	active *signingKey
+	keys   map[string]*signingKey
+}
+
+var ring = &keyRing{keys: map[string]*signingKey{}}
+
+// rotationInterval is how long a key signs new tokens before a fresh one replaces it.
+func rotationInterval() time.Duration {
+	return utils.DurationFromEnv("JWT_KEY_ROTATION_INTERVAL", 30*24*time.Hour)
+}
+
+// overlapWindow is how long a retired key is still published and accepted, so tokens
+// signed just before a rotation stay valid. It never drops below the access token TTL.
+func overlapWindow() time.Duration {
+	overlap := utils.DurationFromEnv("JWT_KEY_OVERLAP", 24*time.Hour)
+	if ttl := models.AccessTokenTTL(); overlap < ttl {
+		return ttl
+	}
+	return overlap
+}
+
+// Init loads the keys, creating the first one if needed, and starts the scheduled rotation.
+func Init() error {
+	if err := rotateIfDue(false); err != nil {
+		return err
+	}
+	if err := load(); err != nil {
+		return err
+	}
+
+	go func() {
+		ticker := time.NewTicker(rotationCheckInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if err := rotateIfDue(false); err != nil {
+				log.Printf("Signing key rotation failed: %v", err)
+			}
+			if err := load(); err != nil {
+				log.Printf("Signing key reload failed: %v", err)
+			}
+		}
+	}()
+	return nil
+}
+
+// Rotate retires the current key immediately and starts signing with a new one.
+func Rotate() error {
+	if err := rotateIfDue(true); err != nil {
+		return err
+	}
+	return load()
+}
+
+// Sign signs the claims with the active key and puts its ID in the "kid" header.
+func Sign(claims jwt.Claims) (string, error) {
+	ring.mu.RLock()
+	active := ring.active
+	ring.mu.RUnlock()
+	if active == nil {
+		return "", errors.New("no active signing key")
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = active.kid
+	return token.SignedString(active.private)
+}
+
+// Keyfunc resolves the public key for a token signed by this module.
+func Keyfunc(t *jwt.Token) (interface{}, error) {
+	if _, ok := t.Method.(*jwt.SigningMethodRSA); !ok {
+		return nil, errors.New("unexpected signing method")
+	}
+	kid, _ := t.Header["kid"].(string)
+
+	ring.mu.RLock()
+	defer ring.mu.RUnlock()
+	key, ok := ring.keys[kid]
+	if !ok {
+		return nil, ErrUnknownKey
+	}
+	return &key.private.PublicKey, nil
+}
+
+type JSONWebKey struct {
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+type JSONWebKeySet struct {
+	Keys []JSONWebKey `json:"keys"`
+}
+
+// JWKS returns every key that may still have signed a valid token, newest first.
+func JWKS() JSONWebKeySet {
+	ring.mu.RLock()
+	keys := make([]*signingKey, 0, len(ring.keys))
+	for _, k := range ring.keys {
+		keys = append(keys, k)
+	}
+	ring.mu.RUnlock()
+
+	sort.Slice(keys, func(i, j int) bool { return keys[i].createdAt.After(keys[j].createdAt) })
+
+	set := JSONWebKeySet{Keys: make([]JSONWebKey, 0, len(keys))}
+	for _, k := range keys {
+		pub := k.private.PublicKey
+		set.Keys = append(set.Keys, JSONWebKey{
+			Kty: "RSA",
+			Use: "sig",
+			Alg: algorithm,
+			Kid: k.kid,
+			N:   base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+			E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+		})
+	}
+	return set
+}
+
+// load replaces the in-memory ring with the keys that have not expired yet.
+func load() error {
+	rows, err := db.DB.Query(`
+		SELECT KID, PRIVATE_KEY, CREATED_AT, RETIRED_AT
+		FROM XXAuth.SIGNING_KEYS
+		WHERE EXPIRES_AT IS NULL OR EXPIRES_AT > SYSUTCDATETIME()
+		ORDER BY CREATED_AT DESC
+	`)
+	if err != nil {
+		return fmt.Errorf("query SIGNING_KEYS: %w", err)
+	}
+	defer rows.Close()
+
+	keys := map[string]*signingKey{}
+	stale := map[string]string{}
+	var active *signingKey
+	for rows.Next() {
+		var kid, stored string
+		var createdAt time.Time
+		var retiredAt sql.NullTime
+		if err := rows.Scan(&kid, &stored, &createdAt, &retiredAt); err != nil {
+			return fmt.Errorf("scan signing key: %w", err)
+		}
+
+		privatePEM, err := secrets.Open(keyContext(kid), stored)
+		if err != nil {
+			return fmt.Errorf("open signing key %s: %w", kid, err)
+		}
+		private, err := decodePrivateKey(privatePEM)
+		if err != nil {
+			return fmt.Errorf("decode signing key %s: %w", kid, err)
+		}
+		if secrets.Stale(stored) {
+			stale[kid] = stored
+		}
+
+		key := &signingKey{kid: kid, private: private, createdAt: createdAt}
+		keys[kid] = key
+		if active == nil && !retiredAt.Valid {
+			active = key
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("iterate signing keys: %w", err)
+	}
+	if active == nil {
+		return errors.New("no active signing key")
+	}
+
+	ring.mu.Lock()
+	ring.keys = keys
+	ring.active = active
+	ring.mu.Unlock()
+
+	for kid, stored := range stale {
+		if err := reseal(kid, stored, keys[kid].private); err != nil {
+			log.Printf("Sealing signing key %s failed: %v", kid, err)
+		}
+	}
+	return nil
+}
+
+// reseal stores a key that was kept in plain PEM, or sealed with a retired secret key,
+// sealed with the active one. Another instance doing the same first is fine.
+func reseal(kid, stored string, private *rsa.PrivateKey) error {
+	sealed, err := sealPrivateKey(kid, private)
+	if err != nil {
+		return err
+	}
+	_, err = db.DB.Exec(`
+		UPDATE XXAuth.SIGNING_KEYS SET PRIVATE_KEY = @sealed WHERE KID = @kid AND PRIVATE_KEY = @stored
+	`, sql.Named("sealed", sealed), sql.Named("kid", kid), sql.Named("stored", stored))
+	if err != nil {
+		return fmt.Errorf("update SIGNING_KEYS: %w", err)
+	}
+	return nil
+}
+
+// rotateIfDue creates a new key when there is none, the active one is older than the
+// rotation interval, or force is set. The lock keeps concurrent instances from rotating twice.
+func rotateIfDue(force bool) error {
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return fmt.Errorf("start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var createdAt time.Time
+	err = tx.QueryRow(`
+		SELECT TOP 1 CREATED_AT
+		FROM XXAuth.SIGNING_KEYS WITH (UPDLOCK, HOLDLOCK)
+		WHERE RETIRED_AT IS NULL
+		ORDER BY CREATED_AT DESC
+	`).Scan(&createdAt)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+	case err != nil:
+		return fmt.Errorf("query SIGNING_KEYS: %w", err)
+	case !force && time.Since(createdAt) < rotationInterval():
+		return nil
+	}
+
+	private, err := rsa.GenerateKey(rand.Reader, keyBits)
+	if err != nil {
+		return fmt.Errorf("generate signing key: %w", err)
+	}
+	kid := uuid.New().String()
+	sealed, err := sealPrivateKey(kid, private)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`
+		UPDATE XXAuth.SIGNING_KEYS
+		SET RETIRED_AT = SYSUTCDATETIME(), EXPIRES_AT = DATEADD(SECOND, @overlap, SYSUTCDATETIME())
+		WHERE RETIRED_AT IS NULL
+	`, sql.Named("overlap", int64(overlapWindow().Seconds())))
+	if err != nil {
+		return fmt.Errorf("retire signing key: %w", err)
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO XXAuth.SIGNING_KEYS (KID, ALGORITHM, PRIVATE_KEY)
+		VALUES (@kid, @algorithm, @private_key)
+	`,
+		sql.Named("kid", kid),
+		sql.Named("algorithm", algorithm),
+		sql.Named("private_key", sealed),
+	)
+	if err != nil {
+		return fmt.Errorf("insert SIGNING_KEYS: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("commit transaction: %w", err)
+	}
+	log.Printf("Rotated JWT signing key, new kid %s", kid)
+	return nil
+}
+
+func keyContext(kid string) string {
+	return "signing_key:" + kid
+}
+
+// sealPrivateKey encodes the key as PEM and seals it for storage under kid.
+func sealPrivateKey(kid string, key *rsa.PrivateKey) (string, error) {
+	encoded := pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(key),
+	})
+	sealed, err := secrets.Seal(keyContext(kid), string(encoded))
+	if err != nil {
+		return "", fmt.Errorf("seal signing key: %w", err)
+	}
+	return sealed, nil
+}
+
+func decodePrivateKey(s string) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode([]byte(s))
+	if block == nil {
+		return nil, errors.New("invalid PEM")
+	}
+	return x509.ParsePKCS1PrivateKey(block.Bytes)
+}
@@ -0,0 +1,59 @@
+package mailer
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+type fileSender struct {
+	dir  string
+	from Address
+}
+
+// NewFileSender writes every message as an .eml file into dir, for local runs and tests.
+func NewFileSender(dir string, from Address) (Sender, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("create mail dir: %w", err)
+	}
+	return &fileSender{dir: dir, from: from}, nil
+}
+
+func (s *fileSender) Send(msg Message) error {
+	name := fmt.Sprintf("%s_%s.eml", time.Now().UTC().Format("20060102T150405.000000000"), sanitizeFileName(msg.To))
+	path := filepath.Join(s.dir, name)
+	if err := os.WriteFile(path, buildMIME(s.from, msg), 0o644); err != nil {
+		return fmt.Errorf("write email: %w", err)
+	}
+	log.Printf("Email to %s written to %s", msg.To, path)
+	return nil
+}
+
+type logSender struct {
+	from Address
+}
+
+// NewLogSender logs the recipient and template of each message and drops it. The body is
+// not logged: it carries live confirmation, reset and unlock links. Use the file backend
+// to read the messages locally.
+func NewLogSender(from Address) Sender {
+	return &logSender{from: from}
+}
+
+func (s *logSender) Send(msg Message) error {
+	log.Printf("Email from %s to %s not sent (log backend), template %s", s.from.Email, msg.To, msg.Template)
+	return nil
+}
+
+func sanitizeFileName(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '.', r == '-', r == '@':
+			return r
+		}
+		return '_'
+	}, s)
+}
@@ -0,0 +1,81 @@
+package mailer
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Message is a rendered email ready to be handed to a Sender.
+type Message struct {
+	To       string
+	Template string
+	Subject  string
+	Text     string
+	HTML     string
+}
+
+// Sender delivers a single message. Implementations must be safe for concurrent use.
+type Sender interface {
+	Send(msg Message) error
+}
+
+// Address is the sender identity used by every backend.
+type Address struct {
+	Name  string
+	Email string
+}
+
+func fromAddress() Address {
+	return Address{
+		Name:  envOr("MAIL_FROM_NAME", "Eoncohub"),
+		Email: envOr("MAIL_FROM", "no-reply@eoncohub.com"),
+	}
+}
+
+// NewSenderFromEnv picks the backend named by MAIL_BACKEND: "sendgrid", "smtp", "file"
+// or "log". Without it SendGrid is used when SENDGRID_API_KEY is set. The log sink, which
+// drops every message, is only picked by default when APP_ENV is "development", so
+// registration also works locally without any mail account; elsewhere a missing mail
+// configuration stops the module instead of silently losing the emails.
+func NewSenderFromEnv() (Sender, error) {
+	from := fromAddress()
+
+	backend := strings.ToLower(os.Getenv("MAIL_BACKEND"))
+	if backend == "" {
+		switch {
+		case os.Getenv("SENDGRID_API_KEY") != "":
+			backend = "sendgrid"
+		case strings.EqualFold(os.Getenv("APP_ENV"), "development"):
+			backend = "log"
+		default:
+			return nil, errors.New("MAIL_BACKEND or SENDGRID_API_KEY must be set outside development")
+		}
+	}
+
+	switch backend {
+	case "sendgrid":
+		return NewSendGridSender(os.Getenv("SENDGRID_API_KEY"), from)
+	case "smtp":
+		return NewSMTPSender(SMTPConfig{
+			Host:     os.Getenv("SMTP_HOST"),
+			Port:     envOr("SMTP_PORT", "587"),
+			Username: os.Getenv("SMTP_USERNAME"),
+			Password: os.Getenv("SMTP_PASSWORD"),
+		}, from)
+	case "file":
+		return NewFileSender(envOr("MAIL_FILE_DIR", "mail_out"), from)
+	case "log":
+		return NewLogSender(from), nil
+	default:
+		return nil, fmt.Errorf("unknown MAIL_BACKEND %q", backend)
+	}
+}
+
+func envOr(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
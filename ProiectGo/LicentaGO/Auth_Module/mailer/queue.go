@@ -0,0 +1,149 @@
+package mailer
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"sync"
+	"time"
+
+	"eoncohub.com/auth_module/utils"
+)
+
+var (
+	ErrQueueFull   = errors.New("mail queue is full")
+	ErrQueueClosed = errors.New("mail queue is closed")
+)
+
+// Queue delivers messages in the background and retries failed sends with exponential
+// backoff, so a mail outage does not fail the request that triggered the email.
+//
+// The queue lives in memory only: messages still queued or waiting for a retry when the
+// module stops are lost. Close delivers the queued ones on a clean shutdown; after a
+// crash the links have to be requested again (resend confirmation, password reset).
+type Queue struct {
+	sender      Sender
+	jobs        chan Message
+	maxAttempts int
+	baseDelay   time.Duration
+
+	mu     sync.RWMutex
+	closed bool
+	wg     sync.WaitGroup
+}
+
+func NewQueue(sender Sender, size, maxAttempts int, baseDelay time.Duration) *Queue {
+	return &Queue{
+		sender:      sender,
+		jobs:        make(chan Message, size),
+		maxAttempts: maxAttempts,
+		baseDelay:   baseDelay,
+	}
+}
+
+// Start launches the delivery workers.
+func (q *Queue) Start(workers int) {
+	for i := 0; i < workers; i++ {
+		q.wg.Add(1)
+		go q.work()
+	}
+}
+
+// Enqueue accepts a message for delivery without waiting for it to be sent.
+func (q *Queue) Enqueue(msg Message) error {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	if q.closed {
+		return ErrQueueClosed
+	}
+
+	select {
+	case q.jobs <- msg:
+		return nil
+	default:
+		return ErrQueueFull
+	}
+}
+
+// Close stops accepting messages and waits for the queued ones to be delivered or given up.
+func (q *Queue) Close() {
+	q.mu.Lock()
+	if q.closed {
+		q.mu.Unlock()
+		return
+	}
+	q.closed = true
+	close(q.jobs)
+	q.mu.Unlock()
+
+	q.wg.Wait()
+}
+
+func (q *Queue) work() {
+	defer q.wg.Done()
+	for msg := range q.jobs {
+		q.deliver(msg)
+	}
+}
+
+func (q *Queue) deliver(msg Message) {
+	for attempt := 1; attempt <= q.maxAttempts; attempt++ {
+		err := q.sender.Send(msg)
+		if err == nil {
+			return
+		}
+		if attempt == q.maxAttempts {
+			log.Printf("Giving up on email to %s (%q) after %d attempts: %v", msg.To, msg.Subject, attempt, err)
+			return
+		}
+
+		delay := time.Duration(math.Pow(2, float64(attempt-1))) * q.baseDelay
+		log.Printf("Email to %s failed (attempt %d/%d), retrying in %s: %v", msg.To, attempt, q.maxAttempts, delay, err)
+		time.Sleep(delay)
+	}
+}
+
+var defaultQueue *Queue
+
+// Init builds the sender configured in the environment and starts the shared queue.
+func Init() error {
+	sender, err := NewSenderFromEnv()
+	if err != nil {
+		return err
+	}
+
+	defaultQueue = NewQueue(
+		sender,
+		utils.IntFromEnv("MAIL_QUEUE_SIZE", 100),
+		utils.IntFromEnv("MAIL_MAX_ATTEMPTS", 5),
+		utils.DurationFromEnv("MAIL_RETRY_DELAY", 2*time.Second),
+	)
+	defaultQueue.Start(utils.IntFromEnv("MAIL_WORKERS", 2))
+	return nil
+}
+
+// Shutdown flushes the shared queue.
+func Shutdown() {
+	if defaultQueue != nil {
+		defaultQueue.Close()
+	}
+}
+
+// Send renders a template and queues the result for delivery to one recipient.
+func Send(to, name, locale string, data any) error {
+	if defaultQueue == nil {
+		return errors.New("mailer is not initialised")
+	}
+
+	msg, err := Render(name, locale, data)
+	if err != nil {
+		return err
+	}
+	msg.To = to
+
+	if err := defaultQueue.Enqueue(msg); err != nil {
+		return fmt.Errorf("queue email to %s: %w", to, err)
+	}
+	return nil
+}
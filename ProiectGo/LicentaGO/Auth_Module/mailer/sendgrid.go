@@ -0,0 +1,40 @@
+package mailer
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/sendgrid/sendgrid-go"
+	"github.com/sendgrid/sendgrid-go/helpers/mail"
+)
+
+type sendGridSender struct {
+	client *sendgrid.Client
+	from   Address
+}
+
+func NewSendGridSender(apiKey string, from Address) (Sender, error) {
+	if apiKey == "" {
+		return nil, errors.New("SendGrid API key is missing")
+	}
+	return &sendGridSender{client: sendgrid.NewSendClient(apiKey), from: from}, nil
+}
+
+func (s *sendGridSender) Send(msg Message) error {
+	message := mail.NewSingleEmail(
+		mail.NewEmail(s.from.Name, s.from.Email),
+		msg.Subject,
+		mail.NewEmail("", msg.To),
+		msg.Text,
+		msg.HTML,
+	)
+
+	resp, err := s.client.Send(message)
+	if err != nil {
+		return fmt.Errorf("send email: %w", err)
+	}
+	if resp.StatusCode >= 400 {
+		return fmt.Errorf("sendgrid error: status %d: %s", resp.StatusCode, resp.Body)
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+package mailer
+
+import (
+	"bytes"
+	"embed"
+	"fmt"
+	htmltemplate "html/template"
+	"io/fs"
+	"os"
+	"strings"
+	texttemplate "text/template"
+	"time"
+)
+
+// Template names, one file per locale under templates/<locale>/<name>.tmpl. Each file
+// defines a "subject", a "text" and an "html" block.
+const (
+	TemplateConfirmAccount = "confirm_account"
+	TemplateConfirmEmail   = "confirm_email"
+	TemplateResetPassword  = "reset_password"
+	TemplateAccountLocked  = "account_locked"
+	TemplateBreakGlass     = "break_glass"
+)
+
+const fallbackLocale = "en"
+
+//go:embed templates
+var embeddedTemplates embed.FS
+
+// templateFS returns MAIL_TEMPLATE_DIR when set, so texts can be edited without a rebuild,
+// and the templates compiled into the binary otherwise.
+func templateFS() fs.FS {
+	if dir := os.Getenv("MAIL_TEMPLATE_DIR"); dir != "" {
+		return os.DirFS(dir)
+	}
+	sub, _ := fs.Sub(embeddedTemplates, "templates")
+	return sub
+}
+
+var templateFuncs = map[string]any{
+	"duration": shortDuration,
+}
+
+// shortDuration prints a validity period without zero units, e.g. "48h" or "30m".
+func shortDuration(d time.Duration) string {
+	s := d.String()
+	if strings.HasSuffix(s, "m0s") {
+		s = strings.TrimSuffix(s, "0s")
+	}
+	if strings.HasSuffix(s, "h0m") {
+		s = strings.TrimSuffix(s, "0m")
+	}
+	return s
+}
+
+// DefaultLocale is MAIL_LOCALE, Romanian unless configured otherwise.
+func DefaultLocale() string {
+	return envOr("MAIL_LOCALE", "ro")
+}
+
+// Render builds the message for a template in the given locale, falling back to the
+// default locale and then to English when the template is not translated.
+func Render(name, locale string, data any) (Message, error) {
+	fsys := templateFS()
+
+	var src []byte
+	var err error
+	for _, l := range []string{locale, DefaultLocale(), fallbackLocale} {
+		if l == "" {
+			continue
+		}
+		src, err = fs.ReadFile(fsys, l+"/"+name+".tmpl")
+		if err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return Message{}, fmt.Errorf("load template %s: %w", name, err)
+	}
+
+	text, err := texttemplate.New(name).Funcs(texttemplate.FuncMap(templateFuncs)).Parse(string(src))
+	if err != nil {
+		return Message{}, fmt.Errorf("parse template %s: %w", name, err)
+	}
+	html, err := htmltemplate.New(name).Funcs(htmltemplate.FuncMap(templateFuncs)).Parse(string(src))
+	if err != nil {
+		return Message{}, fmt.Errorf("parse template %s: %w", name, err)
+	}
+
+	var subject, plain, body bytes.Buffer
+	if err := text.ExecuteTemplate(&subject, "subject", data); err != nil {
+		return Message{}, fmt.Errorf("render %s subject: %w", name, err)
+	}
+	if err := text.ExecuteTemplate(&plain, "text", data); err != nil {
+		return Message{}, fmt.Errorf("render %s text: %w", name, err)
+	}
+	if err := html.ExecuteTemplate(&body, "html", data); err != nil {
+		return Message{}, fmt.Errorf("render %s html: %w", name, err)
+	}
+
+	return Message{
+		Template: name,
+		Subject:  strings.TrimSpace(subject.String()),
+		Text:     strings.TrimSpace(plain.String()),
+		HTML:     strings.TrimSpace(body.String()),
+	}, nil
+}
@@ -2,7 +2,12 @@ package main
 
 import (
 	"eoncohub.com/auth_module/db"
+	"eoncohub.com/auth_module/keys"
+	"eoncohub.com/auth_module/mailer"
+	"eoncohub.com/auth_module/models"
 	"eoncohub.com/auth_module/routes"
+	"eoncohub.com/auth_module/secrets"
+	"eoncohub.com/shared_module/auth"
 	"fmt"
 	"github.com/joho/godotenv"
 	"github.com/labstack/echo/v4"
@@ -19,12 +24,28 @@ func main() {
 	}
 	db.InitDB()
 	defer db.CloseDB()
+	if err := secrets.Check(); err != nil {
+		log.Fatalf("Error loading secret keys: %v", err)
+	}
+	if err := keys.Init(); err != nil {
+		log.Fatalf("Error loading signing keys: %v", err)
+	}
+	if err := mailer.Init(); err != nil {
+		log.Fatalf("Error configuring mail delivery: %v", err)
+	}
+	defer mailer.Shutdown()
+	models.StartRegistrationRecovery()
 	e := echo.New()
+	ipExtractor, err := auth.IPExtractor()
+	if err != nil {
+		log.Fatalf("Error configuring client IPs: %v", err)
+	}
+	e.IPExtractor = ipExtractor
 	e.Use(middleware.Logger())
 	e.Use(middleware.Recover())
 	e.Use(middleware.CORSWithConfig(middleware.CORSConfig{
 		AllowOrigins:     []string{"http://localhost:3000"},
-		AllowHeaders:     []string{echo.HeaderOrigin, echo.HeaderContentType, echo.HeaderAccept},
+		AllowHeaders:     []string{echo.HeaderOrigin, echo.HeaderContentType, echo.HeaderAccept, echo.HeaderAuthorization, auth.CSRFHeader},
 		AllowMethods:     []string{http.MethodGet, http.MethodHead, http.MethodPut, http.MethodPatch, http.MethodPost, http.MethodDelete},
 		AllowCredentials: true,
 	}))
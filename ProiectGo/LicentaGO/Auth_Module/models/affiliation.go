@@ -0,0 +1,206 @@
+package models
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+
+	"eoncohub.com/auth_module/db"
+	"eoncohub.com/shared_module/auth"
+)
+
+var (
+	ErrNotAffiliated     = errors.New("user has no active role at this hospital")
+	ErrAffiliationExists = errors.New("doctor is already affiliated with this hospital")
+)
+
+// Affiliation is a hospital where the user holds at least one active role. Doctors also
+// get their XXPerson.DOCTORS_AND_HOSPITALS row there.
+type Affiliation struct {
+	IDHospital       int64    `json:"id_hospital"`
+	Name             string   `json:"name"`
+	Roles            []string `json:"roles"`
+	IDDoctorHospital int64    `json:"id_doctor_hospital,omitempty"`
+	Current          bool     `json:"current"`
+}
+
+// GetAffiliations lists the hospitals the user can switch to, by name. currentHospitalID
+// marks the one the access token is scoped to.
+func GetAffiliations(userID, personID, currentHospitalID int64) ([]Affiliation, error) {
+	rows, err := db.DB.Query(`
+		SELECT ur.ID_HOSPITAL, h.NAME, r.CODE, dh.ID_DOCTOR_HOSPITAL
+		FROM XXAuth.USER_ROLES ur
+		JOIN XXAuth.ROLES r ON r.ID_ROLE = ur.ID_ROLE
+		JOIN XXPerson.HOSPITALS h ON h.ID_HOSPITAL = ur.ID_HOSPITAL
+		LEFT JOIN XXPerson.DOCTORS d ON d.ID_PERSON = @id_person AND d.ISDELETED = 0
+		LEFT JOIN XXPerson.DOCTORS_AND_HOSPITALS dh
+		       ON dh.ID_DOCTOR = d.ID_DOCTOR AND dh.ID_HOSPITAL = ur.ID_HOSPITAL AND dh.IS_ACTIVE = 1
+		WHERE ur.ID_USER = @id_user AND ur.STATUS = @active
+	`,
+		sql.Named("id_user", userID),
+		sql.Named("id_person", personID),
+		sql.Named("active", StatusActive),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("query affiliations: %w", err)
+	}
+	defer rows.Close()
+
+	byHospital := map[int64]*Affiliation{}
+	for rows.Next() {
+		var hospitalID int64
+		var name, role string
+		var doctorHospital sql.NullInt64
+		if err := rows.Scan(&hospitalID, &name, &role, &doctorHospital); err != nil {
+			return nil, fmt.Errorf("scan affiliation: %w", err)
+		}
+		a, ok := byHospital[hospitalID]
+		if !ok {
+			a = &Affiliation{IDHospital: hospitalID, Name: name, Current: hospitalID == currentHospitalID}
+			byHospital[hospitalID] = a
+		}
+		a.Roles = append(a.Roles, role)
+		if doctorHospital.Valid {
+			a.IDDoctorHospital = doctorHospital.Int64
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("iterate affiliations: %w", err)
+	}
+
+	affiliations := make([]Affiliation, 0, len(byHospital))
+	for _, a := range byHospital {
+		sort.Strings(a.Roles)
+		affiliations = append(affiliations, *a)
+	}
+	sort.Slice(affiliations, func(i, j int) bool { return affiliations[i].Name < affiliations[j].Name })
+	return affiliations, nil
+}
+
+// RequestDoctorAffiliation adds a hospital to a signed-in doctor. Doctor_module records
+// the doctor at the hospital, inactive, and the doctor role there starts PENDING, so the
+// doctor can only switch to it once a hospital admin of that hospital approves it.
+// Doctor_module is called before the transaction, so no lock is held while it answers;
+// its row stays inactive if the request then fails here.
+func RequestDoctorAffiliation(userID, personID int64, hospital string) (int64, error) {
+	hospitalID, err := findHospitalID(db.DB, hospital)
+	if err != nil {
+		return 0, err
+	}
+	if existing, err := doctorRoleCount(db.DB, userID, hospitalID); err != nil {
+		return 0, err
+	} else if existing > 0 {
+		return 0, ErrAffiliationExists
+	}
+
+	if err := addDoctorAffiliation(personID, hospital); err != nil {
+		return 0, err
+	}
+
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if existing, err := doctorRoleCount(tx, userID, hospitalID); err != nil {
+		return 0, err
+	} else if existing > 0 {
+		return 0, ErrAffiliationExists
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO XXAuth.USER_ROLES (ID_USER, ID_ROLE, ID_HOSPITAL, STATUS)
+		SELECT @id_user, ID_ROLE, @id_hospital, @status
+		FROM XXAuth.ROLES
+		WHERE CODE = @role
+	`,
+		sql.Named("id_user", userID),
+		sql.Named("id_hospital", hospitalID),
+		sql.Named("status", StatusPending),
+		sql.Named("role", RoleDoctor),
+	)
+	if err != nil {
+		return 0, fmt.Errorf("insert USER_ROLES: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("commit transaction: %w", err)
+	}
+	return hospitalID, nil
+}
+
+// doctorRoleCount counts the doctor roles of the user at the hospital, whatever their
+// status. In a transaction the range stays locked until it ends.
+func doctorRoleCount(q rowQueryer, userID, hospitalID int64) (int, error) {
+	var count int
+	err := q.QueryRow(`
+		SELECT COUNT(*)
+		FROM XXAuth.USER_ROLES ur WITH (UPDLOCK, HOLDLOCK)
+		JOIN XXAuth.ROLES r ON r.ID_ROLE = ur.ID_ROLE
+		WHERE ur.ID_USER = @id_user AND ur.ID_HOSPITAL = @id_hospital AND r.CODE = @role
+	`,
+		sql.Named("id_user", userID),
+		sql.Named("id_hospital", hospitalID),
+		sql.Named("role", RoleDoctor),
+	).Scan(&count)
+	if err != nil {
+		return 0, fmt.Errorf("query USER_ROLES: %w", err)
+	}
+	return count, nil
+}
+
+// addDoctorAffiliation records the doctor at the hospital through Doctor_module. The
+// call is idempotent, so a request retried after a failure reuses the same row.
+func addDoctorAffiliation(personID int64, hospital string) error {
+	payload, err := json.Marshal(map[string]any{"id_person": personID, "hospital": hospital})
+	if err != nil {
+		return fmt.Errorf("marshal affiliation request: %w", err)
+	}
+
+	req, err := newServiceRequest(http.MethodPost, doctorModuleURL+"/affiliations", auth.ServiceDoctor, bytes.NewBuffer(payload))
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("call doctor module: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("doctor module returned status %d: %s", resp.StatusCode, string(body))
+	}
+	return nil
+}
+
+// setDoctorAffiliationActive activates or ends the doctor's row at the hospital in
+// Doctor_module, after the doctor role there was approved or rejected.
+func setDoctorAffiliationActive(personID, hospitalID int64, active bool) error {
+	payload, err := json.Marshal(map[string]any{"id_person": personID, "id_hospital": hospitalID, "active": active})
+	if err != nil {
+		return fmt.Errorf("marshal affiliation status: %w", err)
+	}
+
+	req, err := newServiceRequest(http.MethodPut, doctorModuleURL+"/affiliations", auth.ServiceDoctor, bytes.NewBuffer(payload))
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("call doctor module: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("doctor module returned status %d: %s", resp.StatusCode, string(body))
+	}
+	return nil
+}
@@ -0,0 +1,183 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"eoncohub.com/auth_module/db"
+)
+
+// USER_ROLES.STATUS values.
+const (
+	StatusInactive = "INACTIVE"
+	StatusPending  = "PENDING"
+	StatusActive   = "ACTIVE"
+	StatusRejected = "REJECTED"
+	StatusDisabled = "DISABLED"
+)
+
+var (
+	ErrNoAdminHospital  = errors.New("admin is not assigned to the selected hospital")
+	ErrPendingNotFound  = errors.New("pending account not found")
+	ErrEmailUnconfirmed = errors.New("the user has not confirmed their email yet")
+)
+
+type PendingUser struct {
+	IDUserRole   int64     `json:"id_user_role"`
+	IDUser       int64     `json:"id_user"`
+	Email        string    `json:"email"`
+	FName        string    `json:"f_name"`
+	LName        string    `json:"l_name"`
+	Role         string    `json:"role"`
+	CreationDate time.Time `json:"creation_date"`
+	// EmailConfirmed tells whether the account can be approved yet.
+	EmailConfirmed bool `json:"email_confirmed"`
+}
+
+// GetAdminHospitalID returns the hospital an admin manages: the hospital selected in the
+// session, provided the user's hospital_admin role there is still active.
+func GetAdminHospitalID(userID, hospitalID int64) (int64, error) {
+	if hospitalID == 0 {
+		return 0, ErrNoAdminHospital
+	}
+	var exists int
+	err := db.DB.QueryRow(`
+		SELECT 1
+		FROM XXAuth.USER_ROLES ur
+		JOIN XXAuth.ROLES r ON r.ID_ROLE = ur.ID_ROLE
+		WHERE ur.ID_USER = @id_user AND ur.ID_HOSPITAL = @id_hospital AND r.CODE = @role AND ur.STATUS = @status
+	`,
+		sql.Named("id_user", userID),
+		sql.Named("id_hospital", hospitalID),
+		sql.Named("role", RoleHospitalAdmin),
+		sql.Named("status", StatusActive),
+	).Scan(&exists)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, ErrNoAdminHospital
+		}
+		return 0, fmt.Errorf("query USER_ROLES: %w", err)
+	}
+	return hospitalID, nil
+}
+
+// GetPendingUsers lists the signups waiting for approval at a hospital, oldest first.
+func GetPendingUsers(hospitalID int64) ([]PendingUser, error) {
+	rows, err := db.DB.Query(`
+		SELECT ur.ID_USER_ROLE, u.ID_USER, u.USERNAME, p.F_NAME, p.L_NAME, r.CODE, ur.CREATION_DATE, u.EMAIL_CONFIRMED
+		FROM XXAuth.USER_ROLES ur
+		JOIN XXAuth.USERS u ON u.ID_USER = ur.ID_USER
+		JOIN XXAuth.ROLES r ON r.ID_ROLE = ur.ID_ROLE
+		JOIN XXPerson.PERSONS p ON p.ID_PERSON = u.ID_PERSON
+		WHERE ur.ID_HOSPITAL = @id_hospital AND ur.STATUS = @status
+		ORDER BY ur.CREATION_DATE
+	`, sql.Named("id_hospital", hospitalID), sql.Named("status", StatusPending))
+	if err != nil {
+		return nil, fmt.Errorf("query pending users: %w", err)
+	}
+	defer rows.Close()
+
+	users := []PendingUser{}
+	for rows.Next() {
+		var u PendingUser
+		if err := rows.Scan(&u.IDUserRole, &u.IDUser, &u.Email, &u.FName, &u.LName, &u.Role, &u.CreationDate, &u.EmailConfirmed); err != nil {
+			return nil, fmt.Errorf("scan pending user: %w", err)
+		}
+		users = append(users, u)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("iterate pending users: %w", err)
+	}
+
+	return users, nil
+}
+
+// ApprovePendingUser activates a pending role at the admin's hospital. It returns
+// ErrEmailUnconfirmed while the user has not confirmed their email, as doctors must
+// before their account is active. A doctor's row at the hospital is activated in
+// Doctor_module after the commit; if that fails the role goes back to pending.
+func ApprovePendingUser(hospitalID, userRoleID int64) error {
+	role, err := resolvePendingUser(hospitalID, userRoleID, StatusActive)
+	if err != nil || role.code != RoleDoctor {
+		return err
+	}
+	if err := setDoctorAffiliationActive(role.personID, hospitalID, true); err != nil {
+		if _, revertErr := db.DB.Exec(`
+			UPDATE XXAuth.USER_ROLES SET STATUS = @pending WHERE ID_USER_ROLE = @id_user_role AND STATUS = @active
+		`,
+			sql.Named("pending", StatusPending),
+			sql.Named("id_user_role", userRoleID),
+			sql.Named("active", StatusActive),
+		); revertErr != nil {
+			log.Printf("Failed to put doctor role %d back to pending: %v", userRoleID, revertErr)
+		}
+		return fmt.Errorf("activate doctor affiliation: %w", err)
+	}
+	return nil
+}
+
+// RejectPendingUser marks a pending role at the admin's hospital as rejected. The row is
+// kept so the decision stays visible. A doctor's row at the hospital is made inactive in
+// Doctor_module, in case it was recorded active.
+func RejectPendingUser(hospitalID, userRoleID int64) error {
+	role, err := resolvePendingUser(hospitalID, userRoleID, StatusRejected)
+	if err != nil || role.code != RoleDoctor {
+		return err
+	}
+	if err := setDoctorAffiliationActive(role.personID, hospitalID, false); err != nil {
+		log.Printf("Failed to end doctor affiliation for role %d: %v", userRoleID, err)
+	}
+	return nil
+}
+
+// resolvedRole is the role a pending decision was made on.
+type resolvedRole struct {
+	code     string
+	personID int64
+}
+
+func resolvePendingUser(hospitalID, userRoleID int64, status string) (resolvedRole, error) {
+	var role resolvedRole
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return role, fmt.Errorf("start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var emailConfirmed bool
+	err = tx.QueryRow(`
+		SELECT u.EMAIL_CONFIRMED, r.CODE, ISNULL(u.ID_PERSON, 0)
+		FROM XXAuth.USER_ROLES ur WITH (UPDLOCK)
+		JOIN XXAuth.USERS u WITH (UPDLOCK) ON u.ID_USER = ur.ID_USER
+		JOIN XXAuth.ROLES r ON r.ID_ROLE = ur.ID_ROLE
+		WHERE ur.ID_USER_ROLE = @id_user_role AND ur.ID_HOSPITAL = @id_hospital AND ur.STATUS = @pending
+	`,
+		sql.Named("id_user_role", userRoleID),
+		sql.Named("id_hospital", hospitalID),
+		sql.Named("pending", StatusPending),
+	).Scan(&emailConfirmed, &role.code, &role.personID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return role, ErrPendingNotFound
+		}
+		return role, fmt.Errorf("query USER_ROLES: %w", err)
+	}
+	if status == StatusActive && !emailConfirmed {
+		return role, ErrEmailUnconfirmed
+	}
+
+	_, err = tx.Exec(`
+		UPDATE XXAuth.USER_ROLES SET STATUS = @status WHERE ID_USER_ROLE = @id_user_role
+	`, sql.Named("status", status), sql.Named("id_user_role", userRoleID))
+	if err != nil {
+		return role, fmt.Errorf("update USER_ROLES: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return role, fmt.Errorf("commit transaction: %w", err)
+	}
+	return role, nil
+}
@@ -0,0 +1,233 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"eoncohub.com/auth_module/db"
+)
+
+// Events recorded in XXAuth.AUTH_AUDIT_LOG.
+const (
+	AuditLogin                = "LOGIN"
+	AuditLockout              = "LOCKOUT"
+	AuditTokenRefresh         = "TOKEN_REFRESH"
+	AuditLogout               = "LOGOUT"
+	AuditEmailConfirmation    = "EMAIL_CONFIRMATION"
+	AuditPasswordResetRequest = "PASSWORD_RESET_REQUEST"
+	AuditPasswordReset        = "PASSWORD_RESET"
+	AuditPasswordChange       = "PASSWORD_CHANGE"
+	AuditSessionRevoked       = "SESSION_REVOKED"
+	AuditHospitalSwitch       = "HOSPITAL_SWITCH"
+	AuditBreakGlass           = "BREAK_GLASS"
+
+	// Actions of a hospital admin on a user; Details names the admin.
+	AuditUserDeactivated      = "USER_DEACTIVATED"
+	AuditUserReactivated      = "USER_REACTIVATED"
+	AuditUserRolesChanged     = "USER_ROLES_CHANGED"
+	AuditPasswordResetForced  = "PASSWORD_RESET_FORCED"
+	AuditConfirmationResent   = "CONFIRMATION_RESENT"
+	AuditAccountUnlocked      = "ACCOUNT_UNLOCKED"
+	AuditMFARequirementChange = "MFA_REQUIREMENT_CHANGE"
+
+	// Actions of an admin on a doctor registration; Details names the registration.
+	AuditRegistrationRetried = "REGISTRATION_RETRIED"
+	AuditRegistrationAborted = "REGISTRATION_ABORTED"
+)
+
+// Outcomes of an audited event.
+const (
+	AuditSuccess = "SUCCESS"
+	AuditFailure = "FAILURE"
+)
+
+// AuditEvent is one entry of the audit log. UserID is zero when the user is unknown,
+// e.g. a failed login for an email without an account.
+type AuditEvent struct {
+	ID        int64     `json:"id_audit"`
+	CreatedAt time.Time `json:"created_at"`
+	Event     string    `json:"event"`
+	Outcome   string    `json:"outcome"`
+	UserID    int64     `json:"id_user,omitempty"`
+	Username  string    `json:"username,omitempty"`
+	IP        string    `json:"ip"`
+	UserAgent string    `json:"user_agent"`
+	Details   string    `json:"details,omitempty"`
+}
+
+// AuditFilter narrows an audit log query. Zero values do not filter; HospitalID limits
+// the entries to users with a role at that hospital.
+type AuditFilter struct {
+	HospitalID int64
+	Event      string
+	Outcome    string
+	UserID     int64
+	Username   string
+	IP         string
+	From       time.Time
+	To         time.Time
+}
+
+// RecordAudit appends an event to the audit log. A failure to write it is logged and
+// never fails the audited request.
+func RecordAudit(e AuditEvent) {
+	if err := writeAudit(e); err != nil {
+		log.Printf("Failed to write audit event %s/%s: %v", e.Event, e.Outcome, err)
+	}
+}
+
+// UserIDForLogin returns the ID of the user with that username, or 0 when there is none.
+// Failed logins and lockouts carry it so that they show up in the account's hospital log.
+func UserIDForLogin(username string) int64 {
+	username = normalizeLogin(username)
+	if username == "" {
+		return 0
+	}
+	var userID int64
+	err := db.DB.QueryRow(`
+		SELECT ID_USER FROM XXAuth.USERS WHERE USERNAME = @username
+	`, sql.Named("username", username)).Scan(&userID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		log.Printf("Failed to look up user for audit: %v", err)
+	}
+	return userID
+}
+
+// writeAudit inserts an audit entry, for callers that must not go on without one.
+func writeAudit(e AuditEvent) error {
+	_, err := db.DB.Exec(`
+		INSERT INTO XXAuth.AUTH_AUDIT_LOG (EVENT, OUTCOME, ID_USER, USERNAME, IP, USER_AGENT, DETAILS)
+		VALUES (@event, @outcome, @id_user, @username, @ip, @user_agent, @details)
+	`,
+		sql.Named("event", e.Event),
+		sql.Named("outcome", e.Outcome),
+		sql.Named("id_user", sql.NullInt64{Int64: e.UserID, Valid: e.UserID != 0}),
+		sql.Named("username", nullString(normalizeLogin(e.Username))),
+		sql.Named("ip", e.IP),
+		sql.Named("user_agent", truncate(e.UserAgent, 512)),
+		sql.Named("details", nullString(truncate(e.Details, 1000))),
+	)
+	if err != nil {
+		return fmt.Errorf("insert AUTH_AUDIT_LOG: %w", err)
+	}
+	return nil
+}
+
+// GetAuditLog returns one page of matching entries, newest first, and the total match count.
+func GetAuditLog(f AuditFilter, page, pageSize int) ([]AuditEvent, int, error) {
+	where, args := f.where()
+
+	var total int
+	if err := db.DB.QueryRow(`SELECT COUNT(*) FROM XXAuth.AUTH_AUDIT_LOG a `+where, args...).Scan(&total); err != nil {
+		return nil, 0, fmt.Errorf("count audit log: %w", err)
+	}
+
+	args = append(args, sql.Named("offset", (page-1)*pageSize), sql.Named("limit", pageSize))
+	events := []AuditEvent{}
+	err := scanAuditLog(`
+		SELECT a.ID_AUDIT, a.CREATED_AT, a.EVENT, a.OUTCOME, a.ID_USER, a.USERNAME, a.IP, a.USER_AGENT, a.DETAILS
+		FROM XXAuth.AUTH_AUDIT_LOG a
+		`+where+`
+		ORDER BY a.ID_AUDIT DESC
+		OFFSET @offset ROWS FETCH NEXT @limit ROWS ONLY
+	`, args, func(e AuditEvent) error {
+		events = append(events, e)
+		return nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return events, total, nil
+}
+
+// ExportAuditLog streams every matching entry, newest first, to fn.
+func ExportAuditLog(f AuditFilter, fn func(AuditEvent) error) error {
+	where, args := f.where()
+	return scanAuditLog(`
+		SELECT a.ID_AUDIT, a.CREATED_AT, a.EVENT, a.OUTCOME, a.ID_USER, a.USERNAME, a.IP, a.USER_AGENT, a.DETAILS
+		FROM XXAuth.AUTH_AUDIT_LOG a
+		`+where+`
+		ORDER BY a.ID_AUDIT DESC
+	`, args, fn)
+}
+
+func scanAuditLog(query string, args []any, fn func(AuditEvent) error) error {
+	rows, err := db.DB.Query(query, args...)
+	if err != nil {
+		return fmt.Errorf("query audit log: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var e AuditEvent
+		var userID sql.NullInt64
+		var username, details sql.NullString
+		if err := rows.Scan(&e.ID, &e.CreatedAt, &e.Event, &e.Outcome, &userID, &username, &e.IP, &e.UserAgent, &details); err != nil {
+			return fmt.Errorf("scan audit event: %w", err)
+		}
+		e.UserID = userID.Int64
+		e.Username = username.String
+		e.Details = details.String
+		if err := fn(e); err != nil {
+			return err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("iterate audit log: %w", err)
+	}
+	return nil
+}
+
+func (f AuditFilter) where() (string, []any) {
+	var conds []string
+	var args []any
+	add := func(cond, name string, value any) {
+		conds = append(conds, cond)
+		args = append(args, sql.Named(name, value))
+	}
+
+	if f.HospitalID != 0 {
+		add(`EXISTS (SELECT 1 FROM XXAuth.USER_ROLES ur WHERE ur.ID_USER = a.ID_USER AND ur.ID_HOSPITAL = @id_hospital)`, "id_hospital", f.HospitalID)
+	}
+	if f.Event != "" {
+		add("a.EVENT = @event", "event", f.Event)
+	}
+	if f.Outcome != "" {
+		add("a.OUTCOME = @outcome", "outcome", f.Outcome)
+	}
+	if f.UserID != 0 {
+		add("a.ID_USER = @id_user", "id_user", f.UserID)
+	}
+	if f.Username != "" {
+		add("a.USERNAME = @username", "username", normalizeLogin(f.Username))
+	}
+	if f.IP != "" {
+		add("a.IP = @ip", "ip", f.IP)
+	}
+	if !f.From.IsZero() {
+		add("a.CREATED_AT >= @from", "from", f.From.UTC())
+	}
+	if !f.To.IsZero() {
+		add("a.CREATED_AT < @to", "to", f.To.UTC())
+	}
+
+	if len(conds) == 0 {
+		return "", nil
+	}
+	return "WHERE " + strings.Join(conds, " AND "), args
+}
+
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
+
+func truncate(s string, max int) string {
+	if len(s) <= max {
+		return s
+	}
+	return s[:max]
+}
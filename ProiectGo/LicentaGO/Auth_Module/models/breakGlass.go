@@ -0,0 +1,143 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"eoncohub.com/auth_module/db"
+	"eoncohub.com/auth_module/mailer"
+)
+
+var ErrBreakGlassUnknown = errors.New("unknown doctor or patient")
+
+// BreakGlassNotice is sent by Patient_Module when a doctor opens the record of a patient
+// they are not linked to. IP and UserAgent are those of the doctor's request.
+type BreakGlassNotice struct {
+	IDAccess         int64     `json:"id_access"`
+	IDPatient        int64     `json:"id_patient"`
+	IDDoctorHospital int64     `json:"id_doctor_hospital"`
+	IDUser           int64     `json:"id_user"`
+	Justification    string    `json:"justification"`
+	ExpiresAt        time.Time `json:"expires_at"`
+	IP               string    `json:"ip"`
+	UserAgent        string    `json:"user_agent"`
+}
+
+// RecordBreakGlass writes the audit entry for an emergency access and emails the
+// patient's treating doctors and the admins of the doctor's hospital. Patient_Module
+// only grants the access once the entry is written; emails are queued and a failure to
+// queue one is logged.
+func RecordBreakGlass(n BreakGlassNotice) error {
+	var username sql.NullString
+	var doctor, hospital string
+	var hospitalID int64
+	err := db.DB.QueryRow(`
+		SELECT u.USERNAME, pe.F_NAME + ' ' + pe.L_NAME, h.ID_HOSPITAL, h.NAME
+		FROM XXPerson.DOCTORS_AND_HOSPITALS dh
+		JOIN XXPerson.DOCTORS d ON d.ID_DOCTOR = dh.ID_DOCTOR
+		JOIN XXPerson.PERSONS pe ON pe.ID_PERSON = d.ID_PERSON
+		JOIN XXPerson.HOSPITALS h ON h.ID_HOSPITAL = dh.ID_HOSPITAL
+		LEFT JOIN XXAuth.USERS u ON u.ID_USER = @id_user AND u.ID_PERSON = d.ID_PERSON
+		WHERE dh.ID_DOCTOR_HOSPITAL = @id_doctor_hospital
+	`, sql.Named("id_user", n.IDUser), sql.Named("id_doctor_hospital", n.IDDoctorHospital)).Scan(&username, &doctor, &hospitalID, &hospital)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && !username.Valid) {
+		return ErrBreakGlassUnknown
+	}
+	if err != nil {
+		return fmt.Errorf("query doctor: %w", err)
+	}
+
+	var patient string
+	err = db.DB.QueryRow(`
+		SELECT pe.F_NAME + ' ' + pe.L_NAME
+		FROM XXPerson.PATIENTS p
+		JOIN XXPerson.PERSONS pe ON pe.ID_PERSON = p.ID_PERSON
+		WHERE p.ID_PATIENT = @id_patient
+	`, sql.Named("id_patient", n.IDPatient)).Scan(&patient)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrBreakGlassUnknown
+	}
+	if err != nil {
+		return fmt.Errorf("query patient: %w", err)
+	}
+
+	err = writeAudit(AuditEvent{
+		Event:     AuditBreakGlass,
+		Outcome:   AuditSuccess,
+		UserID:    n.IDUser,
+		Username:  username.String,
+		IP:        n.IP,
+		UserAgent: n.UserAgent,
+		Details: fmt.Sprintf("patient %d, access %d until %s: %s",
+			n.IDPatient, n.IDAccess, n.ExpiresAt.UTC().Format(time.RFC3339), n.Justification),
+	})
+	if err != nil {
+		return err
+	}
+
+	recipients, err := breakGlassRecipients(n.IDPatient, hospitalID)
+	if err != nil {
+		log.Printf("Break-glass access %d: %v", n.IDAccess, err)
+		return nil
+	}
+	data := map[string]any{
+		"Doctor":        doctor,
+		"Hospital":      hospital,
+		"Patient":       patient,
+		"Justification": n.Justification,
+		"ExpiresAt":     n.ExpiresAt.UTC(),
+	}
+	for _, to := range recipients {
+		if to == username.String {
+			continue
+		}
+		if err := mailer.Send(to, mailer.TemplateBreakGlass, mailer.DefaultLocale(), data); err != nil {
+			log.Printf("Break-glass access %d: failed to queue notification: %v", n.IDAccess, err)
+		}
+	}
+	return nil
+}
+
+// breakGlassRecipients returns the accounts of the doctors treating the patient and of
+// the active hospital admins of the hospital.
+func breakGlassRecipients(patientID, hospitalID int64) ([]string, error) {
+	rows, err := db.DB.Query(`
+		SELECT u.USERNAME
+		FROM XXPerson.PATIENTS_AND_DOCTORS pd
+		JOIN XXPerson.DOCTORS_AND_HOSPITALS dh ON dh.ID_DOCTOR_HOSPITAL = pd.ID_DOCTOR_HOSPITAL
+		JOIN XXPerson.DOCTORS d ON d.ID_DOCTOR = dh.ID_DOCTOR
+		JOIN XXAuth.USERS u ON u.ID_PERSON = d.ID_PERSON
+		WHERE pd.ID_PATIENT = @id_patient AND pd.STATUS = 'ACTIVE'
+		UNION
+		SELECT u.USERNAME
+		FROM XXAuth.USER_ROLES ur
+		JOIN XXAuth.ROLES r ON r.ID_ROLE = ur.ID_ROLE
+		JOIN XXAuth.USERS u ON u.ID_USER = ur.ID_USER
+		WHERE ur.ID_HOSPITAL = @id_hospital AND r.CODE = @role AND ur.STATUS = @active
+	`,
+		sql.Named("id_patient", patientID),
+		sql.Named("id_hospital", hospitalID),
+		sql.Named("role", RoleHospitalAdmin),
+		sql.Named("active", StatusActive),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("query break-glass recipients: %w", err)
+	}
+	defer rows.Close()
+
+	var recipients []string
+	for rows.Next() {
+		var email string
+		if err := rows.Scan(&email); err != nil {
+			return nil, fmt.Errorf("scan break-glass recipient: %w", err)
+		}
+		recipients = append(recipients, email)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("iterate break-glass recipients: %w", err)
+	}
+	return recipients, nil
+}
@@ -0,0 +1,101 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"eoncohub.com/auth_module/db"
+)
+
+var ErrHospitalNotFound = errors.New("hospital not found")
+
+// rowQueryer is a *sql.DB or a *sql.Tx.
+type rowQueryer interface {
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+// findHospitalID resolves a hospital by its name, ignoring case like Doctor_module does.
+func findHospitalID(q rowQueryer, name string) (int64, error) {
+	var id int64
+	err := q.QueryRow(`
+		SELECT ID_HOSPITAL
+		FROM XXPerson.HOSPITALS
+		WHERE UPPER(NAME) = UPPER(@name)
+	`, sql.Named("name", name)).Scan(&id)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, ErrHospitalNotFound
+		}
+		return 0, fmt.Errorf("query HOSPITALS: %w", err)
+	}
+	return id, nil
+}
+
+// hospitalLocality returns the locality and county of a hospital's address.
+func hospitalLocality(tx *sql.Tx, hospitalID int64) (LocReq, error) {
+	var loc LocReq
+	err := tx.QueryRow(`
+		SELECT L.NAME, J.NAME
+		FROM XXPerson.HOSPITALS H
+		JOIN XXPerson.ADDRESS A ON A.ID_ADDRESS = H.ID_ADDRESS
+		JOIN XXPerson.LOC L ON L.ID_LOC = A.ID_LOC
+		JOIN XXPerson.JUD J ON J.ID_JUD = L.ID_JUD
+		WHERE H.ID_HOSPITAL = @id_hospital
+	`, sql.Named("id_hospital", hospitalID)).Scan(&loc.Name, &loc.Jud.Name)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return loc, fmt.Errorf("hospital %d has no locality", hospitalID)
+		}
+		return loc, fmt.Errorf("query error: %w", err)
+	}
+	return loc, nil
+}
+
+// hospitalEmail returns the official address of a hospital, where doctor registrations are confirmed.
+func hospitalEmail(tx *sql.Tx, hospitalID int64) (string, error) {
+	var email string
+	err := tx.QueryRow(`
+		SELECT VA.EMAIL
+		FROM XXPerson.VIRTUAL_ADDRESS VA
+		JOIN XXPerson.HOSPITALS H ON VA.ID_VIRTUAL_ADDRESS = H.ID_VIRTUAL_ADDRESS
+		WHERE H.ID_HOSPITAL = @id_hospital
+	`, sql.Named("id_hospital", hospitalID)).Scan(&email)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", fmt.Errorf("hospital email not found")
+		}
+		return "", fmt.Errorf("query error: %w", err)
+	}
+	return email, nil
+}
+
+// getUserAffiliation returns the hospital the access token is scoped to and, for doctors,
+// the XXPerson.DOCTORS_AND_HOSPITALS row at that hospital. preferredHospitalID is the
+// hospital selected in the session; when the user has no active role there anymore,
+// or none was selected, the first affiliation is used, doctor affiliations first.
+func getUserAffiliation(userID, personID, preferredHospitalID int64) (hospitalID, doctorHospitalID int64, err error) {
+	var hospital, doctorHospital sql.NullInt64
+	err = db.DB.QueryRow(`
+		SELECT TOP 1 ur.ID_HOSPITAL, dh.ID_DOCTOR_HOSPITAL
+		FROM XXAuth.USER_ROLES ur
+		LEFT JOIN XXPerson.DOCTORS d ON d.ID_PERSON = @id_person AND d.ISDELETED = 0
+		LEFT JOIN XXPerson.DOCTORS_AND_HOSPITALS dh
+		       ON dh.ID_DOCTOR = d.ID_DOCTOR AND dh.ID_HOSPITAL = ur.ID_HOSPITAL AND dh.IS_ACTIVE = 1
+		WHERE ur.ID_USER = @id_user AND ur.STATUS = 'ACTIVE' AND ur.ID_HOSPITAL IS NOT NULL
+		ORDER BY CASE WHEN ur.ID_HOSPITAL = @preferred THEN 0 ELSE 1 END,
+		         CASE WHEN dh.ID_DOCTOR_HOSPITAL IS NULL THEN 1 ELSE 0 END,
+		         ur.ID_USER_ROLE
+	`,
+		sql.Named("id_user", userID),
+		sql.Named("id_person", personID),
+		sql.Named("preferred", preferredHospitalID),
+	).Scan(&hospital, &doctorHospital)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, 0, nil
+		}
+		return 0, 0, fmt.Errorf("query affiliation: %w", err)
+	}
+	return hospital.Int64, doctorHospital.Int64, nil
+}
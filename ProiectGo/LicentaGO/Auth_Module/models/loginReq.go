@@ -4,14 +4,20 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
+	"log"
+	"time"
 
 	"eoncohub.com/auth_module/db"
 	"eoncohub.com/auth_module/utils"
 )
 
 type LoginReq struct {
-	Email    string `json:"email"`
-	Password string `json:"password"`
+	Email        string `json:"email"`
+	Password     string `json:"password"`
+	TOTPCode     string `json:"totp_code"`
+	RecoveryCode string `json:"recovery_code"`
+	IP           string `json:"-"`
+	UserAgent    string `json:"-"`
 }
 
 type AuthErrorType string
@@ -20,11 +26,18 @@ const (
 	AuthErrorInvalidCredentials AuthErrorType = "InvalidCredentials"
 	AuthErrorInactiveAccount    AuthErrorType = "InactiveAccount"
 	AuthErrorInternal           AuthErrorType = "InternalError"
+	AuthErrorMFARequired        AuthErrorType = "MFARequired"
+	AuthErrorMFAEnrollment      AuthErrorType = "MFAEnrollmentRequired"
+	AuthErrorInvalidMFACode     AuthErrorType = "InvalidMFACode"
+	AuthErrorAccountLocked      AuthErrorType = "AccountLocked"
+	AuthErrorTooManyAttempts    AuthErrorType = "TooManyAttempts"
 )
 
 type AuthError struct {
 	Type    AuthErrorType
 	Details string
+	// RetryAfter is set for AccountLocked and TooManyAttempts.
+	RetryAfter time.Duration
 }
 
 func (e *AuthError) Error() string {
@@ -32,28 +45,167 @@ func (e *AuthError) Error() string {
 }
 
 type UserCredential struct {
+	UserID     int64
 	Username   string
 	HashedPass string
 	UserRoleID int64
 	PersonID   int64
+	Roles      []string
+	// HospitalID and DoctorHospitalID are zero for users without a hospital or doctor affiliation.
+	HospitalID       int64
+	DoctorHospitalID int64
 }
 
-func (l *LoginReq) Validate() (int64, error) {
+// Validate checks the password and, when the user has two-factor authentication,
+// the TOTP or recovery code sent along with it. If the password is right but the
+// second factor is missing, or enrollment is required first, it returns the
+// credential together with an AuthErrorMFARequired or AuthErrorMFAEnrollment error
+// so the caller can start the second login step.
+//
+// Attempts are throttled per account and per IP, and counted before the password is
+// hashed.
+func (l *LoginReq) Validate() (*UserCredential, error) {
+	attempt, err := BeginLoginAttempt(l.Email, l.IP, l.UserAgent)
+	if err != nil {
+		return nil, err
+	}
+
 	cred, err := findUserCredential(l.Email)
 	if err != nil {
-		return 0, err
+		var authErr *AuthError
+		if errors.As(err, &authErr) && authErr.Type == AuthErrorInvalidCredentials {
+			RecordLoginFailure(attempt, false)
+		}
+		return nil, err
 	}
 
 	if !utils.CheckPasswordHash(l.Password, cred.HashedPass) {
-		return 0, &AuthError{Type: AuthErrorInvalidCredentials, Details: "Password mismatch"}
+		RecordLoginFailure(attempt, true)
+		return nil, &AuthError{Type: AuthErrorInvalidCredentials, Details: "Password mismatch"}
 	}
 
-	return cred.PersonID, nil
+	// The password was right: from here on the attempt no longer counts as a guess
+	if err := cred.loadClaims(0); err != nil {
+		releaseLoginAttempt(attempt)
+		return nil, err
+	}
+
+	mfa, err := GetMFASettings(cred.UserID)
+	if err != nil {
+		return nil, &AuthError{Type: AuthErrorInternal, Details: err.Error()}
+	}
+	switch {
+	case mfa.Enabled:
+		if l.TOTPCode == "" && l.RecoveryCode == "" {
+			releaseLoginAttempt(attempt)
+			return cred, &AuthError{Type: AuthErrorMFARequired, Details: "Second factor required"}
+		}
+		if err := CheckSecondFactor(cred.UserID, l.TOTPCode, l.RecoveryCode); err != nil {
+			RecordLoginFailure(attempt, true)
+			return nil, err
+		}
+	case mfa.Required:
+		releaseLoginAttempt(attempt)
+		return cred, &AuthError{Type: AuthErrorMFAEnrollment, Details: "Two-factor enrollment required"}
+	}
+
+	RecordLoginSuccess(attempt)
+	return cred, nil
+}
+
+// RecordLoginFailure applies the lockouts of a failed attempt; notify is set when the
+// account exists and should receive the unlock email if it gets locked.
+func RecordLoginFailure(attempt *LoginAttempt, notify bool) {
+	if err := attempt.Failed(notify); err != nil {
+		log.Printf("Failed to record login attempt: %v", err)
+	}
+}
+
+// RecordLoginSuccess clears the counters after a complete login.
+func RecordLoginSuccess(attempt *LoginAttempt) {
+	if err := attempt.Succeeded(); err != nil {
+		log.Printf("Failed to reset login attempts: %v", err)
+	}
+}
+
+func releaseLoginAttempt(attempt *LoginAttempt) {
+	if err := attempt.Released(); err != nil {
+		log.Printf("Failed to release login attempt: %v", err)
+	}
+}
+
+// CheckSecondFactor wraps VerifySecondFactor into the AuthError types used by the login flow.
+func CheckSecondFactor(userID int64, totpCode, recoveryCode string) error {
+	err := VerifySecondFactor(userID, totpCode, recoveryCode)
+	if err == nil {
+		return nil
+	}
+	if errors.Is(err, ErrInvalidMFACode) || errors.Is(err, ErrMFANotEnrolled) {
+		return &AuthError{Type: AuthErrorInvalidMFACode, Details: err.Error()}
+	}
+	return &AuthError{Type: AuthErrorInternal, Details: err.Error()}
+}
+
+// GetActiveUserCredential loads the credential of an active user by ID, scoped to the
+// user's first hospital.
+func GetActiveUserCredential(userID int64) (*UserCredential, error) {
+	return GetActiveUserCredentialAt(userID, 0)
+}
+
+// GetActiveUserCredentialAt loads the credential of an active user scoped to the hospital
+// selected in the session, e.g. when refreshing it or switching hospitals.
+func GetActiveUserCredentialAt(userID, hospitalID int64) (*UserCredential, error) {
+	query := `
+		SELECT u.ID_USER, u.USERNAME, u.PASSWORD, ur.ID_USER_ROLE, u.ID_PERSON 
+		FROM XXAuth.USERS u 
+		JOIN XXAuth.USER_ROLES ur ON u.ID_USER = ur.ID_USER 
+		WHERE u.ID_USER = @id_user AND ur.STATUS = 'ACTIVE'
+	`
+
+	var cred UserCredential
+
+	err := db.DB.QueryRow(query, sql.Named("id_user", userID)).Scan(
+		&cred.UserID,
+		&cred.Username,
+		&cred.HashedPass,
+		&cred.UserRoleID,
+		&cred.PersonID,
+	)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, &AuthError{Type: AuthErrorInactiveAccount, Details: "No active user"}
+		}
+		return nil, &AuthError{Type: AuthErrorInternal, Details: fmt.Sprintf("Query error: %v", err)}
+	}
+
+	if err := cred.loadClaims(hospitalID); err != nil {
+		return nil, err
+	}
+
+	return &cred, nil
+}
+
+// loadClaims fills in the affiliation that goes into the access token and the roles
+// held at that hospital.
+func (cred *UserCredential) loadClaims(preferredHospitalID int64) error {
+	hospitalID, doctorHospitalID, err := getUserAffiliation(cred.UserID, cred.PersonID, preferredHospitalID)
+	if err != nil {
+		return &AuthError{Type: AuthErrorInternal, Details: err.Error()}
+	}
+	cred.HospitalID = hospitalID
+	cred.DoctorHospitalID = doctorHospitalID
+
+	roles, err := GetUserRoles(cred.UserID, hospitalID)
+	if err != nil {
+		return &AuthError{Type: AuthErrorInternal, Details: err.Error()}
+	}
+	cred.Roles = roles
+	return nil
 }
 
 func findUserCredential(email string) (*UserCredential, error) {
 	query := `
-		SELECT u.USERNAME, u.PASSWORD, ur.ID_USER_ROLE, u.ID_PERSON 
+		SELECT u.ID_USER, u.USERNAME, u.PASSWORD, ur.ID_USER_ROLE, u.ID_PERSON 
 		FROM XXAuth.USERS u 
 		JOIN XXAuth.USER_ROLES ur ON u.ID_USER = ur.ID_USER 
 		WHERE u.USERNAME = @username AND ur.STATUS = 'ACTIVE'
@@ -62,6 +214,7 @@ func findUserCredential(email string) (*UserCredential, error) {
 	var cred UserCredential
 
 	err := db.DB.QueryRow(query, sql.Named("username", email)).Scan(
+		&cred.UserID,
 		&cred.Username,
 		&cred.HashedPass,
 		&cred.UserRoleID,
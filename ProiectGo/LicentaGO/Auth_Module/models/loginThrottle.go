@@ -0,0 +1,400 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"strings"
+	"time"
+
+	"eoncohub.com/auth_module/db"
+	"eoncohub.com/auth_module/mailer"
+	"eoncohub.com/auth_module/utils"
+)
+
+// Failed logins are counted per account (normalized email) and per client IP in XXAuth.LOGIN_ATTEMPTS.
+const (
+	attemptKeyAccount = "ACCOUNT"
+	attemptKeyIP      = "IP"
+
+	// Failures allowed before every further attempt is delayed.
+	freeLoginAttempts = 3
+	maxLoginDelay     = 30 * time.Second
+)
+
+var ErrInvalidUnlockToken = errors.New("invalid or expired unlock token")
+
+func maxAccountFailures() int {
+	return utils.IntFromEnv("LOGIN_MAX_ACCOUNT_FAILURES", 10)
+}
+
+func maxIPFailures() int {
+	return utils.IntFromEnv("LOGIN_MAX_IP_FAILURES", 50)
+}
+
+func lockoutDuration() time.Duration {
+	return utils.DurationFromEnv("LOGIN_LOCKOUT_DURATION", 15*time.Minute)
+}
+
+// loginDelay is the progressive wait imposed after the given number of consecutive failures.
+func loginDelay(failures int) time.Duration {
+	if failures < freeLoginAttempts {
+		return 0
+	}
+	delay := time.Duration(math.Pow(2, float64(failures-freeLoginAttempts))) * time.Second
+	if delay > maxLoginDelay {
+		return maxLoginDelay
+	}
+	return delay
+}
+
+func normalizeLogin(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// loginBlock turns the lock and delay rows of the account and IP keys into the error
+// refusing the attempt, if any.
+func loginBlock(rows *sql.Rows) error {
+	defer rows.Close()
+
+	var lockErr, delayErr *AuthError
+	for rows.Next() {
+		var keyType string
+		var lockedFor, waitFor sql.NullInt64
+		if err := rows.Scan(&keyType, &lockedFor, &waitFor); err != nil {
+			return &AuthError{Type: AuthErrorInternal, Details: fmt.Sprintf("Scan error: %v", err)}
+		}
+
+		if lockedFor.Valid && lockedFor.Int64 > 0 {
+			retry := time.Duration(lockedFor.Int64) * time.Second
+			if keyType == attemptKeyAccount {
+				lockErr = &AuthError{Type: AuthErrorAccountLocked, Details: "Account temporarily locked", RetryAfter: retry}
+			} else if lockErr == nil {
+				lockErr = &AuthError{Type: AuthErrorTooManyAttempts, Details: "Too many failed attempts from this address", RetryAfter: retry}
+			}
+		}
+		if waitFor.Valid && waitFor.Int64 > 0 {
+			retry := time.Duration(waitFor.Int64) * time.Second
+			if delayErr == nil || retry > delayErr.RetryAfter {
+				delayErr = &AuthError{Type: AuthErrorTooManyAttempts, Details: "Too many failed attempts, try again later", RetryAfter: retry}
+			}
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return &AuthError{Type: AuthErrorInternal, Details: fmt.Sprintf("Iteration error: %v", err)}
+	}
+
+	if lockErr != nil {
+		return lockErr
+	}
+	if delayErr != nil {
+		return delayErr
+	}
+	return nil
+}
+
+// checkAccountLocked refuses a login to a locked account without counting it, for logins
+// that involve no guess, such as single sign-on.
+func checkAccountLocked(email string) error {
+	var lockedFor sql.NullInt64
+	err := db.DB.QueryRow(`
+		SELECT DATEDIFF(SECOND, SYSUTCDATETIME(), LOCKED_UNTIL)
+		FROM XXAuth.LOGIN_ATTEMPTS
+		WHERE KEY_TYPE = @key_type AND KEY_VALUE = @key_value
+	`, sql.Named("key_type", attemptKeyAccount), sql.Named("key_value", normalizeLogin(email))).Scan(&lockedFor)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil
+		}
+		return &AuthError{Type: AuthErrorInternal, Details: fmt.Sprintf("Query error: %v", err)}
+	}
+	if lockedFor.Valid && lockedFor.Int64 > 0 {
+		return &AuthError{
+			Type:       AuthErrorAccountLocked,
+			Details:    "Account temporarily locked",
+			RetryAfter: time.Duration(lockedFor.Int64) * time.Second,
+		}
+	}
+	return nil
+}
+
+// LoginAttempt is a password or code check counted before it runs. Failed applies the
+// lockouts once it turned out wrong, Succeeded and Released give the attempt back.
+type LoginAttempt struct {
+	email, ip, userAgent string
+	accountFailures      int
+	ipFailures           int
+}
+
+// BeginLoginAttempt refuses an attempt while the account or the IP is locked or still
+// inside its progressive delay, and otherwise counts it as a failure and applies the
+// delay that follows, before any password hashing. The check and the count run in one
+// transaction holding the rows, so parallel guesses are counted one after the other
+// and cannot all slip in under the limit.
+func BeginLoginAttempt(email, ip, userAgent string) (*LoginAttempt, error) {
+	a := &LoginAttempt{email: normalizeLogin(email), ip: ip, userAgent: userAgent}
+
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return nil, &AuthError{Type: AuthErrorInternal, Details: fmt.Sprintf("Begin error: %v", err)}
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`
+		SELECT KEY_TYPE,
+		       DATEDIFF(SECOND, SYSUTCDATETIME(), LOCKED_UNTIL),
+		       DATEDIFF(SECOND, SYSUTCDATETIME(), NEXT_ALLOWED_AT)
+		FROM XXAuth.LOGIN_ATTEMPTS WITH (UPDLOCK, HOLDLOCK)
+		WHERE (KEY_TYPE = @account AND KEY_VALUE = @email)
+		   OR (KEY_TYPE = @ip_type AND KEY_VALUE = @ip)
+	`,
+		sql.Named("account", attemptKeyAccount),
+		sql.Named("email", a.email),
+		sql.Named("ip_type", attemptKeyIP),
+		sql.Named("ip", ip),
+	)
+	if err != nil {
+		return nil, &AuthError{Type: AuthErrorInternal, Details: fmt.Sprintf("Query error: %v", err)}
+	}
+	if err := loginBlock(rows); err != nil {
+		return nil, err
+	}
+
+	if a.accountFailures, err = incrementFailures(tx, attemptKeyAccount, a.email); err != nil {
+		return nil, &AuthError{Type: AuthErrorInternal, Details: err.Error()}
+	}
+	if err := setNextAllowed(tx, attemptKeyAccount, a.email, loginDelay(a.accountFailures)); err != nil {
+		return nil, &AuthError{Type: AuthErrorInternal, Details: err.Error()}
+	}
+	if ip != "" {
+		if a.ipFailures, err = incrementFailures(tx, attemptKeyIP, ip); err != nil {
+			return nil, &AuthError{Type: AuthErrorInternal, Details: err.Error()}
+		}
+		if err := setNextAllowed(tx, attemptKeyIP, ip, loginDelay(a.ipFailures)); err != nil {
+			return nil, &AuthError{Type: AuthErrorInternal, Details: err.Error()}
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, &AuthError{Type: AuthErrorInternal, Details: fmt.Sprintf("Commit error: %v", err)}
+	}
+	return a, nil
+}
+
+// Failed locks the account and the IP once the attempt brought them to their limits.
+// When notify is set and the account gets locked, an unlock link is emailed to it.
+// Lockouts go to the audit log.
+func (a *LoginAttempt) Failed(notify bool) error {
+	if a.accountFailures >= maxAccountFailures() {
+		if err := lockAccount(a.email, notify); err != nil {
+			return err
+		}
+		RecordAudit(AuditEvent{
+			Event:     AuditLockout,
+			Outcome:   AuditSuccess,
+			UserID:    UserIDForLogin(a.email),
+			Username:  a.email,
+			IP:        a.ip,
+			UserAgent: a.userAgent,
+			Details:   "account",
+		})
+	}
+
+	if a.ip == "" || a.ipFailures < maxIPFailures() {
+		return nil
+	}
+	_, err := db.DB.Exec(`
+		UPDATE XXAuth.LOGIN_ATTEMPTS
+		SET LOCKED_UNTIL = DATEADD(SECOND, @lockout, SYSUTCDATETIME())
+		WHERE KEY_TYPE = @key_type AND KEY_VALUE = @key_value
+	`,
+		sql.Named("lockout", int64(lockoutDuration().Seconds())),
+		sql.Named("key_type", attemptKeyIP),
+		sql.Named("key_value", a.ip),
+	)
+	if err != nil {
+		return fmt.Errorf("lock IP: %w", err)
+	}
+	log.Printf("Login attempts from %s blocked for %s", a.ip, lockoutDuration())
+	RecordAudit(AuditEvent{
+		Event:     AuditLockout,
+		Outcome:   AuditSuccess,
+		UserID:    UserIDForLogin(a.email),
+		Username:  a.email,
+		IP:        a.ip,
+		UserAgent: a.userAgent,
+		Details:   "ip",
+	})
+	return nil
+}
+
+// Succeeded clears the account counters after a complete login and gives the attempt
+// back to the IP, so that successful logins behind a shared address do not add up.
+func (a *LoginAttempt) Succeeded() error {
+	if err := resetAttempts(attemptKeyAccount, a.email); err != nil {
+		return err
+	}
+	return releaseAttempt(attemptKeyIP, a.ip)
+}
+
+// Released gives the attempt back when the password was right but the login waits for
+// the second factor, which is counted on its own.
+func (a *LoginAttempt) Released() error {
+	if err := releaseAttempt(attemptKeyAccount, a.email); err != nil {
+		return err
+	}
+	return releaseAttempt(attemptKeyIP, a.ip)
+}
+
+// releaseAttempt takes back one failure counted by BeginLoginAttempt, with the delay it
+// set, unless the key got locked meanwhile.
+func releaseAttempt(keyType, keyValue string) error {
+	if keyValue == "" {
+		return nil
+	}
+	_, err := db.DB.Exec(`
+		UPDATE XXAuth.LOGIN_ATTEMPTS
+		SET FAILED_COUNT = CASE WHEN FAILED_COUNT > 0 THEN FAILED_COUNT - 1 ELSE 0 END, NEXT_ALLOWED_AT = NULL
+		WHERE KEY_TYPE = @key_type AND KEY_VALUE = @key_value AND LOCKED_UNTIL IS NULL
+	`, sql.Named("key_type", keyType), sql.Named("key_value", keyValue))
+	if err != nil {
+		return fmt.Errorf("release login attempt: %w", err)
+	}
+	return nil
+}
+
+// UnlockAccount lifts a lockout on behalf of an admin of hospitalID. It returns
+// ErrUserNotInHospital for users without a role there.
+func UnlockAccount(hospitalID, userID int64) error {
+	var username string
+	err := db.DB.QueryRow(`
+		SELECT u.USERNAME
+		FROM XXAuth.USERS u
+		WHERE u.ID_USER = @id_user
+		  AND EXISTS (SELECT 1 FROM XXAuth.USER_ROLES ur WHERE ur.ID_USER = u.ID_USER AND ur.ID_HOSPITAL = @id_hospital)
+	`, sql.Named("id_user", userID), sql.Named("id_hospital", hospitalID)).Scan(&username)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrUserNotInHospital
+		}
+		return fmt.Errorf("query USERS: %w", err)
+	}
+	return resetAttempts(attemptKeyAccount, normalizeLogin(username))
+}
+
+// UnlockAccountByToken lifts a lockout through the link emailed when the account was locked.
+func UnlockAccountByToken(token string) error {
+	result, err := db.DB.Exec(`
+		UPDATE XXAuth.LOGIN_ATTEMPTS
+		SET FAILED_COUNT = 0, LOCKED_UNTIL = NULL, NEXT_ALLOWED_AT = NULL, UNLOCK_TOKEN_HASH = NULL
+		WHERE KEY_TYPE = @key_type AND UNLOCK_TOKEN_HASH = @token_hash
+	`,
+		sql.Named("key_type", attemptKeyAccount),
+		sql.Named("token_hash", utils.HashToken(token)),
+	)
+	if err != nil {
+		return fmt.Errorf("unlock account: %w", err)
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return ErrInvalidUnlockToken
+	}
+	return nil
+}
+
+// incrementFailures adds one failure and returns the new count. Failures older than
+// the lockout window no longer count.
+func incrementFailures(tx *sql.Tx, keyType, keyValue string) (int, error) {
+	var failures int
+	err := tx.QueryRow(`
+		MERGE XXAuth.LOGIN_ATTEMPTS AS target
+		USING (SELECT @key_type AS KEY_TYPE, @key_value AS KEY_VALUE) AS source
+		ON target.KEY_TYPE = source.KEY_TYPE AND target.KEY_VALUE = source.KEY_VALUE
+		WHEN MATCHED THEN
+			UPDATE SET FAILED_COUNT = CASE
+			               WHEN target.LAST_FAILED_AT < DATEADD(SECOND, -@window, SYSUTCDATETIME()) THEN 1
+			               ELSE target.FAILED_COUNT + 1
+			           END,
+			           LAST_FAILED_AT = SYSUTCDATETIME()
+		WHEN NOT MATCHED THEN
+			INSERT (KEY_TYPE, KEY_VALUE, FAILED_COUNT, LAST_FAILED_AT)
+			VALUES (@key_type, @key_value, 1, SYSUTCDATETIME())
+		OUTPUT INSERTED.FAILED_COUNT;
+	`,
+		sql.Named("key_type", keyType),
+		sql.Named("key_value", keyValue),
+		sql.Named("window", int64(lockoutDuration().Seconds())),
+	).Scan(&failures)
+	if err != nil {
+		return 0, fmt.Errorf("record failed login: %w", err)
+	}
+	return failures, nil
+}
+
+func setNextAllowed(tx *sql.Tx, keyType, keyValue string, delay time.Duration) error {
+	if delay <= 0 {
+		return nil
+	}
+	_, err := tx.Exec(`
+		UPDATE XXAuth.LOGIN_ATTEMPTS
+		SET NEXT_ALLOWED_AT = DATEADD(SECOND, @delay, SYSUTCDATETIME())
+		WHERE KEY_TYPE = @key_type AND KEY_VALUE = @key_value
+	`,
+		sql.Named("delay", int64(delay.Seconds())),
+		sql.Named("key_type", keyType),
+		sql.Named("key_value", keyValue),
+	)
+	if err != nil {
+		return fmt.Errorf("set login delay: %w", err)
+	}
+	return nil
+}
+
+func lockAccount(email string, notify bool) error {
+	token, err := utils.GenerateOpaqueToken()
+	if err != nil {
+		return fmt.Errorf("generate unlock token: %w", err)
+	}
+
+	_, err = db.DB.Exec(`
+		UPDATE XXAuth.LOGIN_ATTEMPTS
+		SET LOCKED_UNTIL = DATEADD(SECOND, @lockout, SYSUTCDATETIME()), UNLOCK_TOKEN_HASH = @token_hash
+		WHERE KEY_TYPE = @key_type AND KEY_VALUE = @key_value
+	`,
+		sql.Named("lockout", int64(lockoutDuration().Seconds())),
+		sql.Named("token_hash", utils.HashToken(token)),
+		sql.Named("key_type", attemptKeyAccount),
+		sql.Named("key_value", email),
+	)
+	if err != nil {
+		return fmt.Errorf("lock account: %w", err)
+	}
+	log.Printf("Account %s locked for %s", email, lockoutDuration())
+
+	if notify {
+		unlockURL := fmt.Sprintf("http://localhost:3000/unlock?token=%s", token)
+		if err := sendUnlockEmail(email, unlockURL); err != nil {
+			log.Printf("Failed to send unlock email: %v", err)
+		}
+	}
+	return nil
+}
+
+func resetAttempts(keyType, keyValue string) error {
+	_, err := db.DB.Exec(`
+		UPDATE XXAuth.LOGIN_ATTEMPTS
+		SET FAILED_COUNT = 0, LOCKED_UNTIL = NULL, NEXT_ALLOWED_AT = NULL, UNLOCK_TOKEN_HASH = NULL
+		WHERE KEY_TYPE = @key_type AND KEY_VALUE = @key_value
+	`, sql.Named("key_type", keyType), sql.Named("key_value", keyValue))
+	if err != nil {
+		return fmt.Errorf("reset login attempts: %w", err)
+	}
+	return nil
+}
+
+func sendUnlockEmail(toEmail, unlockURL string) error {
+	return mailer.Send(toEmail, mailer.TemplateAccountLocked, mailer.DefaultLocale(), map[string]any{
+		"URL": unlockURL,
+	})
+}
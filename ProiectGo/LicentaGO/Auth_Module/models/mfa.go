@@ -0,0 +1,294 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"eoncohub.com/auth_module/db"
+	"eoncohub.com/auth_module/secrets"
+	"eoncohub.com/auth_module/utils"
+)
+
+const (
+	mfaIssuer         = "Eoncohub"
+	recoveryCodeCount = 10
+)
+
+var (
+	ErrMFAAlreadyEnabled = errors.New("two-factor authentication is already enabled")
+	ErrMFANotEnrolled    = errors.New("two-factor enrollment was not started")
+	ErrInvalidMFACode    = errors.New("invalid two-factor code")
+)
+
+type MFASettings struct {
+	Enabled  bool `json:"enabled"`
+	Required bool `json:"required"`
+}
+
+type MFAEnrollment struct {
+	Secret     string `json:"secret"`
+	OTPAuthURI string `json:"otpauth_uri"`
+}
+
+// GetMFASettings returns the two-factor state of a user. Users without a row have it disabled and optional.
+func GetMFASettings(userID int64) (MFASettings, error) {
+	var s MFASettings
+	err := db.DB.QueryRow(`
+		SELECT ENABLED, REQUIRED
+		FROM XXAuth.USER_MFA
+		WHERE ID_USER = @id_user
+	`, sql.Named("id_user", userID)).Scan(&s.Enabled, &s.Required)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return MFASettings{}, nil
+		}
+		return MFASettings{}, fmt.Errorf("query USER_MFA: %w", err)
+	}
+	return s, nil
+}
+
+// StartMFAEnrollment stores a fresh, not yet enabled secret for the user and returns
+// it with the otpauth URI to be shown as a QR code.
+func StartMFAEnrollment(userID int64, account string) (*MFAEnrollment, error) {
+	settings, err := GetMFASettings(userID)
+	if err != nil {
+		return nil, err
+	}
+	if settings.Enabled {
+		return nil, ErrMFAAlreadyEnabled
+	}
+
+	secret, err := utils.GenerateTOTPSecret()
+	if err != nil {
+		return nil, fmt.Errorf("generate secret: %w", err)
+	}
+	sealed, err := secrets.Seal(totpSecretContext(userID), secret)
+	if err != nil {
+		return nil, fmt.Errorf("seal secret: %w", err)
+	}
+
+	_, err = db.DB.Exec(`
+		MERGE XXAuth.USER_MFA AS target
+		USING (SELECT @id_user AS ID_USER) AS source
+		ON target.ID_USER = source.ID_USER
+		WHEN MATCHED THEN
+			UPDATE SET TOTP_SECRET = @secret, ENABLED = 0, CONFIRMED_AT = NULL, LAST_USED_STEP = NULL
+		WHEN NOT MATCHED THEN
+			INSERT (ID_USER, TOTP_SECRET, ENABLED, REQUIRED)
+			VALUES (@id_user, @secret, 0, 0);
+	`, sql.Named("id_user", userID), sql.Named("secret", sealed))
+	if err != nil {
+		return nil, fmt.Errorf("store secret: %w", err)
+	}
+
+	return &MFAEnrollment{
+		Secret:     secret,
+		OTPAuthURI: utils.TOTPURI(mfaIssuer, account, secret),
+	}, nil
+}
+
+// ConfirmMFAEnrollment verifies the first code from the authenticator app, enables
+// two-factor authentication and returns the plaintext recovery codes. They are shown
+// once; only their hashes are stored.
+func ConfirmMFAEnrollment(userID int64, code string) ([]string, error) {
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var secret sql.NullString
+	var enabled bool
+	err = tx.QueryRow(`
+		SELECT TOTP_SECRET, ENABLED
+		FROM XXAuth.USER_MFA WITH (UPDLOCK)
+		WHERE ID_USER = @id_user
+	`, sql.Named("id_user", userID)).Scan(&secret, &enabled)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrMFANotEnrolled
+		}
+		return nil, fmt.Errorf("query USER_MFA: %w", err)
+	}
+	if enabled {
+		return nil, ErrMFAAlreadyEnabled
+	}
+	if !secret.Valid || secret.String == "" {
+		return nil, ErrMFANotEnrolled
+	}
+
+	plain, err := openTOTPSecret(userID, secret.String)
+	if err != nil {
+		return nil, err
+	}
+	step, ok := utils.VerifyTOTP(plain, code, time.Now())
+	if !ok {
+		return nil, ErrInvalidMFACode
+	}
+
+	_, err = tx.Exec(`
+		UPDATE XXAuth.USER_MFA
+		SET ENABLED = 1, CONFIRMED_AT = SYSUTCDATETIME(), LAST_USED_STEP = @step
+		WHERE ID_USER = @id_user
+	`, sql.Named("step", step), sql.Named("id_user", userID))
+	if err != nil {
+		return nil, fmt.Errorf("enable USER_MFA: %w", err)
+	}
+
+	codes, err := replaceRecoveryCodes(tx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("commit transaction: %w", err)
+	}
+	return codes, nil
+}
+
+func totpSecretContext(userID int64) string {
+	return fmt.Sprintf("totp_secret:%d", userID)
+}
+
+// openTOTPSecret decrypts the stored TOTP secret of a user.
+func openTOTPSecret(userID int64, stored string) (string, error) {
+	secret, err := secrets.Open(totpSecretContext(userID), stored)
+	if err != nil {
+		return "", fmt.Errorf("open TOTP secret of user %d: %w", userID, err)
+	}
+	return secret, nil
+}
+
+// resealTOTPSecret stores secret sealed with the active key, if the row still holds
+// previous. Secrets stored in plain text, or sealed with a retired key, are sealed again
+// this way when they are next used to log in.
+func resealTOTPSecret(userID int64, secret, previous string) error {
+	sealed, err := secrets.Seal(totpSecretContext(userID), secret)
+	if err != nil {
+		return fmt.Errorf("seal TOTP secret: %w", err)
+	}
+	_, err = db.DB.Exec(`
+		UPDATE XXAuth.USER_MFA
+		SET TOTP_SECRET = @sealed
+		WHERE ID_USER = @id_user AND TOTP_SECRET = @previous
+	`, sql.Named("sealed", sealed), sql.Named("id_user", userID), sql.Named("previous", previous))
+	if err != nil {
+		return fmt.Errorf("update USER_MFA: %w", err)
+	}
+	return nil
+}
+
+func replaceRecoveryCodes(tx *sql.Tx, userID int64) ([]string, error) {
+	_, err := tx.Exec(`DELETE FROM XXAuth.MFA_RECOVERY_CODES WHERE ID_USER = @id_user`, sql.Named("id_user", userID))
+	if err != nil {
+		return nil, fmt.Errorf("delete recovery codes: %w", err)
+	}
+
+	codes := make([]string, 0, recoveryCodeCount)
+	for i := 0; i < recoveryCodeCount; i++ {
+		code, err := utils.GenerateRecoveryCode()
+		if err != nil {
+			return nil, fmt.Errorf("generate recovery code: %w", err)
+		}
+		_, err = tx.Exec(`
+			INSERT INTO XXAuth.MFA_RECOVERY_CODES (ID_USER, CODE_HASH)
+			VALUES (@id_user, @code_hash)
+		`, sql.Named("id_user", userID), sql.Named("code_hash", utils.HashToken(utils.NormalizeRecoveryCode(code))))
+		if err != nil {
+			return nil, fmt.Errorf("insert recovery code: %w", err)
+		}
+		codes = append(codes, code)
+	}
+	return codes, nil
+}
+
+// VerifySecondFactor accepts either a TOTP code or an unused recovery code. Each TOTP
+// time step and each recovery code can be used only once.
+func VerifySecondFactor(userID int64, totpCode, recoveryCode string) error {
+	if recoveryCode != "" {
+		result, err := db.DB.Exec(`
+			UPDATE XXAuth.MFA_RECOVERY_CODES
+			SET USED_AT = SYSUTCDATETIME()
+			WHERE ID_USER = @id_user AND CODE_HASH = @code_hash AND USED_AT IS NULL
+		`,
+			sql.Named("id_user", userID),
+			sql.Named("code_hash", utils.HashToken(utils.NormalizeRecoveryCode(recoveryCode))),
+		)
+		if err != nil {
+			return fmt.Errorf("use recovery code: %w", err)
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			return ErrInvalidMFACode
+		}
+		return nil
+	}
+
+	var secret string
+	err := db.DB.QueryRow(`
+		SELECT TOTP_SECRET
+		FROM XXAuth.USER_MFA
+		WHERE ID_USER = @id_user AND ENABLED = 1
+	`, sql.Named("id_user", userID)).Scan(&secret)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrMFANotEnrolled
+		}
+		return fmt.Errorf("query USER_MFA: %w", err)
+	}
+
+	plain, err := openTOTPSecret(userID, secret)
+	if err != nil {
+		return err
+	}
+	step, ok := utils.VerifyTOTP(plain, totpCode, time.Now())
+	if !ok {
+		return ErrInvalidMFACode
+	}
+
+	result, err := db.DB.Exec(`
+		UPDATE XXAuth.USER_MFA
+		SET LAST_USED_STEP = @step
+		WHERE ID_USER = @id_user AND (LAST_USED_STEP IS NULL OR LAST_USED_STEP < @step)
+	`, sql.Named("step", step), sql.Named("id_user", userID))
+	if err != nil {
+		return fmt.Errorf("update USER_MFA: %w", err)
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return ErrInvalidMFACode
+	}
+	if secrets.Stale(secret) {
+		if err := resealTOTPSecret(userID, plain, secret); err != nil {
+			log.Printf("Sealing TOTP secret of user %d failed: %v", userID, err)
+		}
+	}
+	return nil
+}
+
+// SetMFARequired turns per-user enforcement on or off. Users that are required but
+// not enrolled must enroll before their next login completes. Only users holding a role
+// at hospitalID are changed; others get ErrUserNotInHospital.
+func SetMFARequired(hospitalID, userID int64, required bool) error {
+	result, err := db.DB.Exec(`
+		MERGE XXAuth.USER_MFA AS target
+		USING (
+			SELECT DISTINCT ID_USER FROM XXAuth.USER_ROLES
+			WHERE ID_USER = @id_user AND ID_HOSPITAL = @id_hospital
+		) AS source
+		ON target.ID_USER = source.ID_USER
+		WHEN MATCHED THEN
+			UPDATE SET REQUIRED = @required
+		WHEN NOT MATCHED THEN
+			INSERT (ID_USER, ENABLED, REQUIRED)
+			VALUES (@id_user, 0, @required);
+	`, sql.Named("id_user", userID), sql.Named("id_hospital", hospitalID), sql.Named("required", required))
+	if err != nil {
+		return fmt.Errorf("set MFA requirement: %w", err)
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return ErrUserNotInHospital
+	}
+	return nil
+}
@@ -0,0 +1,215 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"eoncohub.com/auth_module/db"
+	"eoncohub.com/auth_module/mailer"
+	"eoncohub.com/auth_module/password"
+	"eoncohub.com/auth_module/utils"
+)
+
+var (
+	ErrPasswordReused         = errors.New("password was used recently")
+	ErrCurrentPasswordInvalid = errors.New("current password is incorrect")
+)
+
+// passwordHistorySize is how many previous passwords, besides the current one, cannot be reused.
+func passwordHistorySize() int {
+	return utils.IntFromEnv("PASSWORD_HISTORY_SIZE", 5)
+}
+
+// SetPassword replaces a user's password after checking it against the policy, the
+// breached-password list and the password history. The old hash goes into the history.
+func SetPassword(tx *sql.Tx, userID int64, newPassword string) error {
+	var username, currentHash string
+	var fName, lName sql.NullString
+	err := tx.QueryRow(`
+		SELECT u.USERNAME, u.PASSWORD, p.F_NAME, p.L_NAME
+		FROM XXAuth.USERS u
+		LEFT JOIN XXPerson.PERSONS p ON p.ID_PERSON = u.ID_PERSON
+		WHERE u.ID_USER = @id_user
+	`, sql.Named("id_user", userID)).Scan(&username, &currentHash, &fName, &lName)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("user not found")
+		}
+		return fmt.Errorf("query USERS: %w", err)
+	}
+
+	if err := password.Validate(newPassword, username, fName.String, lName.String); err != nil {
+		return err
+	}
+
+	reused, err := isRecentPassword(tx, userID, currentHash, newPassword)
+	if err != nil {
+		return err
+	}
+	if reused {
+		return ErrPasswordReused
+	}
+
+	hashed, err := utils.HashPassword(newPassword)
+	if err != nil {
+		return fmt.Errorf("hash password: %w", err)
+	}
+
+	_, err = tx.Exec(`
+		UPDATE XXAuth.USERS
+		SET PASSWORD = @password
+		WHERE ID_USER = @id_user
+	`, sql.Named("password", hashed), sql.Named("id_user", userID))
+	if err != nil {
+		return fmt.Errorf("update password: %w", err)
+	}
+
+	return recordPasswordHistory(tx, userID, currentHash)
+}
+
+// ChangePassword sets a new password for a signed-in user who proved the current one,
+// and ends every other session of the user.
+func ChangePassword(userID int64, sessionID, currentPassword, newPassword string) error {
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return fmt.Errorf("start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var currentHash string
+	err = tx.QueryRow(`
+		SELECT PASSWORD FROM XXAuth.USERS WITH (UPDLOCK) WHERE ID_USER = @id_user
+	`, sql.Named("id_user", userID)).Scan(&currentHash)
+	if err != nil {
+		return fmt.Errorf("query USERS: %w", err)
+	}
+	if !utils.CheckPasswordHash(currentPassword, currentHash) {
+		return ErrCurrentPasswordInvalid
+	}
+
+	if err := SetPassword(tx, userID, newPassword); err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`
+		UPDATE XXAuth.SESSIONS
+		SET REVOKED_AT = SYSUTCDATETIME()
+		WHERE ID_USER = @id_user AND ID_SESSION <> @id_session AND REVOKED_AT IS NULL
+	`, sql.Named("id_user", userID), sql.Named("id_session", sessionID))
+	if err != nil {
+		return fmt.Errorf("revoke other sessions: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("commit transaction: %w", err)
+	}
+	return nil
+}
+
+func isRecentPassword(tx *sql.Tx, userID int64, currentHash, newPassword string) (bool, error) {
+	if utils.CheckPasswordHash(newPassword, currentHash) {
+		return true, nil
+	}
+
+	rows, err := tx.Query(`
+		SELECT TOP (@limit) PASSWORD_HASH
+		FROM XXAuth.PASSWORD_HISTORY
+		WHERE ID_USER = @id_user
+		ORDER BY CREATED_AT DESC
+	`, sql.Named("limit", passwordHistorySize()), sql.Named("id_user", userID))
+	if err != nil {
+		return false, fmt.Errorf("query PASSWORD_HISTORY: %w", err)
+	}
+	defer rows.Close()
+
+	var hashes []string
+	for rows.Next() {
+		var hash string
+		if err := rows.Scan(&hash); err != nil {
+			return false, fmt.Errorf("scan password history: %w", err)
+		}
+		hashes = append(hashes, hash)
+	}
+	if err := rows.Err(); err != nil {
+		return false, fmt.Errorf("iterate password history: %w", err)
+	}
+
+	for _, hash := range hashes {
+		if utils.CheckPasswordHash(newPassword, hash) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// recordPasswordHistory keeps the replaced hash and drops entries beyond the history size.
+func recordPasswordHistory(tx *sql.Tx, userID int64, oldHash string) error {
+	_, err := tx.Exec(`
+		INSERT INTO XXAuth.PASSWORD_HISTORY (ID_USER, PASSWORD_HASH)
+		VALUES (@id_user, @hash)
+	`, sql.Named("id_user", userID), sql.Named("hash", oldHash))
+	if err != nil {
+		return fmt.Errorf("insert PASSWORD_HISTORY: %w", err)
+	}
+
+	_, err = tx.Exec(`
+		DELETE FROM XXAuth.PASSWORD_HISTORY
+		WHERE ID_USER = @id_user AND ID_PASSWORD_HISTORY NOT IN (
+			SELECT TOP (@limit) ID_PASSWORD_HISTORY
+			FROM XXAuth.PASSWORD_HISTORY
+			WHERE ID_USER = @id_user
+			ORDER BY CREATED_AT DESC, ID_PASSWORD_HISTORY DESC
+		)
+	`, sql.Named("id_user", userID), sql.Named("limit", passwordHistorySize()))
+	if err != nil {
+		return fmt.Errorf("trim PASSWORD_HISTORY: %w", err)
+	}
+	return nil
+}
+
+// RequestPasswordReset emails a reset link and returns the user it was issued for, or
+// zero when the email has no active account.
+func RequestPasswordReset(email string) (int64, error) {
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var userID int64
+	err = tx.QueryRow(`
+		SELECT TOP 1 u.ID_USER
+		FROM XXAuth.USERS u
+		JOIN XXAuth.USER_ROLES ur ON ur.ID_USER = u.ID_USER
+		WHERE u.USERNAME = @username AND ur.STATUS = @status
+	`, sql.Named("username", email), sql.Named("status", StatusActive)).Scan(&userID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, nil
+		}
+		return 0, fmt.Errorf("query USERS: %w", err)
+	}
+
+	resetToken, err := IssueUserToken(tx, userID, TokenPurposeResetPassword, ResetTokenTTL())
+	if err != nil {
+		return userID, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return userID, fmt.Errorf("commit transaction: %w", err)
+	}
+
+	return userID, sendResetEmail(email, passwordResetURL(resetToken))
+}
+
+func passwordResetURL(token string) string {
+	return fmt.Sprintf("http://localhost:3000/reset-password?token=%s", token)
+}
+
+func sendResetEmail(toEmail string, resetLink string) error {
+	return mailer.Send(toEmail, mailer.TemplateResetPassword, mailer.DefaultLocale(), map[string]any{
+		"URL":      resetLink,
+		"ValidFor": ResetTokenTTL(),
+	})
+}
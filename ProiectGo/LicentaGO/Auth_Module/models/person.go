@@ -0,0 +1,96 @@
+package models
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"eoncohub.com/shared_module/auth"
+	"eoncohub.com/shared_module/person"
+)
+
+const personModuleURL = "http://person_module:8080"
+
+type CreatePersonResponse struct {
+	IDPerson int64 `json:"id_person"`
+}
+
+// createPerson stores a person through Person_Module and returns its ID. A person it
+// refuses is returned as a *person.RejectedError.
+func createPerson(p PersonReq) (int64, error) {
+	payload, err := json.Marshal(p)
+	if err != nil {
+		return 0, fmt.Errorf("marshal person request: %w", err)
+	}
+
+	req, err := newServiceRequest(http.MethodPost, personModuleURL+"/create", auth.ServicePerson, bytes.NewBuffer(payload))
+	if err != nil {
+		return 0, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("call person module: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		if person.Rejected(resp.StatusCode) {
+			return 0, &person.RejectedError{Status: resp.StatusCode, Body: body}
+		}
+		return 0, fmt.Errorf("person module returned status %d: %s", resp.StatusCode, string(body))
+	}
+
+	var result CreatePersonResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return 0, fmt.Errorf("decode person response: %w", err)
+	}
+	return result.IDPerson, nil
+}
+
+// rollbackPerson deletes a person created earlier in a flow that failed afterwards.
+func rollbackPerson(idPerson int64) {
+	if err := deletePerson(idPerson); err != nil {
+		log.Printf("RollbackPerson: %v", err)
+	}
+}
+
+// deletePerson removes a person through Person_Module. A person that is already gone
+// counts as deleted, so compensations can be retried.
+func deletePerson(idPerson int64) error {
+	client := &http.Client{Timeout: 3 * time.Second}
+
+	req, err := newServiceRequest(http.MethodDelete, fmt.Sprintf("%s/%d", personModuleURL, idPerson), auth.ServicePerson, nil)
+	if err != nil {
+		return fmt.Errorf("delete person %d: %w", idPerson, err)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("call person module for person %d: %w", idPerson, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotFound {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("person module returned status %d for person %d: %s", resp.StatusCode, idPerson, string(body))
+	}
+	return nil
+}
+
+// newServiceRequest builds a JSON call to another module carrying Auth_Module's service token.
+func newServiceRequest(method, url, service string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return nil, fmt.Errorf("build %s request: %w", service, err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if err := auth.SignServiceRequest(req, auth.ServiceAuth, service); err != nil {
+		return nil, err
+	}
+	return req, nil
+}
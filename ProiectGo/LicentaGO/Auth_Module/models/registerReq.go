@@ -6,20 +6,23 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"log"
 	"net/http"
-	"os"
 	"time"
 
 	"eoncohub.com/auth_module/db"
+	"eoncohub.com/auth_module/mailer"
+	"eoncohub.com/auth_module/password"
 	"eoncohub.com/auth_module/utils"
-
-	"github.com/google/uuid"
-	"github.com/sendgrid/sendgrid-go"
-	"github.com/sendgrid/sendgrid-go/helpers/mail"
+	"eoncohub.com/shared_module/auth"
+	"eoncohub.com/shared_module/person"
 )
 
 var ErrUserAlreadyExists = errors.New("user already exists")
 
+const doctorModuleURL = "http://doctor_module:8081"
+
 type PersonReq struct {
 	FName          string            `json:"f_name"`
 	LName          string            `json:"l_name"`
@@ -28,6 +31,9 @@ type PersonReq struct {
 	BornDate       time.Time         `json:"born_date"`
 	AddressReq     AddressReq        `json:"address"`
 	VirtualAddress VirtualAddressReq `json:"virtual_address"`
+	AllowSimilar   bool              `json:"allow_similar,omitempty"`
+	// Staff lets Person_Module store the person of a staff account without a CNP.
+	Staff bool `json:"staff,omitempty"`
 }
 
 type AddressReq struct {
@@ -52,54 +58,118 @@ type RegisterReq struct {
 	PersonReq PersonReq `json:"person"`
 	Parafa    string    `json:"parafa"`
 	Hospital  string    `json:"hospital"`
-	Password  string    `json:"password"`
+	Password  string    `json:"password,omitempty"`
 }
 
 type DoctorCreationResponse struct {
-	ID      int    `json:"id"`
-	Message string `json:"message"`
+	ID       int    `json:"id"`
+	IDPerson int64  `json:"id_person"`
+	Message  string `json:"message"`
 }
 
+// Register starts the registration saga and runs it as far as it gets. When a service
+// is unavailable it returns ErrRegistrationPending and the registration is retried in
+// the background; see registration.go.
 func (r *RegisterReq) Register() error {
-	tx, err := db.DB.Begin()
+	if err := password.Validate(r.Password, r.PersonReq.VirtualAddress.Email, r.PersonReq.FName, r.PersonReq.LName); err != nil {
+		return err
+	}
+
+	hashed, err := utils.HashPassword(r.Password)
 	if err != nil {
-		return fmt.Errorf("start transaction: %w", err)
+		return fmt.Errorf("hash password: %w", err)
 	}
-	defer tx.Rollback()
 
-	officialEmail, err := r.getOfficialHospitalEmail(tx)
+	reg, err := startRegistration(r, hashed)
 	if err != nil {
-		return fmt.Errorf("get hospital email: %w", err)
+		return err
 	}
 
-	token := uuid.New().String()
-	confirmURL := fmt.Sprintf("https://localhost:3000/confirm?token=%s", token)
+	if err := reg.run(); err != nil {
+		log.Printf("Registration %d: attempt %d failed, will retry: %v", reg.IDRegistration, reg.Attempts, err)
+	}
 
-	if err := sendConfirmationEmail(officialEmail, confirmURL); err != nil {
-		return fmt.Errorf("send confirmation email: %w", err)
+	switch reg.State {
+	case RegistrationCompleted:
+		return nil
+	case RegistrationAborted, RegistrationFailed:
+		if errors.Is(reg.cause, ErrUserAlreadyExists) {
+			return ErrUserAlreadyExists
+		}
+		return fmt.Errorf("registration failed: %w", reg.cause)
+	default:
+		return ErrRegistrationPending
 	}
+}
 
-	personID, err := r.createDoctorProfile()
+// ResendConfirmation issues a new confirmation link for a doctor whose account is still
+// waiting for it, or for a staff signup waiting for approval; the previous link stops
+// working. Unknown or already confirmed emails are ignored so the caller cannot tell
+// them apart.
+func ResendConfirmation(email string) error {
+	tx, err := db.DB.Begin()
 	if err != nil {
-		return fmt.Errorf("create doctor profile: %w", err)
+		return fmt.Errorf("start transaction: %w", err)
 	}
+	defer tx.Rollback()
 
-	if err := r.insertUser(tx, int64(personID), token); err != nil {
-		if errors.Is(err, ErrUserAlreadyExists) {
-			return ErrUserAlreadyExists
+	var idUser int64
+	var hospitalID sql.NullInt64
+	var status string
+	err = tx.QueryRow(`
+		SELECT TOP 1 u.ID_USER, ur.ID_HOSPITAL, ur.STATUS
+		FROM XXAuth.USERS u
+		JOIN XXAuth.USER_ROLES ur ON ur.ID_USER = u.ID_USER
+		WHERE u.USERNAME = @username AND u.EMAIL_CONFIRMED = 0 AND ur.STATUS IN (@inactive, @pending)
+	`,
+		sql.Named("username", email),
+		sql.Named("inactive", StatusInactive),
+		sql.Named("pending", StatusPending),
+	).Scan(&idUser, &hospitalID, &status)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil
 		}
-		return fmt.Errorf("insert user: %w", err)
+		return fmt.Errorf("query USERS: %w", err)
+	}
+	if status == StatusPending {
+		return reissueSignupConfirmation(tx, idUser, email)
+	}
+	if !hospitalID.Valid {
+		return fmt.Errorf("user %d has no hospital to confirm with", idUser)
+	}
+
+	return reissueConfirmation(tx, idUser, hospitalID.Int64)
+}
+
+// reissueConfirmation replaces the user's confirmation link, commits tx and emails the
+// new link to the hospital.
+func reissueConfirmation(tx *sql.Tx, idUser, hospitalID int64) error {
+	officialEmail, err := hospitalEmail(tx, hospitalID)
+	if err != nil {
+		return fmt.Errorf("get hospital email: %w", err)
+	}
+
+	token, err := IssueUserToken(tx, idUser, TokenPurposeConfirmEmail, ConfirmationTokenTTL())
+	if err != nil {
+		return fmt.Errorf("issue confirmation token: %w", err)
 	}
 
 	if err := tx.Commit(); err != nil {
 		return fmt.Errorf("commit transaction: %w", err)
 	}
 
-	return nil
+	return sendConfirmationEmail(officialEmail, confirmationURL(token))
+}
+
+func confirmationURL(token string) string {
+	return fmt.Sprintf("http://localhost:3000/confirm?token=%s", token)
 }
 
-func (r *RegisterReq) createDoctorProfile() (int, error) {
-	doctorURL := "http://doctor_module:8081/create"
+// createDoctorProfile creates the doctor through Doctor_module. Rejections by
+// Doctor_module are permanent; anything else may succeed on a retry.
+func (r *RegisterReq) createDoctorProfile() (DoctorCreationResponse, error) {
+	doctorURL := doctorModuleURL + "/create"
 
 	payload, err := json.Marshal(map[string]interface{}{
 		"person":   r.PersonReq,
@@ -107,104 +177,114 @@ func (r *RegisterReq) createDoctorProfile() (int, error) {
 		"hospital": r.Hospital,
 	})
 	if err != nil {
-		return 0, fmt.Errorf("marshal doctor request: %w", err)
+		return DoctorCreationResponse{}, fmt.Errorf("marshal doctor request: %w", err)
 	}
 
-	resp, err := http.Post(doctorURL, "application/json", bytes.NewBuffer(payload))
+	req, err := newServiceRequest(http.MethodPost, doctorURL, auth.ServiceDoctor, bytes.NewBuffer(payload))
+	if err != nil {
+		return DoctorCreationResponse{}, err
+	}
+	resp, err := registrationClient.Do(req)
 	if err != nil {
-		return 0, fmt.Errorf("call doctor module: %w", err)
+		return DoctorCreationResponse{}, fmt.Errorf("call doctor module: %w", err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return 0, fmt.Errorf("doctor module returned status: %s", resp.Status)
+		body, _ := io.ReadAll(resp.Body)
+		if person.Rejected(resp.StatusCode) {
+			return DoctorCreationResponse{}, permanent(&person.RejectedError{Status: resp.StatusCode, Body: body})
+		}
+		err := fmt.Errorf("doctor module returned status %d: %s", resp.StatusCode, string(body))
+		if resp.StatusCode >= 400 && resp.StatusCode < 500 {
+			return DoctorCreationResponse{}, permanent(err)
+		}
+		return DoctorCreationResponse{}, err
 	}
 
 	var result DoctorCreationResponse
 	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
-		return 0, fmt.Errorf("decode doctor response: %w", err)
+		return DoctorCreationResponse{}, fmt.Errorf("decode doctor response: %w", err)
 	}
 
-	return result.ID, nil
+	if result.IDPerson == 0 || result.ID == 0 {
+		return DoctorCreationResponse{}, fmt.Errorf("doctor module returned no person or doctor ID")
+	}
+	return result, nil
 }
 
-func (r *RegisterReq) getOfficialHospitalEmail(tx *sql.Tx) (string, error) {
-	var email string
-	err := tx.QueryRow(`
-		SELECT VA.EMAIL
-		FROM XXPerson.VIRTUAL_ADDRESS VA
-		JOIN XXPerson.HOSPITALS H ON VA.ID_VIRTUAL_ADDRESS = H.ID_VIRTUAL_ADDRESS
-		WHERE H.NAME = @hospitalName
-	`,
-		sql.Named("hospitalName", r.Hospital),
-	).Scan(&email)
+// discardDoctor undoes createDoctorProfile, except for the person. A doctor that is
+// already gone counts as discarded.
+func discardDoctor(idDoctorHospital int64) error {
+	client := &http.Client{Timeout: 3 * time.Second}
+
+	req, err := newServiceRequest(http.MethodDelete, fmt.Sprintf("%s/%d", doctorModuleURL, idDoctorHospital), auth.ServiceDoctor, nil)
 	if err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			return "", fmt.Errorf("hospital email not found")
-		}
-		return "", fmt.Errorf("query error: %w", err)
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("call doctor module: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotFound {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("doctor module returned status %d for doctor hospital %d: %s", resp.StatusCode, idDoctorHospital, string(body))
 	}
-	return email, nil
+	return nil
 }
 
-func (r *RegisterReq) insertUser(tx *sql.Tx, personID int64, token string) error {
-	hashed, err := utils.HashPassword(r.Password)
+// insertDoctorUser creates the account of a registered doctor, waiting for the hospital
+// to confirm it.
+func insertDoctorUser(tx *sql.Tx, email, passwordHash string, personID, hospitalID int64) (int64, error) {
+	var exists bool
+	err := tx.QueryRow(`
+		SELECT CASE WHEN EXISTS (SELECT 1 FROM XXAuth.USERS WITH (UPDLOCK, HOLDLOCK) WHERE USERNAME = @username) THEN 1 ELSE 0 END
+	`, sql.Named("username", email)).Scan(&exists)
 	if err != nil {
-		return fmt.Errorf("hash password: %w", err)
+		return 0, fmt.Errorf("query USERS: %w", err)
+	}
+	if exists {
+		return 0, ErrUserAlreadyExists
 	}
 
 	var idUser int64
 	err = tx.QueryRow(`
-		INSERT INTO XXAuth.USERS (USERNAME, PASSWORD, ID_PERSON, CONFIRMATION_TOKEN, EMAIL_CONFIRMED)
+		INSERT INTO XXAuth.USERS (USERNAME, PASSWORD, ID_PERSON, EMAIL_CONFIRMED)
 		OUTPUT INSERTED.ID_USER
-		VALUES (@username, @password, @id_person, @token, @confirmed)
+		VALUES (@username, @password, @id_person, @confirmed)
 	`,
-		sql.Named("username", r.PersonReq.VirtualAddress.Email),
-		sql.Named("password", hashed),
+		sql.Named("username", email),
+		sql.Named("password", passwordHash),
 		sql.Named("id_person", personID),
-		sql.Named("token", token),
 		sql.Named("confirmed", false),
 	).Scan(&idUser)
 	if err != nil {
-		return fmt.Errorf("insert USERS: %w", err)
+		return 0, fmt.Errorf("insert USERS: %w", err)
 	}
 
 	_, err = tx.Exec(`
-		INSERT INTO XXAuth.USER_ROLES (ID_USER, ID_ROLE, STATUS)
-		VALUES (@id_user, @id_role, 'INACTIVE')
+		INSERT INTO XXAuth.USER_ROLES (ID_USER, ID_ROLE, ID_HOSPITAL, STATUS)
+		SELECT @id_user, ID_ROLE, @id_hospital, @status
+		FROM XXAuth.ROLES
+		WHERE CODE = @role
 	`,
 		sql.Named("id_user", idUser),
-		sql.Named("id_role", 1),
+		sql.Named("id_hospital", hospitalID),
+		sql.Named("status", StatusInactive),
+		sql.Named("role", RoleDoctor),
 	)
 	if err != nil {
-		return fmt.Errorf("insert USER_ROLES: %w", err)
+		return 0, fmt.Errorf("insert USER_ROLES: %w", err)
 	}
 
-	return nil
+	return idUser, nil
 }
 
 func sendConfirmationEmail(toEmail, confirmURL string) error {
-	apiKey := os.Getenv("SENDGRID_API_KEY")
-	if apiKey == "" {
-		return errors.New("SendGrid API key is missing")
-	}
-
-	from := mail.NewEmail("Eoncohub", "no-reply@eoncohub.com")
-	subject := "Confirm Your Account"
-	to := mail.NewEmail("", toEmail)
-
-	plain := fmt.Sprintf("Please confirm your account: %s", confirmURL)
-	html := fmt.Sprintf(`<p>Please confirm your account by clicking below:</p><p><a href="%s">Confirm Account</a></p>`, confirmURL)
-
-	message := mail.NewSingleEmail(from, subject, to, plain, html)
-	client := sendgrid.NewSendClient(apiKey)
-	resp, err := client.Send(message)
-	if err != nil {
-		return fmt.Errorf("send email: %w", err)
-	}
-	if resp.StatusCode >= 400 {
-		return fmt.Errorf("sendgrid error: %s", resp.Body)
-	}
-
-	return nil
+	return mailer.Send(toEmail, mailer.TemplateConfirmAccount, mailer.DefaultLocale(), map[string]any{
+		"URL":      confirmURL,
+		"ValidFor": ConfirmationTokenTTL(),
+	})
 }
@@ -0,0 +1,720 @@
+package models
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"eoncohub.com/auth_module/db"
+	"eoncohub.com/auth_module/utils"
+)
+
+// Doctor registration spans Doctor_module, Person_Module and this module, so it runs as
+// a saga persisted in XXAuth.REGISTRATIONS. Each step moves the registration to the next
+// state; a failed step is retried with backoff, and a step that cannot succeed undoes
+// the earlier ones in reverse order.
+const (
+	RegistrationStarted       = "STARTED"        // nothing created yet
+	RegistrationDoctorCreated = "DOCTOR_CREATED" // person and doctor exist in XXPerson
+	RegistrationUserCreated   = "USER_CREATED"   // account exists, confirmation not sent yet
+	RegistrationCompleted     = "COMPLETED"
+	RegistrationCompensating  = "COMPENSATING" // undoing the steps above
+	RegistrationAborted       = "ABORTED"      // everything undone
+	RegistrationFailed        = "FAILED"       // compensation gave up, an admin has to act
+)
+
+var (
+	ErrRegistrationPending  = errors.New("registration accepted, it will complete once the other services respond")
+	ErrRegistrationNotFound = errors.New("registration not found")
+	ErrRegistrationFinished = errors.New("registration has already finished")
+	ErrRegistrationBusy     = errors.New("registration is being processed, try again shortly")
+)
+
+// registrationLease is how long a run owns a registration. Runs that crash lose it and
+// the worker picks the registration up again.
+const registrationLease = 2 * time.Minute
+
+// registrationClient calls the other modules for a run. Its timeout is well under the
+// lease, so a run cannot still be waiting on a call once another run has taken over.
+var registrationClient = &http.Client{Timeout: 30 * time.Second}
+
+func registrationMaxAttempts() int {
+	return utils.IntFromEnv("REGISTRATION_MAX_ATTEMPTS", 6)
+}
+
+func registrationRetryDelay() time.Duration {
+	return utils.DurationFromEnv("REGISTRATION_RETRY_DELAY", 30*time.Second)
+}
+
+func registrationStuckAfter() time.Duration {
+	return utils.DurationFromEnv("REGISTRATION_STUCK_AFTER", 15*time.Minute)
+}
+
+// Registration is a doctor registration as admins see it. The IDs are those of the
+// records created so far; compensation clears them as it deletes the records.
+type Registration struct {
+	IDRegistration   int64      `json:"id_registration"`
+	Email            string     `json:"email"`
+	IDHospital       int64      `json:"id_hospital"`
+	State            string     `json:"state"`
+	IDPerson         int64      `json:"id_person,omitempty"`
+	IDDoctorHospital int64      `json:"id_doctor_hospital,omitempty"`
+	IDUser           int64      `json:"id_user,omitempty"`
+	Attempts         int        `json:"attempts"`
+	LastError        string     `json:"last_error,omitempty"`
+	NextAttemptAt    *time.Time `json:"next_attempt_at,omitempty"`
+	CreatedAt        time.Time  `json:"created_at"`
+	UpdatedAt        time.Time  `json:"updated_at"`
+}
+
+// registration is a saga being run. The request is kept without its password, which is
+// only stored hashed until the account exists.
+type registration struct {
+	Registration
+	req          RegisterReq
+	passwordHash string
+	// cause is the failure that started compensation during this run.
+	cause error
+}
+
+// permanentError marks a step failure that retrying cannot fix.
+type permanentError struct{ err error }
+
+func (e permanentError) Error() string { return e.err.Error() }
+func (e permanentError) Unwrap() error { return e.err }
+
+func permanent(err error) error { return permanentError{err} }
+
+func isPermanent(err error) bool {
+	var p permanentError
+	return errors.As(err, &p)
+}
+
+// startRegistration records a new registration and claims it for the caller. An email
+// with an account or with another registration in progress is refused.
+func startRegistration(r *RegisterReq, passwordHash string) (*registration, error) {
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	hospitalID, err := findHospitalID(tx, r.Hospital)
+	if err != nil {
+		return nil, err
+	}
+
+	email := r.PersonReq.VirtualAddress.Email
+	var exists bool
+	err = tx.QueryRow(`
+		SELECT CASE WHEN EXISTS (SELECT 1 FROM XXAuth.USERS WHERE USERNAME = @email)
+		         OR EXISTS (SELECT 1 FROM XXAuth.REGISTRATIONS WITH (UPDLOCK, HOLDLOCK)
+		                    WHERE EMAIL = @email AND STATE NOT IN (@completed, @aborted))
+		       THEN 1 ELSE 0 END
+	`,
+		sql.Named("email", email),
+		sql.Named("completed", RegistrationCompleted),
+		sql.Named("aborted", RegistrationAborted),
+	).Scan(&exists)
+	if err != nil {
+		return nil, fmt.Errorf("query USERS: %w", err)
+	}
+	if exists {
+		return nil, ErrUserAlreadyExists
+	}
+
+	stored := *r
+	stored.Password = ""
+	payload, err := json.Marshal(stored)
+	if err != nil {
+		return nil, fmt.Errorf("marshal registration: %w", err)
+	}
+
+	reg := &registration{req: stored, passwordHash: passwordHash}
+	err = tx.QueryRow(`
+		INSERT INTO XXAuth.REGISTRATIONS (EMAIL, ID_HOSPITAL, PAYLOAD, PASSWORD_HASH, STATE, NEXT_ATTEMPT_AT, CLAIMED_UNTIL)
+		OUTPUT INSERTED.ID_REGISTRATION, INSERTED.CREATED_AT
+		VALUES (@email, @id_hospital, @payload, @password_hash, @state, SYSUTCDATETIME(), DATEADD(SECOND, @lease, SYSUTCDATETIME()))
+	`,
+		sql.Named("email", email),
+		sql.Named("id_hospital", hospitalID),
+		sql.Named("payload", string(payload)),
+		sql.Named("password_hash", passwordHash),
+		sql.Named("state", RegistrationStarted),
+		sql.Named("lease", int64(registrationLease.Seconds())),
+	).Scan(&reg.IDRegistration, &reg.CreatedAt)
+	if err != nil {
+		return nil, fmt.Errorf("insert REGISTRATIONS: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("commit transaction: %w", err)
+	}
+
+	reg.Email = email
+	reg.IDHospital = hospitalID
+	reg.State = RegistrationStarted
+	return reg, nil
+}
+
+// run advances the registration until it finishes or a step has to wait for a retry.
+// The returned error is the failure that made it wait, if any.
+func (r *registration) run() error {
+	for {
+		var err error
+		switch r.State {
+		case RegistrationStarted:
+			err = r.createDoctor()
+		case RegistrationDoctorCreated:
+			err = r.createUser()
+		case RegistrationUserCreated:
+			err = r.sendConfirmation()
+		case RegistrationCompensating:
+			err = r.compensate()
+		default:
+			return nil
+		}
+		if err == nil {
+			continue
+		}
+
+		if r.State != RegistrationCompensating && (isPermanent(err) || r.Attempts+1 >= registrationMaxAttempts()) {
+			log.Printf("Registration %d: %s failed, compensating: %v", r.IDRegistration, r.State, err)
+			r.cause = err
+			r.LastError = err.Error()
+			if err := r.moveTo(db.DB, RegistrationCompensating); err != nil {
+				return err
+			}
+			continue
+		}
+		return r.retryLater(err)
+	}
+}
+
+// createDoctor creates the person and the doctor through Doctor_module. It first looks
+// for the doctor an earlier run may have created before losing the response, since a run
+// that crashed or timed out does not always get to count its attempt.
+func (r *registration) createDoctor() error {
+	personID, doctorHospitalID, err := r.findCreatedDoctor()
+	if err != nil {
+		return err
+	}
+	if personID != 0 {
+		r.IDPerson, r.IDDoctorHospital = personID, doctorHospitalID
+		return r.moveTo(db.DB, RegistrationDoctorCreated)
+	}
+
+	created, err := r.req.createDoctorProfile()
+	if err != nil {
+		return fmt.Errorf("create doctor profile: %w", err)
+	}
+	r.IDPerson, r.IDDoctorHospital = created.IDPerson, int64(created.ID)
+	return r.moveTo(db.DB, RegistrationDoctorCreated)
+}
+
+// findCreatedDoctor returns a doctor with the registration's parafa at its hospital
+// that no account and no other registration claims.
+func (r *registration) findCreatedDoctor() (personID, doctorHospitalID int64, err error) {
+	err = db.DB.QueryRow(`
+		SELECT TOP 1 d.ID_PERSON, dh.ID_DOCTOR_HOSPITAL
+		FROM XXPerson.DOCTORS d
+		JOIN XXPerson.DOCTORS_AND_HOSPITALS dh ON dh.ID_DOCTOR = d.ID_DOCTOR AND dh.ID_HOSPITAL = @id_hospital
+		WHERE d.PARAFA = @parafa AND d.ISDELETED = 0
+		  AND NOT EXISTS (SELECT 1 FROM XXAuth.USERS u WHERE u.ID_PERSON = d.ID_PERSON)
+		  AND NOT EXISTS (SELECT 1 FROM XXAuth.REGISTRATIONS r
+		                  WHERE r.ID_PERSON = d.ID_PERSON AND r.ID_REGISTRATION <> @id_registration)
+		ORDER BY dh.ID_DOCTOR_HOSPITAL DESC
+	`,
+		sql.Named("id_hospital", r.IDHospital),
+		sql.Named("parafa", r.req.Parafa),
+		sql.Named("id_registration", r.IDRegistration),
+	).Scan(&personID, &doctorHospitalID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, 0, nil
+	}
+	if err != nil {
+		return 0, 0, fmt.Errorf("query DOCTORS: %w", err)
+	}
+	return personID, doctorHospitalID, nil
+}
+
+// createUser inserts the account together with the state change, so a crash cannot
+// leave an account the registration does not know about.
+func (r *registration) createUser() error {
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return fmt.Errorf("start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	idUser, err := insertDoctorUser(tx, r.Email, r.passwordHash, r.IDPerson, r.IDHospital)
+	if err != nil {
+		if errors.Is(err, ErrUserAlreadyExists) {
+			return permanent(err)
+		}
+		return fmt.Errorf("insert user: %w", err)
+	}
+
+	// Work on a copy so a failed commit leaves the registration as it is in the table.
+	next := *r
+	next.IDUser = idUser
+	if err := next.moveTo(tx, RegistrationUserCreated); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("commit transaction: %w", err)
+	}
+	*r = next
+	return nil
+}
+
+// sendConfirmation emails the hospital a confirmation link. Every attempt issues a new
+// link, since the previous one was only kept hashed.
+func (r *registration) sendConfirmation() error {
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return fmt.Errorf("start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err := reissueConfirmation(tx, r.IDUser, r.IDHospital); err != nil {
+		return fmt.Errorf("send confirmation: %w", err)
+	}
+	return r.moveTo(db.DB, RegistrationCompleted)
+}
+
+// compensate undoes whatever the registration created, newest first. Each record is
+// forgotten once deleted, so a retry continues where the previous attempt stopped.
+func (r *registration) compensate() error {
+	if r.IDUser != 0 {
+		if err := deleteUnconfirmedUser(r.IDUser); err != nil {
+			return err
+		}
+		r.IDUser = 0
+		if err := r.save(db.DB, true); err != nil {
+			return err
+		}
+	}
+	if r.IDDoctorHospital != 0 {
+		if err := discardDoctor(r.IDDoctorHospital); err != nil {
+			return err
+		}
+		r.IDDoctorHospital = 0
+		if err := r.save(db.DB, true); err != nil {
+			return err
+		}
+	}
+	if r.IDPerson != 0 {
+		if err := deletePerson(r.IDPerson); err != nil {
+			return err
+		}
+		r.IDPerson = 0
+	}
+	return r.moveTo(db.DB, RegistrationAborted)
+}
+
+// deleteUnconfirmedUser removes an account created by a registration, with its
+// confirmation links. An account that was confirmed in the meantime is left alone.
+func deleteUnconfirmedUser(idUser int64) error {
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return fmt.Errorf("start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var confirmed bool
+	err = tx.QueryRow(`
+		SELECT EMAIL_CONFIRMED FROM XXAuth.USERS WITH (UPDLOCK) WHERE ID_USER = @id_user
+	`, sql.Named("id_user", idUser)).Scan(&confirmed)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("query USERS: %w", err)
+	}
+	if confirmed {
+		return permanent(fmt.Errorf("user %d already confirmed their email", idUser))
+	}
+
+	for _, stmt := range []string{
+		`DELETE FROM XXAuth.USER_TOKENS WHERE ID_USER = @id_user`,
+		`DELETE FROM XXAuth.USER_ROLES WHERE ID_USER = @id_user`,
+		`DELETE FROM XXAuth.USERS WHERE ID_USER = @id_user`,
+	} {
+		if _, err := tx.Exec(stmt, sql.Named("id_user", idUser)); err != nil {
+			return fmt.Errorf("delete user %d: %w", idUser, err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("commit transaction: %w", err)
+	}
+	return nil
+}
+
+// moveTo persists the next state. Attempts start over for every step.
+func (r *registration) moveTo(ex sqlExecer, state string) error {
+	r.State = state
+	r.Attempts = 0
+	if state != RegistrationCompensating && state != RegistrationAborted {
+		r.LastError = ""
+	}
+	return r.save(ex, true)
+}
+
+// retryLater counts the failed attempt and schedules the next one with exponential
+// backoff. A compensation that cannot succeed or runs out of attempts stops as FAILED.
+func (r *registration) retryLater(cause error) error {
+	r.Attempts++
+	r.LastError = cause.Error()
+	if r.State == RegistrationCompensating && (isPermanent(cause) || r.Attempts >= registrationMaxAttempts()) {
+		log.Printf("Registration %d: compensation gave up: %v", r.IDRegistration, cause)
+		r.State = RegistrationFailed
+	}
+	if err := r.save(db.DB, false); err != nil {
+		log.Printf("Registration %d: %v", r.IDRegistration, err)
+	}
+	return cause
+}
+
+func (r *registration) backoff() time.Duration {
+	delay := registrationRetryDelay()
+	for i := 1; i < r.Attempts && delay < time.Hour; i++ {
+		delay *= 2
+	}
+	if delay > time.Hour {
+		delay = time.Hour
+	}
+	return delay
+}
+
+// sqlExecer is satisfied by *sql.DB and *sql.Tx.
+type sqlExecer interface {
+	Exec(query string, args ...any) (sql.Result, error)
+}
+
+// save writes the registration back. While claimed, the run keeps its lease; otherwise
+// the lease is released and the next attempt is scheduled, unless the state is final.
+// The password hash is dropped once it can no longer be needed.
+func (r *registration) save(ex sqlExecer, claimed bool) error {
+	next := sql.NullInt64{Valid: true}
+	switch r.State {
+	case RegistrationCompleted, RegistrationAborted, RegistrationFailed:
+		claimed, next.Valid = false, false
+	default:
+		if !claimed {
+			next.Int64 = int64(r.backoff().Seconds())
+		}
+	}
+	if r.State != RegistrationStarted && r.State != RegistrationDoctorCreated {
+		r.passwordHash = ""
+	}
+
+	_, err := ex.Exec(`
+		UPDATE XXAuth.REGISTRATIONS
+		SET STATE = @state,
+		    ID_PERSON = @id_person,
+		    ID_DOCTOR_HOSPITAL = @id_doctor_hospital,
+		    ID_USER = @id_user,
+		    PASSWORD_HASH = @password_hash,
+		    ATTEMPTS = @attempts,
+		    LAST_ERROR = @last_error,
+		    NEXT_ATTEMPT_AT = CASE WHEN @next IS NULL THEN NULL ELSE DATEADD(SECOND, @next, SYSUTCDATETIME()) END,
+		    CLAIMED_UNTIL = CASE WHEN @claimed = 1 THEN DATEADD(SECOND, @lease, SYSUTCDATETIME()) ELSE NULL END,
+		    UPDATED_AT = SYSUTCDATETIME()
+		WHERE ID_REGISTRATION = @id_registration
+	`,
+		sql.Named("state", r.State),
+		sql.Named("id_person", nullID(r.IDPerson)),
+		sql.Named("id_doctor_hospital", nullID(r.IDDoctorHospital)),
+		sql.Named("id_user", nullID(r.IDUser)),
+		sql.Named("password_hash", nullString(r.passwordHash)),
+		sql.Named("attempts", r.Attempts),
+		sql.Named("last_error", nullString(truncate(r.LastError, 1000))),
+		sql.Named("next", next),
+		sql.Named("claimed", claimed),
+		sql.Named("lease", int64(registrationLease.Seconds())),
+		sql.Named("id_registration", r.IDRegistration),
+	)
+	if err != nil {
+		return fmt.Errorf("update REGISTRATIONS %d: %w", r.IDRegistration, err)
+	}
+	return nil
+}
+
+func nullID(id int64) sql.NullInt64 {
+	return sql.NullInt64{Int64: id, Valid: id != 0}
+}
+
+const registrationColumns = `
+	ID_REGISTRATION, EMAIL, ID_HOSPITAL, STATE, ID_PERSON, ID_DOCTOR_HOSPITAL, ID_USER,
+	ATTEMPTS, LAST_ERROR, NEXT_ATTEMPT_AT, CREATED_AT, UPDATED_AT`
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanRegistration(row rowScanner, extra ...any) (Registration, error) {
+	var reg Registration
+	var person, doctorHospital, user sql.NullInt64
+	var lastError sql.NullString
+	var next sql.NullTime
+	dest := append([]any{
+		&reg.IDRegistration, &reg.Email, &reg.IDHospital, &reg.State, &person, &doctorHospital, &user,
+		&reg.Attempts, &lastError, &next, &reg.CreatedAt, &reg.UpdatedAt,
+	}, extra...)
+	if err := row.Scan(dest...); err != nil {
+		return reg, err
+	}
+	reg.IDPerson, reg.IDDoctorHospital, reg.IDUser = person.Int64, doctorHospital.Int64, user.Int64
+	reg.LastError = lastError.String
+	if next.Valid {
+		reg.NextAttemptAt = &next.Time
+	}
+	return reg, nil
+}
+
+// claimRegistration takes the lease on a registration that is due and not being run,
+// or returns nil when another run has it or it is not due.
+func claimRegistration(id int64) (*registration, error) {
+	var payload string
+	var passwordHash sql.NullString
+	reg, err := scanRegistration(db.DB.QueryRow(`
+		UPDATE XXAuth.REGISTRATIONS
+		SET CLAIMED_UNTIL = DATEADD(SECOND, @lease, SYSUTCDATETIME())
+		OUTPUT `+prefixColumns("INSERTED.", registrationColumns)+`, INSERTED.PAYLOAD, INSERTED.PASSWORD_HASH
+		WHERE ID_REGISTRATION = @id_registration
+		  AND STATE NOT IN (@completed, @aborted, @failed)
+		  AND NEXT_ATTEMPT_AT <= SYSUTCDATETIME()
+		  AND (CLAIMED_UNTIL IS NULL OR CLAIMED_UNTIL < SYSUTCDATETIME())
+	`,
+		sql.Named("lease", int64(registrationLease.Seconds())),
+		sql.Named("id_registration", id),
+		sql.Named("completed", RegistrationCompleted),
+		sql.Named("aborted", RegistrationAborted),
+		sql.Named("failed", RegistrationFailed),
+	), &payload, &passwordHash)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("claim registration %d: %w", id, err)
+	}
+
+	r := &registration{Registration: reg, passwordHash: passwordHash.String}
+	if err := json.Unmarshal([]byte(payload), &r.req); err != nil {
+		return nil, fmt.Errorf("decode registration %d: %w", id, err)
+	}
+	return r, nil
+}
+
+func prefixColumns(prefix, columns string) string {
+	fields := strings.Split(columns, ",")
+	for i, f := range fields {
+		fields[i] = prefix + strings.TrimSpace(f)
+	}
+	return strings.Join(fields, ", ")
+}
+
+// StartRegistrationRecovery retries the registrations that are due in the background,
+// including those left behind by a crashed process once their lease expires.
+func StartRegistrationRecovery() {
+	interval := utils.DurationFromEnv("REGISTRATION_RETRY_INTERVAL", 30*time.Second)
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if err := retryDueRegistrations(); err != nil {
+				log.Printf("Registration recovery failed: %v", err)
+			}
+		}
+	}()
+}
+
+func retryDueRegistrations() error {
+	rows, err := db.DB.Query(`
+		SELECT TOP 20 ID_REGISTRATION
+		FROM XXAuth.REGISTRATIONS
+		WHERE STATE NOT IN (@completed, @aborted, @failed)
+		  AND NEXT_ATTEMPT_AT <= SYSUTCDATETIME()
+		  AND (CLAIMED_UNTIL IS NULL OR CLAIMED_UNTIL < SYSUTCDATETIME())
+		ORDER BY NEXT_ATTEMPT_AT
+	`,
+		sql.Named("completed", RegistrationCompleted),
+		sql.Named("aborted", RegistrationAborted),
+		sql.Named("failed", RegistrationFailed),
+	)
+	if err != nil {
+		return fmt.Errorf("query REGISTRATIONS: %w", err)
+	}
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return fmt.Errorf("scan registration: %w", err)
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("iterate registrations: %w", err)
+	}
+
+	for _, id := range ids {
+		r, err := claimRegistration(id)
+		if err != nil {
+			log.Printf("Registration %d: %v", id, err)
+			continue
+		}
+		if r == nil {
+			continue
+		}
+		if err := r.run(); err != nil {
+			log.Printf("Registration %d: attempt %d failed: %v", id, r.Attempts, err)
+		}
+	}
+	return nil
+}
+
+// RegistrationFilter narrows the admin listing. Without a State only stuck
+// registrations are listed: failed ones and those that have not moved for a while.
+// HospitalID zero lists every hospital.
+type RegistrationFilter struct {
+	HospitalID int64
+	State      string
+}
+
+func (f RegistrationFilter) where() (string, []any) {
+	conds := []string{"1 = 1"}
+	args := []any{}
+	if f.HospitalID != 0 {
+		conds = append(conds, "ID_HOSPITAL = @id_hospital")
+		args = append(args, sql.Named("id_hospital", f.HospitalID))
+	}
+	if f.State != "" {
+		conds = append(conds, "STATE = @state")
+		args = append(args, sql.Named("state", f.State))
+	} else {
+		conds = append(conds, `(STATE = @failed OR (STATE NOT IN (@completed, @aborted)
+			AND UPDATED_AT < DATEADD(SECOND, -@stuck_after, SYSUTCDATETIME())))`)
+		args = append(args,
+			sql.Named("failed", RegistrationFailed),
+			sql.Named("completed", RegistrationCompleted),
+			sql.Named("aborted", RegistrationAborted),
+			sql.Named("stuck_after", int64(registrationStuckAfter().Seconds())),
+		)
+	}
+	return "WHERE " + strings.Join(conds, " AND "), args
+}
+
+// ListRegistrations returns a page of registrations, oldest first, and the total count.
+func ListRegistrations(f RegistrationFilter, page, pageSize int) ([]Registration, int, error) {
+	where, args := f.where()
+
+	var total int
+	if err := db.DB.QueryRow(`SELECT COUNT(*) FROM XXAuth.REGISTRATIONS `+where, args...).Scan(&total); err != nil {
+		return nil, 0, fmt.Errorf("count registrations: %w", err)
+	}
+
+	args = append(args, sql.Named("offset", (page-1)*pageSize), sql.Named("limit", pageSize))
+	rows, err := db.DB.Query(`
+		SELECT `+registrationColumns+`
+		FROM XXAuth.REGISTRATIONS
+		`+where+`
+		ORDER BY CREATED_AT, ID_REGISTRATION
+		OFFSET @offset ROWS FETCH NEXT @limit ROWS ONLY
+	`, args...)
+	if err != nil {
+		return nil, 0, fmt.Errorf("query registrations: %w", err)
+	}
+	defer rows.Close()
+
+	registrations := []Registration{}
+	for rows.Next() {
+		reg, err := scanRegistration(rows)
+		if err != nil {
+			return nil, 0, fmt.Errorf("scan registration: %w", err)
+		}
+		registrations = append(registrations, reg)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, fmt.Errorf("iterate registrations: %w", err)
+	}
+	return registrations, total, nil
+}
+
+// GetRegistration returns one registration. hospitalID zero allows any hospital.
+func GetRegistration(hospitalID, id int64) (Registration, error) {
+	reg, err := scanRegistration(db.DB.QueryRow(`
+		SELECT `+registrationColumns+`
+		FROM XXAuth.REGISTRATIONS
+		WHERE ID_REGISTRATION = @id_registration AND (@id_hospital = 0 OR ID_HOSPITAL = @id_hospital)
+	`, sql.Named("id_registration", id), sql.Named("id_hospital", hospitalID)))
+	if errors.Is(err, sql.ErrNoRows) {
+		return reg, ErrRegistrationNotFound
+	}
+	if err != nil {
+		return reg, fmt.Errorf("query registration %d: %w", id, err)
+	}
+	return reg, nil
+}
+
+// RetryRegistration runs a waiting or failed registration now, with its attempts reset.
+// A failed one resumes its compensation.
+func RetryRegistration(hospitalID, id int64) (Registration, error) {
+	return rescheduleRegistration(hospitalID, id, `CASE WHEN STATE = @failed THEN @compensating ELSE STATE END`)
+}
+
+// AbortRegistration gives up on a registration and undoes what it created.
+func AbortRegistration(hospitalID, id int64) (Registration, error) {
+	return rescheduleRegistration(hospitalID, id, `@compensating`)
+}
+
+// rescheduleRegistration moves an unfinished registration that no run holds to the given
+// state, makes it due and runs it right away.
+func rescheduleRegistration(hospitalID, id int64, state string) (Registration, error) {
+	reg, err := GetRegistration(hospitalID, id)
+	if err != nil {
+		return reg, err
+	}
+	if reg.State == RegistrationCompleted || reg.State == RegistrationAborted {
+		return reg, ErrRegistrationFinished
+	}
+
+	res, err := db.DB.Exec(`
+		UPDATE XXAuth.REGISTRATIONS
+		SET STATE = `+state+`, ATTEMPTS = 0, NEXT_ATTEMPT_AT = SYSUTCDATETIME(), UPDATED_AT = SYSUTCDATETIME()
+		WHERE ID_REGISTRATION = @id_registration
+		  AND STATE NOT IN (@completed, @aborted)
+		  AND (CLAIMED_UNTIL IS NULL OR CLAIMED_UNTIL < SYSUTCDATETIME())
+	`,
+		sql.Named("failed", RegistrationFailed),
+		sql.Named("compensating", RegistrationCompensating),
+		sql.Named("completed", RegistrationCompleted),
+		sql.Named("aborted", RegistrationAborted),
+		sql.Named("id_registration", id),
+	)
+	if err != nil {
+		return reg, fmt.Errorf("update REGISTRATIONS %d: %w", id, err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return reg, ErrRegistrationBusy
+	}
+
+	r, err := claimRegistration(id)
+	if err != nil {
+		return reg, err
+	}
+	if r != nil {
+		if err := r.run(); err != nil {
+			log.Printf("Registration %d: attempt %d failed: %v", id, r.Attempts, err)
+		}
+	}
+	return GetRegistration(hospitalID, id)
+}
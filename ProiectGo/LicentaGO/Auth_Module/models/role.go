@@ -0,0 +1,48 @@
+package models
+
+import (
+	"database/sql"
+	"fmt"
+
+	"eoncohub.com/auth_module/db"
+	"eoncohub.com/shared_module/auth"
+)
+
+// Role codes as stored in XXAuth.ROLES.CODE and carried in the "roles" claim of the access token.
+const (
+	RoleDoctor        = auth.RoleDoctor
+	RoleNurse         = auth.RoleNurse
+	RoleAssistant     = auth.RoleAssistant
+	RoleHospitalAdmin = auth.RoleHospitalAdmin
+	RolePlatformAdmin = auth.RolePlatformAdmin
+)
+
+// GetUserRoles returns the codes of the user's active roles at a hospital, together
+// with the roles that are not tied to any hospital, such as platform_admin.
+func GetUserRoles(userID, hospitalID int64) ([]string, error) {
+	rows, err := db.DB.Query(`
+		SELECT r.CODE
+		FROM XXAuth.USER_ROLES ur
+		JOIN XXAuth.ROLES r ON r.ID_ROLE = ur.ID_ROLE
+		WHERE ur.ID_USER = @id_user AND ur.STATUS = 'ACTIVE'
+		  AND (ur.ID_HOSPITAL IS NULL OR ur.ID_HOSPITAL = @id_hospital)
+	`, sql.Named("id_user", userID), sql.Named("id_hospital", hospitalID))
+	if err != nil {
+		return nil, fmt.Errorf("query roles: %w", err)
+	}
+	defer rows.Close()
+
+	var roles []string
+	for rows.Next() {
+		var code string
+		if err := rows.Scan(&code); err != nil {
+			return nil, fmt.Errorf("scan role: %w", err)
+		}
+		roles = append(roles, code)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("iterate roles: %w", err)
+	}
+
+	return roles, nil
+}
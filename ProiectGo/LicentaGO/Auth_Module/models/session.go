@@ -0,0 +1,284 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"eoncohub.com/auth_module/db"
+	"eoncohub.com/auth_module/utils"
+	"eoncohub.com/shared_module/auth"
+	"github.com/google/uuid"
+)
+
+var (
+	ErrInvalidRefreshToken = errors.New("invalid or expired refresh token")
+	ErrSessionNotFound     = errors.New("session not found")
+)
+
+type Session struct {
+	ID     string `json:"id_session"`
+	UserID int64  `json:"id_user"`
+	// HospitalID is the hospital selected for the session, zero when none was.
+	HospitalID int64 `json:"id_hospital,omitempty"`
+}
+
+// SessionInfo describes the client a session is opened from.
+type SessionInfo struct {
+	IP         string
+	UserAgent  string
+	Method     string
+	HospitalID int64
+}
+
+// ActiveSession is an open session as listed to its owner. IP is the address of the
+// last login or refresh; LastSeenAt is kept current by every module's JWT middleware.
+type ActiveSession struct {
+	ID          string    `json:"id_session"`
+	Device      string    `json:"device"`
+	UserAgent   string    `json:"user_agent"`
+	IP          string    `json:"ip"`
+	LoginMethod string    `json:"login_method"`
+	CreatedAt   time.Time `json:"created_at"`
+	LastSeenAt  time.Time `json:"last_seen_at"`
+	ExpiresAt   time.Time `json:"expires_at"`
+	Current     bool      `json:"current"`
+}
+
+// AccessTokenTTL is the lifetime of the JWT placed in the "token" cookie.
+func AccessTokenTTL() time.Duration {
+	return utils.DurationFromEnv("ACCESS_TOKEN_TTL", 15*time.Minute)
+}
+
+// RefreshTokenTTL is the absolute lifetime of a session; rotating the refresh token does not extend it.
+func RefreshTokenTTL() time.Duration {
+	return utils.DurationFromEnv("REFRESH_TOKEN_TTL", 7*24*time.Hour)
+}
+
+// CreateSession opens a new server-side session for the user and returns its ID
+// together with the plaintext refresh token. Only the token hash is persisted.
+func CreateSession(userID int64, info SessionInfo) (string, string, error) {
+	refreshToken, err := utils.GenerateOpaqueToken()
+	if err != nil {
+		return "", "", fmt.Errorf("generate refresh token: %w", err)
+	}
+	sessionID := uuid.New().String()
+
+	_, err = db.DB.Exec(`
+		INSERT INTO XXAuth.SESSIONS (ID_SESSION, ID_USER, REFRESH_TOKEN_HASH, CREATED_AT, EXPIRES_AT,
+		                             LAST_SEEN_AT, IP, USER_AGENT, DEVICE, LOGIN_METHOD, ID_HOSPITAL)
+		VALUES (@id_session, @id_user, @token_hash, SYSUTCDATETIME(), DATEADD(SECOND, @ttl, SYSUTCDATETIME()),
+		        SYSUTCDATETIME(), @ip, @user_agent, @device, @method, @id_hospital)
+	`,
+		sql.Named("id_session", sessionID),
+		sql.Named("id_user", userID),
+		sql.Named("token_hash", utils.HashToken(refreshToken)),
+		sql.Named("ttl", int64(RefreshTokenTTL().Seconds())),
+		sql.Named("ip", info.IP),
+		sql.Named("user_agent", truncate(info.UserAgent, 512)),
+		sql.Named("device", utils.DeviceLabel(info.UserAgent)),
+		sql.Named("method", info.Method),
+		sql.Named("id_hospital", sql.NullInt64{Int64: info.HospitalID, Valid: info.HospitalID != 0}),
+	)
+	if err != nil {
+		return "", "", fmt.Errorf("insert SESSIONS: %w", err)
+	}
+
+	return sessionID, refreshToken, nil
+}
+
+// RotateSession exchanges a refresh token for a new one and records the client address.
+// Presenting a token that was already rotated is treated as theft and revokes the whole session.
+func RotateSession(refreshToken, ip string) (*Session, string, error) {
+	newToken, err := utils.GenerateOpaqueToken()
+	if err != nil {
+		return nil, "", fmt.Errorf("generate refresh token: %w", err)
+	}
+	oldHash := utils.HashToken(refreshToken)
+
+	var session Session
+	var hospitalID sql.NullInt64
+	err = db.DB.QueryRow(`
+		UPDATE s
+		SET PREVIOUS_TOKEN_HASH = s.REFRESH_TOKEN_HASH,
+		    REFRESH_TOKEN_HASH = @new_hash,
+		    LAST_REFRESHED_AT = SYSUTCDATETIME(),
+		    LAST_SEEN_AT = SYSUTCDATETIME(),
+		    IP = @ip
+		OUTPUT INSERTED.ID_SESSION, INSERTED.ID_USER, INSERTED.ID_HOSPITAL
+		FROM XXAuth.SESSIONS s
+		WHERE s.REFRESH_TOKEN_HASH = @old_hash
+		  AND s.REVOKED_AT IS NULL
+		  AND s.EXPIRES_AT > SYSUTCDATETIME()
+		  AND EXISTS (
+		      SELECT 1 FROM XXAuth.USER_ROLES ur
+		      WHERE ur.ID_USER = s.ID_USER AND ur.STATUS = 'ACTIVE'
+		  )
+	`,
+		sql.Named("new_hash", utils.HashToken(newToken)),
+		sql.Named("old_hash", oldHash),
+		sql.Named("ip", ip),
+	).Scan(&session.ID, &session.UserID, &hospitalID)
+	if err == nil {
+		session.HospitalID = hospitalID.Int64
+		return &session, newToken, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return nil, "", fmt.Errorf("rotate refresh token: %w", err)
+	}
+
+	result, err := db.DB.Exec(`
+		UPDATE XXAuth.SESSIONS
+		SET REVOKED_AT = SYSUTCDATETIME()
+		WHERE PREVIOUS_TOKEN_HASH = @old_hash AND REVOKED_AT IS NULL
+	`, sql.Named("old_hash", oldHash))
+	if err != nil {
+		return nil, "", fmt.Errorf("revoke reused session: %w", err)
+	}
+	if n, _ := result.RowsAffected(); n > 0 {
+		log.Printf("Refresh token reuse detected, session revoked")
+	}
+
+	return nil, "", ErrInvalidRefreshToken
+}
+
+// RevokeSession ends a single session. Revoking an unknown or already revoked session is not an error.
+func RevokeSession(sessionID string) error {
+	_, err := db.DB.Exec(`
+		UPDATE XXAuth.SESSIONS
+		SET REVOKED_AT = SYSUTCDATETIME()
+		WHERE ID_SESSION = @id_session AND REVOKED_AT IS NULL
+	`, sql.Named("id_session", sessionID))
+	if err != nil {
+		return fmt.Errorf("revoke session: %w", err)
+	}
+	return nil
+}
+
+// RevokeSessionByRefreshToken ends the session that currently owns the refresh token.
+func RevokeSessionByRefreshToken(refreshToken string) error {
+	_, err := db.DB.Exec(`
+		UPDATE XXAuth.SESSIONS
+		SET REVOKED_AT = SYSUTCDATETIME()
+		WHERE REFRESH_TOKEN_HASH = @token_hash AND REVOKED_AT IS NULL
+	`, sql.Named("token_hash", utils.HashToken(refreshToken)))
+	if err != nil {
+		return fmt.Errorf("revoke session: %w", err)
+	}
+	return nil
+}
+
+// RevokeUserSessions ends every open session of a user, e.g. after a password
+// reset or when the account is deactivated.
+func RevokeUserSessions(tx *sql.Tx, userID int64) error {
+	_, err := tx.Exec(`
+		UPDATE XXAuth.SESSIONS
+		SET REVOKED_AT = SYSUTCDATETIME()
+		WHERE ID_USER = @id_user AND REVOKED_AT IS NULL
+	`, sql.Named("id_user", userID))
+	if err != nil {
+		return fmt.Errorf("revoke user sessions: %w", err)
+	}
+	return nil
+}
+
+// IsSessionActive reports whether the session exists, is neither revoked nor
+// expired, and still belongs to an active account.
+func IsSessionActive(sessionID string) (bool, error) {
+	return auth.SQLSessionChecker(db.DB)(sessionID)
+}
+
+// ListUserSessions returns the open sessions of a user, most recently seen first.
+// currentSessionID marks the session the request was made with.
+func ListUserSessions(userID int64, currentSessionID string) ([]ActiveSession, error) {
+	rows, err := db.DB.Query(`
+		SELECT ID_SESSION, DEVICE, USER_AGENT, IP, LOGIN_METHOD, CREATED_AT,
+		       COALESCE(LAST_SEEN_AT, LAST_REFRESHED_AT, CREATED_AT), EXPIRES_AT
+		FROM XXAuth.SESSIONS
+		WHERE ID_USER = @id_user AND REVOKED_AT IS NULL AND EXPIRES_AT > SYSUTCDATETIME()
+		ORDER BY COALESCE(LAST_SEEN_AT, LAST_REFRESHED_AT, CREATED_AT) DESC
+	`, sql.Named("id_user", userID))
+	if err != nil {
+		return nil, fmt.Errorf("query sessions: %w", err)
+	}
+	defer rows.Close()
+
+	sessions := []ActiveSession{}
+	for rows.Next() {
+		var s ActiveSession
+		var device, userAgent, ip, method sql.NullString
+		if err := rows.Scan(&s.ID, &device, &userAgent, &ip, &method, &s.CreatedAt, &s.LastSeenAt, &s.ExpiresAt); err != nil {
+			return nil, fmt.Errorf("scan session: %w", err)
+		}
+		s.Device = device.String
+		s.UserAgent = userAgent.String
+		s.IP = ip.String
+		s.LoginMethod = method.String
+		s.Current = s.ID == currentSessionID
+		sessions = append(sessions, s)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("iterate sessions: %w", err)
+	}
+	return sessions, nil
+}
+
+// RevokeUserSession ends one open session of the user. Sessions of other users are
+// reported as not found.
+func RevokeUserSession(userID int64, sessionID string) error {
+	result, err := db.DB.Exec(`
+		UPDATE XXAuth.SESSIONS
+		SET REVOKED_AT = SYSUTCDATETIME()
+		WHERE ID_SESSION = @id_session AND ID_USER = @id_user AND REVOKED_AT IS NULL
+	`, sql.Named("id_session", sessionID), sql.Named("id_user", userID))
+	if err != nil {
+		return fmt.Errorf("revoke session: %w", err)
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return ErrSessionNotFound
+	}
+	return nil
+}
+
+// RevokeOtherSessions ends every open session of the user except keepSessionID, which
+// may be empty to end them all. It returns how many sessions were ended.
+func RevokeOtherSessions(userID int64, keepSessionID string) (int64, error) {
+	result, err := db.DB.Exec(`
+		UPDATE XXAuth.SESSIONS
+		SET REVOKED_AT = SYSUTCDATETIME()
+		WHERE ID_USER = @id_user AND ID_SESSION <> @keep AND REVOKED_AT IS NULL
+	`, sql.Named("id_user", userID), sql.Named("keep", keepSessionID))
+	if err != nil {
+		return 0, fmt.Errorf("revoke sessions: %w", err)
+	}
+	n, _ := result.RowsAffected()
+	return n, nil
+}
+
+// SetSessionHospital selects the hospital the session's access tokens are scoped to.
+// The user must hold an active role there.
+func SetSessionHospital(userID int64, sessionID string, hospitalID int64) error {
+	result, err := db.DB.Exec(`
+		UPDATE XXAuth.SESSIONS
+		SET ID_HOSPITAL = @id_hospital
+		WHERE ID_SESSION = @id_session AND ID_USER = @id_user AND REVOKED_AT IS NULL
+		  AND EXISTS (
+		      SELECT 1 FROM XXAuth.USER_ROLES ur
+		      WHERE ur.ID_USER = @id_user AND ur.ID_HOSPITAL = @id_hospital AND ur.STATUS = @active
+		  )
+	`,
+		sql.Named("id_hospital", hospitalID),
+		sql.Named("id_session", sessionID),
+		sql.Named("id_user", userID),
+		sql.Named("active", StatusActive),
+	)
+	if err != nil {
+		return fmt.Errorf("update session hospital: %w", err)
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return ErrNotAffiliated
+	}
+	return nil
+}
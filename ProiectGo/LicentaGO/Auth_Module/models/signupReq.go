@@ -1,5 +1,32 @@
 package models
 
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	"eoncohub.com/auth_module/db"
+	"eoncohub.com/auth_module/mailer"
+	"eoncohub.com/auth_module/password"
+	"eoncohub.com/auth_module/utils"
+)
+
+var (
+	ErrPasswordMismatch = errors.New("passwords do not match")
+	ErrInvalidRole      = errors.New("role cannot be requested through signup")
+	ErrMissingFields    = errors.New("missing required fields")
+)
+
+// signupRoles are the roles staff can request themselves. Doctors go through /register
+// and platform admins are assigned directly in the database.
+var signupRoles = map[string]bool{
+	RoleNurse:         true,
+	RoleAssistant:     true,
+	RoleHospitalAdmin: true,
+}
+
 type SignupReq struct {
 	Clinic          string `json:"clinic"`
 	ConfirmPassword string `json:"confirmPassword"`
@@ -12,3 +39,155 @@ type SignupReq struct {
 	Surname         string `json:"surname"`
 	Role            int    `json:"role"`
 }
+
+// Signup creates the person and a user whose role stays PENDING until a hospital
+// admin of the requested clinic approves it, and emails the user a confirmation link.
+// The role can only be approved once the email is confirmed.
+func (s *SignupReq) Signup() error {
+	s.Email = strings.TrimSpace(s.Email)
+	if s.Email == "" || s.Password == "" || s.Clinic == "" || s.Name == "" || s.Surname == "" {
+		return ErrMissingFields
+	}
+	if s.Password != s.ConfirmPassword {
+		return ErrPasswordMismatch
+	}
+	if err := password.Validate(s.Password, s.Email, s.Name, s.Surname); err != nil {
+		return err
+	}
+
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return fmt.Errorf("start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err := s.checkRole(tx); err != nil {
+		return err
+	}
+
+	hospitalID, err := findHospitalID(tx, s.Clinic)
+	if err != nil {
+		return err
+	}
+
+	var exists bool
+	err = tx.QueryRow(`
+		SELECT CASE WHEN EXISTS (SELECT 1 FROM XXAuth.USERS WHERE USERNAME = @username) THEN 1 ELSE 0 END
+	`, sql.Named("username", s.Email)).Scan(&exists)
+	if err != nil {
+		return fmt.Errorf("query USERS: %w", err)
+	}
+	if exists {
+		return ErrUserAlreadyExists
+	}
+
+	personID, err := createPerson(PersonReq{
+		FName: s.Name,
+		LName: s.Surname,
+		AddressReq: AddressReq{
+			Loc: LocReq{Name: s.Locality, Jud: JudReq{Name: s.County}},
+		},
+		VirtualAddress: VirtualAddressReq{Email: s.Email},
+		Staff:          true,
+	})
+	if err != nil {
+		return fmt.Errorf("create person: %w", err)
+	}
+
+	idUser, err := s.insertUser(tx, personID, hospitalID)
+	if err != nil {
+		rollbackPerson(personID)
+		return fmt.Errorf("insert user: %w", err)
+	}
+
+	token, err := IssueUserToken(tx, idUser, TokenPurposeConfirmEmail, ConfirmationTokenTTL())
+	if err != nil {
+		rollbackPerson(personID)
+		return fmt.Errorf("issue confirmation token: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		rollbackPerson(personID)
+		return fmt.Errorf("commit transaction: %w", err)
+	}
+
+	// The account stands without the email; the user can ask for a new link
+	if err := sendSignupConfirmation(s.Email, token); err != nil {
+		log.Printf("Failed to send signup confirmation: %v", err)
+	}
+	return nil
+}
+
+// reissueSignupConfirmation replaces the confirmation link of a signed-up user, commits
+// tx and emails the new link to the user.
+func reissueSignupConfirmation(tx *sql.Tx, idUser int64, email string) error {
+	token, err := IssueUserToken(tx, idUser, TokenPurposeConfirmEmail, ConfirmationTokenTTL())
+	if err != nil {
+		return fmt.Errorf("issue confirmation token: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("commit transaction: %w", err)
+	}
+
+	return sendSignupConfirmation(email, token)
+}
+
+func sendSignupConfirmation(toEmail, token string) error {
+	return mailer.Send(toEmail, mailer.TemplateConfirmEmail, mailer.DefaultLocale(), map[string]any{
+		"URL":      confirmationURL(token),
+		"ValidFor": ConfirmationTokenTTL(),
+	})
+}
+
+func (s *SignupReq) checkRole(tx *sql.Tx) error {
+	var code string
+	err := tx.QueryRow(`SELECT CODE FROM XXAuth.ROLES WHERE ID_ROLE = @id_role`, sql.Named("id_role", s.Role)).Scan(&code)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrInvalidRole
+		}
+		return fmt.Errorf("query ROLES: %w", err)
+	}
+	if !signupRoles[code] {
+		return ErrInvalidRole
+	}
+	return nil
+}
+
+func (s *SignupReq) insertUser(tx *sql.Tx, personID, hospitalID int64) (int64, error) {
+	hashed, err := utils.HashPassword(s.Password)
+	if err != nil {
+		return 0, fmt.Errorf("hash password: %w", err)
+	}
+
+	var idUser int64
+	err = tx.QueryRow(`
+		INSERT INTO XXAuth.USERS (USERNAME, PASSWORD, ID_PERSON, EMAIL_CONFIRMED)
+		OUTPUT INSERTED.ID_USER
+		VALUES (@username, @password, @id_person, @confirmed)
+	`,
+		sql.Named("username", s.Email),
+		sql.Named("password", hashed),
+		sql.Named("id_person", personID),
+		sql.Named("confirmed", false),
+	).Scan(&idUser)
+	if err != nil {
+		return 0, fmt.Errorf("insert USERS: %w", err)
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO XXAuth.USER_ROLES (ID_USER, ID_ROLE, ID_HOSPITAL, STATUS)
+		VALUES (@id_user, @id_role, @id_hospital, @status)
+	`,
+		sql.Named("id_user", idUser),
+		sql.Named("id_role", s.Role),
+		sql.Named("id_hospital", hospitalID),
+		sql.Named("status", StatusPending),
+	)
+	if err != nil {
+		return 0, fmt.Errorf("insert USER_ROLES: %w", err)
+	}
+
+	return idUser, nil
+}
@@ -0,0 +1,480 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"eoncohub.com/auth_module/db"
+	"eoncohub.com/auth_module/oidc"
+	"eoncohub.com/auth_module/secrets"
+	"eoncohub.com/auth_module/utils"
+)
+
+var (
+	ErrSSONotConfigured = errors.New("single sign-on is not configured for this hospital")
+	ErrInvalidSSOState  = errors.New("invalid or expired single sign-on request")
+	ErrSSOUserNotFound  = errors.New("no account matches the identity provider login")
+)
+
+// ssoLoginTTL is how long the user has to come back from the identity provider.
+const ssoLoginTTL = 10 * time.Minute
+
+// jitRoles are the roles just-in-time provisioning may grant. Doctors need a profile in
+// Doctor_module and register through /register; their account is linked on first SSO login.
+var jitRoles = map[string]bool{
+	RoleNurse:     true,
+	RoleAssistant: true,
+}
+
+// HospitalIdP is the identity provider configuration of a hospital (XXAuth.HOSPITAL_IDP).
+type HospitalIdP struct {
+	HospitalID   int64
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	Scopes       []string
+	// AllowJIT creates accounts for unknown users of the hospital with JITRole.
+	AllowJIT       bool
+	JITRole        string
+	JITAutoApprove bool
+	// EmailDomains limits provisioning to these domains; empty allows any.
+	EmailDomains []string
+}
+
+type SSOHospital struct {
+	IDHospital int64  `json:"id_hospital"`
+	Name       string `json:"name"`
+}
+
+// SSOLogin is an authorization request waiting for the identity provider to redirect back.
+type SSOLogin struct {
+	HospitalID    int64
+	State         string
+	Nonce         string
+	CodeVerifier  string
+	CodeChallenge string
+}
+
+// Provider returns the OIDC client for the hospital's identity provider.
+func (idp *HospitalIdP) Provider(redirectURL string) *oidc.Provider {
+	return &oidc.Provider{
+		Issuer:       idp.Issuer,
+		ClientID:     idp.ClientID,
+		ClientSecret: idp.ClientSecret,
+		Scopes:       idp.Scopes,
+		RedirectURL:  redirectURL,
+	}
+}
+
+// GetSSOHospitals lists the hospitals whose staff can sign in through an identity provider.
+func GetSSOHospitals() ([]SSOHospital, error) {
+	rows, err := db.DB.Query(`
+		SELECT h.ID_HOSPITAL, h.NAME
+		FROM XXAuth.HOSPITAL_IDP i
+		JOIN XXPerson.HOSPITALS h ON h.ID_HOSPITAL = i.ID_HOSPITAL
+		WHERE i.ENABLED = 1
+		ORDER BY h.NAME
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("query HOSPITAL_IDP: %w", err)
+	}
+	defer rows.Close()
+
+	hospitals := []SSOHospital{}
+	for rows.Next() {
+		var h SSOHospital
+		if err := rows.Scan(&h.IDHospital, &h.Name); err != nil {
+			return nil, fmt.Errorf("scan hospital: %w", err)
+		}
+		hospitals = append(hospitals, h)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("iterate hospitals: %w", err)
+	}
+	return hospitals, nil
+}
+
+// GetHospitalIdP loads the enabled identity provider configuration of a hospital.
+func GetHospitalIdP(hospitalID int64) (*HospitalIdP, error) {
+	var idp HospitalIdP
+	var secret, scopes, jitRole, domains sql.NullString
+	err := db.DB.QueryRow(`
+		SELECT ID_HOSPITAL, ISSUER, CLIENT_ID, CLIENT_SECRET, SCOPES, ALLOW_JIT, JIT_ROLE, JIT_AUTO_APPROVE, EMAIL_DOMAINS
+		FROM XXAuth.HOSPITAL_IDP
+		WHERE ID_HOSPITAL = @id_hospital AND ENABLED = 1
+	`, sql.Named("id_hospital", hospitalID)).Scan(
+		&idp.HospitalID,
+		&idp.Issuer,
+		&idp.ClientID,
+		&secret,
+		&scopes,
+		&idp.AllowJIT,
+		&jitRole,
+		&idp.JITAutoApprove,
+		&domains,
+	)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrSSONotConfigured
+		}
+		return nil, fmt.Errorf("query HOSPITAL_IDP: %w", err)
+	}
+
+	if idp.ClientSecret, err = openClientSecret(hospitalID, secret.String); err != nil {
+		return nil, err
+	}
+	idp.Scopes = strings.Fields(scopes.String)
+	idp.JITRole = jitRole.String
+	for _, d := range strings.Split(domains.String, ",") {
+		if d = strings.ToLower(strings.TrimSpace(d)); d != "" {
+			idp.EmailDomains = append(idp.EmailDomains, d)
+		}
+	}
+	return &idp, nil
+}
+
+func clientSecretContext(hospitalID int64) string {
+	return fmt.Sprintf("sso_client_secret:%d", hospitalID)
+}
+
+// openClientSecret decrypts the stored client secret of a hospital. A secret entered in
+// plain text, or sealed with a retired key, is sealed with the active key on the way.
+func openClientSecret(hospitalID int64, stored string) (string, error) {
+	if stored == "" {
+		return "", nil
+	}
+	secret, err := secrets.Open(clientSecretContext(hospitalID), stored)
+	if err != nil {
+		return "", fmt.Errorf("open client secret of hospital %d: %w", hospitalID, err)
+	}
+	if secrets.Stale(stored) {
+		if err := storeClientSecret(hospitalID, secret, stored); err != nil {
+			log.Printf("Sealing client secret of hospital %d failed: %v", hospitalID, err)
+		}
+	}
+	return secret, nil
+}
+
+// SetClientSecret stores the client secret of a hospital's identity provider, sealed.
+func SetClientSecret(hospitalID int64, secret string) error {
+	return storeClientSecret(hospitalID, secret, "")
+}
+
+// storeClientSecret seals secret into HOSPITAL_IDP. With previous set, the row is only
+// updated if it still holds that value.
+func storeClientSecret(hospitalID int64, secret, previous string) error {
+	sealed, err := secrets.Seal(clientSecretContext(hospitalID), secret)
+	if err != nil {
+		return fmt.Errorf("seal client secret: %w", err)
+	}
+	result, err := db.DB.Exec(`
+		UPDATE XXAuth.HOSPITAL_IDP
+		SET CLIENT_SECRET = @sealed
+		WHERE ID_HOSPITAL = @id_hospital AND (@previous = N'' OR CLIENT_SECRET = @previous)
+	`,
+		sql.Named("sealed", sealed),
+		sql.Named("id_hospital", hospitalID),
+		sql.Named("previous", previous),
+	)
+	if err != nil {
+		return fmt.Errorf("update HOSPITAL_IDP: %w", err)
+	}
+	if n, _ := result.RowsAffected(); n == 0 && previous == "" {
+		return ErrSSONotConfigured
+	}
+	return nil
+}
+
+// StartSSOLogin stores the state, nonce and PKCE verifier of a new authorization request.
+// Only the hash of the state is kept, like the other one-time tokens.
+func StartSSOLogin(hospitalID int64) (*SSOLogin, error) {
+	state, err := utils.GenerateOpaqueToken()
+	if err != nil {
+		return nil, fmt.Errorf("generate state: %w", err)
+	}
+	nonce, err := utils.GenerateOpaqueToken()
+	if err != nil {
+		return nil, fmt.Errorf("generate nonce: %w", err)
+	}
+	verifier, challenge, err := oidc.NewPKCE()
+	if err != nil {
+		return nil, fmt.Errorf("generate PKCE verifier: %w", err)
+	}
+
+	_, err = db.DB.Exec(`
+		INSERT INTO XXAuth.SSO_LOGINS (STATE_HASH, ID_HOSPITAL, NONCE, CODE_VERIFIER, EXPIRES_AT)
+		VALUES (@state_hash, @id_hospital, @nonce, @code_verifier, DATEADD(SECOND, @ttl, SYSUTCDATETIME()))
+	`,
+		sql.Named("state_hash", utils.HashToken(state)),
+		sql.Named("id_hospital", hospitalID),
+		sql.Named("nonce", nonce),
+		sql.Named("code_verifier", verifier),
+		sql.Named("ttl", int64(ssoLoginTTL.Seconds())),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("insert SSO_LOGINS: %w", err)
+	}
+
+	return &SSOLogin{
+		HospitalID:    hospitalID,
+		State:         state,
+		Nonce:         nonce,
+		CodeVerifier:  verifier,
+		CodeChallenge: challenge,
+	}, nil
+}
+
+// ConsumeSSOLogin marks an unexpired authorization request as used and returns it.
+func ConsumeSSOLogin(state string) (*SSOLogin, error) {
+	login := SSOLogin{State: state}
+	err := db.DB.QueryRow(`
+		UPDATE XXAuth.SSO_LOGINS
+		SET USED_AT = SYSUTCDATETIME()
+		OUTPUT INSERTED.ID_HOSPITAL, INSERTED.NONCE, INSERTED.CODE_VERIFIER
+		WHERE STATE_HASH = @state_hash AND USED_AT IS NULL AND EXPIRES_AT > SYSUTCDATETIME()
+	`, sql.Named("state_hash", utils.HashToken(state))).Scan(&login.HospitalID, &login.Nonce, &login.CodeVerifier)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrInvalidSSOState
+		}
+		return nil, fmt.Errorf("consume SSO login: %w", err)
+	}
+	return &login, nil
+}
+
+// ResolveSSOUser maps a verified ID token to an account and returns its credential.
+// A known (issuer, subject) pair wins; otherwise a verified email is matched against the
+// users of the hospital and linked, and as a last resort the account is provisioned when
+// the hospital allows it. Accounts of other hospitals are never matched by email.
+func ResolveSSOUser(idp *HospitalIdP, id *oidc.IDToken) (*UserCredential, error) {
+	userID, err := findLinkedUser(id.Issuer, id.Subject)
+	if err != nil {
+		return nil, &AuthError{Type: AuthErrorInternal, Details: err.Error()}
+	}
+
+	if userID == 0 {
+		if id.Email == "" || !id.EmailVerified {
+			return nil, &AuthError{Type: AuthErrorInvalidCredentials, Details: ErrSSOUserNotFound.Error()}
+		}
+		userID, err = linkUserByEmail(idp, id)
+		if errors.Is(err, ErrSSOUserNotFound) && idp.canProvision(id.Email) {
+			userID, err = provisionSSOUser(idp, id)
+		}
+		if err != nil {
+			if errors.Is(err, ErrSSOUserNotFound) || errors.Is(err, ErrUserAlreadyExists) {
+				return nil, &AuthError{Type: AuthErrorInvalidCredentials, Details: ErrSSOUserNotFound.Error()}
+			}
+			return nil, &AuthError{Type: AuthErrorInternal, Details: err.Error()}
+		}
+	}
+
+	_, err = db.DB.Exec(`
+		UPDATE XXAuth.USER_IDENTITIES
+		SET LAST_LOGIN_AT = SYSUTCDATETIME()
+		WHERE ISSUER = @issuer AND SUBJECT = @subject
+	`, sql.Named("issuer", id.Issuer), sql.Named("subject", id.Subject))
+	if err != nil {
+		log.Printf("Failed to update SSO last login: %v", err)
+	}
+
+	// The session starts at the hospital the user signed in through.
+	return GetActiveUserCredentialAt(userID, idp.HospitalID)
+}
+
+// CheckSSOLogin applies the gates of a password login to a resolved SSO login: a locked
+// account is refused, and a user with two-factor authentication enabled or required
+// gets an AuthErrorMFARequired or AuthErrorMFAEnrollment error, so the login continues
+// with the second step like after a correct password.
+func CheckSSOLogin(cred *UserCredential) error {
+	if err := checkAccountLocked(cred.Username); err != nil {
+		return err
+	}
+
+	mfa, err := GetMFASettings(cred.UserID)
+	if err != nil {
+		return &AuthError{Type: AuthErrorInternal, Details: err.Error()}
+	}
+	switch {
+	case mfa.Enabled:
+		return &AuthError{Type: AuthErrorMFARequired, Details: "Second factor required"}
+	case mfa.Required:
+		return &AuthError{Type: AuthErrorMFAEnrollment, Details: "Two-factor enrollment required"}
+	}
+	return nil
+}
+
+func (idp *HospitalIdP) canProvision(email string) bool {
+	if !idp.AllowJIT || !jitRoles[idp.JITRole] {
+		return false
+	}
+	if len(idp.EmailDomains) == 0 {
+		return true
+	}
+	at := strings.LastIndex(email, "@")
+	if at < 0 {
+		return false
+	}
+	domain := strings.ToLower(email[at+1:])
+	for _, d := range idp.EmailDomains {
+		if domain == d {
+			return true
+		}
+	}
+	return false
+}
+
+func findLinkedUser(issuer, subject string) (int64, error) {
+	var userID int64
+	err := db.DB.QueryRow(`
+		SELECT ID_USER FROM XXAuth.USER_IDENTITIES WHERE ISSUER = @issuer AND SUBJECT = @subject
+	`, sql.Named("issuer", issuer), sql.Named("subject", subject)).Scan(&userID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, nil
+		}
+		return 0, fmt.Errorf("query USER_IDENTITIES: %w", err)
+	}
+	return userID, nil
+}
+
+// linkUserByEmail links the external identity to the user with the same email who holds
+// a role at the hospital.
+func linkUserByEmail(idp *HospitalIdP, id *oidc.IDToken) (int64, error) {
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var userID int64
+	err = tx.QueryRow(`
+		SELECT TOP 1 u.ID_USER
+		FROM XXAuth.USERS u
+		JOIN XXAuth.USER_ROLES ur ON ur.ID_USER = u.ID_USER
+		WHERE u.USERNAME = @username AND ur.ID_HOSPITAL = @id_hospital
+	`, sql.Named("username", id.Email), sql.Named("id_hospital", idp.HospitalID)).Scan(&userID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, ErrSSOUserNotFound
+		}
+		return 0, fmt.Errorf("query USERS: %w", err)
+	}
+
+	if err := linkIdentity(tx, userID, id); err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("commit transaction: %w", err)
+	}
+	return userID, nil
+}
+
+// provisionSSOUser creates the person and user for a first-time SSO login. The role is
+// PENDING until a hospital admin approves it, unless the hospital approves automatically.
+func provisionSSOUser(idp *HospitalIdP, id *oidc.IDToken) (int64, error) {
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var exists bool
+	err = tx.QueryRow(`
+		SELECT CASE WHEN EXISTS (SELECT 1 FROM XXAuth.USERS WHERE USERNAME = @username) THEN 1 ELSE 0 END
+	`, sql.Named("username", id.Email)).Scan(&exists)
+	if err != nil {
+		return 0, fmt.Errorf("query USERS: %w", err)
+	}
+	if exists {
+		return 0, ErrUserAlreadyExists
+	}
+
+	// The account has no usable password; the user can still set one through password reset.
+	unusable, err := utils.GenerateOpaqueToken()
+	if err != nil {
+		return 0, fmt.Errorf("generate password: %w", err)
+	}
+	hashed, err := utils.HashPassword(unusable)
+	if err != nil {
+		return 0, fmt.Errorf("hash password: %w", err)
+	}
+
+	// The provider knows nothing of an address; the person starts out in the hospital's locality
+	loc, err := hospitalLocality(tx, idp.HospitalID)
+	if err != nil {
+		return 0, fmt.Errorf("get hospital locality: %w", err)
+	}
+
+	personID, err := createPerson(PersonReq{
+		FName:          id.GivenName,
+		LName:          id.FamilyName,
+		AddressReq:     AddressReq{Loc: loc},
+		VirtualAddress: VirtualAddressReq{Email: id.Email},
+		Staff:          true,
+	})
+	if err != nil {
+		return 0, fmt.Errorf("create person: %w", err)
+	}
+
+	status := StatusPending
+	if idp.JITAutoApprove {
+		status = StatusActive
+	}
+
+	var userID int64
+	err = tx.QueryRow(`
+		INSERT INTO XXAuth.USERS (USERNAME, PASSWORD, ID_PERSON, EMAIL_CONFIRMED)
+		OUTPUT INSERTED.ID_USER
+		VALUES (@username, @password, @id_person, @confirmed)
+	`,
+		sql.Named("username", id.Email),
+		sql.Named("password", hashed),
+		sql.Named("id_person", personID),
+		sql.Named("confirmed", true),
+	).Scan(&userID)
+	if err == nil {
+		_, err = tx.Exec(`
+			INSERT INTO XXAuth.USER_ROLES (ID_USER, ID_ROLE, ID_HOSPITAL, STATUS)
+			SELECT @id_user, ID_ROLE, @id_hospital, @status
+			FROM XXAuth.ROLES
+			WHERE CODE = @role
+		`,
+			sql.Named("id_user", userID),
+			sql.Named("id_hospital", idp.HospitalID),
+			sql.Named("status", status),
+			sql.Named("role", idp.JITRole),
+		)
+	}
+	if err == nil {
+		err = linkIdentity(tx, userID, id)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		rollbackPerson(personID)
+		return 0, fmt.Errorf("provision user: %w", err)
+	}
+
+	return userID, nil
+}
+
+func linkIdentity(tx *sql.Tx, userID int64, id *oidc.IDToken) error {
+	_, err := tx.Exec(`
+		INSERT INTO XXAuth.USER_IDENTITIES (ID_USER, ISSUER, SUBJECT, EMAIL)
+		VALUES (@id_user, @issuer, @subject, @email)
+	`,
+		sql.Named("id_user", userID),
+		sql.Named("issuer", id.Issuer),
+		sql.Named("subject", id.Subject),
+		sql.Named("email", id.Email),
+	)
+	if err != nil {
+		return fmt.Errorf("insert USER_IDENTITIES: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,481 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"eoncohub.com/auth_module/db"
+	"eoncohub.com/auth_module/utils"
+)
+
+var (
+	ErrUserNotInHospital = errors.New("user not found at this hospital")
+	ErrRoleNotAssignable = errors.New("role cannot be assigned by a hospital admin")
+	ErrOwnAccount        = errors.New("admins cannot deactivate their own account")
+	ErrOwnAdminRole      = errors.New("admins cannot remove their own hospital_admin role")
+	ErrNoRolesLeft       = errors.New("user must keep at least one role at the hospital")
+	ErrStatusUnchanged   = errors.New("user is not in a state this action applies to")
+	ErrNothingToConfirm  = errors.New("user is not waiting for email confirmation")
+)
+
+// assignableRoles are the roles a hospital admin may grant or remove. Doctor roles come
+// with a registration confirmed by the hospital and are left alone.
+var assignableRoles = map[string]bool{
+	RoleNurse:         true,
+	RoleAssistant:     true,
+	RoleHospitalAdmin: true,
+}
+
+// ManagedUser is a user as seen by the admin of a hospital: Roles only lists the roles
+// held at that hospital.
+type ManagedUser struct {
+	IDUser         int64         `json:"id_user"`
+	Email          string        `json:"email"`
+	FName          string        `json:"f_name"`
+	LName          string        `json:"l_name"`
+	EmailConfirmed bool          `json:"email_confirmed"`
+	Roles          []ManagedRole `json:"roles"`
+}
+
+type ManagedRole struct {
+	IDUserRole   int64     `json:"id_user_role"`
+	Role         string    `json:"role"`
+	Status       string    `json:"status"`
+	CreationDate time.Time `json:"creation_date"`
+}
+
+// UserFilter narrows a user listing. Status and Role match any of the user's roles at
+// the hospital; Query matches the email or the name.
+type UserFilter struct {
+	Status string
+	Role   string
+	Query  string
+}
+
+// ListHospitalUsers returns one page of the users holding a role at the hospital,
+// ordered by ID, and the total match count.
+func ListHospitalUsers(hospitalID int64, f UserFilter, page, pageSize int) ([]ManagedUser, int, error) {
+	where, args := f.where(hospitalID)
+
+	var total int
+	err := db.DB.QueryRow(`
+		SELECT COUNT(*)
+		FROM XXAuth.USERS u
+		LEFT JOIN XXPerson.PERSONS p ON p.ID_PERSON = u.ID_PERSON
+		`+where, args...).Scan(&total)
+	if err != nil {
+		return nil, 0, fmt.Errorf("count users: %w", err)
+	}
+
+	args = append(args, sql.Named("offset", (page-1)*pageSize), sql.Named("limit", pageSize))
+	users, err := queryManagedUsers(hospitalID, `
+		SELECT u.ID_USER, u.USERNAME, p.F_NAME, p.L_NAME, u.EMAIL_CONFIRMED
+		FROM XXAuth.USERS u
+		LEFT JOIN XXPerson.PERSONS p ON p.ID_PERSON = u.ID_PERSON
+		`+where+`
+		ORDER BY u.ID_USER
+		OFFSET @offset ROWS FETCH NEXT @limit ROWS ONLY
+	`, args...)
+	if err != nil {
+		return nil, 0, err
+	}
+	return users, total, nil
+}
+
+// GetHospitalUser returns a single user holding a role at the hospital.
+func GetHospitalUser(hospitalID, userID int64) (ManagedUser, error) {
+	users, err := queryManagedUsers(hospitalID, `
+		SELECT u.ID_USER, u.USERNAME, p.F_NAME, p.L_NAME, u.EMAIL_CONFIRMED
+		FROM XXAuth.USERS u
+		LEFT JOIN XXPerson.PERSONS p ON p.ID_PERSON = u.ID_PERSON
+		WHERE u.ID_USER = @id_user AND EXISTS (
+			SELECT 1 FROM XXAuth.USER_ROLES ur WHERE ur.ID_USER = u.ID_USER AND ur.ID_HOSPITAL = @id_hospital
+		)
+	`, sql.Named("id_user", userID), sql.Named("id_hospital", hospitalID))
+	if err != nil {
+		return ManagedUser{}, err
+	}
+	if len(users) == 0 {
+		return ManagedUser{}, ErrUserNotInHospital
+	}
+	return users[0], nil
+}
+
+// IsUserInHospital reports whether the user holds any role, in any status, at the hospital.
+func IsUserInHospital(hospitalID, userID int64) (bool, error) {
+	var exists int
+	err := db.DB.QueryRow(`
+		SELECT CASE WHEN EXISTS (
+			SELECT 1 FROM XXAuth.USER_ROLES WHERE ID_USER = @id_user AND ID_HOSPITAL = @id_hospital
+		) THEN 1 ELSE 0 END
+	`, sql.Named("id_user", userID), sql.Named("id_hospital", hospitalID)).Scan(&exists)
+	if err != nil {
+		return false, fmt.Errorf("query USER_ROLES: %w", err)
+	}
+	return exists == 1, nil
+}
+
+// DeactivateUser disables every active role of the user at the hospital and ends the
+// user's sessions. Roles at other hospitals are not touched.
+func DeactivateUser(hospitalID, adminID, userID int64) error {
+	if userID == adminID {
+		return ErrOwnAccount
+	}
+	return setHospitalStatus(hospitalID, userID, StatusActive, StatusDisabled, true)
+}
+
+// ReactivateUser restores the roles disabled by DeactivateUser.
+func ReactivateUser(hospitalID, userID int64) error {
+	return setHospitalStatus(hospitalID, userID, StatusDisabled, StatusActive, false)
+}
+
+func setHospitalStatus(hospitalID, userID int64, from, to string, revoke bool) error {
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return fmt.Errorf("start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`
+		UPDATE XXAuth.USER_ROLES
+		SET STATUS = @to
+		WHERE ID_USER = @id_user AND ID_HOSPITAL = @id_hospital AND STATUS = @from
+	`,
+		sql.Named("to", to),
+		sql.Named("id_user", userID),
+		sql.Named("id_hospital", hospitalID),
+		sql.Named("from", from),
+	)
+	if err != nil {
+		return fmt.Errorf("update USER_ROLES: %w", err)
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return ErrStatusUnchanged
+	}
+
+	if revoke {
+		if err := RevokeUserSessions(tx, userID); err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("commit transaction: %w", err)
+	}
+	return nil
+}
+
+// SetUserRoles makes roles the user's assignable roles at the hospital. Added roles take
+// the status the user currently has there; removing a role ends the user's sessions so
+// the old roles do not linger in access tokens.
+func SetUserRoles(hospitalID, adminID, userID int64, roles []string) error {
+	wanted := map[string]bool{}
+	for _, role := range roles {
+		if !assignableRoles[role] {
+			return fmt.Errorf("%w: %s", ErrRoleNotAssignable, role)
+		}
+		wanted[role] = true
+	}
+	if userID == adminID && !wanted[RoleHospitalAdmin] {
+		return ErrOwnAdminRole
+	}
+
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return fmt.Errorf("start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`
+		SELECT ur.ID_USER_ROLE, r.CODE, ur.STATUS
+		FROM XXAuth.USER_ROLES ur WITH (UPDLOCK)
+		JOIN XXAuth.ROLES r ON r.ID_ROLE = ur.ID_ROLE
+		WHERE ur.ID_USER = @id_user AND ur.ID_HOSPITAL = @id_hospital
+	`, sql.Named("id_user", userID), sql.Named("id_hospital", hospitalID))
+	if err != nil {
+		return fmt.Errorf("query USER_ROLES: %w", err)
+	}
+	current := map[string]int64{}
+	var statuses []string
+	kept := 0
+	for rows.Next() {
+		var id int64
+		var code, status string
+		if err := rows.Scan(&id, &code, &status); err != nil {
+			rows.Close()
+			return fmt.Errorf("scan user role: %w", err)
+		}
+		statuses = append(statuses, status)
+		if assignableRoles[code] {
+			current[code] = id
+		} else {
+			kept++
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("iterate user roles: %w", err)
+	}
+
+	if len(statuses) == 0 {
+		return ErrUserNotInHospital
+	}
+	if kept+len(wanted) == 0 {
+		return ErrNoRolesLeft
+	}
+
+	removed := false
+	for code, id := range current {
+		if wanted[code] {
+			continue
+		}
+		_, err := tx.Exec(`DELETE FROM XXAuth.USER_ROLES WHERE ID_USER_ROLE = @id_user_role`, sql.Named("id_user_role", id))
+		if err != nil {
+			return fmt.Errorf("delete USER_ROLES: %w", err)
+		}
+		removed = true
+	}
+
+	status := hospitalStatus(statuses)
+	for code := range wanted {
+		if _, ok := current[code]; ok {
+			continue
+		}
+		_, err := tx.Exec(`
+			INSERT INTO XXAuth.USER_ROLES (ID_USER, ID_ROLE, ID_HOSPITAL, STATUS)
+			SELECT @id_user, ID_ROLE, @id_hospital, @status
+			FROM XXAuth.ROLES
+			WHERE CODE = @role
+		`,
+			sql.Named("id_user", userID),
+			sql.Named("id_hospital", hospitalID),
+			sql.Named("status", status),
+			sql.Named("role", code),
+		)
+		if err != nil {
+			return fmt.Errorf("insert USER_ROLES: %w", err)
+		}
+	}
+
+	if removed {
+		if err := RevokeUserSessions(tx, userID); err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("commit transaction: %w", err)
+	}
+	return nil
+}
+
+// hospitalStatus picks the status a new role inherits from the user's existing ones:
+// active wins, then disabled, so granting a role never bypasses confirmation or approval.
+func hospitalStatus(statuses []string) string {
+	for _, want := range []string{StatusActive, StatusDisabled, StatusPending, StatusInactive} {
+		for _, s := range statuses {
+			if s == want {
+				return want
+			}
+		}
+	}
+	return StatusRejected
+}
+
+// ForcePasswordReset replaces the user's password with an unusable one, ends every
+// session and emails a reset link to the user.
+func ForcePasswordReset(hospitalID, userID int64) error {
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return fmt.Errorf("start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var email, currentHash string
+	err = tx.QueryRow(`
+		SELECT u.USERNAME, u.PASSWORD
+		FROM XXAuth.USERS u WITH (UPDLOCK)
+		WHERE u.ID_USER = @id_user AND EXISTS (
+			SELECT 1 FROM XXAuth.USER_ROLES ur WHERE ur.ID_USER = u.ID_USER AND ur.ID_HOSPITAL = @id_hospital
+		)
+	`, sql.Named("id_user", userID), sql.Named("id_hospital", hospitalID)).Scan(&email, &currentHash)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrUserNotInHospital
+		}
+		return fmt.Errorf("query USERS: %w", err)
+	}
+
+	// Nobody knows the random password, so the reset link is the only way back in.
+	random, err := utils.GenerateOpaqueToken()
+	if err != nil {
+		return err
+	}
+	hashed, err := utils.HashPassword(random)
+	if err != nil {
+		return fmt.Errorf("hash password: %w", err)
+	}
+	_, err = tx.Exec(`
+		UPDATE XXAuth.USERS
+		SET PASSWORD = @password
+		WHERE ID_USER = @id_user
+	`, sql.Named("password", hashed), sql.Named("id_user", userID))
+	if err != nil {
+		return fmt.Errorf("update password: %w", err)
+	}
+	if err := recordPasswordHistory(tx, userID, currentHash); err != nil {
+		return err
+	}
+	if err := RevokeUserSessions(tx, userID); err != nil {
+		return err
+	}
+
+	resetToken, err := IssueUserToken(tx, userID, TokenPurposeResetPassword, ResetTokenTTL())
+	if err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("commit transaction: %w", err)
+	}
+
+	return sendResetEmail(email, passwordResetURL(resetToken))
+}
+
+// ResendUserConfirmation issues a new confirmation link for a user of the hospital whose
+// email is not confirmed yet: to the hospital for a doctor registration, to the user for
+// a staff signup.
+func ResendUserConfirmation(hospitalID, userID int64) error {
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return fmt.Errorf("start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var email string
+	var emailConfirmed bool
+	var waiting, pending int
+	err = tx.QueryRow(`
+		SELECT u.USERNAME, u.EMAIL_CONFIRMED,
+			(SELECT COUNT(*) FROM XXAuth.USER_ROLES ur
+			 WHERE ur.ID_USER = u.ID_USER AND ur.ID_HOSPITAL = @id_hospital AND ur.STATUS = @inactive),
+			(SELECT COUNT(*) FROM XXAuth.USER_ROLES ur
+			 WHERE ur.ID_USER = u.ID_USER AND ur.ID_HOSPITAL = @id_hospital AND ur.STATUS = @pending)
+		FROM XXAuth.USERS u
+		WHERE u.ID_USER = @id_user AND EXISTS (
+			SELECT 1 FROM XXAuth.USER_ROLES ur WHERE ur.ID_USER = u.ID_USER AND ur.ID_HOSPITAL = @id_hospital
+		)
+	`,
+		sql.Named("id_user", userID),
+		sql.Named("id_hospital", hospitalID),
+		sql.Named("inactive", StatusInactive),
+		sql.Named("pending", StatusPending),
+	).Scan(&email, &emailConfirmed, &waiting, &pending)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrUserNotInHospital
+		}
+		return fmt.Errorf("query USERS: %w", err)
+	}
+	switch {
+	case emailConfirmed:
+		return ErrNothingToConfirm
+	case waiting > 0:
+		return reissueConfirmation(tx, userID, hospitalID)
+	case pending > 0:
+		return reissueSignupConfirmation(tx, userID, email)
+	}
+	return ErrNothingToConfirm
+}
+
+func queryManagedUsers(hospitalID int64, query string, args ...any) ([]ManagedUser, error) {
+	rows, err := db.DB.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("query users: %w", err)
+	}
+	defer rows.Close()
+
+	users := []ManagedUser{}
+	index := map[int64]int{}
+	for rows.Next() {
+		var u ManagedUser
+		var fName, lName sql.NullString
+		if err := rows.Scan(&u.IDUser, &u.Email, &fName, &lName, &u.EmailConfirmed); err != nil {
+			return nil, fmt.Errorf("scan user: %w", err)
+		}
+		u.FName = fName.String
+		u.LName = lName.String
+		u.Roles = []ManagedRole{}
+		index[u.IDUser] = len(users)
+		users = append(users, u)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("iterate users: %w", err)
+	}
+	if len(users) == 0 {
+		return users, nil
+	}
+
+	params := make([]string, 0, len(users))
+	roleArgs := []any{sql.Named("id_hospital", hospitalID)}
+	for i, u := range users {
+		name := fmt.Sprintf("u%d", i)
+		params = append(params, "@"+name)
+		roleArgs = append(roleArgs, sql.Named(name, u.IDUser))
+	}
+	roleRows, err := db.DB.Query(`
+		SELECT ur.ID_USER, ur.ID_USER_ROLE, r.CODE, ur.STATUS, ur.CREATION_DATE
+		FROM XXAuth.USER_ROLES ur
+		JOIN XXAuth.ROLES r ON r.ID_ROLE = ur.ID_ROLE
+		WHERE ur.ID_HOSPITAL = @id_hospital AND ur.ID_USER IN (`+strings.Join(params, ", ")+`)
+		ORDER BY ur.ID_USER_ROLE
+	`, roleArgs...)
+	if err != nil {
+		return nil, fmt.Errorf("query user roles: %w", err)
+	}
+	defer roleRows.Close()
+
+	for roleRows.Next() {
+		var userID int64
+		var r ManagedRole
+		if err := roleRows.Scan(&userID, &r.IDUserRole, &r.Role, &r.Status, &r.CreationDate); err != nil {
+			return nil, fmt.Errorf("scan user role: %w", err)
+		}
+		if i, ok := index[userID]; ok {
+			users[i].Roles = append(users[i].Roles, r)
+		}
+	}
+	if err := roleRows.Err(); err != nil {
+		return nil, fmt.Errorf("iterate user roles: %w", err)
+	}
+	return users, nil
+}
+
+func (f UserFilter) where(hospitalID int64) (string, []any) {
+	roleCond := "ur.ID_USER = u.ID_USER AND ur.ID_HOSPITAL = @id_hospital"
+	args := []any{sql.Named("id_hospital", hospitalID)}
+
+	if f.Status != "" {
+		roleCond += " AND ur.STATUS = @status"
+		args = append(args, sql.Named("status", f.Status))
+	}
+	if f.Role != "" {
+		roleCond += " AND EXISTS (SELECT 1 FROM XXAuth.ROLES r WHERE r.ID_ROLE = ur.ID_ROLE AND r.CODE = @role)"
+		args = append(args, sql.Named("role", f.Role))
+	}
+	where := "WHERE EXISTS (SELECT 1 FROM XXAuth.USER_ROLES ur WHERE " + roleCond + ")"
+
+	if q := strings.TrimSpace(f.Query); q != "" {
+		where += ` AND (u.USERNAME LIKE @query ESCAPE '\' OR p.F_NAME LIKE @query ESCAPE '\' OR p.L_NAME LIKE @query ESCAPE '\')`
+		args = append(args, sql.Named("query", "%"+escapeLike(q)+"%"))
+	}
+	return where, args
+}
+
+// escapeLike makes the wildcards of a LIKE pattern match literally.
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`, `[`, `\[`).Replace(s)
+}
@@ -0,0 +1,82 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"eoncohub.com/auth_module/utils"
+)
+
+// Purposes of the one-time tokens sent by email and stored in XXAuth.USER_TOKENS.
+const (
+	TokenPurposeConfirmEmail  = "CONFIRM_EMAIL"
+	TokenPurposeResetPassword = "RESET_PASSWORD"
+)
+
+var ErrInvalidUserToken = errors.New("invalid or expired token")
+
+func ConfirmationTokenTTL() time.Duration {
+	return utils.DurationFromEnv("CONFIRMATION_TOKEN_TTL", 48*time.Hour)
+}
+
+func ResetTokenTTL() time.Duration {
+	return utils.DurationFromEnv("RESET_TOKEN_TTL", time.Hour)
+}
+
+// IssueUserToken creates a one-time token for the given purpose and returns it in
+// plaintext for the email link. Only its hash is stored, and any earlier unused token
+// with the same purpose stops working.
+func IssueUserToken(tx *sql.Tx, userID int64, purpose string, ttl time.Duration) (string, error) {
+	token, err := utils.GenerateOpaqueToken()
+	if err != nil {
+		return "", fmt.Errorf("generate token: %w", err)
+	}
+
+	_, err = tx.Exec(`
+		UPDATE XXAuth.USER_TOKENS
+		SET USED_AT = SYSUTCDATETIME()
+		WHERE ID_USER = @id_user AND PURPOSE = @purpose AND USED_AT IS NULL
+	`, sql.Named("id_user", userID), sql.Named("purpose", purpose))
+	if err != nil {
+		return "", fmt.Errorf("invalidate previous tokens: %w", err)
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO XXAuth.USER_TOKENS (ID_USER, PURPOSE, TOKEN_HASH, EXPIRES_AT)
+		VALUES (@id_user, @purpose, @token_hash, DATEADD(SECOND, @ttl, SYSUTCDATETIME()))
+	`,
+		sql.Named("id_user", userID),
+		sql.Named("purpose", purpose),
+		sql.Named("token_hash", utils.HashToken(token)),
+		sql.Named("ttl", int64(ttl.Seconds())),
+	)
+	if err != nil {
+		return "", fmt.Errorf("insert USER_TOKENS: %w", err)
+	}
+
+	return token, nil
+}
+
+// ConsumeUserToken marks an unexpired, unused token as used and returns its user.
+func ConsumeUserToken(tx *sql.Tx, token, purpose string) (int64, error) {
+	var userID int64
+	err := tx.QueryRow(`
+		UPDATE XXAuth.USER_TOKENS
+		SET USED_AT = SYSUTCDATETIME()
+		OUTPUT INSERTED.ID_USER
+		WHERE TOKEN_HASH = @token_hash AND PURPOSE = @purpose
+		  AND USED_AT IS NULL AND EXPIRES_AT > SYSUTCDATETIME()
+	`,
+		sql.Named("token_hash", utils.HashToken(token)),
+		sql.Named("purpose", purpose),
+	).Scan(&userID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, ErrInvalidUserToken
+		}
+		return 0, fmt.Errorf("consume token: %w", err)
+	}
+	return userID, nil
+}
@@ -0,0 +1,258 @@
+// Package oidc is the relying-party side of the OpenID Connect authorization code flow
+// with PKCE, used to sign hospital staff in through their hospital's identity provider.
+package oidc
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"eoncohub.com/auth_module/utils"
+	"eoncohub.com/shared_module/auth"
+	"github.com/golang-jwt/jwt"
+)
+
+const discoveryCacheTTL = time.Hour
+
+var ErrInvalidIDToken = errors.New("invalid ID token")
+
+// Provider is the configuration of one identity provider as registered for a hospital.
+type Provider struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	Scopes       []string
+	RedirectURL  string
+}
+
+// IDToken holds the claims of a verified ID token that the login flow needs.
+type IDToken struct {
+	Issuer        string
+	Subject       string
+	Email         string
+	EmailVerified bool
+	GivenName     string
+	FamilyName    string
+}
+
+type metadata struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+type cachedMetadata struct {
+	metadata
+	keys      *auth.KeySet
+	fetchedAt time.Time
+}
+
+var (
+	client = &http.Client{Timeout: 10 * time.Second}
+
+	discoveryMu sync.Mutex
+	discovered  = map[string]*cachedMetadata{}
+)
+
+// NewPKCE returns a random code verifier and its S256 challenge.
+func NewPKCE() (verifier, challenge string, err error) {
+	verifier, err = utils.GenerateOpaqueToken()
+	if err != nil {
+		return "", "", err
+	}
+	sum := sha256.Sum256([]byte(verifier))
+	return verifier, base64.RawURLEncoding.EncodeToString(sum[:]), nil
+}
+
+// AuthCodeURL returns the authorization endpoint URL the browser is redirected to.
+func (p *Provider) AuthCodeURL(ctx context.Context, state, nonce, codeChallenge string) (string, error) {
+	md, err := discover(ctx, p.Issuer)
+	if err != nil {
+		return "", err
+	}
+
+	q := url.Values{}
+	q.Set("response_type", "code")
+	q.Set("client_id", p.ClientID)
+	q.Set("redirect_uri", p.RedirectURL)
+	q.Set("scope", strings.Join(p.scopes(), " "))
+	q.Set("state", state)
+	q.Set("nonce", nonce)
+	q.Set("code_challenge", codeChallenge)
+	q.Set("code_challenge_method", "S256")
+
+	sep := "?"
+	if strings.Contains(md.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return md.AuthorizationEndpoint + sep + q.Encode(), nil
+}
+
+// Exchange redeems an authorization code and returns the verified ID token. The token
+// must be signed by the issuer, addressed to this client and carry the expected nonce.
+func (p *Provider) Exchange(ctx context.Context, code, codeVerifier, nonce string) (*IDToken, error) {
+	md, err := discover(ctx, p.Issuer)
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", p.RedirectURL)
+	form.Set("code_verifier", codeVerifier)
+	form.Set("client_id", p.ClientID)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, md.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, fmt.Errorf("build token request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if p.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.ClientID), url.QueryEscape(p.ClientSecret))
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("call token endpoint: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("token endpoint returned status %d: %s", resp.StatusCode, string(body))
+	}
+
+	var tokens struct {
+		IDToken string `json:"id_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tokens); err != nil {
+		return nil, fmt.Errorf("decode token response: %w", err)
+	}
+	if tokens.IDToken == "" {
+		return nil, fmt.Errorf("%w: missing from token response", ErrInvalidIDToken)
+	}
+
+	return p.verify(md, tokens.IDToken, nonce)
+}
+
+func (p *Provider) verify(md *cachedMetadata, rawIDToken, nonce string) (*IDToken, error) {
+	claims := jwt.MapClaims{}
+	token, err := jwt.ParseWithClaims(rawIDToken, claims, md.keys.Keyfunc)
+	if err != nil || !token.Valid {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidIDToken, err)
+	}
+
+	if iss, _ := claims["iss"].(string); iss != md.Issuer {
+		return nil, fmt.Errorf("%w: unexpected issuer %q", ErrInvalidIDToken, iss)
+	}
+	if !hasAudience(claims["aud"], p.ClientID) {
+		return nil, fmt.Errorf("%w: not issued for this client", ErrInvalidIDToken)
+	}
+	if _, ok := claims["exp"]; !ok {
+		return nil, fmt.Errorf("%w: missing expiry", ErrInvalidIDToken)
+	}
+	if got, _ := claims["nonce"].(string); got == "" || got != nonce {
+		return nil, fmt.Errorf("%w: nonce mismatch", ErrInvalidIDToken)
+	}
+
+	id := &IDToken{Issuer: md.Issuer}
+	id.Subject, _ = claims["sub"].(string)
+	id.Email, _ = claims["email"].(string)
+	id.GivenName, _ = claims["given_name"].(string)
+	id.FamilyName, _ = claims["family_name"].(string)
+	switch v := claims["email_verified"].(type) {
+	case bool:
+		id.EmailVerified = v
+	case string:
+		// Some providers send the flag as a string.
+		id.EmailVerified = v == "true"
+	}
+	if id.Subject == "" {
+		return nil, fmt.Errorf("%w: missing subject", ErrInvalidIDToken)
+	}
+	return id, nil
+}
+
+func (p *Provider) scopes() []string {
+	scopes := p.Scopes
+	if len(scopes) == 0 {
+		scopes = []string{"openid", "email", "profile"}
+	}
+	for _, s := range scopes {
+		if s == "openid" {
+			return scopes
+		}
+	}
+	return append([]string{"openid"}, scopes...)
+}
+
+func hasAudience(aud interface{}, clientID string) bool {
+	switch v := aud.(type) {
+	case string:
+		return v == clientID
+	case []interface{}:
+		for _, a := range v {
+			if s, _ := a.(string); s == clientID {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// discover fetches and caches the provider metadata from the issuer's well-known endpoint.
+func discover(ctx context.Context, issuer string) (*cachedMetadata, error) {
+	issuer = strings.TrimSuffix(issuer, "/")
+
+	discoveryMu.Lock()
+	defer discoveryMu.Unlock()
+
+	if md, ok := discovered[issuer]; ok && time.Since(md.fetchedAt) < discoveryCacheTTL {
+		return md, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, issuer+"/.well-known/openid-configuration", nil)
+	if err != nil {
+		return nil, fmt.Errorf("build discovery request: %w", err)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("fetch discovery document: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetch discovery document: status %d", resp.StatusCode)
+	}
+
+	var md metadata
+	if err := json.NewDecoder(resp.Body).Decode(&md); err != nil {
+		return nil, fmt.Errorf("decode discovery document: %w", err)
+	}
+	if strings.TrimSuffix(md.Issuer, "/") != issuer {
+		return nil, fmt.Errorf("discovery document is for issuer %q, expected %q", md.Issuer, issuer)
+	}
+	if md.AuthorizationEndpoint == "" || md.TokenEndpoint == "" || md.JWKSURI == "" {
+		return nil, errors.New("discovery document is missing endpoints")
+	}
+
+	cached := &cachedMetadata{metadata: md, fetchedAt: time.Now()}
+	if prev, ok := discovered[issuer]; ok && prev.JWKSURI == md.JWKSURI {
+		cached.keys = prev.keys
+	} else {
+		cached.keys = auth.NewKeySet(md.JWKSURI)
+	}
+	discovered[issuer] = cached
+	return cached, nil
+}
@@ -0,0 +1,81 @@
+package password
+
+import (
+	"bufio"
+	"crypto/sha1"
+	_ "embed"
+	"encoding/hex"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+)
+
+// The breached-password list is a set of uppercase SHA-1 hashes, one per line, optionally
+// followed by ":count" as in the Have I Been Pwned downloads. It is indexed by the first
+// five hex characters (the k-anonymity range prefix), so a lookup only compares suffixes
+// within one range. A larger list can be supplied through PASSWORD_BREACH_LIST.
+const rangePrefixLen = 5
+
+//go:embed breached_sha1.txt
+var bundledList string
+
+var (
+	breachedOnce   sync.Once
+	breachedRanges map[string]map[string]struct{}
+)
+
+// IsBreached reports whether the password's SHA-1 appears in the breached-password list.
+func IsBreached(pw string) bool {
+	breachedOnce.Do(loadBreachedList)
+
+	sum := sha1.Sum([]byte(pw))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	suffixes, ok := breachedRanges[hash[:rangePrefixLen]]
+	if !ok {
+		return false
+	}
+	_, found := suffixes[hash[rangePrefixLen:]]
+	return found
+}
+
+func loadBreachedList() {
+	breachedRanges = map[string]map[string]struct{}{}
+	addHashes(strings.NewReader(bundledList))
+
+	path := os.Getenv("PASSWORD_BREACH_LIST")
+	if path == "" {
+		return
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		log.Printf("Could not open PASSWORD_BREACH_LIST, using the bundled list only: %v", err)
+		return
+	}
+	defer f.Close()
+	addHashes(f)
+}
+
+func addHashes(r io.Reader) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if i := strings.IndexByte(line, ':'); i >= 0 {
+			line = line[:i]
+		}
+		if len(line) != sha1.Size*2 {
+			continue
+		}
+		line = strings.ToUpper(line)
+
+		prefix, suffix := line[:rangePrefixLen], line[rangePrefixLen:]
+		if breachedRanges[prefix] == nil {
+			breachedRanges[prefix] = map[string]struct{}{}
+		}
+		breachedRanges[prefix][suffix] = struct{}{}
+	}
+	if err := scanner.Err(); err != nil {
+		log.Printf("Reading breached-password list: %v", err)
+	}
+}
@@ -0,0 +1,116 @@
+package password
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"eoncohub.com/auth_module/utils"
+)
+
+// bcrypt ignores everything after 72 bytes, so longer passwords are refused rather than truncated.
+const bcryptMaxBytes = 72
+
+// Fragments of the user's email or name shorter than this are not checked.
+const minPersonalFragment = 4
+
+// PolicyError lists every rule a password breaks, so the user can fix them at once.
+type PolicyError struct {
+	Problems []string
+}
+
+func (e *PolicyError) Error() string {
+	return "password does not meet the policy: " + strings.Join(e.Problems, "; ")
+}
+
+type Policy struct {
+	MinLength  int
+	MinClasses int
+}
+
+// PolicyFromEnv reads PASSWORD_MIN_LENGTH and PASSWORD_MIN_CLASSES (out of lowercase,
+// uppercase, digits and symbols).
+func PolicyFromEnv() Policy {
+	minClasses := utils.IntFromEnv("PASSWORD_MIN_CLASSES", 3)
+	if minClasses > 4 {
+		minClasses = 4
+	}
+	return Policy{
+		MinLength:  utils.IntFromEnv("PASSWORD_MIN_LENGTH", 10),
+		MinClasses: minClasses,
+	}
+}
+
+// Validate checks a new password against the configured policy and the breached-password
+// list. personal holds the user's email, name and surname, none of which may appear in it.
+func Validate(pw string, personal ...string) error {
+	var problems []string
+	policy := PolicyFromEnv()
+
+	if n := utf8.RuneCountInString(pw); n < policy.MinLength {
+		problems = append(problems, fmt.Sprintf("must be at least %d characters long", policy.MinLength))
+	}
+	if len(pw) > bcryptMaxBytes {
+		problems = append(problems, fmt.Sprintf("must be at most %d bytes long", bcryptMaxBytes))
+	}
+	if classes := characterClasses(pw); classes < policy.MinClasses {
+		problems = append(problems, fmt.Sprintf("must mix at least %d of lowercase letters, uppercase letters, digits and symbols", policy.MinClasses))
+	}
+	if containsPersonalInfo(pw, personal) {
+		problems = append(problems, "must not contain your email or name")
+	}
+	if pw != "" && IsBreached(pw) {
+		problems = append(problems, "appears in a list of breached passwords")
+	}
+
+	if len(problems) > 0 {
+		return &PolicyError{Problems: problems}
+	}
+	return nil
+}
+
+func characterClasses(pw string) int {
+	var lower, upper, digit, symbol bool
+	for _, r := range pw {
+		switch {
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsDigit(r):
+			digit = true
+		default:
+			symbol = true
+		}
+	}
+
+	n := 0
+	for _, ok := range []bool{lower, upper, digit, symbol} {
+		if ok {
+			n++
+		}
+	}
+	return n
+}
+
+// containsPersonalInfo looks for the parts of the email local part and of the names in
+// the password, ignoring case.
+func containsPersonalInfo(pw string, personal []string) bool {
+	lower := strings.ToLower(pw)
+	for _, value := range personal {
+		value = strings.ToLower(value)
+		if at := strings.IndexByte(value, '@'); at >= 0 {
+			value = value[:at]
+		}
+		fragments := strings.FieldsFunc(value, func(r rune) bool {
+			return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+		})
+		for _, f := range fragments {
+			if utf8.RuneCountInString(f) >= minPersonalFragment && strings.Contains(lower, f) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,97 @@
+package routes
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+
+	"eoncohub.com/auth_module/models"
+	"eoncohub.com/shared_module/auth"
+	"github.com/labstack/echo/v4"
+)
+
+// unlockUser lifts a login lockout on behalf of a hospital admin.
+func unlockUser(c echo.Context) error {
+	hospitalID, userID, ok, err := hospitalUser(c)
+	if !ok {
+		return err
+	}
+
+	if err := models.UnlockAccount(hospitalID, userID); err != nil {
+		return userActionError(c, err, "Could not unlock account")
+	}
+
+	auditAdminAction(c, models.AuditAccountUnlocked, userID, "")
+	return c.JSON(http.StatusOK, map[string]string{"message": "Account unlocked"})
+}
+
+// listPendingUsers returns the signups waiting for approval at the admin's hospital.
+func listPendingUsers(c echo.Context) error {
+	hospitalID, ok, err := adminHospitalID(c)
+	if !ok {
+		return err
+	}
+
+	users, err := models.GetPendingUsers(hospitalID)
+	if err != nil {
+		log.Printf("Pending users error: %v", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Could not load pending accounts"})
+	}
+
+	return c.JSON(http.StatusOK, users)
+}
+
+func approvePendingUser(c echo.Context) error {
+	return resolvePendingUser(c, models.ApprovePendingUser, "Account approved")
+}
+
+func rejectPendingUser(c echo.Context) error {
+	return resolvePendingUser(c, models.RejectPendingUser, "Account rejected")
+}
+
+func resolvePendingUser(c echo.Context, resolve func(hospitalID, userRoleID int64) error, message string) error {
+	userRoleID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid account ID"})
+	}
+
+	hospitalID, ok, err := adminHospitalID(c)
+	if !ok {
+		return err
+	}
+
+	if err := resolve(hospitalID, userRoleID); err != nil {
+		if errors.Is(err, models.ErrPendingNotFound) {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "Pending account not found"})
+		}
+		if errors.Is(err, models.ErrEmailUnconfirmed) {
+			return c.JSON(http.StatusConflict, map[string]string{"error": err.Error()})
+		}
+		log.Printf("Pending account error: %v", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Could not update account"})
+	}
+
+	return c.JSON(http.StatusOK, map[string]string{"message": message})
+}
+
+// adminHospitalID resolves the hospital of the signed-in admin. When it returns false
+// the error response has already been written and err is the result of writing it.
+func adminHospitalID(c echo.Context) (int64, bool, error) {
+	userID, err := auth.UserID(c)
+	if err != nil {
+		return 0, false, c.JSON(http.StatusUnauthorized, map[string]string{"error": "Unauthorized"})
+	}
+
+	// A platform admin or a user without a hospital has no hospital_id; the lookup fails below.
+	sessionHospitalID, _ := auth.HospitalID(c)
+	hospitalID, err := models.GetAdminHospitalID(userID, sessionHospitalID)
+	if err != nil {
+		if errors.Is(err, models.ErrNoAdminHospital) {
+			return 0, false, c.JSON(http.StatusForbidden, map[string]string{"error": err.Error()})
+		}
+		log.Printf("Admin hospital error: %v", err)
+		return 0, false, c.JSON(http.StatusInternalServerError, map[string]string{"error": "Could not load admin hospital"})
+	}
+	return hospitalID, true, nil
+}
@@ -0,0 +1,130 @@
+package routes
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"eoncohub.com/auth_module/handlers"
+	"eoncohub.com/auth_module/models"
+	"eoncohub.com/shared_module/auth"
+	"github.com/labstack/echo/v4"
+)
+
+type switchHospitalReq struct {
+	IDHospital int64 `json:"id_hospital"`
+}
+
+type affiliationReq struct {
+	Hospital string `json:"hospital"`
+}
+
+// listAffiliations returns the hospitals the signed-in user can switch to.
+func listAffiliations(c echo.Context) error {
+	claims, err := auth.ClaimsFrom(c)
+	if err != nil {
+		return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Unauthorized"})
+	}
+	userID, _ := claims.UserID()
+
+	affiliations, err := models.GetAffiliations(userID, claims.PersonID, claims.HospitalID)
+	if err != nil {
+		log.Printf("Affiliations error: %v", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Could not load affiliations"})
+	}
+	return c.JSON(http.StatusOK, affiliations)
+}
+
+// switchHospital scopes the session to another hospital of the user and re-issues the
+// access token, so the roles and the doctor affiliation every module sees follow it.
+// Later refreshes keep the selection.
+func switchHospital(c echo.Context) error {
+	userID, err := auth.UserID(c)
+	if err != nil {
+		return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Unauthorized"})
+	}
+	sessionID, _ := auth.SessionID(c)
+
+	var req switchHospitalReq
+	if err := c.Bind(&req); err != nil || req.IDHospital == 0 {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "id_hospital is required"})
+	}
+
+	if err := models.SetSessionHospital(userID, sessionID, req.IDHospital); err != nil {
+		if errors.Is(err, models.ErrNotAffiliated) {
+			return c.JSON(http.StatusForbidden, map[string]string{"error": err.Error()})
+		}
+		log.Printf("Switch hospital error: %v", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Could not switch hospital"})
+	}
+
+	cred, err := models.GetActiveUserCredentialAt(userID, req.IDHospital)
+	if err != nil {
+		log.Printf("Switch hospital error: %v", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Could not switch hospital"})
+	}
+	accessToken, err := signAccessToken(cred, sessionID)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Could not generate token"})
+	}
+
+	// Browsers get the new token in the cookie they authenticated with; bearer clients
+	// take it from the body.
+	if cookie, err := c.Cookie(accessTokenCookie); err == nil && cookie.Value != "" {
+		c.SetCookie(authCookie(accessTokenCookie, accessToken, time.Now().Add(models.AccessTokenTTL())))
+	}
+
+	handlers.Audit(c, models.AuditEvent{
+		Event:    models.AuditHospitalSwitch,
+		Outcome:  models.AuditSuccess,
+		UserID:   cred.UserID,
+		Username: cred.Username,
+		Details:  fmt.Sprintf("hospital %d", cred.HospitalID),
+	})
+
+	c.Response().Header().Set("Cache-Control", "no-store")
+	return c.JSON(http.StatusOK, map[string]any{
+		"access_token":       accessToken,
+		"token_type":         "Bearer",
+		"expires_in":         int(models.AccessTokenTTL().Seconds()),
+		"id_hospital":        cred.HospitalID,
+		"id_doctor_hospital": cred.DoctorHospitalID,
+		"roles":              cred.Roles,
+	})
+}
+
+// requestAffiliation lets a doctor ask to work at another hospital. The new doctor role
+// waits for a hospital admin of that hospital in the pending accounts list.
+func requestAffiliation(c echo.Context) error {
+	claims, err := auth.ClaimsFrom(c)
+	if err != nil {
+		return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Unauthorized"})
+	}
+	userID, _ := claims.UserID()
+
+	var req affiliationReq
+	if err := c.Bind(&req); err != nil || strings.TrimSpace(req.Hospital) == "" {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "hospital is required"})
+	}
+
+	hospitalID, err := models.RequestDoctorAffiliation(userID, claims.PersonID, strings.TrimSpace(req.Hospital))
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrHospitalNotFound):
+			return c.JSON(http.StatusNotFound, map[string]string{"error": err.Error()})
+		case errors.Is(err, models.ErrAffiliationExists):
+			return c.JSON(http.StatusConflict, map[string]string{"error": err.Error()})
+		}
+		log.Printf("Affiliation request error: %v", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Could not request affiliation"})
+	}
+
+	return c.JSON(http.StatusOK, map[string]any{
+		"message":     "Affiliation requested, waiting for approval by the hospital",
+		"id_hospital": hospitalID,
+		"status":      models.StatusPending,
+	})
+}
@@ -0,0 +1,30 @@
+package routes
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+
+	"eoncohub.com/auth_module/models"
+	"github.com/labstack/echo/v4"
+)
+
+// recordBreakGlass audits an emergency access to a patient record and notifies the
+// people responsible for the patient. Called by Patient_Module before it grants access.
+func recordBreakGlass(c echo.Context) error {
+	var notice models.BreakGlassNotice
+	if err := c.Bind(&notice); err != nil || notice.IDAccess == 0 || notice.IDPatient == 0 ||
+		notice.IDDoctorHospital == 0 || notice.IDUser == 0 || strings.TrimSpace(notice.Justification) == "" {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request"})
+	}
+
+	if err := models.RecordBreakGlass(notice); err != nil {
+		if errors.Is(err, models.ErrBreakGlassUnknown) {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": err.Error()})
+		}
+		log.Printf("Break-glass error: %v", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Could not record emergency access"})
+	}
+	return c.JSON(http.StatusOK, map[string]string{"message": "Emergency access recorded"})
+}
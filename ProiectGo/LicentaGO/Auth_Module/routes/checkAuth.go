@@ -1,13 +1,20 @@
 package routes
 
 import (
-	"fmt"
-	"github.com/labstack/echo/v4"
 	"net/http"
+
+	"eoncohub.com/shared_module/auth"
+	"github.com/labstack/echo/v4"
 )
 
 func checkAuth(c echo.Context) error {
-	user := c.Get("user").(string)
-	fmt.Println("User: ", user)
-	return c.JSON(http.StatusOK, map[string]any{"isLoggedIn": true, "user": user})
+	claims, err := auth.ClaimsFrom(c)
+	if err != nil {
+		return c.JSON(http.StatusUnauthorized, map[string]any{"isLoggedIn": false})
+	}
+	return c.JSON(http.StatusOK, map[string]any{
+		"isLoggedIn": true,
+		"user":       claims.Subject,
+		"roles":      claims.Roles,
+	})
 }
@@ -0,0 +1,14 @@
+package routes
+
+import (
+	"net/http"
+
+	"eoncohub.com/auth_module/keys"
+	"github.com/labstack/echo/v4"
+)
+
+// jwks publishes the public keys the other modules use to verify access tokens.
+func jwks(c echo.Context) error {
+	c.Response().Header().Set("Cache-Control", "public, max-age=300")
+	return c.JSON(http.StatusOK, keys.JWKS())
+}
@@ -1,14 +1,13 @@
 package routes
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
-	"os"
 	"strconv"
-	"time"
 
+	"eoncohub.com/auth_module/handlers"
 	"eoncohub.com/auth_module/models"
-	"github.com/golang-jwt/jwt"
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/gommon/log"
 )
@@ -22,45 +21,137 @@ func login(c echo.Context) error {
 		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request"})
 	}
 
-	id, err := loginReq.Validate()
+	loginReq.IP = c.RealIP()
+	loginReq.UserAgent = c.Request().UserAgent()
+
+	cred, err := loginReq.Validate()
 	if err != nil {
+		var authErr *models.AuthError
+		if errors.As(err, &authErr) && cred != nil {
+			switch authErr.Type {
+			case models.AuthErrorMFARequired:
+				return secondFactorChallenge(c, cred.UserID, "mfa_required")
+			case models.AuthErrorMFAEnrollment:
+				return secondFactorChallenge(c, cred.UserID, "mfa_enrollment_required")
+			}
+		}
 		log.Printf("Validation error: %v", err)
+		auditLoginFailure(c, loginReq.Email, err)
+		return authErrorResponse(c, err)
+	}
+
+	return completeLogin(c, cred, "password")
+}
+
+// auditLoginFailure records a failed login with the AuthError type as details.
+func auditLoginFailure(c echo.Context, username string, err error) {
+	details := err.Error()
+	var authErr *models.AuthError
+	if errors.As(err, &authErr) {
+		details = string(authErr.Type)
+	}
+	handlers.Audit(c, models.AuditEvent{
+		Event:    models.AuditLogin,
+		Outcome:  models.AuditFailure,
+		UserID:   models.UserIDForLogin(username),
+		Username: username,
+		Details:  details,
+	})
+}
+
+// authErrorResponse maps login errors to a status code and exposes the AuthError
+// type so the frontend can pick the right message.
+func authErrorResponse(c echo.Context, err error) error {
+	var authErr *models.AuthError
+	if !errors.As(err, &authErr) {
 		return c.JSON(http.StatusUnauthorized, map[string]string{"error": err.Error()})
 	}
 
-	// Create the JWT claims, which includes the username and expiry time
-	claims := &jwt.StandardClaims{
-		ExpiresAt: time.Now().Add(time.Hour * 8).Unix(),
-		Issuer:    strconv.FormatInt(id, 10),
+	status := http.StatusUnauthorized
+	body := map[string]any{"error": err.Error(), "type": authErr.Type}
+	switch authErr.Type {
+	case models.AuthErrorAccountLocked:
+		status = http.StatusLocked
+	case models.AuthErrorTooManyAttempts:
+		status = http.StatusTooManyRequests
+	case models.AuthErrorInternal:
+		status = http.StatusInternalServerError
+	}
+	if authErr.RetryAfter > 0 {
+		seconds := int(authErr.RetryAfter.Seconds())
+		c.Response().Header().Set("Retry-After", strconv.Itoa(seconds))
+		body["retry_after"] = seconds
 	}
 
-	// Create token with claims
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	return c.JSON(status, body)
+}
 
-	// Generate encoded token and send it as response.
-	t, err := token.SignedString([]byte(os.Getenv("JWT_SECRET")))
+// secondFactorChallenge answers a correct password when the login still needs a
+// TOTP code or a first enrollment. The returned token is exchanged at /login/mfa
+// or /login/mfa/enroll/*.
+func secondFactorChallenge(c echo.Context, userID int64, step string) error {
+	mfaToken, err := signMFAToken(userID)
 	if err != nil {
 		return c.JSON(http.StatusInternalServerError, map[string]string{
 			"error": "Could not generate token",
 		})
 	}
 
-	fmt.Println("Token: ", t)
-
-	// Set the JWT as an HTTP-only cookie
-	cookie := new(http.Cookie)
-	cookie.Name = "token"
-	cookie.Value = t
-	cookie.Expires = time.Now().Add(8 * time.Hour)
-	cookie.HttpOnly = true
-	cookie.Secure = false
-	cookie.SameSite = http.SameSiteLaxMode
-	cookie.Path = "/"
-	c.Response().Header().Set("Access-Control-Allow-Origin", "http://localhost:3000")
-	c.Response().Header().Set("Access-Control-Allow-Credentials", "true")
-	c.SetCookie(cookie)
+	return c.JSON(http.StatusOK, map[string]any{
+		step:        true,
+		"mfa_token": mfaToken,
+	})
+}
+
+// completeLogin opens the session and sets the auth cookies once every factor has been checked.
+func completeLogin(c echo.Context, cred *models.UserCredential, method string) error {
+	if err := startSession(c, cred, method); err != nil {
+		log.Printf("Session error: %v", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": "Could not create session",
+		})
+	}
 
 	return c.JSON(http.StatusOK, map[string]string{
 		"message": "Login successful",
 	})
 }
+
+// startSession opens the session and writes the auth cookies; method says how the user
+// authenticated.
+func startSession(c echo.Context, cred *models.UserCredential, method string) error {
+	sessionID, refreshToken, err := openSession(c, cred, method)
+	if err != nil {
+		return err
+	}
+
+	if err := setAuthCookies(c, cred, sessionID, refreshToken); err != nil {
+		return fmt.Errorf("sign access token: %w", err)
+	}
+
+	c.Response().Header().Set("Access-Control-Allow-Origin", "http://localhost:3000")
+	c.Response().Header().Set("Access-Control-Allow-Credentials", "true")
+	return nil
+}
+
+// openSession creates the server-side session and records the successful login.
+func openSession(c echo.Context, cred *models.UserCredential, method string) (string, string, error) {
+	sessionID, refreshToken, err := models.CreateSession(cred.UserID, models.SessionInfo{
+		IP:         c.RealIP(),
+		UserAgent:  c.Request().UserAgent(),
+		Method:     method,
+		HospitalID: cred.HospitalID,
+	})
+	if err != nil {
+		return "", "", err
+	}
+
+	handlers.Audit(c, models.AuditEvent{
+		Event:    models.AuditLogin,
+		Outcome:  models.AuditSuccess,
+		UserID:   cred.UserID,
+		Username: cred.Username,
+		Details:  method,
+	})
+	return sessionID, refreshToken, nil
+}
@@ -1,21 +1,34 @@
 package routes
 
 import (
-	"github.com/labstack/echo/v4"
+	"log"
 	"net/http"
-	"time"
+
+	"eoncohub.com/auth_module/handlers"
+	"eoncohub.com/auth_module/models"
+	"eoncohub.com/shared_module/auth"
+	"github.com/labstack/echo/v4"
 )
 
+// logout revokes the server-side session so that neither the access token nor the
+// refresh token can be used again, then clears both cookies.
 func logout(c echo.Context) error {
-	cookie := new(http.Cookie)
-	cookie.Name = "token"
-	cookie.Value = ""
-	cookie.Expires = time.Now().Add(-1 * time.Hour) // Set expiration to the past
-	cookie.HttpOnly = true
-	cookie.Secure = false
-	cookie.Path = "/"
+	if sessionID, err := auth.SessionID(c); err == nil && sessionID != "" {
+		if err := models.RevokeSession(sessionID); err != nil {
+			log.Printf("Logout error: %v", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Could not end session"})
+		}
+	} else if cookie, err := c.Cookie(refreshTokenCookie); err == nil && cookie.Value != "" {
+		if err := models.RevokeSessionByRefreshToken(cookie.Value); err != nil {
+			log.Printf("Logout error: %v", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Could not end session"})
+		}
+	}
+
+	clearAuthCookies(c)
 
-	c.SetCookie(cookie)
+	userID, _ := auth.UserID(c)
+	handlers.Audit(c, models.AuditEvent{Event: models.AuditLogout, Outcome: models.AuditSuccess, UserID: userID})
 
 	return c.JSON(http.StatusOK, map[string]string{
 		"message": "Logged out successfully",
@@ -0,0 +1,185 @@
+package routes
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+
+	"eoncohub.com/auth_module/models"
+	"eoncohub.com/shared_module/auth"
+	"github.com/labstack/echo/v4"
+)
+
+type mfaLoginReq struct {
+	MFAToken     string `json:"mfa_token"`
+	TOTPCode     string `json:"totp_code"`
+	RecoveryCode string `json:"recovery_code"`
+}
+
+type mfaRequirementReq struct {
+	Required bool `json:"required"`
+}
+
+// loginMFA is the second login step: it exchanges the MFA token from /login and a
+// TOTP or recovery code for the session cookies.
+func loginMFA(c echo.Context) error {
+	var req mfaLoginReq
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request"})
+	}
+	if req.TOTPCode == "" && req.RecoveryCode == "" {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Missing two-factor code"})
+	}
+
+	userID, err := parseMFAToken(req.MFAToken)
+	if err != nil {
+		return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Invalid or expired MFA token"})
+	}
+
+	cred, err := models.GetActiveUserCredential(userID)
+	if err != nil {
+		return c.JSON(http.StatusUnauthorized, map[string]string{"error": err.Error()})
+	}
+
+	// Code guesses count against the same limits as password guesses
+	attempt, err := models.BeginLoginAttempt(cred.Username, c.RealIP(), c.Request().UserAgent())
+	if err != nil {
+		auditLoginFailure(c, cred.Username, err)
+		return authErrorResponse(c, err)
+	}
+	if err := models.CheckSecondFactor(userID, req.TOTPCode, req.RecoveryCode); err != nil {
+		log.Printf("MFA error: %v", err)
+		models.RecordLoginFailure(attempt, true)
+		auditLoginFailure(c, cred.Username, err)
+		return authErrorResponse(c, err)
+	}
+	models.RecordLoginSuccess(attempt)
+
+	return completeLogin(c, cred, "mfa")
+}
+
+// startMFAEnrollment generates a secret for the signed-in user.
+func startMFAEnrollment(c echo.Context) error {
+	userID, err := auth.UserID(c)
+	if err != nil {
+		return c.JSON(http.StatusUnauthorized, map[string]string{"error": "User ID not found in token"})
+	}
+	return beginEnrollment(c, userID)
+}
+
+// confirmMFAEnrollment enables two-factor authentication for the signed-in user.
+func confirmMFAEnrollment(c echo.Context) error {
+	userID, err := auth.UserID(c)
+	if err != nil {
+		return c.JSON(http.StatusUnauthorized, map[string]string{"error": "User ID not found in token"})
+	}
+
+	var req mfaLoginReq
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request"})
+	}
+
+	codes, err := models.ConfirmMFAEnrollment(userID, req.TOTPCode)
+	if err != nil {
+		return enrollmentError(c, err)
+	}
+
+	return c.JSON(http.StatusOK, map[string]any{
+		"message":        "Two-factor authentication enabled",
+		"recovery_codes": codes,
+	})
+}
+
+// loginMFAEnroll starts the enrollment that an admin made mandatory, using the MFA
+// token from /login instead of a session.
+func loginMFAEnroll(c echo.Context) error {
+	var req mfaLoginReq
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request"})
+	}
+
+	userID, err := parseMFAToken(req.MFAToken)
+	if err != nil {
+		return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Invalid or expired MFA token"})
+	}
+	return beginEnrollment(c, userID)
+}
+
+// loginMFAEnrollVerify confirms a mandatory enrollment and completes the login.
+func loginMFAEnrollVerify(c echo.Context) error {
+	var req mfaLoginReq
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request"})
+	}
+
+	userID, err := parseMFAToken(req.MFAToken)
+	if err != nil {
+		return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Invalid or expired MFA token"})
+	}
+
+	codes, err := models.ConfirmMFAEnrollment(userID, req.TOTPCode)
+	if err != nil {
+		return enrollmentError(c, err)
+	}
+
+	cred, err := models.GetActiveUserCredential(userID)
+	if err != nil {
+		return c.JSON(http.StatusUnauthorized, map[string]string{"error": err.Error()})
+	}
+	if err := startSession(c, cred, "mfa"); err != nil {
+		log.Printf("Session error: %v", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Could not create session"})
+	}
+
+	return c.JSON(http.StatusOK, map[string]any{
+		"message":        "Login successful",
+		"recovery_codes": codes,
+	})
+}
+
+// setUserMFARequirement lets a hospital admin require two-factor authentication for a user.
+func setUserMFARequirement(c echo.Context) error {
+	hospitalID, userID, ok, err := hospitalUser(c)
+	if !ok {
+		return err
+	}
+
+	var req mfaRequirementReq
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request"})
+	}
+
+	if err := models.SetMFARequired(hospitalID, userID, req.Required); err != nil {
+		return userActionError(c, err, "Could not update two-factor requirement")
+	}
+
+	auditAdminAction(c, models.AuditMFARequirementChange, userID, fmt.Sprintf("required: %t", req.Required))
+
+	return c.JSON(http.StatusOK, map[string]any{"id_user": userID, "mfa_required": req.Required})
+}
+
+func beginEnrollment(c echo.Context, userID int64) error {
+	cred, err := models.GetActiveUserCredential(userID)
+	if err != nil {
+		return c.JSON(http.StatusUnauthorized, map[string]string{"error": err.Error()})
+	}
+
+	enrollment, err := models.StartMFAEnrollment(userID, cred.Username)
+	if err != nil {
+		return enrollmentError(c, err)
+	}
+
+	return c.JSON(http.StatusOK, enrollment)
+}
+
+func enrollmentError(c echo.Context, err error) error {
+	switch {
+	case errors.Is(err, models.ErrMFAAlreadyEnabled):
+		return c.JSON(http.StatusConflict, map[string]string{"error": err.Error()})
+	case errors.Is(err, models.ErrMFANotEnrolled), errors.Is(err, models.ErrInvalidMFACode):
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+	log.Printf("MFA enrollment error: %v", err)
+	return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Could not update two-factor settings"})
+}
@@ -0,0 +1,71 @@
+package routes
+
+import (
+	"errors"
+	"log"
+	"net/http"
+
+	"eoncohub.com/auth_module/handlers"
+	"eoncohub.com/auth_module/models"
+	"eoncohub.com/auth_module/password"
+	"eoncohub.com/shared_module/auth"
+	"github.com/labstack/echo/v4"
+)
+
+type changePasswordReq struct {
+	CurrentPassword string `json:"current_password"`
+	NewPassword     string `json:"new_password"`
+}
+
+// changePassword sets a new password for the signed-in user and signs out their other sessions.
+func changePassword(c echo.Context) error {
+	userID, err := auth.UserID(c)
+	if err != nil {
+		return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Unauthorized"})
+	}
+	sessionID, err := auth.SessionID(c)
+	if err != nil {
+		return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Unauthorized"})
+	}
+
+	var req changePasswordReq
+	if err := c.Bind(&req); err != nil || req.CurrentPassword == "" || req.NewPassword == "" {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Current and new password are required"})
+	}
+
+	err = models.ChangePassword(userID, sessionID, req.CurrentPassword, req.NewPassword)
+	event := models.AuditEvent{Event: models.AuditPasswordChange, Outcome: models.AuditSuccess, UserID: userID}
+	if err != nil {
+		event.Outcome = models.AuditFailure
+		event.Details = err.Error()
+	}
+	handlers.Audit(c, event)
+	if handled, respErr := passwordErrorResponse(c, err); handled {
+		return respErr
+	}
+	if err != nil {
+		if errors.Is(err, models.ErrCurrentPasswordInvalid) {
+			return c.JSON(http.StatusForbidden, map[string]string{"error": "Current password is incorrect"})
+		}
+		log.Printf("Change password error: %v", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Could not change password"})
+	}
+
+	return c.JSON(http.StatusOK, map[string]string{"message": "Password changed successfully"})
+}
+
+// passwordErrorResponse answers policy and reuse errors with 400 and the broken rules.
+// It reports false for any other error, leaving the response to the caller.
+func passwordErrorResponse(c echo.Context, err error) (bool, error) {
+	var policyErr *password.PolicyError
+	switch {
+	case errors.As(err, &policyErr):
+		return true, c.JSON(http.StatusBadRequest, map[string]any{
+			"error":    "Password does not meet the policy",
+			"problems": policyErr.Problems,
+		})
+	case errors.Is(err, models.ErrPasswordReused):
+		return true, c.JSON(http.StatusBadRequest, map[string]string{"error": "Password was used recently"})
+	}
+	return false, nil
+}
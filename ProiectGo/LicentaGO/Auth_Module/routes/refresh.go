@@ -0,0 +1,60 @@
+package routes
+
+import (
+	"errors"
+	"log"
+	"net/http"
+
+	"eoncohub.com/auth_module/handlers"
+	"eoncohub.com/auth_module/models"
+	"github.com/labstack/echo/v4"
+)
+
+var errSessionExpired = errors.New("session expired")
+
+// refresh rotates the refresh token and issues a new access token for the same session.
+func refresh(c echo.Context) error {
+	cookie, err := c.Cookie(refreshTokenCookie)
+	if err != nil || cookie.Value == "" {
+		return c.JSON(http.StatusUnauthorized, map[string]any{"error": "Missing refresh token", "isLoggedIn": false})
+	}
+
+	session, cred, refreshToken, err := rotateRefreshToken(c, cookie.Value)
+	if err != nil {
+		if errors.Is(err, errSessionExpired) {
+			clearAuthCookies(c)
+			return c.JSON(http.StatusUnauthorized, map[string]any{"error": "Session expired", "isLoggedIn": false})
+		}
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Could not refresh session"})
+	}
+
+	if err := setAuthCookies(c, cred, session.ID, refreshToken); err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Could not generate token"})
+	}
+
+	return c.JSON(http.StatusOK, map[string]string{"message": "Session refreshed"})
+}
+
+// rotateRefreshToken exchanges a refresh token for a new one and reloads the user for
+// the next access token. It returns errSessionExpired when the session cannot go on.
+func rotateRefreshToken(c echo.Context, token string) (*models.Session, *models.UserCredential, string, error) {
+	session, refreshToken, err := models.RotateSession(token, c.RealIP())
+	if err != nil {
+		if errors.Is(err, models.ErrInvalidRefreshToken) {
+			handlers.Audit(c, models.AuditEvent{Event: models.AuditTokenRefresh, Outcome: models.AuditFailure, Details: err.Error()})
+			return nil, nil, "", errSessionExpired
+		}
+		log.Printf("Refresh error: %v", err)
+		return nil, nil, "", err
+	}
+
+	cred, err := models.GetActiveUserCredentialAt(session.UserID, session.HospitalID)
+	if err != nil {
+		log.Printf("Refresh error: %v", err)
+		handlers.Audit(c, models.AuditEvent{Event: models.AuditTokenRefresh, Outcome: models.AuditFailure, UserID: session.UserID, Details: err.Error()})
+		return nil, nil, "", errSessionExpired
+	}
+
+	handlers.Audit(c, models.AuditEvent{Event: models.AuditTokenRefresh, Outcome: models.AuditSuccess, UserID: cred.UserID, Username: cred.Username})
+	return session, cred, refreshToken, nil
+}
@@ -1,10 +1,12 @@
 package routes
 
 import (
-	"eoncohub.com/auth_module/models"
+	"errors"
 	"log"
 	"net/http"
 
+	"eoncohub.com/auth_module/models"
+	"eoncohub.com/shared_module/person"
 	"github.com/labstack/echo/v4"
 )
 
@@ -20,8 +22,22 @@ func registerUser(context echo.Context) error {
 
 	err = registerReq.Register()
 	if err != nil {
-		if err == models.ErrUserAlreadyExists {
+		switch {
+		case errors.Is(err, models.ErrUserAlreadyExists):
 			return context.JSON(http.StatusConflict, map[string]string{"error": "User already exists"})
+		case errors.Is(err, models.ErrHospitalNotFound):
+			return context.JSON(http.StatusNotFound, map[string]string{"error": err.Error()})
+		case errors.Is(err, models.ErrRegistrationPending):
+			// The registration is stored and retried; the hospital gets the confirmation email once it completes.
+			return context.JSON(http.StatusAccepted, map[string]string{"message": err.Error()})
+		}
+		// Anyone can register, so a duplicate only says that the person exists.
+		var rejected *person.RejectedError
+		if errors.As(err, &rejected) {
+			return context.JSON(rejected.Summary(false))
+		}
+		if handled, respErr := passwordErrorResponse(context, err); handled {
+			return respErr
 		}
 		log.Printf("Registration error: %v", err)
 		return context.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
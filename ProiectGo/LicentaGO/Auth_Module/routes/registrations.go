@@ -0,0 +1,136 @@
+package routes
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+
+	"eoncohub.com/auth_module/handlers"
+	"eoncohub.com/auth_module/models"
+	"eoncohub.com/shared_module/auth"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	defaultRegistrationPageSize = 50
+	maxRegistrationPageSize     = 200
+)
+
+// listRegistrations returns stuck doctor registrations, or those in ?state= when given.
+func listRegistrations(c echo.Context) error {
+	hospitalID, ok, err := registrationHospital(c)
+	if !ok {
+		return err
+	}
+
+	page, err := positiveIntParam(c, "page", 1)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid page"})
+	}
+	pageSize, err := positiveIntParam(c, "page_size", defaultRegistrationPageSize)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid page size"})
+	}
+	if pageSize > maxRegistrationPageSize {
+		pageSize = maxRegistrationPageSize
+	}
+
+	filter := models.RegistrationFilter{HospitalID: hospitalID, State: c.QueryParam("state")}
+	registrations, total, err := models.ListRegistrations(filter, page, pageSize)
+	if err != nil {
+		log.Printf("Registrations error: %v", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Could not load registrations"})
+	}
+
+	return c.JSON(http.StatusOK, map[string]any{
+		"registrations": registrations,
+		"page":          page,
+		"page_size":     pageSize,
+		"total":         total,
+	})
+}
+
+func getRegistration(c echo.Context) error {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid registration ID"})
+	}
+	hospitalID, ok, err := registrationHospital(c)
+	if !ok {
+		return err
+	}
+
+	reg, err := models.GetRegistration(hospitalID, id)
+	if err != nil {
+		return registrationError(c, err)
+	}
+	return c.JSON(http.StatusOK, reg)
+}
+
+// retryRegistration runs a waiting or failed registration right away.
+func retryRegistration(c echo.Context) error {
+	return rescheduleRegistration(c, models.RetryRegistration, models.AuditRegistrationRetried)
+}
+
+// abortRegistration gives up on a registration and deletes what it created.
+func abortRegistration(c echo.Context) error {
+	return rescheduleRegistration(c, models.AbortRegistration, models.AuditRegistrationAborted)
+}
+
+func rescheduleRegistration(c echo.Context, action func(hospitalID, id int64) (models.Registration, error), event string) error {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid registration ID"})
+	}
+	hospitalID, ok, err := registrationHospital(c)
+	if !ok {
+		return err
+	}
+
+	reg, err := action(hospitalID, id)
+	if err != nil {
+		return registrationError(c, err)
+	}
+
+	adminID, _ := auth.UserID(c)
+	handlers.Audit(c, models.AuditEvent{
+		Event:    event,
+		Outcome:  models.AuditSuccess,
+		UserID:   reg.IDUser,
+		Username: reg.Email,
+		Details:  fmt.Sprintf("registration %d, now %s, by admin %d", reg.IDRegistration, reg.State, adminID),
+	})
+	return c.JSON(http.StatusOK, reg)
+}
+
+// registrationHospital scopes a hospital admin to their hospital. Platform admins see
+// every hospital, or the one in ?hospital_id=.
+func registrationHospital(c echo.Context) (int64, bool, error) {
+	claims, err := auth.ClaimsFrom(c)
+	if err != nil {
+		return 0, false, c.JSON(http.StatusUnauthorized, map[string]string{"error": "Unauthorized"})
+	}
+	if claims.HasRole(auth.RolePlatformAdmin) {
+		var hospitalID int64
+		if v := c.QueryParam("hospital_id"); v != "" {
+			if hospitalID, err = strconv.ParseInt(v, 10, 64); err != nil {
+				return 0, false, c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid hospital_id"})
+			}
+		}
+		return hospitalID, true, nil
+	}
+	return adminHospitalID(c)
+}
+
+func registrationError(c echo.Context, err error) error {
+	switch {
+	case errors.Is(err, models.ErrRegistrationNotFound):
+		return c.JSON(http.StatusNotFound, map[string]string{"error": err.Error()})
+	case errors.Is(err, models.ErrRegistrationFinished), errors.Is(err, models.ErrRegistrationBusy):
+		return c.JSON(http.StatusConflict, map[string]string{"error": err.Error()})
+	}
+	log.Printf("Registration error: %v", err)
+	return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Could not update registration"})
+}
@@ -2,24 +2,79 @@ package routes
 
 import (
 	"eoncohub.com/auth_module/handlers"
-	"eoncohub.com/auth_module/middleware"
+	"eoncohub.com/auth_module/keys"
+	"eoncohub.com/auth_module/models"
+	"eoncohub.com/shared_module/auth"
 	"github.com/labstack/echo/v4"
 )
 
 func RegisterRoutes(server *echo.Echo) {
 	// Public routes
 	server.POST("/login", login)
+	server.POST("/login/mfa", loginMFA)
+	server.POST("/login/mfa/enroll", loginMFAEnroll)
+	server.POST("/login/mfa/enroll/verify", loginMFAEnrollVerify)
 	server.POST("/signup", signup)
-	server.POST("/logout", logout)
+	server.POST("/logout", logout, auth.CSRFMiddleware())
+	server.POST("/refresh", refresh, auth.CSRFMiddleware())
+	server.POST("/token", issueToken)
+	server.GET("/.well-known/jwks.json", jwks)
+	server.GET("/sso/hospitals", listSSOHospitals)
+	server.GET("/sso/:hospital/login", startSSOLogin)
+	server.GET("/sso/callback", ssoCallback)
 	server.POST("/register", registerUser)
 	server.GET("/confirm", handlers.ConfirmEmail)
+	server.POST("/resend-confirmation", handlers.ResendConfirmation)
+	server.GET("/unlock", handlers.UnlockAccount)
 	server.POST("/request-password-reset", handlers.RequestPasswordReset)
 	server.POST("/confirm-password-reset", handlers.ConfirmPasswordReset)
 
+	// Called by Patient_Module with a service token
+	server.POST("/break-glass", recordBreakGlass, auth.RequireService(auth.ServiceAuth, auth.ServicePatient))
+
 	// Protected routes
 	protected := server.Group("/api")
-	protected.Use(middleware.JWTMiddleware)
+	protected.Use(auth.JWTMiddleware(auth.Config{
+		Keyfunc:  keys.Keyfunc,
+		Sessions: models.IsSessionActive,
+	}))
 	protected.GET("/check", checkAuth)
 	protected.POST("/logout", logout)
+	protected.POST("/password/change", changePassword)
+	protected.GET("/sessions", listSessions)
+	protected.DELETE("/sessions", revokeAllSessions)
+	protected.DELETE("/sessions/:id", revokeSession)
+	protected.GET("/affiliations", listAffiliations)
+	protected.POST("/affiliations", requestAffiliation, auth.RequireRoles(auth.RoleDoctor))
+	protected.POST("/switch-hospital", switchHospital)
+	protected.POST("/mfa/enroll", startMFAEnrollment)
+	protected.POST("/mfa/enroll/verify", confirmMFAEnrollment)
+
+	// Hospital admin routes
+	admin := protected.Group("/admin", auth.RequireRoles(auth.RoleHospitalAdmin))
+	admin.GET("/users", listUsers)
+	admin.GET("/users/:id", getUser)
+	admin.POST("/users/:id/deactivate", deactivateUser)
+	admin.POST("/users/:id/reactivate", reactivateUser)
+	admin.PUT("/users/:id/roles", setUserRoles)
+	admin.POST("/users/:id/password-reset", forcePasswordReset)
+	admin.POST("/users/:id/resend-confirmation", resendUserConfirmation)
+	admin.PUT("/users/:id/mfa", setUserMFARequirement)
+	admin.POST("/users/:id/unlock", unlockUser)
+	admin.GET("/pending-users", listPendingUsers)
+	admin.POST("/pending-users/:id/approve", approvePendingUser)
+	admin.POST("/pending-users/:id/reject", rejectPendingUser)
+
+	// Doctor registrations that did not complete, scoped to the hospital for hospital admins
+	registrations := protected.Group("/admin/registrations", auth.RequireRoles(auth.RoleHospitalAdmin, auth.RolePlatformAdmin))
+	registrations.GET("", listRegistrations)
+	registrations.GET("/:id", getRegistration)
+	registrations.POST("/:id/retry", retryRegistration)
+	registrations.POST("/:id/abort", abortRegistration)
+
+	// Audit log, scoped to the hospital for hospital admins
+	audit := protected.Group("/admin/audit", auth.RequireRoles(auth.RoleHospitalAdmin, auth.RolePlatformAdmin))
+	audit.GET("", listAuditLog)
+	audit.GET("/export", exportAuditLog)
 
 }
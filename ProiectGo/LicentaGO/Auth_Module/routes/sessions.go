@@ -0,0 +1,84 @@
+package routes
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+
+	"eoncohub.com/auth_module/handlers"
+	"eoncohub.com/auth_module/models"
+	"eoncohub.com/shared_module/auth"
+	"github.com/labstack/echo/v4"
+)
+
+// listSessions returns the open sessions of the signed-in user, the current one marked.
+func listSessions(c echo.Context) error {
+	userID, err := auth.UserID(c)
+	if err != nil {
+		return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Unauthorized"})
+	}
+	sessionID, _ := auth.SessionID(c)
+
+	sessions, err := models.ListUserSessions(userID, sessionID)
+	if err != nil {
+		log.Printf("List sessions error: %v", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Could not load sessions"})
+	}
+	return c.JSON(http.StatusOK, sessions)
+}
+
+// revokeSession signs one of the user's devices out. Revoking the current session
+// also clears the cookies, like logout.
+func revokeSession(c echo.Context) error {
+	userID, err := auth.UserID(c)
+	if err != nil {
+		return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Unauthorized"})
+	}
+	currentID, _ := auth.SessionID(c)
+	sessionID := c.Param("id")
+
+	if err := models.RevokeUserSession(userID, sessionID); err != nil {
+		if errors.Is(err, models.ErrSessionNotFound) {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "Session not found"})
+		}
+		log.Printf("Revoke session error: %v", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Could not end session"})
+	}
+
+	handlers.Audit(c, models.AuditEvent{Event: models.AuditSessionRevoked, Outcome: models.AuditSuccess, UserID: userID, Details: "session " + sessionID})
+	if sessionID == currentID {
+		clearAuthCookies(c)
+	}
+	return c.JSON(http.StatusOK, map[string]any{"message": "Session ended", "current": sessionID == currentID})
+}
+
+// revokeAllSessions signs the user out everywhere. With ?keep_current=true the session
+// making the request stays open.
+func revokeAllSessions(c echo.Context) error {
+	userID, err := auth.UserID(c)
+	if err != nil {
+		return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Unauthorized"})
+	}
+	keepCurrent, _ := strconv.ParseBool(c.QueryParam("keep_current"))
+
+	keep := ""
+	if keepCurrent {
+		keep, _ = auth.SessionID(c)
+	}
+	n, err := models.RevokeOtherSessions(userID, keep)
+	if err != nil {
+		log.Printf("Revoke sessions error: %v", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Could not end sessions"})
+	}
+
+	details := "all sessions"
+	if keepCurrent {
+		details = "all other sessions"
+	}
+	handlers.Audit(c, models.AuditEvent{Event: models.AuditSessionRevoked, Outcome: models.AuditSuccess, UserID: userID, Details: details})
+	if !keepCurrent {
+		clearAuthCookies(c)
+	}
+	return c.JSON(http.StatusOK, map[string]any{"message": "Sessions ended", "revoked": n})
+}
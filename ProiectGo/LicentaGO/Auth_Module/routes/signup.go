@@ -1,18 +1,47 @@
 package routes
 
 import (
+	"errors"
+	"log"
+	"net/http"
+
 	"eoncohub.com/auth_module/models"
+	"eoncohub.com/shared_module/person"
 	"github.com/labstack/echo/v4"
 )
 
 func signup(context echo.Context) error {
 	var req models.SignupReq
 	if err := context.Bind(&req); err != nil {
-		return context.JSON(400, map[string]string{"message": "Invalid request"})
+		return context.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request"})
+	}
+
+	err := req.Signup()
+	var rejected *person.RejectedError
+	if handled, respErr := passwordErrorResponse(context, err); handled {
+		return respErr
 	}
 
-	if req.Role == 1 {
+	switch {
+	case err == nil:
+	case errors.Is(err, models.ErrMissingFields),
+		errors.Is(err, models.ErrPasswordMismatch),
+		errors.Is(err, models.ErrInvalidRole):
+		return context.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	case errors.Is(err, models.ErrHospitalNotFound):
+		return context.JSON(http.StatusBadRequest, map[string]string{"error": "Unknown clinic"})
+	case errors.Is(err, models.ErrUserAlreadyExists):
+		return context.JSON(http.StatusConflict, map[string]string{"error": "User already exists"})
+	case errors.As(err, &rejected) && rejected.Status == http.StatusBadRequest:
+		return context.JSONBlob(rejected.Status, rejected.Body)
+	case rejected != nil:
+		return context.JSON(http.StatusConflict, map[string]string{"error": "Person already exists"})
+	default:
+		log.Printf("Signup error: %v", err)
+		return context.JSON(http.StatusInternalServerError, map[string]string{"error": "Could not complete signup"})
 	}
 
-	return context.JSON(200, map[string]string{"message": "Signup successful"})
+	return context.JSON(http.StatusOK, map[string]string{
+		"message": "Signup successful, confirm your email through the link sent to it; your account is waiting for approval",
+	})
 }
@@ -0,0 +1,186 @@
+package routes
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+
+	"eoncohub.com/auth_module/models"
+	"github.com/labstack/echo/v4"
+)
+
+// ssoStateCookie ties the callback to the browser that started the login, so a code
+// obtained by someone else cannot be injected into this session.
+const ssoStateCookie = "sso_state"
+
+// ssoRedirectURL is the callback registered with every hospital identity provider.
+func ssoRedirectURL() string {
+	if v := os.Getenv("SSO_REDIRECT_URL"); v != "" {
+		return v
+	}
+	return "http://localhost:8082/sso/callback"
+}
+
+// ssoFrontendURL is where the browser lands after the callback, with ?sso_error=<type> on failure.
+func ssoFrontendURL() string {
+	if v := os.Getenv("SSO_FRONTEND_URL"); v != "" {
+		return v
+	}
+	return "http://localhost:3000/"
+}
+
+func listSSOHospitals(c echo.Context) error {
+	hospitals, err := models.GetSSOHospitals()
+	if err != nil {
+		log.Printf("List SSO hospitals error: %v", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Could not load hospitals"})
+	}
+	return c.JSON(http.StatusOK, hospitals)
+}
+
+// startSSOLogin redirects the browser to the identity provider of the hospital.
+func startSSOLogin(c echo.Context) error {
+	hospitalID, err := strconv.ParseInt(c.Param("hospital"), 10, 64)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid hospital ID"})
+	}
+
+	idp, err := models.GetHospitalIdP(hospitalID)
+	if err != nil {
+		if errors.Is(err, models.ErrSSONotConfigured) {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": err.Error()})
+		}
+		log.Printf("SSO configuration error: %v", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Could not start single sign-on"})
+	}
+
+	login, err := models.StartSSOLogin(hospitalID)
+	if err != nil {
+		log.Printf("SSO start error: %v", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Could not start single sign-on"})
+	}
+
+	authURL, err := idp.Provider(ssoRedirectURL()).AuthCodeURL(c.Request().Context(), login.State, login.Nonce, login.CodeChallenge)
+	if err != nil {
+		log.Printf("SSO discovery error for hospital %d: %v", hospitalID, err)
+		return c.JSON(http.StatusBadGateway, map[string]string{"error": "Identity provider is unavailable"})
+	}
+
+	c.SetCookie(ssoCookie(login.State, time.Now().Add(10*time.Minute)))
+	return c.Redirect(http.StatusFound, authURL)
+}
+
+// ssoCallback finishes the authorization code flow, opens a session and sends the
+// browser back to the frontend. Locked accounts are refused, and users with two-factor
+// authentication continue with the second step as after a password.
+func ssoCallback(c echo.Context) error {
+	state := c.QueryParam("state")
+	cookie, err := c.Cookie(ssoStateCookie)
+	c.SetCookie(ssoCookie("", time.Now().Add(-time.Hour)))
+	if state == "" || err != nil || cookie.Value != state {
+		return ssoFailure(c, "InvalidState")
+	}
+
+	login, err := models.ConsumeSSOLogin(state)
+	if err != nil {
+		if !errors.Is(err, models.ErrInvalidSSOState) {
+			log.Printf("SSO state error: %v", err)
+		}
+		return ssoFailure(c, "InvalidState")
+	}
+
+	if idpErr := c.QueryParam("error"); idpErr != "" {
+		log.Printf("SSO identity provider error for hospital %d: %s %s", login.HospitalID, idpErr, c.QueryParam("error_description"))
+		return ssoFailure(c, "ProviderError")
+	}
+	code := c.QueryParam("code")
+	if code == "" {
+		return ssoFailure(c, "ProviderError")
+	}
+
+	idp, err := models.GetHospitalIdP(login.HospitalID)
+	if err != nil {
+		log.Printf("SSO configuration error: %v", err)
+		return ssoFailure(c, "ProviderError")
+	}
+
+	idToken, err := idp.Provider(ssoRedirectURL()).Exchange(c.Request().Context(), code, login.CodeVerifier, login.Nonce)
+	if err != nil {
+		log.Printf("SSO code exchange error for hospital %d: %v", login.HospitalID, err)
+		return ssoFailure(c, "ProviderError")
+	}
+
+	cred, err := models.ResolveSSOUser(idp, idToken)
+	if err != nil {
+		log.Printf("SSO login error for hospital %d: %v", login.HospitalID, err)
+		auditLoginFailure(c, idToken.Email, err)
+		var authErr *models.AuthError
+		if errors.As(err, &authErr) {
+			return ssoFailure(c, string(authErr.Type))
+		}
+		return ssoFailure(c, string(models.AuthErrorInternal))
+	}
+
+	if err := models.CheckSSOLogin(cred); err != nil {
+		var authErr *models.AuthError
+		if errors.As(err, &authErr) {
+			switch authErr.Type {
+			case models.AuthErrorMFARequired:
+				return ssoSecondFactor(c, cred.UserID, "mfa_required")
+			case models.AuthErrorMFAEnrollment:
+				return ssoSecondFactor(c, cred.UserID, "mfa_enrollment_required")
+			}
+		}
+		log.Printf("SSO login refused for hospital %d: %v", login.HospitalID, err)
+		auditLoginFailure(c, cred.Username, err)
+		if errors.As(err, &authErr) {
+			return ssoFailure(c, string(authErr.Type))
+		}
+		return ssoFailure(c, string(models.AuthErrorInternal))
+	}
+
+	if err := startSession(c, cred, "sso"); err != nil {
+		log.Printf("Session error: %v", err)
+		return ssoFailure(c, string(models.AuthErrorInternal))
+	}
+
+	return c.Redirect(http.StatusFound, ssoFrontendURL())
+}
+
+// ssoSecondFactor sends the browser back to the frontend with the MFA token of
+// secondFactorChallenge in the URL fragment, which is not sent to servers or in the
+// Referer header. The frontend finishes the login with /login/mfa or /login/mfa/enroll/*.
+func ssoSecondFactor(c echo.Context, userID int64, step string) error {
+	mfaToken, err := signMFAToken(userID)
+	if err != nil {
+		log.Printf("MFA token error: %v", err)
+		return ssoFailure(c, string(models.AuthErrorInternal))
+	}
+	target, err := url.Parse(ssoFrontendURL())
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid frontend URL"})
+	}
+	target.Fragment = url.Values{step: {"true"}, "mfa_token": {mfaToken}}.Encode()
+	return c.Redirect(http.StatusFound, target.String())
+}
+
+func ssoFailure(c echo.Context, errorType string) error {
+	target, err := url.Parse(ssoFrontendURL())
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": errorType})
+	}
+	q := target.Query()
+	q.Set("sso_error", errorType)
+	target.RawQuery = q.Encode()
+	return c.Redirect(http.StatusFound, target.String())
+}
+
+func ssoCookie(value string, expires time.Time) *http.Cookie {
+	cookie := authCookie(ssoStateCookie, value, expires)
+	cookie.Path = "/sso"
+	return cookie
+}
@@ -0,0 +1,104 @@
+package routes
+
+import (
+	"errors"
+	"log"
+	"net/http"
+
+	"eoncohub.com/auth_module/models"
+	"github.com/labstack/echo/v4"
+)
+
+// tokenReq is the body of POST /token, as JSON or form data.
+type tokenReq struct {
+	GrantType string `json:"grant_type" form:"grant_type"`
+	// Password grant; username is accepted as an alias of email.
+	Email        string `json:"email" form:"email"`
+	Username     string `json:"username" form:"username"`
+	Password     string `json:"password" form:"password"`
+	TOTPCode     string `json:"totp_code" form:"totp_code"`
+	RecoveryCode string `json:"recovery_code" form:"recovery_code"`
+	// Refresh grant.
+	RefreshToken string `json:"refresh_token" form:"refresh_token"`
+}
+
+// issueToken is the login for clients without a browser: the tokens are returned in
+// the body instead of cookies and the access token is sent back as a bearer token.
+func issueToken(c echo.Context) error {
+	var req tokenReq
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request"})
+	}
+	c.Response().Header().Set("Cache-Control", "no-store")
+
+	switch req.GrantType {
+	case "password":
+		return passwordGrant(c, req)
+	case "refresh_token":
+		return refreshGrant(c, req)
+	default:
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Unsupported grant_type, use password or refresh_token"})
+	}
+}
+
+// passwordGrant checks the credentials, including the second factor when the account
+// has one, in a single request.
+func passwordGrant(c echo.Context, req tokenReq) error {
+	loginReq := models.LoginReq{
+		Email:        req.Email,
+		Password:     req.Password,
+		TOTPCode:     req.TOTPCode,
+		RecoveryCode: req.RecoveryCode,
+		IP:           c.RealIP(),
+		UserAgent:    c.Request().UserAgent(),
+	}
+	if loginReq.Email == "" {
+		loginReq.Email = req.Username
+	}
+	if loginReq.Email == "" || loginReq.Password == "" {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Email and password are required"})
+	}
+
+	cred, err := loginReq.Validate()
+	if err != nil {
+		log.Printf("Token validation error: %v", err)
+		auditLoginFailure(c, loginReq.Email, err)
+		return authErrorResponse(c, err)
+	}
+
+	sessionID, refreshToken, err := openSession(c, cred, "token")
+	if err != nil {
+		log.Printf("Session error: %v", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Could not create session"})
+	}
+	return tokenResponse(c, cred, sessionID, refreshToken)
+}
+
+func refreshGrant(c echo.Context, req tokenReq) error {
+	if req.RefreshToken == "" {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Missing refresh token"})
+	}
+
+	session, cred, refreshToken, err := rotateRefreshToken(c, req.RefreshToken)
+	if err != nil {
+		if errors.Is(err, errSessionExpired) {
+			return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Session expired"})
+		}
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Could not refresh session"})
+	}
+	return tokenResponse(c, cred, session.ID, refreshToken)
+}
+
+func tokenResponse(c echo.Context, cred *models.UserCredential, sessionID, refreshToken string) error {
+	accessToken, err := signAccessToken(cred, sessionID)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Could not generate token"})
+	}
+
+	return c.JSON(http.StatusOK, map[string]any{
+		"access_token":  accessToken,
+		"token_type":    "Bearer",
+		"expires_in":    int(models.AccessTokenTTL().Seconds()),
+		"refresh_token": refreshToken,
+	})
+}
@@ -0,0 +1,122 @@
+package routes
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"eoncohub.com/auth_module/keys"
+	"eoncohub.com/auth_module/models"
+	"eoncohub.com/auth_module/utils"
+	"eoncohub.com/shared_module/auth"
+	"github.com/golang-jwt/jwt"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	accessTokenCookie  = auth.AccessTokenCookie
+	refreshTokenCookie = auth.RefreshTokenCookie
+
+	// mfaAudience marks the short-lived token that only proves the password step of a login.
+	mfaAudience = "mfa"
+	mfaTokenTTL = 5 * time.Minute
+)
+
+// signAccessToken builds the short-lived JWT read by every module through the shared
+// auth library. Subject carries the user ID and Id the session ID checked by JWTMiddleware.
+func signAccessToken(cred *models.UserCredential, sessionID string) (string, error) {
+	now := time.Now()
+	claims := &auth.Claims{
+		Roles:            cred.Roles,
+		PersonID:         cred.PersonID,
+		DoctorHospitalID: cred.DoctorHospitalID,
+		HospitalID:       cred.HospitalID,
+		StandardClaims: jwt.StandardClaims{
+			Id:        sessionID,
+			Subject:   strconv.FormatInt(cred.UserID, 10),
+			Issuer:    auth.Issuer,
+			IssuedAt:  now.Unix(),
+			ExpiresAt: now.Add(models.AccessTokenTTL()).Unix(),
+		},
+	}
+
+	return keys.Sign(claims)
+}
+
+// signMFAToken issues the token that links the password step of a login to the
+// second-factor step. It has no session ID, so no JWTMiddleware accepts it.
+func signMFAToken(userID int64) (string, error) {
+	now := time.Now()
+	claims := &jwt.StandardClaims{
+		Audience:  mfaAudience,
+		Subject:   strconv.FormatInt(userID, 10),
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(mfaTokenTTL).Unix(),
+	}
+
+	return keys.Sign(claims)
+}
+
+// parseMFAToken returns the user ID of a valid, unexpired MFA token.
+func parseMFAToken(tokenString string) (int64, error) {
+	claims := &jwt.StandardClaims{}
+	token, err := jwt.ParseWithClaims(tokenString, claims, keys.Keyfunc)
+	if err != nil || !token.Valid || !claims.VerifyAudience(mfaAudience, true) {
+		return 0, errors.New("invalid MFA token")
+	}
+	return strconv.ParseInt(claims.Subject, 10, 64)
+}
+
+// setAuthCookies writes the access and refresh cookies for a session, and the CSRF
+// cookie the frontend echoes back in a header. An existing CSRF token is kept so
+// requests already in flight during a refresh still match.
+func setAuthCookies(c echo.Context, cred *models.UserCredential, sessionID, refreshToken string) error {
+	accessToken, err := signAccessToken(cred, sessionID)
+	if err != nil {
+		return err
+	}
+
+	csrfToken := ""
+	if cookie, err := c.Cookie(auth.CSRFCookie); err == nil {
+		csrfToken = cookie.Value
+	}
+	if csrfToken == "" {
+		if csrfToken, err = utils.GenerateOpaqueToken(); err != nil {
+			return fmt.Errorf("generate CSRF token: %w", err)
+		}
+	}
+
+	expires := time.Now().Add(models.RefreshTokenTTL())
+	c.SetCookie(authCookie(accessTokenCookie, accessToken, time.Now().Add(models.AccessTokenTTL())))
+	c.SetCookie(authCookie(refreshTokenCookie, refreshToken, expires))
+	c.SetCookie(csrfCookie(csrfToken, expires))
+	return nil
+}
+
+func clearAuthCookies(c echo.Context) {
+	expired := time.Now().Add(-1 * time.Hour) // Set expiration to the past
+	c.SetCookie(authCookie(accessTokenCookie, "", expired))
+	c.SetCookie(authCookie(refreshTokenCookie, "", expired))
+	c.SetCookie(csrfCookie("", expired))
+}
+
+// csrfCookie must be readable by the frontend script, unlike the auth cookies.
+func csrfCookie(value string, expires time.Time) *http.Cookie {
+	cookie := authCookie(auth.CSRFCookie, value, expires)
+	cookie.HttpOnly = false
+	return cookie
+}
+
+func authCookie(name, value string, expires time.Time) *http.Cookie {
+	cookie := new(http.Cookie)
+	cookie.Name = name
+	cookie.Value = value
+	cookie.Expires = expires
+	cookie.HttpOnly = true
+	cookie.Secure = false
+	cookie.SameSite = http.SameSiteLaxMode
+	cookie.Path = "/"
+	return cookie
+}
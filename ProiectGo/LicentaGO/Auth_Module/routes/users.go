@@ -0,0 +1,211 @@
+package routes
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"eoncohub.com/auth_module/handlers"
+	"eoncohub.com/auth_module/models"
+	"eoncohub.com/shared_module/auth"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	defaultUserPageSize = 25
+	maxUserPageSize     = 200
+)
+
+type userRolesReq struct {
+	Roles []string `json:"roles"`
+}
+
+// listUsers returns a page of the users holding a role at the admin's hospital.
+func listUsers(c echo.Context) error {
+	hospitalID, ok, err := adminHospitalID(c)
+	if !ok {
+		return err
+	}
+
+	page, err := positiveIntParam(c, "page", 1)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid page"})
+	}
+	pageSize, err := positiveIntParam(c, "page_size", defaultUserPageSize)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid page size"})
+	}
+	if pageSize > maxUserPageSize {
+		pageSize = maxUserPageSize
+	}
+
+	filter := models.UserFilter{
+		Status: strings.ToUpper(c.QueryParam("status")),
+		Role:   c.QueryParam("role"),
+		Query:  c.QueryParam("q"),
+	}
+	users, total, err := models.ListHospitalUsers(hospitalID, filter, page, pageSize)
+	if err != nil {
+		log.Printf("List users error: %v", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Could not load users"})
+	}
+
+	return c.JSON(http.StatusOK, map[string]any{
+		"users":     users,
+		"page":      page,
+		"page_size": pageSize,
+		"total":     total,
+	})
+}
+
+func getUser(c echo.Context) error {
+	hospitalID, userID, ok, err := hospitalUser(c)
+	if !ok {
+		return err
+	}
+
+	user, err := models.GetHospitalUser(hospitalID, userID)
+	if err != nil {
+		return userActionError(c, err, "Could not load user")
+	}
+	return c.JSON(http.StatusOK, user)
+}
+
+// deactivateUser disables the user's roles at the admin's hospital and signs the user out.
+func deactivateUser(c echo.Context) error {
+	hospitalID, userID, ok, err := hospitalUser(c)
+	if !ok {
+		return err
+	}
+	adminID, _ := auth.UserID(c)
+
+	if err := models.DeactivateUser(hospitalID, adminID, userID); err != nil {
+		return userActionError(c, err, "Could not deactivate user")
+	}
+
+	auditAdminAction(c, models.AuditUserDeactivated, userID, "")
+	return c.JSON(http.StatusOK, map[string]string{"message": "User deactivated"})
+}
+
+func reactivateUser(c echo.Context) error {
+	hospitalID, userID, ok, err := hospitalUser(c)
+	if !ok {
+		return err
+	}
+
+	if err := models.ReactivateUser(hospitalID, userID); err != nil {
+		return userActionError(c, err, "Could not reactivate user")
+	}
+
+	auditAdminAction(c, models.AuditUserReactivated, userID, "")
+	return c.JSON(http.StatusOK, map[string]string{"message": "User reactivated"})
+}
+
+// setUserRoles replaces the nurse, assistant and hospital_admin roles of the user at the
+// admin's hospital.
+func setUserRoles(c echo.Context) error {
+	hospitalID, userID, ok, err := hospitalUser(c)
+	if !ok {
+		return err
+	}
+	adminID, _ := auth.UserID(c)
+
+	var req userRolesReq
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request"})
+	}
+
+	if err := models.SetUserRoles(hospitalID, adminID, userID, req.Roles); err != nil {
+		return userActionError(c, err, "Could not update roles")
+	}
+
+	auditAdminAction(c, models.AuditUserRolesChanged, userID, "roles: "+strings.Join(req.Roles, ","))
+
+	user, err := models.GetHospitalUser(hospitalID, userID)
+	if err != nil {
+		return userActionError(c, err, "Could not load user")
+	}
+	return c.JSON(http.StatusOK, user)
+}
+
+// forcePasswordReset invalidates the user's password and emails a reset link.
+func forcePasswordReset(c echo.Context) error {
+	hospitalID, userID, ok, err := hospitalUser(c)
+	if !ok {
+		return err
+	}
+
+	if err := models.ForcePasswordReset(hospitalID, userID); err != nil {
+		return userActionError(c, err, "Could not reset password")
+	}
+
+	auditAdminAction(c, models.AuditPasswordResetForced, userID, "")
+	return c.JSON(http.StatusOK, map[string]string{"message": "Password reset email sent"})
+}
+
+func resendUserConfirmation(c echo.Context) error {
+	hospitalID, userID, ok, err := hospitalUser(c)
+	if !ok {
+		return err
+	}
+
+	if err := models.ResendUserConfirmation(hospitalID, userID); err != nil {
+		return userActionError(c, err, "Could not resend confirmation")
+	}
+
+	auditAdminAction(c, models.AuditConfirmationResent, userID, "")
+	return c.JSON(http.StatusOK, map[string]string{"message": "Confirmation email sent"})
+}
+
+// hospitalUser resolves the :id user of an admin action and checks that the user holds a
+// role at the admin's hospital. When it returns false the error response has already
+// been written and err is the result of writing it.
+func hospitalUser(c echo.Context) (int64, int64, bool, error) {
+	userID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return 0, 0, false, c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid user ID"})
+	}
+
+	hospitalID, ok, err := adminHospitalID(c)
+	if !ok {
+		return 0, 0, false, err
+	}
+
+	member, err := models.IsUserInHospital(hospitalID, userID)
+	if err != nil {
+		log.Printf("User membership error: %v", err)
+		return 0, 0, false, c.JSON(http.StatusInternalServerError, map[string]string{"error": "Could not load user"})
+	}
+	if !member {
+		return 0, 0, false, c.JSON(http.StatusNotFound, map[string]string{"error": models.ErrUserNotInHospital.Error()})
+	}
+	return hospitalID, userID, true, nil
+}
+
+func userActionError(c echo.Context, err error, message string) error {
+	switch {
+	case errors.Is(err, models.ErrUserNotInHospital):
+		return c.JSON(http.StatusNotFound, map[string]string{"error": err.Error()})
+	case errors.Is(err, models.ErrRoleNotAssignable), errors.Is(err, models.ErrNoRolesLeft):
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	case errors.Is(err, models.ErrOwnAccount), errors.Is(err, models.ErrOwnAdminRole):
+		return c.JSON(http.StatusForbidden, map[string]string{"error": err.Error()})
+	case errors.Is(err, models.ErrStatusUnchanged), errors.Is(err, models.ErrNothingToConfirm):
+		return c.JSON(http.StatusConflict, map[string]string{"error": err.Error()})
+	}
+	log.Printf("User management error: %v", err)
+	return c.JSON(http.StatusInternalServerError, map[string]string{"error": message})
+}
+
+// auditAdminAction records an action a hospital admin took on a user.
+func auditAdminAction(c echo.Context, event string, userID int64, details string) {
+	adminID, _ := auth.UserID(c)
+	by := fmt.Sprintf("by admin %d", adminID)
+	if details != "" {
+		by += "; " + details
+	}
+	handlers.Audit(c, models.AuditEvent{Event: event, Outcome: models.AuditSuccess, UserID: userID, Details: by})
+}
@@ -0,0 +1,163 @@
+// Package secrets seals the secrets Auth_Module keeps in its own tables, such as the JWT
+// signing keys, so that a copy of the database alone does not give them away.
+//
+// Values are sealed with AES-256-GCM under a master key from AUTH_SECRET_KEYS and stored
+// as text:
+//
+//	sec1.<key id>.<sealed value>
+//
+// AUTH_SECRET_KEYS lists the master keys as "id:base64,id:base64" (32 bytes each, ids
+// made of letters, digits and '-'), AUTH_SECRET_ACTIVE_KEY names the one new values are
+// sealed with and the others are only used to open values sealed before a rotation.
+// Values without the sec1 prefix were stored before sealing and are returned as they
+// are; Stale tells the caller to seal them again.
+package secrets
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+const (
+	prefix  = "sec1."
+	keySize = 32
+)
+
+var (
+	ErrNoKeys     = errors.New("AUTH_SECRET_KEYS and AUTH_SECRET_ACTIVE_KEY must be set")
+	ErrUnknownKey = errors.New("secret sealed with a key missing from AUTH_SECRET_KEYS")
+	ErrMalformed  = errors.New("malformed sealed secret")
+)
+
+type keyring struct {
+	active string
+	keys   map[string]cipher.AEAD
+}
+
+var (
+	loadOnce sync.Once
+	loaded   *keyring
+	loadErr  error
+)
+
+// Check loads the keys from the environment and reports what is wrong with them. The
+// module calls it on startup.
+func Check() error {
+	_, err := keys()
+	return err
+}
+
+// Seal encrypts value with the active key. context names what the value is, e.g.
+// "signing_key:<kid>", and must be given again to open it, so a sealed value copied to
+// another row does not open.
+func Seal(context, value string) (string, error) {
+	k, err := keys()
+	if err != nil {
+		return "", err
+	}
+
+	aead := k.keys[k.active]
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", fmt.Errorf("secrets: generate nonce: %w", err)
+	}
+	sealed := aead.Seal(nonce, nonce, []byte(value), []byte(k.active+"."+context))
+	return prefix + k.active + "." + base64.RawURLEncoding.EncodeToString(sealed), nil
+}
+
+// Open decrypts a value stored by Seal under the same context. Values stored before
+// sealing are returned unchanged.
+func Open(context, stored string) (string, error) {
+	if !strings.HasPrefix(stored, prefix) {
+		return stored, nil
+	}
+	k, err := keys()
+	if err != nil {
+		return "", err
+	}
+
+	id, encoded, ok := strings.Cut(strings.TrimPrefix(stored, prefix), ".")
+	if !ok {
+		return "", ErrMalformed
+	}
+	aead, ok := k.keys[id]
+	if !ok {
+		return "", fmt.Errorf("%w: %s", ErrUnknownKey, id)
+	}
+	sealed, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil || len(sealed) < aead.NonceSize() {
+		return "", ErrMalformed
+	}
+	value, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], []byte(id+"."+context))
+	if err != nil {
+		return "", ErrMalformed
+	}
+	return string(value), nil
+}
+
+// Stale reports whether stored was written before sealing or sealed with a key other
+// than the active one, so that it should be sealed again.
+func Stale(stored string) bool {
+	k, err := keys()
+	if err != nil {
+		return false
+	}
+	return !strings.HasPrefix(stored, prefix+k.active+".")
+}
+
+func keys() (*keyring, error) {
+	loadOnce.Do(func() {
+		loaded, loadErr = loadKeys()
+	})
+	return loaded, loadErr
+}
+
+func loadKeys() (*keyring, error) {
+	list, active := os.Getenv("AUTH_SECRET_KEYS"), os.Getenv("AUTH_SECRET_ACTIVE_KEY")
+	if list == "" || active == "" {
+		return nil, ErrNoKeys
+	}
+
+	k := &keyring{active: active, keys: map[string]cipher.AEAD{}}
+	for _, entry := range strings.Split(list, ",") {
+		id, encoded, ok := strings.Cut(strings.TrimSpace(entry), ":")
+		if !ok || !validID(id) {
+			return nil, fmt.Errorf("secrets: AUTH_SECRET_KEYS entry %q is not id:base64", entry)
+		}
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil || len(key) != keySize {
+			return nil, fmt.Errorf("secrets: key %s must be %d bytes in base64", id, keySize)
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, fmt.Errorf("secrets: %w", err)
+		}
+		if k.keys[id], err = cipher.NewGCM(block); err != nil {
+			return nil, fmt.Errorf("secrets: %w", err)
+		}
+	}
+	if _, ok := k.keys[active]; !ok {
+		return nil, fmt.Errorf("secrets: AUTH_SECRET_ACTIVE_KEY %s is not in AUTH_SECRET_KEYS", active)
+	}
+	return k, nil
+}
+
+func validID(id string) bool {
+	if id == "" {
+		return false
+	}
+	for _, r := range id {
+		if r > unicode.MaxASCII || !(unicode.IsLetter(r) || unicode.IsDigit(r) || r == '-') {
+			return false
+		}
+	}
+	return true
+}
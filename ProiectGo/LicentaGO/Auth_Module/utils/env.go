@@ -0,0 +1,33 @@
+package utils
+
+import (
+	"os"
+	"strconv"
+	"time"
+)
+
+// DurationFromEnv parses a Go duration (e.g. "15m") from the environment, falling back to def.
+func DurationFromEnv(key string, def time.Duration) time.Duration {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		return def
+	}
+	return d
+}
+
+// IntFromEnv parses a positive integer from the environment, falling back to def.
+func IntFromEnv(key string, def int) int {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n <= 0 {
+		return def
+	}
+	return n
+}
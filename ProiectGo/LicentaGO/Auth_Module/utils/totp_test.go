@@ -0,0 +1,94 @@
+package utils
+
+import (
+	"testing"
+	"time"
+)
+
+// rfc6238Secret is the SHA-1 key of the RFC 6238 test vectors, "12345678901234567890", in base32.
+const rfc6238Secret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestVerifyTOTPRFC6238(t *testing.T) {
+	// RFC 6238 appendix B, SHA-1, truncated to the last 6 of the 8 digits.
+	tests := []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	for _, tt := range tests {
+		at := time.Unix(tt.unix, 0)
+		step, ok := VerifyTOTP(rfc6238Secret, tt.code, at)
+		if !ok {
+			t.Errorf("VerifyTOTP(%q) at %d = false, want true", tt.code, tt.unix)
+			continue
+		}
+		if want := tt.unix / totpPeriod; step != want {
+			t.Errorf("VerifyTOTP(%q) at %d step = %d, want %d", tt.code, tt.unix, step, want)
+		}
+	}
+}
+
+func TestVerifyTOTPSkew(t *testing.T) {
+	key, err := totpEncoding.DecodeString(rfc6238Secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := time.Unix(1111111111, 0)
+	current := at.Unix() / totpPeriod
+
+	for offset := int64(-3); offset <= 3; offset++ {
+		code := totpCode(key, current+offset)
+		step, ok := VerifyTOTP(rfc6238Secret, code, at)
+		inWindow := offset >= -totpSkew && offset <= totpSkew
+		if ok != inWindow {
+			t.Errorf("code of step %+d: ok = %v, want %v", offset, ok, inWindow)
+		}
+		// The matched step is what LAST_USED_STEP records to refuse a replay.
+		if ok && step != current+offset {
+			t.Errorf("code of step %+d: step = %d, want %d", offset, step, current+offset)
+		}
+	}
+}
+
+func TestVerifyTOTPInput(t *testing.T) {
+	at := time.Unix(59, 0)
+	tests := []struct {
+		name   string
+		secret string
+		code   string
+		want   bool
+	}{
+		{"surrounding spaces", rfc6238Secret, " 287082 ", true},
+		{"lower-case secret", "gezdgnbvgy3tqojqgezdgnbvgy3tqojq", "287082", true},
+		{"wrong code", rfc6238Secret, "287083", false},
+		{"too short", rfc6238Secret, "28708", false},
+		{"eight digits", rfc6238Secret, "94287082", false},
+		{"invalid secret", "not base32!", "287082", false},
+	}
+	for _, tt := range tests {
+		if _, ok := VerifyTOTP(tt.secret, tt.code, at); ok != tt.want {
+			t.Errorf("%s: VerifyTOTP = %v, want %v", tt.name, ok, tt.want)
+		}
+	}
+}
+
+func TestGenerateTOTPSecretRoundTrip(t *testing.T) {
+	secret, err := GenerateTOTPSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := totpEncoding.DecodeString(secret)
+	if err != nil || len(key) != 20 {
+		t.Fatalf("secret %q decodes to %d bytes, err %v", secret, len(key), err)
+	}
+	now := time.Now()
+	if _, ok := VerifyTOTP(secret, totpCode(key, now.Unix()/totpPeriod), now); !ok {
+		t.Error("code of a generated secret is not accepted")
+	}
+}
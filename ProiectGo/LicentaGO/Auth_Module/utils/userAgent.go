@@ -0,0 +1,50 @@
+package utils
+
+import "strings"
+
+// DeviceLabel summarizes a user agent as "<browser> on <platform>" so users can tell
+// their sessions apart. Parts that cannot be recognised are reported as unknown.
+func DeviceLabel(userAgent string) string {
+	if userAgent == "" {
+		return "Unknown device"
+	}
+	return firstMatch(userAgent, browsers, "Unknown browser") + " on " + firstMatch(userAgent, platforms, "unknown platform")
+}
+
+type uaPattern struct {
+	token string
+	name  string
+}
+
+// Order matters: Edge and Opera also announce Chrome, Chrome also announces Safari,
+// and Android and iOS also announce Linux and Mac OS X.
+var browsers = []uaPattern{
+	{"Edg/", "Edge"},
+	{"OPR/", "Opera"},
+	{"Firefox/", "Firefox"},
+	{"Chrome/", "Chrome"},
+	{"CriOS/", "Chrome"},
+	{"Safari/", "Safari"},
+	{"curl/", "curl"},
+	{"PostmanRuntime/", "Postman"},
+	{"okhttp/", "Android app"},
+}
+
+var platforms = []uaPattern{
+	{"Android", "Android"},
+	{"iPhone", "iPhone"},
+	{"iPad", "iPad"},
+	{"Windows", "Windows"},
+	{"Mac OS X", "macOS"},
+	{"CrOS", "ChromeOS"},
+	{"Linux", "Linux"},
+}
+
+func firstMatch(userAgent string, patterns []uaPattern, fallback string) string {
+	for _, p := range patterns {
+		if strings.Contains(userAgent, p.token) {
+			return p.name
+		}
+	}
+	return fallback
+}
@@ -4,7 +4,6 @@ go 1.23.0
 
 require (
 	github.com/Azure/azure-storage-blob-go v0.15.0
-	github.com/golang-jwt/jwt v3.2.2+incompatible
 	github.com/google/uuid v1.6.0
 	github.com/joho/godotenv v1.5.1
 	github.com/labstack/echo/v4 v4.12.0
@@ -12,7 +11,10 @@ require (
 	github.com/microsoft/go-mssqldb v1.7.2
 )
 
+require github.com/golang-jwt/jwt v3.2.2+incompatible // indirect
+
 require (
+	eoncohub.com/shared_module v0.0.0
 	github.com/Azure/azure-pipeline-go v0.2.3 // indirect
 	github.com/Azure/azure-sdk-for-go/sdk/azcore v1.14.0 // indirect
 	github.com/Azure/azure-sdk-for-go/sdk/azidentity v1.7.0 // indirect
@@ -32,3 +34,5 @@ require (
 	golang.org/x/text v0.16.0 // indirect
 	golang.org/x/time v0.5.0 // indirect
 )
+
+replace eoncohub.com/shared_module => ../Shared_Module
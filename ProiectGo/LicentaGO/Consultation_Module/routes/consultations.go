@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"eoncohub.com/consulation_module/models"
 	"eoncohub.com/consulation_module/utils"
+	"eoncohub.com/shared_module/auth"
 	"fmt"
 	"github.com/labstack/echo/v4"
 	"log"
@@ -14,13 +15,15 @@ import (
 const maxUploadSize = 10 << 20 // 10 MB
 
 func getConsultation(c echo.Context) error {
-	idDoctorString := c.Get("user").(string)
+	idDoctor, err := auth.DoctorHospitalID(c)
+	if err != nil {
+		return c.JSON(http.StatusForbidden, map[string]string{"error": err.Error()})
+	}
 
 	// get idPatient from url
 	idPatientString := c.Param("id")
 	idPatient, err := strconv.ParseInt(idPatientString, 10, 64)
 
-	idDoctor, err := strconv.ParseInt(idDoctorString, 10, 64)
 	consultation, err := models.GetLastConsultation(idDoctor, idPatient)
 	if err != nil {
 		return c.JSON(http.StatusInternalServerError, map[string]any{
@@ -31,12 +34,14 @@ func getConsultation(c echo.Context) error {
 }
 
 func getAllConsultations(c echo.Context) error {
-	idDoctorString := c.Get("user").(string)
+	idDoctor, err := auth.DoctorHospitalID(c)
+	if err != nil {
+		return c.JSON(http.StatusForbidden, map[string]string{"error": err.Error()})
+	}
 
 	idPatientString := c.Param("id")
 	idPatient, err := strconv.ParseInt(idPatientString, 10, 64)
 
-	idDoctor, err := strconv.ParseInt(idDoctorString, 10, 64)
 	consultations, err := models.GetAllConsultations(idDoctor, idPatient)
 	if err != nil {
 		return c.JSON(http.StatusInternalServerError, map[string]any{
@@ -173,9 +178,10 @@ func createConsultation(c echo.Context) error {
 	}
 	consultationRequest.BloodUrl = URL
 
-	idDoctorString := c.Get("user").(string)
-
-	idDoctor, err := strconv.ParseInt(idDoctorString, 10, 64)
+	idDoctor, err := auth.DoctorHospitalID(c)
+	if err != nil {
+		return c.JSON(http.StatusForbidden, map[string]string{"error": err.Error()})
+	}
 	idAppointment, err := consultationRequest.CreateConsultation(idDoctor)
 	if err != nil {
 		return c.JSON(http.StatusInternalServerError, map[string]any{
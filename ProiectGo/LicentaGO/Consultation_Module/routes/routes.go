@@ -1,14 +1,18 @@
 package routes
 
 import (
-	"eoncohub.com/consulation_module/middleware"
+	"eoncohub.com/consulation_module/db"
+	"eoncohub.com/shared_module/auth"
 	"github.com/labstack/echo/v4"
 )
 
 func RegisterRoutes(server *echo.Echo) {
+	clinicalStaff := auth.RequireRoles(auth.RoleDoctor, auth.RoleNurse)
+	doctorsOnly := auth.RequireRoles(auth.RoleDoctor)
+
 	protected := server.Group("/api")
-	protected.Use(middleware.JWTMiddleware)
-	protected.POST("/create", createConsultation)
-	protected.GET("/:id/get-last", getConsultation)
-	protected.GET("/:id/get-all", getAllConsultations)
+	protected.Use(auth.JWTMiddleware(auth.Config{Sessions: auth.SQLSessionChecker(db.DB)}))
+	protected.POST("/create", createConsultation, doctorsOnly)
+	protected.GET("/:id/get-last", getConsultation, clinicalStaff)
+	protected.GET("/:id/get-all", getAllConsultations, clinicalStaff)
 }
@@ -0,0 +1,101 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"eoncohub.com/doctor_module/db"
+)
+
+var (
+	ErrDoctorNotFound   = errors.New("doctor not found")
+	ErrDoctorExists     = errors.New("the person is already a doctor")
+	ErrHospitalNotFound = errors.New("hospital not found")
+	ErrPersonNotFound   = errors.New("no person with this ID and CNP")
+)
+
+type AffiliationReq struct {
+	IDPerson int64  `json:"id_person"`
+	Hospital string `json:"hospital"`
+}
+
+type AffiliationStatusReq struct {
+	IDPerson   int64 `json:"id_person"`
+	IDHospital int64 `json:"id_hospital"`
+	Active     bool  `json:"active"`
+}
+
+// AddAffiliation records an existing doctor at another hospital and returns the
+// DOCTORS_AND_HOSPITALS row. The row starts inactive: Auth_Module activates it with
+// SetAffiliationActive once a hospital admin approves the doctor there. Asking again for
+// the same hospital returns the existing row as it is.
+func AddAffiliation(req AffiliationReq) (int64, error) {
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var idDoctor int64
+	err = tx.QueryRow(`SELECT ID_DOCTOR FROM XXPerson.DOCTORS WHERE ID_PERSON = @p1 AND ISDELETED = 0`,
+		sql.Named("p1", req.IDPerson)).Scan(&idDoctor)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, ErrDoctorNotFound
+		}
+		return 0, fmt.Errorf("failed to retrieve doctor: %w", err)
+	}
+
+	var hospitalID int64
+	err = tx.QueryRow("SELECT ID_HOSPITAL FROM XXPerson.HOSPITALS WHERE UPPER(NAME) = UPPER(@p1)",
+		sql.Named("p1", req.Hospital)).Scan(&hospitalID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, ErrHospitalNotFound
+		}
+		return 0, fmt.Errorf("failed to retrieve hospital: %w", err)
+	}
+
+	var idDoctorHospital int64
+	err = tx.QueryRow(`
+        SELECT ID_DOCTOR_HOSPITAL
+        FROM XXPerson.DOCTORS_AND_HOSPITALS WITH (UPDLOCK, HOLDLOCK)
+        WHERE ID_DOCTOR = @p1 AND ID_HOSPITAL = @p2
+    `, sql.Named("p1", idDoctor), sql.Named("p2", hospitalID)).Scan(&idDoctorHospital)
+	if errors.Is(err, sql.ErrNoRows) {
+		err = tx.QueryRow(`
+            INSERT INTO XXPerson.DOCTORS_AND_HOSPITALS (ID_DOCTOR, ID_HOSPITAL, IS_ACTIVE)
+            OUTPUT INSERTED.ID_DOCTOR_HOSPITAL
+            VALUES (@p1, @p2, 0)
+        `, sql.Named("p1", idDoctor), sql.Named("p2", hospitalID)).Scan(&idDoctorHospital)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to record affiliation: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return idDoctorHospital, nil
+}
+
+// SetAffiliationActive activates or ends the affiliation of a doctor at a hospital,
+// following the decision on the doctor role there. Setting the current value again is
+// not an error.
+func SetAffiliationActive(req AffiliationStatusReq) error {
+	result, err := db.DB.Exec(`
+        UPDATE dh
+        SET IS_ACTIVE = @p3
+        FROM XXPerson.DOCTORS_AND_HOSPITALS dh
+        JOIN XXPerson.DOCTORS d ON d.ID_DOCTOR = dh.ID_DOCTOR
+        WHERE d.ID_PERSON = @p1 AND d.ISDELETED = 0 AND dh.ID_HOSPITAL = @p2
+    `, sql.Named("p1", req.IDPerson), sql.Named("p2", req.IDHospital), sql.Named("p3", req.Active))
+	if err != nil {
+		return fmt.Errorf("failed to update affiliation: %w", err)
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return ErrDoctorNotFound
+	}
+	return nil
+}
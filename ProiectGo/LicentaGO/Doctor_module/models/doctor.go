@@ -16,6 +16,9 @@ import (
 
 	"eoncohub.com/doctor_module/db"
 	"eoncohub.com/doctor_module/utils"
+	"eoncohub.com/shared_module/auth"
+	"eoncohub.com/shared_module/person"
+	"eoncohub.com/shared_module/pii"
 )
 
 type Person struct {
@@ -27,6 +30,7 @@ type Person struct {
 	BornDate       time.Time      `json:"born_date"`
 	Address        Address        `json:"address"`
 	VirtualAddress VirtualAddress `json:"virtual_address"`
+	AllowSimilar   bool           `json:"allow_similar,omitempty"`
 }
 
 type VirtualAddress struct {
@@ -80,7 +84,22 @@ func removeEmptyFields(input interface{}) (map[string]interface{}, error) {
 
 // !!! Azure specific code!!!
 
+// CreateDoctor creates the person and the doctor at its hospital. With Person.IDPerson
+// set, the existing person with that ID and CNP becomes the doctor instead, as
+// Person_Module reports for a CNP it already knows.
 func (doctor *Doctor) CreateDoctor() (int, error) {
+	if doctor.Person.IDPerson != 0 {
+		ok, err := person.HasCNP(db.DB, doctor.Person.IDPerson, doctor.Person.CNP)
+		if err != nil {
+			return 0, err
+		}
+		if !ok {
+			return 0, ErrPersonNotFound
+		}
+		// The person is not ours to delete when the doctor cannot be stored.
+		return doctor.insertDoctor()
+	}
+
 	// Marshal the person data into JSON
 	requestBody, err := json.Marshal(doctor.Person)
 	if err != nil {
@@ -90,7 +109,11 @@ func (doctor *Doctor) CreateDoctor() (int, error) {
 	log.Printf("CreateDoctor Called - Request Body: %s", string(requestBody))
 
 	// Call the create person endpoint
-	resp, err := http.Post("http://person_module:8080/create", "application/json", bytes.NewBuffer(requestBody))
+	req, err := newPersonRequest(http.MethodPost, "http://person_module:8080/create", bytes.NewBuffer(requestBody))
+	if err != nil {
+		return 0, err
+	}
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
 		return 0, fmt.Errorf("failed to call create person endpoint: %w", err)
 	}
@@ -98,6 +121,9 @@ func (doctor *Doctor) CreateDoctor() (int, error) {
 
 	if resp.StatusCode != http.StatusOK {
 		bodyBytes, _ := io.ReadAll(resp.Body)
+		if person.Rejected(resp.StatusCode) {
+			return 0, &person.RejectedError{Status: resp.StatusCode, Body: bodyBytes}
+		}
 		return 0, fmt.Errorf("failed to create person, status code: %d, body: %s", resp.StatusCode, string(bodyBytes))
 	}
 
@@ -105,7 +131,22 @@ func (doctor *Doctor) CreateDoctor() (int, error) {
 	if err := json.NewDecoder(resp.Body).Decode(&personResponse); err != nil {
 		return 0, fmt.Errorf("failed to decode person response: %w", err)
 	}
+	doctor.Person.IDPerson = int64(personResponse.IDPerson)
+
+	newID, err := doctor.insertDoctor()
+	if err != nil {
+		// The person was created first; remove it so a failed creation leaves nothing behind.
+		if delErr := deletePerson(doctor.Person.IDPerson); delErr != nil {
+			log.Printf("CreateDoctor: failed to roll back person %d: %v", doctor.Person.IDPerson, delErr)
+		}
+		return 0, err
+	}
+	return newID, nil
+}
 
+// insertDoctor stores the doctor of an already created person at its hospital and
+// returns the DOCTORS_AND_HOSPITALS row.
+func (doctor *Doctor) insertDoctor() (int, error) {
 	// Begin transaction
 	tx, err := db.DB.Begin()
 	if err != nil {
@@ -113,13 +154,28 @@ func (doctor *Doctor) CreateDoctor() (int, error) {
 	}
 	defer tx.Rollback() // Rollback if not committed
 
+	// A person is a doctor once, whatever the number of hospitals
+	var exists bool
+	err = tx.QueryRow(`
+		SELECT CASE WHEN EXISTS (
+			SELECT 1 FROM XXPerson.DOCTORS WITH (UPDLOCK, HOLDLOCK)
+			WHERE ID_PERSON = @p1 AND ISDELETED = 0
+		) THEN 1 ELSE 0 END
+	`, sql.Named("p1", doctor.Person.IDPerson)).Scan(&exists)
+	if err != nil {
+		return 0, fmt.Errorf("failed to check existing doctor: %w", err)
+	}
+	if exists {
+		return 0, ErrDoctorExists
+	}
+
 	// Insert the doctor into the DOCTORS table and get the new ID using OUTPUT clause
 	query := `
         INSERT INTO XXPerson.DOCTORS (ID_PERSON, PARAFA) 
         OUTPUT INSERTED.ID_DOCTOR 
         VALUES (@p1, @p2)
     `
-	err = tx.QueryRow(query, sql.Named("p1", personResponse.IDPerson), sql.Named("p2", doctor.Parafa)).Scan(&doctor.IDDoctor)
+	err = tx.QueryRow(query, sql.Named("p1", doctor.Person.IDPerson), sql.Named("p2", doctor.Parafa)).Scan(&doctor.IDDoctor)
 	if err != nil {
 		return 0, fmt.Errorf("failed to insert doctor: %w", err)
 	}
@@ -129,7 +185,7 @@ func (doctor *Doctor) CreateDoctor() (int, error) {
 	err = tx.QueryRow("SELECT ID_HOSPITAL FROM XXPerson.HOSPITALS WHERE UPPER(NAME) = UPPER(@p1)", sql.Named("p1", doctor.Hospital)).Scan(&hospitalID)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
-			return 0, fmt.Errorf("hospital not found: %s", doctor.Hospital)
+			return 0, fmt.Errorf("%w: %s", ErrHospitalNotFound, doctor.Hospital)
 		}
 		return 0, fmt.Errorf("failed to retrieve hospital: %w", err)
 	}
@@ -208,6 +264,10 @@ func (doctor *Doctor) GetDoctorByID(idDoctorHospital int64) (DoctorResponse, err
 	if err != nil {
 		return DoctorResponse{}, fmt.Errorf("failed to retrieve doctor: %w", err)
 	}
+	p := &doctorResponse.Person
+	if err := pii.DecryptPerson(&p.CNP, &p.VirtualAddress.Email, &p.VirtualAddress.PhoneNumber, &p.Address.Address); err != nil {
+		return DoctorResponse{}, err
+	}
 
 	return doctorResponse, nil
 }
@@ -259,11 +319,10 @@ func (doctor *Doctor) UpdateDoctor(idDoctorHospital int64) error {
 		}
 
 		url := fmt.Sprintf("http://person_module:8080/%d", doctor.Person.IDPerson)
-		req, err := http.NewRequest(http.MethodPut, url, bytes.NewBuffer(requestBody))
+		req, err := newPersonRequest(http.MethodPut, url, bytes.NewBuffer(requestBody))
 		if err != nil {
-			return fmt.Errorf("failed to create HTTP request: %w", err)
+			return err
 		}
-		req.Header.Set("Content-Type", "application/json")
 
 		start = time.Now()
 		client := &http.Client{Timeout: 3 * time.Second}
@@ -317,3 +376,76 @@ func SoftDeleteDoctor(idDoctorHospital int64) error {
 
 	return nil
 }
+
+// DiscardDoctor removes a doctor whose registration was abandoned in Auth_Module. The
+// hospital row is deleted, and the doctor itself once it has no hospital left; the
+// person stays for the caller to delete. Unlike SoftDeleteDoctor nothing is kept,
+// because nothing can reference a doctor that never got an account.
+func DiscardDoctor(idDoctorHospital int64) error {
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var idDoctor int64
+	err = tx.QueryRow(`
+        DELETE FROM XXPerson.DOCTORS_AND_HOSPITALS
+        OUTPUT DELETED.ID_DOCTOR
+        WHERE ID_DOCTOR_HOSPITAL = @p1
+    `, sql.Named("p1", idDoctorHospital)).Scan(&idDoctor)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrDoctorNotFound
+		}
+		return fmt.Errorf("failed to delete doctor hospital: %w", err)
+	}
+
+	_, err = tx.Exec(`
+        DELETE FROM XXPerson.DOCTORS
+        WHERE ID_DOCTOR = @p1
+          AND NOT EXISTS (SELECT 1 FROM XXPerson.DOCTORS_AND_HOSPITALS WHERE ID_DOCTOR = @p1)
+    `, sql.Named("p1", idDoctor))
+	if err != nil {
+		return fmt.Errorf("failed to delete doctor: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+// deletePerson removes a person through Person_Module. A person that is already gone
+// counts as deleted.
+func deletePerson(idPerson int64) error {
+	req, err := newPersonRequest(http.MethodDelete, fmt.Sprintf("http://person_module:8080/%d", idPerson), nil)
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Timeout: 3 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to call delete person endpoint: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotFound {
+		bodyBytes, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("failed to delete person, status code: %d, body: %s", resp.StatusCode, string(bodyBytes))
+	}
+	return nil
+}
+
+// newPersonRequest builds a call to Person_Module carrying this module's service token.
+func newPersonRequest(method, url string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create HTTP request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if err := auth.SignServiceRequest(req, auth.ServiceDoctor, auth.ServicePerson); err != nil {
+		return nil, err
+	}
+	return req, nil
+}
@@ -1,11 +1,14 @@
 package routes
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
 	"strconv"
 
 	"eoncohub.com/doctor_module/models"
+	"eoncohub.com/shared_module/auth"
+	"eoncohub.com/shared_module/person"
 	"github.com/labstack/echo/v4"
 )
 
@@ -19,19 +22,86 @@ func createDoctor(context echo.Context) error {
 	idDoctor, err := doctor.CreateDoctor()
 
 	if err != nil {
+		if errors.Is(err, models.ErrHospitalNotFound) || errors.Is(err, models.ErrPersonNotFound) {
+			return context.JSON(http.StatusNotFound, map[string]string{"error": err.Error()})
+		}
+		if errors.Is(err, models.ErrDoctorExists) {
+			return context.JSON(http.StatusConflict, map[string]string{"error": err.Error()})
+		}
+		// A duplicate only tells whether the person exists, with the ID to attach for the
+		// same CNP; other people's details are not shown to the caller.
+		var rejected *person.RejectedError
+		if errors.As(err, &rejected) {
+			return context.JSON(rejected.Summary(true))
+		}
 		return context.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
 	}
-	return context.JSON(http.StatusOK, map[string]any{"message": "Doctor created successfully", "id": idDoctor})
+	return context.JSON(http.StatusOK, map[string]any{
+		"message":   "Doctor created successfully",
+		"id":        idDoctor,
+		"id_person": doctor.Person.IDPerson,
+	})
 }
 
-func getDoctorV2Handler(context echo.Context) error {
-	idStr := context.Get("user").(string)
-	fmt.Println("User inside request: ", idStr)
-	idDoctorHospital, err := strconv.ParseInt(idStr, 10, 64)
+// addAffiliation records a registered doctor at another hospital. Called by Auth_Module.
+func addAffiliation(context echo.Context) error {
+	var req models.AffiliationReq
+	if err := context.Bind(&req); err != nil || req.IDPerson == 0 || req.Hospital == "" {
+		return context.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request"})
+	}
+
+	idDoctorHospital, err := models.AddAffiliation(req)
+	if err != nil {
+		if errors.Is(err, models.ErrDoctorNotFound) || errors.Is(err, models.ErrHospitalNotFound) {
+			return context.JSON(http.StatusNotFound, map[string]string{"error": err.Error()})
+		}
+		return context.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+
+	return context.JSON(http.StatusOK, map[string]any{"id_doctor_hospital": idDoctorHospital})
+}
+
+// setAffiliationStatus activates or ends an affiliation once the doctor role at the
+// hospital is approved or rejected. Called by Auth_Module.
+func setAffiliationStatus(context echo.Context) error {
+	var req models.AffiliationStatusReq
+	if err := context.Bind(&req); err != nil || req.IDPerson == 0 || req.IDHospital == 0 {
+		return context.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request"})
+	}
+
+	if err := models.SetAffiliationActive(req); err != nil {
+		if errors.Is(err, models.ErrDoctorNotFound) {
+			return context.JSON(http.StatusNotFound, map[string]string{"error": err.Error()})
+		}
+		return context.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+
+	return context.JSON(http.StatusOK, map[string]string{"message": "Affiliation updated"})
+}
+
+// discardDoctor undoes /create for a registration Auth_Module abandoned. Called by Auth_Module.
+func discardDoctor(context echo.Context) error {
+	idDoctorHospital, err := strconv.ParseInt(context.Param("id"), 10, 64)
 	if err != nil {
 		return context.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid doctor hospital ID"})
 	}
 
+	if err := models.DiscardDoctor(idDoctorHospital); err != nil {
+		if errors.Is(err, models.ErrDoctorNotFound) {
+			return context.JSON(http.StatusNotFound, map[string]string{"error": err.Error()})
+		}
+		return context.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+
+	return context.JSON(http.StatusOK, map[string]string{"message": "Doctor discarded"})
+}
+
+func getDoctorV2Handler(context echo.Context) error {
+	idDoctorHospital, err := auth.DoctorHospitalID(context)
+	if err != nil {
+		return context.JSON(http.StatusForbidden, map[string]string{"error": err.Error()})
+	}
+
 	var doctor models.Doctor
 	doctorResponse, err := doctor.GetDoctorByID(idDoctorHospital)
 	if err != nil {
@@ -50,10 +120,9 @@ func updateDoctor(context echo.Context) error {
 
 	fmt.Printf("Ce am primit: %+v\n", doctor)
 
-	idDoctorHospitalStr := context.Get("user").(string)
-	idDoctorHospital, err := strconv.ParseInt(idDoctorHospitalStr, 10, 64)
+	idDoctorHospital, err := auth.DoctorHospitalID(context)
 	if err != nil {
-		return context.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid doctor hospital ID"})
+		return context.JSON(http.StatusForbidden, map[string]string{"error": err.Error()})
 	}
 
 	err = doctor.UpdateDoctor(idDoctorHospital)
@@ -66,7 +135,10 @@ func updateDoctor(context echo.Context) error {
 
 func softDeleteDoctor(context echo.Context) error {
 	// Parse the doctor hospital ID from the URL
-	idDoctorHospitalStr := context.Get("id").(string)
+	idDoctorHospitalStr := context.Param("id")
+	if idDoctorHospitalStr == "" {
+		idDoctorHospitalStr = context.QueryParam("id")
+	}
 	idDoctorHospital, err := strconv.ParseInt(idDoctorHospitalStr, 10, 64)
 	if err != nil {
 		return context.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid doctor hospital ID"})
@@ -1,18 +1,27 @@
 package routes
 
 import (
-	"eoncohub.com/doctor_module/middleware"
+	"eoncohub.com/doctor_module/db"
+	"eoncohub.com/shared_module/auth"
 	"github.com/labstack/echo/v4"
 )
 
 func RegisterRoutes(server *echo.Echo) {
-	// These routes will be accessible without the /api prefix
-	server.POST("/create", createDoctor)
+	doctorsOnly := auth.RequireRoles(auth.RoleDoctor)
+	admins := auth.RequireRoles(auth.RoleHospitalAdmin, auth.RolePlatformAdmin)
+
+	// Called by Auth_Module for doctor registration, its compensation and hospital affiliations
+	server.POST("/create", createDoctor, auth.RequireService(auth.ServiceDoctor, auth.ServiceAuth))
+	server.DELETE("/:id", discardDoctor, auth.RequireService(auth.ServiceDoctor, auth.ServiceAuth))
+	server.POST("/affiliations", addAffiliation, auth.RequireService(auth.ServiceDoctor, auth.ServiceAuth))
+	server.PUT("/affiliations", setAffiliationStatus, auth.RequireService(auth.ServiceDoctor, auth.ServiceAuth))
 
 	// This route will be accessible with the /api prefix
 	protected := server.Group("/api")
-	protected.Use(middleware.JWTMiddleware)
-	protected.GET("/doctor", getDoctorV2Handler)
-	protected.PUT("/doctor/update", updateDoctor)
-	protected.DELETE("/doctor/delete", softDeleteDoctor)
+	protected.Use(auth.JWTMiddleware(auth.Config{Sessions: auth.SQLSessionChecker(db.DB)}))
+	protected.GET("/doctor", getDoctorV2Handler, doctorsOnly)
+	protected.PUT("/doctor/update", updateDoctor, doctorsOnly)
+	// The ID goes in the path; the original route takes it as ?id= and is kept for existing callers
+	protected.DELETE("/doctor/delete/:id", softDeleteDoctor, admins)
+	protected.DELETE("/doctor/delete", softDeleteDoctor, admins)
 }
@@ -1,14 +1,14 @@
 module eoncohub.com/patient_module
 
-go 1.22.5
+go 1.23.0
 
 require (
-	github.com/golang-jwt/jwt v3.2.2+incompatible
 	github.com/joho/godotenv v1.5.1
 	github.com/labstack/gommon v0.4.2
 )
 
 require (
+	github.com/golang-jwt/jwt v3.2.2+incompatible // indirect
 	github.com/golang-sql/civil v0.0.0-20220223132316-b832511892a9 // indirect
 	github.com/golang-sql/sqlexp v0.1.0 // indirect
 	golang.org/x/crypto v0.22.0 // indirect
@@ -18,6 +18,7 @@ require (
 )
 
 require (
+	eoncohub.com/shared_module v0.0.0
 	github.com/labstack/echo/v4 v4.12.0
 	github.com/mattn/go-colorable v0.1.13 // indirect
 	github.com/mattn/go-isatty v0.0.20 // indirect
@@ -26,3 +27,5 @@ require (
 	github.com/valyala/fasttemplate v1.2.2 // indirect
 	golang.org/x/sys v0.19.0 // indirect
 )
+
+replace eoncohub.com/shared_module => ../Shared_Module
@@ -6,6 +6,8 @@ import (
 
 	"eoncohub.com/patient_module/db"
 	"eoncohub.com/patient_module/routes"
+	"eoncohub.com/shared_module/auth"
+	"eoncohub.com/shared_module/pii"
 	"github.com/joho/godotenv"
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
@@ -18,6 +20,9 @@ func main() {
 	if err != nil {
 		log.Fatalf("Error loading .env file: %v", err)
 	}
+	if err := pii.Check(); err != nil {
+		log.Fatalf("Encryption keys: %v", err)
+	}
 
 	err = db.InitDB()
 	if err != nil {
@@ -27,11 +32,16 @@ func main() {
 
 	// Start the server
 	e := echo.New()
+	ipExtractor, err := auth.IPExtractor()
+	if err != nil {
+		log.Fatalf("Error configuring client IPs: %v", err)
+	}
+	e.IPExtractor = ipExtractor
 	e.Use(middleware.Logger())
 	e.Use(middleware.Recover())
 	e.Use(middleware.CORSWithConfig(middleware.CORSConfig{
 		AllowOrigins:     []string{"http://localhost:3000"},
-		AllowHeaders:     []string{echo.HeaderOrigin, echo.HeaderContentType, echo.HeaderAccept},
+		AllowHeaders:     []string{echo.HeaderOrigin, echo.HeaderContentType, echo.HeaderAccept, echo.HeaderAuthorization, auth.CSRFHeader},
 		AllowMethods:     []string{http.MethodGet, http.MethodHead, http.MethodPut, http.MethodPatch, http.MethodPost, http.MethodDelete},
 		AllowCredentials: true,
 	}))
@@ -0,0 +1,285 @@
+package models
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"eoncohub.com/patient_module/db"
+	"eoncohub.com/patient_module/utils"
+	"eoncohub.com/shared_module/auth"
+)
+
+var (
+	ErrPatientNotFound     = errors.New("patient not found")
+	ErrPatientLinked       = errors.New("patient is already linked to this doctor")
+	ErrBreakGlassNotFound  = errors.New("emergency access not found")
+	ErrBreakGlassReviewed  = errors.New("emergency access has already been reviewed")
+	ErrBreakGlassNotLogged = errors.New("emergency access could not be recorded, try again")
+)
+
+// BreakGlassTTL is how long an emergency access to a patient record lasts.
+func BreakGlassTTL() time.Duration {
+	return utils.DurationFromEnv("BREAK_GLASS_TTL", time.Hour)
+}
+
+// BreakGlassAccess is a time-limited read access to a patient a doctor is not linked to,
+// kept for review by the hospital admins.
+type BreakGlassAccess struct {
+	IDAccess         int64      `json:"id_access"`
+	IDPatient        int64      `json:"id_patient"`
+	IDDoctorHospital int64      `json:"id_doctor_hospital"`
+	IDUser           int64      `json:"id_user"`
+	IDHospital       int64      `json:"id_hospital"`
+	Justification    string     `json:"justification"`
+	GrantedAt        time.Time  `json:"granted_at"`
+	ExpiresAt        time.Time  `json:"expires_at"`
+	UseCount         int        `json:"use_count"`
+	LastUsedAt       *time.Time `json:"last_used_at,omitempty"`
+	ReviewedAt       *time.Time `json:"reviewed_at,omitempty"`
+	ReviewedBy       int64      `json:"reviewed_by,omitempty"`
+	ReviewNote       string     `json:"review_note,omitempty"`
+}
+
+// GrantBreakGlass gives a doctor read access to a patient they are not linked to, for
+// BreakGlassTTL. Only patients of the doctor's hospital, linked there to any doctor, can
+// be opened, so the grant is kept under a hospital whose admins are responsible for the
+// patient. The grant is stored inactive and only activated once Auth_Module has audited
+// it and notified the patient's doctors and the hospital admins, so an access that was
+// not audited never opens the record, whatever fails afterwards.
+func GrantBreakGlass(idPatient, idDoctorHospital, userID int64, justification, ip, userAgent string) (BreakGlassAccess, error) {
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return BreakGlassAccess{}, fmt.Errorf("start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var linked bool
+	err = tx.QueryRow(`
+		SELECT CASE WHEN EXISTS (
+			SELECT 1 FROM XXPerson.PATIENTS_AND_DOCTORS
+			WHERE ID_PATIENT = P.ID_PATIENT AND ID_DOCTOR_HOSPITAL = @p2
+		) THEN 1 ELSE 0 END
+		FROM XXPerson.PATIENTS P
+		WHERE P.ID_PATIENT = @p1 AND P.ISDELETED = 0
+		  AND EXISTS (
+			SELECT 1
+			FROM XXPerson.PATIENTS_AND_DOCTORS PD
+			JOIN XXPerson.DOCTORS_AND_HOSPITALS PDH ON PDH.ID_DOCTOR_HOSPITAL = PD.ID_DOCTOR_HOSPITAL
+			JOIN XXPerson.DOCTORS_AND_HOSPITALS DH ON DH.ID_HOSPITAL = PDH.ID_HOSPITAL
+			WHERE PD.ID_PATIENT = P.ID_PATIENT AND DH.ID_DOCTOR_HOSPITAL = @p2
+		  )
+	`, sql.Named("p1", idPatient), sql.Named("p2", idDoctorHospital)).Scan(&linked)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return BreakGlassAccess{}, ErrPatientNotFound
+		}
+		return BreakGlassAccess{}, fmt.Errorf("query patient: %w", err)
+	}
+	if linked {
+		return BreakGlassAccess{}, ErrPatientLinked
+	}
+
+	access := BreakGlassAccess{
+		IDPatient:        idPatient,
+		IDDoctorHospital: idDoctorHospital,
+		IDUser:           userID,
+		Justification:    justification,
+	}
+	err = tx.QueryRow(`
+		INSERT INTO XXPerson.BREAK_GLASS_ACCESS (ID_PATIENT, ID_DOCTOR_HOSPITAL, ID_USER, ID_HOSPITAL, JUSTIFICATION, EXPIRES_AT)
+		OUTPUT INSERTED.ID_ACCESS, INSERTED.ID_HOSPITAL, INSERTED.GRANTED_AT, INSERTED.EXPIRES_AT
+		SELECT @p1, @p2, @p3, DH.ID_HOSPITAL, @p4, DATEADD(SECOND, @p5, SYSUTCDATETIME())
+		FROM XXPerson.DOCTORS_AND_HOSPITALS DH
+		WHERE DH.ID_DOCTOR_HOSPITAL = @p2
+	`,
+		sql.Named("p1", idPatient),
+		sql.Named("p2", idDoctorHospital),
+		sql.Named("p3", userID),
+		sql.Named("p4", justification),
+		sql.Named("p5", int64(BreakGlassTTL().Seconds())),
+	).Scan(&access.IDAccess, &access.IDHospital, &access.GrantedAt, &access.ExpiresAt)
+	if err != nil {
+		return BreakGlassAccess{}, fmt.Errorf("insert break-glass access: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return BreakGlassAccess{}, fmt.Errorf("commit transaction: %w", err)
+	}
+
+	if err := notifyBreakGlass(access, ip, userAgent); err != nil {
+		// The inactive grant gives no access; removing it only keeps the table tidy.
+		if _, delErr := db.DB.Exec(`DELETE FROM XXPerson.BREAK_GLASS_ACCESS WHERE ID_ACCESS = @p1 AND ACTIVATED_AT IS NULL`,
+			sql.Named("p1", access.IDAccess)); delErr != nil {
+			return BreakGlassAccess{}, fmt.Errorf("%w: %v; remove inactive access %d: %v", ErrBreakGlassNotLogged, err, access.IDAccess, delErr)
+		}
+		return BreakGlassAccess{}, fmt.Errorf("%w: %v", ErrBreakGlassNotLogged, err)
+	}
+
+	_, err = db.DB.Exec(`
+		UPDATE XXPerson.BREAK_GLASS_ACCESS SET ACTIVATED_AT = SYSUTCDATETIME() WHERE ID_ACCESS = @p1
+	`, sql.Named("p1", access.IDAccess))
+	if err != nil {
+		return BreakGlassAccess{}, fmt.Errorf("activate break-glass access %d: %w", access.IDAccess, err)
+	}
+	return access, nil
+}
+
+// notifyBreakGlass has Auth_Module write the audit entry and email the people
+// responsible for the patient.
+func notifyBreakGlass(access BreakGlassAccess, ip, userAgent string) error {
+	payload, err := json.Marshal(map[string]any{
+		"id_access":          access.IDAccess,
+		"id_patient":         access.IDPatient,
+		"id_doctor_hospital": access.IDDoctorHospital,
+		"id_user":            access.IDUser,
+		"justification":      access.Justification,
+		"expires_at":         access.ExpiresAt,
+		"ip":                 ip,
+		"user_agent":         userAgent,
+	})
+	if err != nil {
+		return fmt.Errorf("marshal break-glass notice: %w", err)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, "http://auth_module:8082/break-glass", bytes.NewBuffer(payload))
+	if err != nil {
+		return fmt.Errorf("failed to create HTTP request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if err := auth.SignServiceRequest(req, auth.ServicePatient, auth.ServiceAuth); err != nil {
+		return err
+	}
+
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("call auth module: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		bodyBytes, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("auth module returned status %d: %s", resp.StatusCode, string(bodyBytes))
+	}
+	return nil
+}
+
+// recordBreakGlassUse counts a read made under the doctor's emergency access, for review.
+func recordBreakGlassUse(idPatient, idDoctorHospital int64) error {
+	_, err := db.DB.Exec(`
+		UPDATE XXPerson.BREAK_GLASS_ACCESS
+		SET USE_COUNT = USE_COUNT + 1, LAST_USED_AT = SYSUTCDATETIME()
+		WHERE ID_PATIENT = @p1 AND ID_DOCTOR_HOSPITAL = @p2 AND ACTIVATED_AT IS NOT NULL AND EXPIRES_AT > SYSUTCDATETIME()
+	`, sql.Named("p1", idPatient), sql.Named("p2", idDoctorHospital))
+	if err != nil {
+		return fmt.Errorf("update break-glass access: %w", err)
+	}
+	return nil
+}
+
+const breakGlassColumns = `
+	ID_ACCESS, ID_PATIENT, ID_DOCTOR_HOSPITAL, ID_USER, ID_HOSPITAL, JUSTIFICATION, GRANTED_AT, EXPIRES_AT,
+	USE_COUNT, LAST_USED_AT, REVIEWED_AT, REVIEWED_BY, REVIEW_NOTE`
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanBreakGlass(row rowScanner) (BreakGlassAccess, error) {
+	var a BreakGlassAccess
+	var lastUsed, reviewedAt sql.NullTime
+	var reviewedBy sql.NullInt64
+	var note sql.NullString
+	err := row.Scan(&a.IDAccess, &a.IDPatient, &a.IDDoctorHospital, &a.IDUser, &a.IDHospital, &a.Justification,
+		&a.GrantedAt, &a.ExpiresAt, &a.UseCount, &lastUsed, &reviewedAt, &reviewedBy, &note)
+	if err != nil {
+		return a, err
+	}
+	if lastUsed.Valid {
+		a.LastUsedAt = &lastUsed.Time
+	}
+	if reviewedAt.Valid {
+		a.ReviewedAt = &reviewedAt.Time
+	}
+	a.ReviewedBy = reviewedBy.Int64
+	a.ReviewNote = note.String
+	return a, nil
+}
+
+// ListBreakGlass returns the emergency accesses granted by doctors of the hospital,
+// newest first. hospitalID zero lists every hospital. Grants not activated yet are left
+// out: they never opened a record.
+func ListBreakGlass(hospitalID int64, unreviewedOnly bool) ([]BreakGlassAccess, error) {
+	rows, err := db.DB.Query(`
+		SELECT `+breakGlassColumns+`
+		FROM XXPerson.BREAK_GLASS_ACCESS
+		WHERE (@p1 = 0 OR ID_HOSPITAL = @p1) AND (@p2 = 0 OR REVIEWED_AT IS NULL) AND ACTIVATED_AT IS NOT NULL
+		ORDER BY GRANTED_AT DESC
+	`, sql.Named("p1", hospitalID), sql.Named("p2", unreviewedOnly))
+	if err != nil {
+		return nil, fmt.Errorf("query break-glass accesses: %w", err)
+	}
+	defer rows.Close()
+
+	accesses := []BreakGlassAccess{}
+	for rows.Next() {
+		a, err := scanBreakGlass(rows)
+		if err != nil {
+			return nil, fmt.Errorf("scan break-glass access: %w", err)
+		}
+		accesses = append(accesses, a)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("iterate break-glass accesses: %w", err)
+	}
+	return accesses, nil
+}
+
+// ReviewBreakGlass records that an admin reviewed an emergency access, with a note.
+func ReviewBreakGlass(hospitalID, idAccess, reviewerID int64, note string) (BreakGlassAccess, error) {
+	a, err := scanBreakGlass(db.DB.QueryRow(`
+		UPDATE XXPerson.BREAK_GLASS_ACCESS
+		SET REVIEWED_AT = SYSUTCDATETIME(), REVIEWED_BY = @p3, REVIEW_NOTE = @p4
+		OUTPUT `+prefixColumns("INSERTED.", breakGlassColumns)+`
+		WHERE ID_ACCESS = @p1 AND (@p2 = 0 OR ID_HOSPITAL = @p2) AND REVIEWED_AT IS NULL AND ACTIVATED_AT IS NOT NULL
+	`,
+		sql.Named("p1", idAccess),
+		sql.Named("p2", hospitalID),
+		sql.Named("p3", reviewerID),
+		sql.Named("p4", sql.NullString{String: note, Valid: note != ""}),
+	))
+	if errors.Is(err, sql.ErrNoRows) {
+		var reviewed bool
+		err := db.DB.QueryRow(`
+			SELECT CASE WHEN REVIEWED_AT IS NULL THEN 0 ELSE 1 END
+			FROM XXPerson.BREAK_GLASS_ACCESS
+			WHERE ID_ACCESS = @p1 AND (@p2 = 0 OR ID_HOSPITAL = @p2) AND ACTIVATED_AT IS NOT NULL
+		`, sql.Named("p1", idAccess), sql.Named("p2", hospitalID)).Scan(&reviewed)
+		if errors.Is(err, sql.ErrNoRows) {
+			return BreakGlassAccess{}, ErrBreakGlassNotFound
+		}
+		if err != nil {
+			return BreakGlassAccess{}, fmt.Errorf("query break-glass access: %w", err)
+		}
+		return BreakGlassAccess{}, ErrBreakGlassReviewed
+	}
+	if err != nil {
+		return BreakGlassAccess{}, fmt.Errorf("review break-glass access: %w", err)
+	}
+	return a, nil
+}
+
+func prefixColumns(prefix, columns string) string {
+	fields := strings.Split(columns, ",")
+	for i, f := range fields {
+		fields[i] = prefix + strings.TrimSpace(f)
+	}
+	return strings.Join(fields, ", ")
+}
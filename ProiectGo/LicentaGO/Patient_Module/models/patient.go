@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
@@ -12,6 +13,9 @@ import (
 	"eoncohub.com/patient_module/utils"
 
 	"eoncohub.com/patient_module/db"
+	"eoncohub.com/shared_module/auth"
+	"eoncohub.com/shared_module/person"
+	"eoncohub.com/shared_module/pii"
 	"github.com/labstack/gommon/log"
 )
 
@@ -24,6 +28,7 @@ type Person struct {
 	Sex            string         `json:"sex"`
 	Address        Address        `json:"address"`
 	VirtualAddress VirtualAddress `json:"virtual_address"`
+	AllowSimilar   bool           `json:"allow_similar,omitempty"`
 }
 
 type VirtualAddress struct {
@@ -41,6 +46,8 @@ type Patient struct {
 }
 type PatientResponse struct {
 	Patient Patient `json:"patient"`
+	// BreakGlassUntil is set when the record is read under an emergency access.
+	BreakGlassUntil *time.Time `json:"break_glass_until,omitempty"`
 }
 
 func rollbackPerson(idPerson int) {
@@ -49,7 +56,7 @@ func rollbackPerson(idPerson int) {
 	}
 
 	url := fmt.Sprintf("http://person_module:8080/%d", idPerson)
-	req, err := http.NewRequest(http.MethodDelete, url, nil)
+	req, err := newPersonRequest(http.MethodDelete, url, nil)
 	if err != nil {
 		log.Warnf("RollbackPerson: failed to build request for ID %d: %v", idPerson, err)
 		return
@@ -72,13 +79,28 @@ func rollbackPerson(idPerson int) {
 	}
 }
 
+// ErrPersonNotFound is returned for an existing person to attach whose ID and CNP do not match.
+var ErrPersonNotFound = errors.New("no person with this ID and CNP")
+
+// CreatePatient creates the person and the patient, linked to the doctor. With
+// Person.IDPerson set, the existing person with that ID and CNP is used instead, as
+// Person_Module reports for a CNP it already knows; a patient that already exists for
+// them is linked to the doctor.
 func (patient *Patient) CreatePatient(doctorID int64) error {
+	if patient.Person.IDPerson != 0 {
+		return patient.attachPerson(doctorID)
+	}
+
 	requestBody, err := json.Marshal(patient.Person)
 	if err != nil {
 		return fmt.Errorf("marshal person request: %w", err)
 	}
 
-	resp, err := http.Post("http://person_module:8080/create", "application/json", bytes.NewBuffer(requestBody))
+	req, err := newPersonRequest(http.MethodPost, "http://person_module:8080/create", bytes.NewBuffer(requestBody))
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
 		return fmt.Errorf("call create person endpoint: %w", err)
 	}
@@ -86,6 +108,9 @@ func (patient *Patient) CreatePatient(doctorID int64) error {
 
 	if resp.StatusCode != http.StatusOK {
 		bodyBytes, _ := io.ReadAll(resp.Body)
+		if person.Rejected(resp.StatusCode) {
+			return &person.RejectedError{Status: resp.StatusCode, Body: bodyBytes}
+		}
 		return fmt.Errorf("create person failed, status: %d, response: %s", resp.StatusCode, string(bodyBytes))
 	}
 
@@ -133,6 +158,66 @@ func (patient *Patient) CreatePatient(doctorID int64) error {
 	return nil
 }
 
+// attachPerson makes the existing person Person.IDPerson a patient of the doctor.
+func (patient *Patient) attachPerson(doctorID int64) error {
+	ok, err := person.HasCNP(db.DB, patient.Person.IDPerson, patient.Person.CNP)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrPersonNotFound
+	}
+
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return fmt.Errorf("start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var idPatient int64
+	var linked bool
+	err = tx.QueryRow(`
+		SELECT P.ID_PATIENT,
+		       CASE WHEN EXISTS (
+		           SELECT 1 FROM XXPerson.PATIENTS_AND_DOCTORS
+		           WHERE ID_PATIENT = P.ID_PATIENT AND ID_DOCTOR_HOSPITAL = @p2
+		       ) THEN 1 ELSE 0 END
+		FROM XXPerson.PATIENTS P WITH (UPDLOCK, HOLDLOCK)
+		WHERE P.ID_PERSON = @p1 AND P.ISDELETED = 0
+	`, sql.Named("p1", patient.Person.IDPerson), sql.Named("p2", doctorID)).Scan(&idPatient, &linked)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		err = tx.QueryRow(`
+			INSERT INTO XXPerson.PATIENTS (ID_PERSON)
+			OUTPUT INSERTED.ID_PATIENT
+			VALUES (@p1)
+		`, sql.Named("p1", patient.Person.IDPerson)).Scan(&idPatient)
+		if err != nil {
+			return fmt.Errorf("insert patient: %w", err)
+		}
+	case err != nil:
+		return fmt.Errorf("query patient: %w", err)
+	case linked:
+		return ErrPatientLinked
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO XXPerson.PATIENTS_AND_DOCTORS (ID_PATIENT, ID_DOCTOR_HOSPITAL, STATUS)
+		VALUES (@p1, @p2, 'ACTIVE')
+	`, sql.Named("p1", idPatient), sql.Named("p2", doctorID))
+	if err != nil {
+		return fmt.Errorf("insert patients_and_doctors: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("commit transaction: %w", err)
+	}
+	patient.IDPatient = idPatient
+
+	log.Infof("Patient attached: ID_PATIENT=%d, ID_PERSON=%d", idPatient, patient.Person.IDPerson)
+	return nil
+}
+
 func (patient *Patient) GetPatientByID(idDoctor, idPatient int64) (PatientResponse, error) {
 	var response PatientResponse
 
@@ -149,7 +234,9 @@ func (patient *Patient) GetPatientByID(idDoctor, idPatient int64) (PatientRespon
             VA.PHONE_NUMBER,
             AD.ADDRESS,
             LOC.NAME AS LOC_NAME,
-            JUD.NAME AS JUD_NAME
+            JUD.NAME AS JUD_NAME,
+            LINK.LINKED,
+            BG.EXPIRES_AT
         FROM 
             XXPerson.PATIENTS P
         JOIN 
@@ -162,12 +249,24 @@ func (patient *Patient) GetPatientByID(idDoctor, idPatient int64) (PatientRespon
             XXPerson.LOC LOC ON AD.ID_LOC = LOC.ID_LOC
         JOIN 
             XXPerson.JUD JUD ON LOC.ID_JUD = JUD.ID_JUD
-        JOIN 
-            XXPerson.PATIENTS_AND_DOCTORS PD ON P.ID_PATIENT = PD.ID_PATIENT
+        CROSS APPLY (
+            SELECT CASE WHEN EXISTS (
+                SELECT 1 FROM XXPerson.PATIENTS_AND_DOCTORS PD
+                WHERE PD.ID_PATIENT = P.ID_PATIENT AND PD.ID_DOCTOR_HOSPITAL = @p2
+            ) THEN 1 ELSE 0 END AS LINKED
+        ) LINK
+        OUTER APPLY (
+            SELECT MAX(EXPIRES_AT) AS EXPIRES_AT
+            FROM XXPerson.BREAK_GLASS_ACCESS
+            WHERE ID_PATIENT = P.ID_PATIENT AND ID_DOCTOR_HOSPITAL = @p2
+              AND ACTIVATED_AT IS NOT NULL AND EXPIRES_AT > SYSUTCDATETIME()
+        ) BG
         WHERE 
-            P.ID_PATIENT = @p1 AND PD.ID_DOCTOR_HOSPITAL = @p2
+            P.ID_PATIENT = @p1 AND (LINK.LINKED = 1 OR BG.EXPIRES_AT IS NOT NULL)
     `
 
+	var linked bool
+	var breakGlassUntil sql.NullTime
 	err := db.DB.QueryRow(query, sql.Named("p1", idPatient), sql.Named("p2", idDoctor)).Scan(
 		&response.Patient.IDPatient,
 		&response.Patient.Person.IDPerson,
@@ -181,14 +280,28 @@ func (patient *Patient) GetPatientByID(idDoctor, idPatient int64) (PatientRespon
 		&response.Patient.Person.Address.Address,
 		&response.Patient.Person.Address.Locality.Name,
 		&response.Patient.Person.Address.Locality.Jud.Name,
+		&linked,
+		&breakGlassUntil,
 	)
 
 	if err != nil {
 		if err == sql.ErrNoRows {
-			return PatientResponse{}, fmt.Errorf("no patient found with ID %d for doctor ID %d", idPatient, idDoctor)
+			return PatientResponse{}, fmt.Errorf("%w: no patient with ID %d for doctor ID %d", ErrPatientNotFound, idPatient, idDoctor)
 		}
 		return PatientResponse{}, fmt.Errorf("failed to retrieve patient: %w", err)
 	}
+	p := &response.Patient.Person
+	if err := pii.DecryptPerson(&p.CNP, &p.VirtualAddress.Email, &p.VirtualAddress.PhoneNumber, &p.Address.Address); err != nil {
+		return PatientResponse{}, err
+	}
+
+	// Reads under an emergency access are counted for the admins reviewing it.
+	if !linked {
+		response.BreakGlassUntil = &breakGlassUntil.Time
+		if err := recordBreakGlassUse(idPatient, idDoctor); err != nil {
+			log.Errorf("GetPatientByID: %v", err)
+		}
+	}
 
 	return response, nil
 }
@@ -255,6 +368,10 @@ func GetAllPatientsByDoctorID(idDoctor int64) ([]PatientResponse, error) {
 		if err != nil {
 			return nil, fmt.Errorf("failed to scan patient row: %w", err)
 		}
+		p := &patient.Patient.Person
+		if err := pii.DecryptPerson(&p.CNP, &p.VirtualAddress.Email, &p.VirtualAddress.PhoneNumber, &p.Address.Address); err != nil {
+			return nil, err
+		}
 		patients = append(patients, patient)
 	}
 
@@ -353,11 +470,10 @@ func (patient *Patient) UpdatePatient(idPatient int64) error {
 		}
 
 		url := fmt.Sprintf("http://person_module:8080/%d", patient.Person.IDPerson)
-		req, err := http.NewRequest(http.MethodPut, url, bytes.NewBuffer(requestBody))
+		req, err := newPersonRequest(http.MethodPut, url, bytes.NewBuffer(requestBody))
 		if err != nil {
-			return fmt.Errorf("failed to create HTTP request: %w", err)
+			return err
 		}
-		req.Header.Set("Content-Type", "application/json")
 
 		start = time.Now()
 		client := &http.Client{Timeout: 3 * time.Second}
@@ -376,3 +492,16 @@ func (patient *Patient) UpdatePatient(idPatient int64) error {
 
 	return nil
 }
+
+// newPersonRequest builds a call to Person_Module carrying this module's service token.
+func newPersonRequest(method, url string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create HTTP request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if err := auth.SignServiceRequest(req, auth.ServicePatient, auth.ServicePerson); err != nil {
+		return nil, err
+	}
+	return req, nil
+}
@@ -0,0 +1,136 @@
+package routes
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"eoncohub.com/patient_module/models"
+	"eoncohub.com/shared_module/auth"
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/gommon/log"
+)
+
+const (
+	minJustificationLength = 20
+	maxJustificationLength = 500
+)
+
+type breakGlassReq struct {
+	Justification string `json:"justification"`
+}
+
+type breakGlassReviewReq struct {
+	Note string `json:"note"`
+}
+
+// breakGlass opens the record of a patient the doctor is not linked to, for a limited
+// time, after the doctor explains why.
+func breakGlass(context echo.Context) error {
+	idPatient, err := strconv.ParseInt(context.Param("id"), 10, 64)
+	if err != nil {
+		return context.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid patient ID"})
+	}
+	doctorID, err := auth.DoctorHospitalID(context)
+	if err != nil {
+		return context.JSON(http.StatusForbidden, map[string]string{"error": err.Error()})
+	}
+	userID, err := auth.UserID(context)
+	if err != nil {
+		return context.JSON(http.StatusUnauthorized, map[string]string{"error": "Unauthorized"})
+	}
+
+	var req breakGlassReq
+	if err := context.Bind(&req); err != nil {
+		return context.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request data"})
+	}
+	justification := strings.TrimSpace(req.Justification)
+	if n := utf8.RuneCountInString(justification); n < minJustificationLength || n > maxJustificationLength {
+		return context.JSON(http.StatusBadRequest, map[string]string{
+			"error": "A justification of 20 to 500 characters is required",
+		})
+	}
+
+	access, err := models.GrantBreakGlass(idPatient, doctorID, userID, justification, context.RealIP(), context.Request().UserAgent())
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrPatientNotFound):
+			return context.JSON(http.StatusNotFound, map[string]string{"error": err.Error()})
+		case errors.Is(err, models.ErrPatientLinked):
+			return context.JSON(http.StatusConflict, map[string]string{"error": err.Error()})
+		case errors.Is(err, models.ErrBreakGlassNotLogged):
+			log.Errorf("Break-glass error: %v", err)
+			return context.JSON(http.StatusServiceUnavailable, map[string]string{"error": models.ErrBreakGlassNotLogged.Error()})
+		}
+		return context.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+
+	return context.JSON(http.StatusOK, access)
+}
+
+// listBreakGlass returns the emergency accesses of the admin's hospital, or of every
+// hospital for platform admins. ?unreviewed=true leaves out the reviewed ones.
+func listBreakGlass(context echo.Context) error {
+	hospitalID, ok, err := breakGlassHospital(context)
+	if !ok {
+		return err
+	}
+	unreviewed, _ := strconv.ParseBool(context.QueryParam("unreviewed"))
+
+	accesses, err := models.ListBreakGlass(hospitalID, unreviewed)
+	if err != nil {
+		return context.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+	return context.JSON(http.StatusOK, accesses)
+}
+
+// reviewBreakGlass marks an emergency access as reviewed, with an optional note.
+func reviewBreakGlass(context echo.Context) error {
+	idAccess, err := strconv.ParseInt(context.Param("id"), 10, 64)
+	if err != nil {
+		return context.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid access ID"})
+	}
+	hospitalID, ok, err := breakGlassHospital(context)
+	if !ok {
+		return err
+	}
+	reviewerID, err := auth.UserID(context)
+	if err != nil {
+		return context.JSON(http.StatusUnauthorized, map[string]string{"error": "Unauthorized"})
+	}
+
+	var req breakGlassReviewReq
+	if err := context.Bind(&req); err != nil {
+		return context.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request data"})
+	}
+
+	access, err := models.ReviewBreakGlass(hospitalID, idAccess, reviewerID, strings.TrimSpace(req.Note))
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrBreakGlassNotFound):
+			return context.JSON(http.StatusNotFound, map[string]string{"error": err.Error()})
+		case errors.Is(err, models.ErrBreakGlassReviewed):
+			return context.JSON(http.StatusConflict, map[string]string{"error": err.Error()})
+		}
+		return context.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+	return context.JSON(http.StatusOK, access)
+}
+
+// breakGlassHospital returns the hospital a hospital admin reviews, from the access
+// token; platform admins review every hospital and get zero.
+func breakGlassHospital(context echo.Context) (int64, bool, error) {
+	claims, err := auth.ClaimsFrom(context)
+	if err != nil {
+		return 0, false, context.JSON(http.StatusUnauthorized, map[string]string{"error": "Unauthorized"})
+	}
+	if claims.HasRole(auth.RolePlatformAdmin) {
+		return 0, true, nil
+	}
+	if claims.HospitalID == 0 {
+		return 0, false, context.JSON(http.StatusForbidden, map[string]string{"error": "No hospital in token"})
+	}
+	return claims.HospitalID, true, nil
+}
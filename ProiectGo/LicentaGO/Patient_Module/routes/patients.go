@@ -1,11 +1,14 @@
 package routes
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
 	"strconv"
 
 	"eoncohub.com/patient_module/models"
+	"eoncohub.com/shared_module/auth"
+	"eoncohub.com/shared_module/person"
 	"github.com/labstack/echo/v4"
 )
 
@@ -17,18 +20,25 @@ func createPatient(context echo.Context) error {
 		return context.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request data"})
 	}
 
-	doctorIDstr, ok := context.Get("user").(string) // "user" here refers to the "Issuer" field, which is the doctor ID.
-	if !ok {
-		return context.JSON(http.StatusUnauthorized, map[string]string{"error": "Doctor ID not found in token"})
-	}
-
-	doctorID, err := strconv.ParseInt(doctorIDstr, 10, 64)
+	doctorID, err := auth.DoctorHospitalID(context)
 	if err != nil {
-		return context.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid doctor ID"})
+		return context.JSON(http.StatusForbidden, map[string]string{"error": err.Error()})
 	}
 
 	err = patient.CreatePatient(doctorID)
 	if err != nil {
+		// A duplicate only tells whether the person exists, with the ID to attach for the
+		// same CNP; other people's details are not shown to the doctor.
+		var rejected *person.RejectedError
+		if errors.As(err, &rejected) {
+			return context.JSON(rejected.Summary(true))
+		}
+		if errors.Is(err, models.ErrPersonNotFound) {
+			return context.JSON(http.StatusNotFound, map[string]string{"error": err.Error()})
+		}
+		if errors.Is(err, models.ErrPatientLinked) {
+			return context.JSON(http.StatusConflict, map[string]string{"error": err.Error()})
+		}
 		return context.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
 	}
 
@@ -42,15 +52,17 @@ func getPatientByID(context echo.Context) error {
 	if err != nil {
 		return context.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid patient ID"})
 	}
-	doctorIDstr, ok := context.Get("user").(string) // "user" here refers to the "Issuer" field, which is the doctor ID.
-	if !ok {
-		return context.JSON(http.StatusUnauthorized, map[string]string{"error": "Doctor ID not found in token"})
+	doctorID, err := auth.DoctorHospitalID(context)
+	if err != nil {
+		return context.JSON(http.StatusForbidden, map[string]string{"error": err.Error()})
 	}
-
-	doctorID, err := strconv.ParseInt(doctorIDstr, 10, 64)
 	var patient models.Patient
 	patientResponse, err := patient.GetPatientByID(doctorID, idPatient)
 	if err != nil {
+		if errors.Is(err, models.ErrPatientNotFound) {
+			// Doctors can still open the record with POST /api/patient/:id/break-glass.
+			return context.JSON(http.StatusNotFound, map[string]string{"error": err.Error()})
+		}
 		return context.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
 	}
 
@@ -58,14 +70,9 @@ func getPatientByID(context echo.Context) error {
 }
 
 func getAllPatients(context echo.Context) error {
-	doctorIDstr, ok := context.Get("user").(string) // "user" here refers to the "Issuer" field, which is the doctor ID.
-	if !ok {
-		return context.JSON(http.StatusUnauthorized, map[string]string{"error": "Doctor ID not found in token"})
-	}
-
-	doctorID, err := strconv.ParseInt(doctorIDstr, 10, 64)
+	doctorID, err := auth.DoctorHospitalID(context)
 	if err != nil {
-		return context.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid doctor ID"})
+		return context.JSON(http.StatusForbidden, map[string]string{"error": err.Error()})
 	}
 	var patientList []models.PatientResponse
 	patientList, err = models.GetAllPatientsByDoctorID(doctorID)
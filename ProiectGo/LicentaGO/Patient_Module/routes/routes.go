@@ -1,17 +1,26 @@
 package routes
 
 import (
-	"eoncohub.com/patient_module/middleware"
+	"eoncohub.com/patient_module/db"
+	"eoncohub.com/shared_module/auth"
 	"github.com/labstack/echo/v4"
 )
 
 func RegisterRoutes(server *echo.Echo) {
+	clinicalStaff := auth.RequireRoles(auth.RoleDoctor, auth.RoleNurse)
+	doctorsOnly := auth.RequireRoles(auth.RoleDoctor)
+	admins := auth.RequireRoles(auth.RoleHospitalAdmin, auth.RolePlatformAdmin)
 
 	protected := server.Group("/api")
-	protected.Use(middleware.JWTMiddleware)
-	protected.POST("/patient/create", createPatient)
-	protected.GET("/patient/:id", getPatientByID)
-	protected.GET("/patients", getAllPatients)
-	protected.DELETE("/patient/delete/:id", deletePatient)
-	protected.PUT("/patient/update/:id", updatePatient)
+	protected.Use(auth.JWTMiddleware(auth.Config{Sessions: auth.SQLSessionChecker(db.DB)}))
+	protected.POST("/patient/create", createPatient, doctorsOnly)
+	protected.GET("/patient/:id", getPatientByID, clinicalStaff)
+	protected.GET("/patients", getAllPatients, clinicalStaff)
+	protected.DELETE("/patient/delete/:id", deletePatient, doctorsOnly)
+	protected.PUT("/patient/update/:id", updatePatient, doctorsOnly)
+
+	// Emergency access to patients of other doctors, reviewed by the hospital admins
+	protected.POST("/patient/:id/break-glass", breakGlass, doctorsOnly)
+	protected.GET("/break-glass", listBreakGlass, admins)
+	protected.POST("/break-glass/:id/review", reviewBreakGlass, admins)
 }
@@ -0,0 +1,19 @@
+package utils
+
+import (
+	"os"
+	"time"
+)
+
+// DurationFromEnv parses a Go duration (e.g. "15m") from the environment, falling back to def.
+func DurationFromEnv(key string, def time.Duration) time.Duration {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		return def
+	}
+	return d
+}
@@ -0,0 +1,239 @@
+// Command piirotate re-encrypts the CNPs, emails, phone numbers and street addresses of
+// XXPerson with the active key of PII_ACTIVE_KEY and fills in their blind indexes. It
+// encrypts the values stored before encryption the same way.
+//
+// It works in small batches, each in its own short transaction, while the modules keep
+// running. A row is only rewritten if it still holds the value that was read, so a
+// change made meanwhile by Person_Module, which already uses the active key, is kept.
+// Run it once every module has been restarted with the new PII_ACTIVE_KEY, and remove
+// the old key from PII_KEYS after it reports no rows left.
+//
+//	go run ./cmd/piirotate
+//	go run ./cmd/piirotate -batch 200 -pause 500ms
+//	go run ./cmd/piirotate -dry-run
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"eoncohub.com/person_module/db"
+	"eoncohub.com/shared_module/pii"
+	"github.com/joho/godotenv"
+)
+
+type column struct {
+	name  string
+	field string
+	hash  string // the blind index column, empty for fields that are not looked up
+}
+
+type table struct {
+	name    string
+	id      string
+	columns []column
+	// skip leaves out rows that are not personal data: the contact details and
+	// addresses of hospitals.
+	skip string
+}
+
+var tables = []table{
+	{
+		name:    "XXPerson.PERSONS",
+		id:      "ID_PERSON",
+		columns: []column{{"CNP", pii.FieldCNP, "CNP_HASH"}},
+	},
+	{
+		name: "XXPerson.VIRTUAL_ADDRESS",
+		id:   "ID_VIRTUAL_ADDRESS",
+		columns: []column{
+			{"EMAIL", pii.FieldEmail, "EMAIL_HASH"},
+			{"PHONE_NUMBER", pii.FieldPhone, "PHONE_HASH"},
+		},
+		skip: "EXISTS (SELECT 1 FROM XXPerson.HOSPITALS h WHERE h.ID_VIRTUAL_ADDRESS = t.ID_VIRTUAL_ADDRESS)",
+	},
+	{
+		name:    "XXPerson.ADDRESS",
+		id:      "ID_ADDRESS",
+		columns: []column{{"ADDRESS", pii.FieldAddress, ""}},
+		skip:    "EXISTS (SELECT 1 FROM XXPerson.HOSPITALS h WHERE h.ID_ADDRESS = t.ID_ADDRESS)",
+	},
+}
+
+func main() {
+	batch := flag.Int("batch", 500, "rows per transaction")
+	pause := flag.Duration("pause", 100*time.Millisecond, "wait between batches, to leave room for the modules")
+	dryRun := flag.Bool("dry-run", false, "only count the rows left to re-encrypt")
+	flag.Parse()
+	if *batch <= 0 {
+		log.Fatal("-batch must be positive")
+	}
+
+	if err := godotenv.Load(); err != nil {
+		log.Printf("No .env file, using the environment: %v", err)
+	}
+	active, err := pii.ActiveKey()
+	if err != nil {
+		log.Fatalf("Encryption keys: %v", err)
+	}
+	if err := db.InitDB(); err != nil {
+		log.Fatalf("Failed to initialize database: %v", err)
+	}
+	defer db.CloseDB()
+
+	// Values sealed with the active key start with this and need no work.
+	current := "pii1." + active + ".%"
+	for _, t := range tables {
+		if *dryRun {
+			var left int
+			err := db.DB.QueryRow("SELECT COUNT(*) FROM "+t.name+" t WHERE "+t.stale(), sql.Named("current", current)).Scan(&left)
+			if err != nil {
+				log.Fatalf("Counting %s: %v", t.name, err)
+			}
+			log.Printf("%s: %d rows to re-encrypt with key %s", t.name, left, active)
+			continue
+		}
+
+		rotated, skipped, err := t.rotate(current, *batch, *pause)
+		if err != nil {
+			log.Fatalf("Re-encrypting %s: %v", t.name, err)
+		}
+		log.Printf("%s: %d rows re-encrypted with key %s, %d changed meanwhile and left as they are", t.name, rotated, active, skipped)
+	}
+}
+
+// stale selects the rows holding a value that is not sealed with the active key or has
+// no blind index yet.
+func (t table) stale() string {
+	var cond []string
+	for _, c := range t.columns {
+		cond = append(cond, fmt.Sprintf("(t.%[1]s <> N'' AND t.%[1]s NOT LIKE @current)", c.name))
+		if c.hash != "" {
+			cond = append(cond, fmt.Sprintf("(t.%s <> N'' AND t.%s IS NULL)", c.name, c.hash))
+		}
+	}
+	where := "(" + strings.Join(cond, " OR ") + ")"
+	if t.skip != "" {
+		where += " AND NOT " + t.skip
+	}
+	return where
+}
+
+// rotate re-encrypts the stale rows of t in batches, in the order of their ID.
+func (t table) rotate(current string, batch int, pause time.Duration) (rotated, skipped int, err error) {
+	var columns []string
+	for _, c := range t.columns {
+		columns = append(columns, "t."+c.name)
+	}
+	query := fmt.Sprintf("SELECT TOP (@batch) t.%s, %s FROM %s t WHERE t.%s > @last AND %s ORDER BY t.%s",
+		t.id, strings.Join(columns, ", "), t.name, t.id, t.stale(), t.id)
+
+	var last int64
+	for {
+		rows, err := readBatch(query, len(t.columns), sql.Named("batch", batch), sql.Named("last", last), sql.Named("current", current))
+		if err != nil {
+			return rotated, skipped, err
+		}
+		if len(rows) == 0 {
+			return rotated, skipped, nil
+		}
+		last = rows[len(rows)-1].id
+
+		r, s, err := t.rewrite(rows)
+		if err != nil {
+			return rotated, skipped, err
+		}
+		rotated += r
+		skipped += s
+		time.Sleep(pause)
+	}
+}
+
+type row struct {
+	id     int64
+	values []sql.NullString
+}
+
+func readBatch(query string, n int, args ...any) ([]row, error) {
+	result, err := db.DB.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer result.Close()
+
+	var rows []row
+	for result.Next() {
+		r := row{values: make([]sql.NullString, n)}
+		dest := []any{&r.id}
+		for i := range r.values {
+			dest = append(dest, &r.values[i])
+		}
+		if err := result.Scan(dest...); err != nil {
+			return nil, err
+		}
+		rows = append(rows, r)
+	}
+	return rows, result.Err()
+}
+
+// rewrite stores the rows sealed with the active key in one transaction. Each update
+// checks the old values, so rows changed since they were read are skipped.
+func (t table) rewrite(rows []row) (rotated, skipped int, err error) {
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return 0, 0, err
+	}
+	defer tx.Rollback()
+
+	for _, r := range rows {
+		var set, match []string
+		args := []any{sql.Named("id", r.id)}
+		for i, c := range t.columns {
+			old := r.values[i]
+			param := fmt.Sprintf("v%d", i)
+			if !old.Valid {
+				match = append(match, "t."+c.name+" IS NULL")
+				continue
+			}
+			match = append(match, fmt.Sprintf("t.%s = @old%d", c.name, i))
+			args = append(args, sql.Named(fmt.Sprintf("old%d", i), old.String))
+
+			plain, err := pii.Decrypt(c.field, old.String)
+			if err != nil {
+				return 0, 0, fmt.Errorf("%s %d, %s: %w", t.id, r.id, c.name, err)
+			}
+			sealed, err := pii.Encrypt(c.field, plain)
+			if err != nil {
+				return 0, 0, err
+			}
+			set = append(set, fmt.Sprintf("t.%s = @%s", c.name, param))
+			args = append(args, sql.Named(param, sealed))
+			if c.hash != "" {
+				index, err := pii.Index(c.field, plain)
+				if err != nil {
+					return 0, 0, err
+				}
+				set = append(set, fmt.Sprintf("t.%s = @%s_hash", c.hash, param))
+				args = append(args, sql.Named(param+"_hash", index))
+			}
+		}
+
+		result, err := tx.Exec(fmt.Sprintf("UPDATE t SET %s FROM %s t WHERE t.%s = @id AND %s",
+			strings.Join(set, ", "), t.name, t.id, strings.Join(match, " AND ")), args...)
+		if err != nil {
+			return 0, 0, fmt.Errorf("%s %d: %w", t.id, r.id, err)
+		}
+		if n, err := result.RowsAffected(); err != nil {
+			return 0, 0, err
+		} else if n == 0 {
+			skipped++
+		} else {
+			rotated++
+		}
+	}
+	return rotated, skipped, tx.Commit()
+}
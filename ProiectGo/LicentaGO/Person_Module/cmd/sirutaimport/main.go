@@ -0,0 +1,412 @@
+// Command sirutaimport loads the counties and localities of the official SIRUTA
+// nomenclature (INS) into XXPerson.JUD and XXPerson.LOC. It can be run again on a newer
+// edition: rows are matched on their SIRUTA code and updated, new ones are inserted and
+// none are deleted, since addresses point at them. On the first run, counties and
+// localities already in the tables are matched by name, ignoring diacritics, so their IDs
+// are kept.
+//
+// The CSV needs the SIRUTA, DENLOC, JUD, SIRSUP and TIP columns, separated by ';' or ',',
+// in UTF-8 or Windows-1250. It uses the DB_* variables of the module.
+//
+//	go run ./cmd/sirutaimport -file siruta.csv
+//	go run ./cmd/sirutaimport -file siruta.csv -dry-run
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"eoncohub.com/person_module/db"
+	"eoncohub.com/person_module/utils"
+	"github.com/joho/godotenv"
+	"golang.org/x/text/encoding/charmap"
+)
+
+// SIRUTA TIP values: 40 is a county, 1 to 6 are municipalities, towns, communes and the
+// sectors of Bucharest, and from 9 on the localities they are made of.
+const (
+	tipCounty        = 40
+	tipLastAdminUnit = 6
+)
+
+// insertBatch keeps a batch of rows under the 2100 parameters of SQL Server.
+const insertBatch = 300
+
+type record struct {
+	siruta int64
+	name   string
+	jud    int
+	sirsup int64
+	tip    int
+}
+
+type county struct {
+	code   int
+	siruta int64
+	name   string
+}
+
+type locality struct {
+	siruta int64
+	name   string
+	jud    int
+	tip    int
+	uat    string
+}
+
+func main() {
+	file := flag.String("file", "", "SIRUTA CSV file")
+	encoding := flag.String("encoding", "auto", "encoding of the file: auto, utf-8 or windows-1250")
+	dryRun := flag.Bool("dry-run", false, "parse the file and report what it contains without touching the database")
+	flag.Parse()
+	if *file == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	records, err := readSiruta(*file, *encoding)
+	if err != nil {
+		log.Fatalf("Reading %s: %v", *file, err)
+	}
+	counties, localities := split(records)
+	log.Printf("%s: %d counties, %d localities", *file, len(counties), len(localities))
+	if *dryRun {
+		return
+	}
+
+	if err := godotenv.Load(); err != nil {
+		log.Printf("No .env file, using the environment: %v", err)
+	}
+	if err := db.InitDB(); err != nil {
+		log.Fatalf("Failed to initialize database: %v", err)
+	}
+	defer db.CloseDB()
+
+	if err := load(counties, localities); err != nil {
+		log.Fatalf("Import failed: %v", err)
+	}
+}
+
+// readSiruta parses the CSV into records, finding the columns by their header.
+func readSiruta(path, encoding string) ([]record, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	raw = bytes.TrimPrefix(raw, []byte("\xef\xbb\xbf"))
+	switch strings.ToLower(encoding) {
+	case "auto":
+		if !utf8.Valid(raw) {
+			raw, err = charmap.Windows1250.NewDecoder().Bytes(raw)
+		}
+	case "windows-1250", "cp1250":
+		raw, err = charmap.Windows1250.NewDecoder().Bytes(raw)
+	case "utf-8", "utf8":
+	default:
+		return nil, fmt.Errorf("unknown encoding %q", encoding)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("decode: %w", err)
+	}
+
+	header, _, _ := bytes.Cut(raw, []byte("\n"))
+	r := csv.NewReader(bytes.NewReader(raw))
+	r.Comma = ','
+	if bytes.Count(header, []byte(";")) > bytes.Count(header, []byte(",")) {
+		r.Comma = ';'
+	}
+	r.FieldsPerRecord = -1
+	r.LazyQuotes = true
+	r.TrimLeadingSpace = true
+
+	columns, err := r.Read()
+	if err != nil {
+		return nil, fmt.Errorf("read header: %w", err)
+	}
+	index := map[string]int{}
+	for i, c := range columns {
+		index[strings.ToUpper(strings.TrimSpace(c))] = i
+	}
+	for _, c := range []string{"SIRUTA", "DENLOC", "JUD", "SIRSUP", "TIP"} {
+		if _, ok := index[c]; !ok {
+			return nil, fmt.Errorf("missing column %s", c)
+		}
+	}
+
+	var records []record
+	for line := 2; ; line++ {
+		row, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		field := func(name string) string {
+			if i := index[name]; i < len(row) {
+				return strings.TrimSpace(row[i])
+			}
+			return ""
+		}
+		var rec record
+		var errs [4]error
+		rec.siruta, errs[0] = strconv.ParseInt(field("SIRUTA"), 10, 64)
+		rec.jud, errs[1] = strconv.Atoi(field("JUD"))
+		rec.sirsup, errs[2] = strconv.ParseInt(field("SIRSUP"), 10, 64)
+		rec.tip, errs[3] = strconv.Atoi(field("TIP"))
+		for _, err := range errs {
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", line, err)
+			}
+		}
+		rec.name = field("DENLOC")
+		if rec.name == "" {
+			return nil, fmt.Errorf("line %d: empty DENLOC", line)
+		}
+		records = append(records, rec)
+	}
+	return records, nil
+}
+
+// split keeps the counties and the localities, each locality with the name of the
+// municipality, town or commune it belongs to.
+func split(records []record) ([]county, []locality) {
+	adminUnits := map[int64]string{}
+	for _, r := range records {
+		if r.tip >= 1 && r.tip <= tipLastAdminUnit {
+			adminUnits[r.siruta] = displayName(r.name)
+		}
+	}
+
+	var counties []county
+	var localities []locality
+	for _, r := range records {
+		switch {
+		case r.tip == tipCounty:
+			counties = append(counties, county{code: r.jud, siruta: r.siruta, name: countyName(r.name)})
+		case r.tip > tipLastAdminUnit:
+			localities = append(localities, locality{
+				siruta: r.siruta,
+				name:   displayName(r.name),
+				jud:    r.jud,
+				tip:    r.tip,
+				uat:    adminUnits[r.sirsup],
+			})
+		}
+	}
+	return counties, localities
+}
+
+// countyName drops the "JUDEȚUL" or "MUNICIPIUL" SIRUTA puts before county names.
+func countyName(name string) string {
+	name = displayName(name)
+	for _, prefix := range []string{"Județul ", "Judetul ", "Municipiul "} {
+		name = strings.TrimPrefix(name, prefix)
+	}
+	return name
+}
+
+// displayName turns an upper-case SIRUTA name into the usual spelling, with comma-below
+// ș and ț: "NEGREŞTI-OAŞ" becomes "Negrești-Oaș", "VALEA LUI MIHAI" "Valea lui Mihai".
+func displayName(name string) string {
+	name = strings.NewReplacer("ş", "ș", "ţ", "ț", "Ş", "Ș", "Ţ", "Ț").Replace(name)
+	words := strings.Fields(strings.ToLower(name))
+	for i, w := range words {
+		if i > 0 && isParticle(w) {
+			continue
+		}
+		words[i] = capitalize(w)
+	}
+	return strings.Join(words, " ")
+}
+
+func isParticle(w string) bool {
+	switch w {
+	case "de", "din", "lui", "la", "cu", "pe", "sub", "peste":
+		return true
+	}
+	return false
+}
+
+// capitalize upper-cases the first letter of the word and of each part after a dash,
+// dot or parenthesis.
+func capitalize(w string) string {
+	runes := []rune(w)
+	upper := true
+	for i, r := range runes {
+		if upper && unicode.IsLetter(r) {
+			runes[i] = unicode.ToUpper(r)
+			upper = false
+		}
+		if r == '-' || r == '.' || r == '(' {
+			upper = true
+		}
+	}
+	return string(runes)
+}
+
+// load upserts the counties and localities in one transaction.
+func load(counties []county, localities []locality) error {
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Without parameters the statement runs as a plain batch, so the temporary tables
+	// last for the whole transaction instead of a single sp_executesql call.
+	_, err = tx.Exec(`
+        CREATE TABLE #COUNTIES (CODE INT NOT NULL, SIRUTA INT NOT NULL, NAME NVARCHAR(100) NOT NULL, FOLDED NVARCHAR(100) NOT NULL);
+        CREATE TABLE #LOCALITIES (SIRUTA INT NOT NULL, NAME NVARCHAR(100) NOT NULL, FOLDED NVARCHAR(100) NOT NULL,
+                                  JUD INT NOT NULL, TIP INT NOT NULL, UAT NVARCHAR(100) NULL);`)
+	if err != nil {
+		return fmt.Errorf("create staging tables: %w", err)
+	}
+
+	countyRows := make([][]any, len(counties))
+	for i, c := range counties {
+		countyRows[i] = []any{c.code, c.siruta, c.name, utils.FoldDiacritics(c.name)}
+	}
+	if err := insertRows(tx, "#COUNTIES (CODE, SIRUTA, NAME, FOLDED)", countyRows); err != nil {
+		return err
+	}
+	localityRows := make([][]any, len(localities))
+	for i, l := range localities {
+		localityRows[i] = []any{l.siruta, l.name, utils.FoldDiacritics(l.name), l.jud, l.tip, sql.NullString{String: l.uat, Valid: l.uat != ""}}
+	}
+	if err := insertRows(tx, "#LOCALITIES (SIRUTA, NAME, FOLDED, JUD, TIP, UAT)", localityRows); err != nil {
+		return err
+	}
+
+	// Counties and localities entered before the import keep their ID when their name
+	// matches exactly one SIRUTA entry of the county.
+	attached, err := exec(tx, `
+        WITH candidates AS (
+            SELECT j.ID_JUD, s.CODE, s.SIRUTA,
+                   COUNT(*) OVER (PARTITION BY j.ID_JUD) AS PER_ROW,
+                   COUNT(*) OVER (PARTITION BY s.CODE) AS PER_ENTRY
+            FROM XXPerson.JUD j
+            JOIN #COUNTIES s ON s.FOLDED = `+utils.FoldSQL("j.NAME")+`
+            WHERE j.CODE IS NULL AND NOT EXISTS (SELECT 1 FROM XXPerson.JUD x WHERE x.CODE = s.CODE)
+        )
+        UPDATE j SET j.CODE = c.CODE, j.SIRUTA = c.SIRUTA
+        FROM XXPerson.JUD j
+        JOIN candidates c ON c.ID_JUD = j.ID_JUD
+        WHERE c.PER_ROW = 1 AND c.PER_ENTRY = 1`)
+	if err != nil {
+		return fmt.Errorf("match existing counties: %w", err)
+	}
+	inserted, updated, err := merge(tx, `
+        MERGE XXPerson.JUD AS j
+        USING #COUNTIES AS s ON j.CODE = s.CODE
+        WHEN MATCHED THEN UPDATE SET j.NAME = s.NAME, j.SIRUTA = s.SIRUTA
+        WHEN NOT MATCHED BY TARGET THEN INSERT (NAME, CODE, SIRUTA) VALUES (s.NAME, s.CODE, s.SIRUTA)
+        OUTPUT $action;`)
+	if err != nil {
+		return fmt.Errorf("merge counties: %w", err)
+	}
+	log.Printf("Counties: %d matched by name, %d inserted, %d updated", attached, inserted, updated)
+
+	attached, err = exec(tx, `
+        WITH candidates AS (
+            SELECT l.ID_LOC, s.SIRUTA,
+                   COUNT(*) OVER (PARTITION BY l.ID_LOC) AS PER_ROW,
+                   COUNT(*) OVER (PARTITION BY s.SIRUTA) AS PER_ENTRY
+            FROM XXPerson.LOC l
+            JOIN XXPerson.JUD j ON j.ID_JUD = l.ID_JUD
+            JOIN #LOCALITIES s ON s.JUD = j.CODE AND s.FOLDED = `+utils.FoldSQL("l.NAME")+`
+            WHERE l.SIRUTA IS NULL AND NOT EXISTS (SELECT 1 FROM XXPerson.LOC x WHERE x.SIRUTA = s.SIRUTA)
+        )
+        UPDATE l SET l.SIRUTA = c.SIRUTA
+        FROM XXPerson.LOC l
+        JOIN candidates c ON c.ID_LOC = l.ID_LOC
+        WHERE c.PER_ROW = 1 AND c.PER_ENTRY = 1`)
+	if err != nil {
+		return fmt.Errorf("match existing localities: %w", err)
+	}
+	inserted, updated, err = merge(tx, `
+        MERGE XXPerson.LOC AS l
+        USING (SELECT s.SIRUTA, s.NAME, s.TIP, s.UAT, j.ID_JUD
+               FROM #LOCALITIES s
+               JOIN XXPerson.JUD j ON j.CODE = s.JUD) AS s
+        ON l.SIRUTA = s.SIRUTA
+        WHEN MATCHED THEN UPDATE SET l.NAME = s.NAME, l.ID_JUD = s.ID_JUD, l.TIP = s.TIP, l.UAT = s.UAT
+        WHEN NOT MATCHED BY TARGET THEN INSERT (NAME, ID_JUD, SIRUTA, TIP, UAT) VALUES (s.NAME, s.ID_JUD, s.SIRUTA, s.TIP, s.UAT)
+        OUTPUT $action;`)
+	if err != nil {
+		return fmt.Errorf("merge localities: %w", err)
+	}
+	log.Printf("Localities: %d matched by name, %d inserted, %d updated", attached, inserted, updated)
+
+	var leftOver int
+	if err := tx.QueryRow(`SELECT COUNT(*) FROM XXPerson.LOC WHERE SIRUTA IS NULL`).Scan(&leftOver); err != nil {
+		return fmt.Errorf("count unmatched localities: %w", err)
+	}
+	if leftOver > 0 {
+		log.Printf("%d localities entered before the import match no SIRUTA entry and were left as they are", leftOver)
+	}
+
+	return tx.Commit()
+}
+
+// insertRows inserts rows into a staging table, several per statement.
+func insertRows(tx *sql.Tx, table string, rows [][]any) error {
+	for start := 0; start < len(rows); start += insertBatch {
+		end := min(start+insertBatch, len(rows))
+		var values []string
+		var args []any
+		for _, row := range rows[start:end] {
+			params := make([]string, len(row))
+			for i, v := range row {
+				name := fmt.Sprintf("p%d", len(args)+1)
+				params[i] = "@" + name
+				args = append(args, sql.Named(name, v))
+			}
+			values = append(values, "("+strings.Join(params, ", ")+")")
+		}
+		if _, err := tx.Exec("INSERT INTO "+table+" VALUES "+strings.Join(values, ", "), args...); err != nil {
+			return fmt.Errorf("stage %s: %w", table, err)
+		}
+	}
+	return nil
+}
+
+func exec(tx *sql.Tx, query string) (int64, error) {
+	result, err := tx.Exec(query)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// merge runs a MERGE that outputs $action and counts its inserts and updates.
+func merge(tx *sql.Tx, query string) (inserted, updated int, err error) {
+	rows, err := tx.Query(query)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var action string
+		if err := rows.Scan(&action); err != nil {
+			return 0, 0, err
+		}
+		switch action {
+		case "INSERT":
+			inserted++
+		case "UPDATE":
+			updated++
+		}
+	}
+	return inserted, updated, rows.Err()
+}
@@ -7,10 +7,13 @@ require (
 	github.com/labstack/echo/v4 v4.12.0
 	github.com/labstack/gommon v0.4.2
 	github.com/microsoft/go-mssqldb v1.7.2
+	golang.org/x/text v0.18.0
 )
 
+require github.com/golang-jwt/jwt v3.2.2+incompatible // indirect
+
 require (
-	github.com/golang-jwt/jwt v3.2.2+incompatible // indirect
+	eoncohub.com/shared_module v0.0.0
 	github.com/golang-sql/civil v0.0.0-20220223132316-b832511892a9 // indirect
 	github.com/golang-sql/sqlexp v0.1.0 // indirect
 	github.com/mattn/go-colorable v0.1.13 // indirect
@@ -20,6 +23,7 @@ require (
 	golang.org/x/crypto v0.27.0 // indirect
 	golang.org/x/net v0.27.0 // indirect
 	golang.org/x/sys v0.25.0 // indirect
-	golang.org/x/text v0.18.0 // indirect
 	golang.org/x/time v0.5.0 // indirect
 )
+
+replace eoncohub.com/shared_module => ../Shared_Module
@@ -5,12 +5,19 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"time"
+
+	"eoncohub.com/shared_module/pii"
 )
 
+// Address is one version of a person's postal address. A change expires it with
+// DateOut and stores a new version, like VirtualAddress.
 type Address struct {
-	IDAddress int64  `json:"id_address"`
-	Loc       Loc    `json:"loc"`
-	Address   string `json:"address"`
+	IDAddress int64     `json:"id_address"`
+	Loc       Loc       `json:"loc"`
+	Address   string    `json:"address"`
+	DateIn    time.Time `json:"date_in"`
+	DateOut   time.Time `json:"date_out"`
 }
 
 func (a *Address) CreateAddress(tx *sql.Tx) error {
@@ -28,11 +35,15 @@ func (a *Address) CreateAddress(tx *sql.Tx) error {
 	}
 
 	log.Printf("Loc ID: %d", a.Loc.ID)
+	address, err := seal(pii.FieldAddress, a.Address)
+	if err != nil {
+		return err
+	}
 	// Define the SQL Server INSERT statement
 	const insertQuery = `
-        INSERT INTO XXPerson.ADDRESS (ID_LOC, ADDRESS) 
-        OUTPUT INSERTED.ID_ADDRESS
-        VALUES (@p1, @p2)`
+        INSERT INTO XXPerson.ADDRESS (ID_LOC, ADDRESS, DATE_IN) 
+        OUTPUT INSERTED.ID_ADDRESS, INSERTED.DATE_IN
+        VALUES (@p1, @p2, GETDATE())`
 
 	// Prepare the statement
 	stmt, err := tx.Prepare(insertQuery)
@@ -47,7 +58,7 @@ func (a *Address) CreateAddress(tx *sql.Tx) error {
 	}(stmt)
 
 	// Execute the statement and capture the inserted ID
-	err = stmt.QueryRow(a.Loc.ID, a.Address).Scan(&a.IDAddress)
+	err = stmt.QueryRow(a.Loc.ID, address.value).Scan(&a.IDAddress, &a.DateIn)
 	log.Println(a.IDAddress)
 	if err != nil {
 		return fmt.Errorf("error inserting Address: %w", err)
@@ -64,8 +75,9 @@ func (a *Address) UpdateAddress(tx *sql.Tx) error {
 	}
 
 	// Check if Address exists
-	var exists int
-	err = tx.QueryRow("SELECT 1 FROM XXPerson.ADDRESS WHERE ID_ADDRESS = @p1", a.IDAddress).Scan(&exists)
+	var currentLoc int64
+	var currentAddress sql.NullString
+	err = tx.QueryRow("SELECT ID_LOC, ADDRESS FROM XXPerson.ADDRESS WHERE ID_ADDRESS = @p1", a.IDAddress).Scan(&currentLoc, &currentAddress)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			// If not exists, create a new Address
@@ -74,23 +86,38 @@ func (a *Address) UpdateAddress(tx *sql.Tx) error {
 		return err
 	}
 
-	// If exists, update the Address
-	stmt, err := tx.Prepare("UPDATE XXPerson.ADDRESS SET ID_LOC = @p1, ADDRESS = @p2 WHERE ID_ADDRESS = @p3")
+	// Nothing changed, keep the current version
+	current := Address{Address: currentAddress.String}
+	if err := current.decrypt(); err != nil {
+		return err
+	}
+	if currentLoc == a.Loc.ID && current.Address == a.Address {
+		return nil
+	}
+	address, err := seal(pii.FieldAddress, a.Address)
 	if err != nil {
 		return err
 	}
-	defer func(stmt *sql.Stmt) {
-		err := stmt.Close()
-		if err != nil {
 
-		}
-	}(stmt)
+	// Expire the current version and store the new one for the same person
+	_, err = tx.Exec(`
+        UPDATE XXPerson.ADDRESS 
+        SET DATE_OUT = GETDATE() 
+        WHERE ID_ADDRESS = @p1 AND DATE_OUT IS NULL
+    `, sql.Named("p1", a.IDAddress))
+	if err != nil {
+		return fmt.Errorf("error expiring old address: %w", err)
+	}
 
-	// Execute the statement
-	_, err = stmt.Exec(a.Loc.ID, a.Address, a.IDAddress)
+	err = tx.QueryRow(`
+        INSERT INTO XXPerson.ADDRESS (ID_LOC, ADDRESS, DATE_IN, ID_PERSON) 
+        OUTPUT INSERTED.ID_ADDRESS, INSERTED.DATE_IN
+        SELECT @p1, @p2, GETDATE(), ID_PERSON FROM XXPerson.ADDRESS WHERE ID_ADDRESS = @p3
+    `, sql.Named("p1", a.Loc.ID), sql.Named("p2", address.value), sql.Named("p3", a.IDAddress)).Scan(&a.IDAddress, &a.DateIn)
 	if err != nil {
-		return err
+		return fmt.Errorf("error creating new address: %w", err)
 	}
+	a.DateOut = time.Time{}
 
 	return nil
 }
@@ -0,0 +1,214 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"eoncohub.com/person_module/utils"
+)
+
+const (
+	SexMale   = "M"
+	SexFemale = "F"
+)
+
+// cnpWeights are the weights of the first 12 digits in the control digit.
+const cnpWeights = "279146358279"
+
+// cnpAnyCounty is the county code of CNPs issued regardless of the county of birth.
+const cnpAnyCounty = 70
+
+// cnpCounties maps the county code of a CNP (JJ) to its county, folded like
+// utils.FoldDiacritics. 41-48 are the sectors of Bucharest.
+var cnpCounties = map[int]string{
+	1: "ALBA", 2: "ARAD", 3: "ARGES", 4: "BACAU", 5: "BIHOR", 6: "BISTRITA-NASAUD",
+	7: "BOTOSANI", 8: "BRASOV", 9: "BRAILA", 10: "BUZAU", 11: "CARAS-SEVERIN", 12: "CLUJ",
+	13: "CONSTANTA", 14: "COVASNA", 15: "DAMBOVITA", 16: "DOLJ", 17: "GALATI", 18: "GORJ",
+	19: "HARGHITA", 20: "HUNEDOARA", 21: "IALOMITA", 22: "IASI", 23: "ILFOV", 24: "MARAMURES",
+	25: "MEHEDINTI", 26: "MURES", 27: "NEAMT", 28: "OLT", 29: "PRAHOVA", 30: "SATU MARE",
+	31: "SALAJ", 32: "SIBIU", 33: "SUCEAVA", 34: "TELEORMAN", 35: "TIMIS", 36: "TULCEA",
+	37: "VASLUI", 38: "VALCEA", 39: "VRANCEA", 40: "BUCURESTI",
+	41: "BUCURESTI", 42: "BUCURESTI", 43: "BUCURESTI", 44: "BUCURESTI", 45: "BUCURESTI",
+	46: "BUCURESTI", 47: "BUCURESTI", 48: "BUCURESTI",
+	51: "CALARASI", 52: "GIURGIU",
+}
+
+// CNP is what a Romanian personal numeric code (SAAMMDDJJNNNC) encodes.
+type CNP struct {
+	// Sex is empty for the 9 prefix, which does not encode it.
+	Sex      string
+	BornDate time.Time
+	County   int
+	// Foreign is set for the 7, 8 and 9 prefixes of foreign residents. Their CNP does not
+	// encode the century, so BornDate is the latest one not in the future, and their
+	// county is the one that issued the residence permit.
+	Foreign bool
+}
+
+// ParseCNP checks the structure and control digit of cnp and decodes it.
+func ParseCNP(cnp string) (CNP, error) {
+	if len(cnp) != 13 || utils.Digits(cnp) != cnp {
+		return CNP{}, errors.New("must be 13 digits")
+	}
+	digit := func(i int) int { return int(cnp[i] - '0') }
+	number := func(i, n int) int {
+		v := 0
+		for _, c := range cnp[i : i+n] {
+			v = v*10 + int(c-'0')
+		}
+		return v
+	}
+
+	sum := 0
+	for i := range cnpWeights {
+		sum += digit(i) * int(cnpWeights[i]-'0')
+	}
+	control := sum % 11
+	if control == 10 {
+		control = 1
+	}
+	if control != digit(12) {
+		return CNP{}, errors.New("control digit does not match")
+	}
+
+	var c CNP
+	century := 0
+	switch s := digit(0); s {
+	case 1, 2:
+		century = 1900
+	case 3, 4:
+		century = 1800
+	case 5, 6:
+		century = 2000
+	case 7, 8, 9:
+		c.Foreign = true
+	default:
+		return CNP{}, fmt.Errorf("%d is not a valid first digit", s)
+	}
+	switch digit(0) {
+	case 1, 3, 5, 7:
+		c.Sex = SexMale
+	case 2, 4, 6, 8:
+		c.Sex = SexFemale
+	}
+
+	now := time.Now().UTC()
+	yy, mm, dd := number(1, 2), number(3, 2), number(5, 2)
+	if c.Foreign {
+		century = 2000
+	}
+	born := time.Date(century+yy, time.Month(mm), dd, 0, 0, 0, 0, time.UTC)
+	if mm < 1 || mm > 12 || born.Day() != dd {
+		return CNP{}, fmt.Errorf("%s is not a valid birth date", cnp[1:7])
+	}
+	if c.Foreign && born.After(now) {
+		born = born.AddDate(-100, 0, 0)
+	}
+	if born.After(now) {
+		return CNP{}, errors.New("birth date is in the future")
+	}
+	c.BornDate = born
+
+	c.County = number(7, 2)
+	if _, ok := cnpCounties[c.County]; !ok && c.County != cnpAnyCounty {
+		return CNP{}, fmt.Errorf("%02d is not a valid county code", c.County)
+	}
+	return c, nil
+}
+
+// ValidationError lists the invalid fields of a person, by JSON name.
+type ValidationError struct {
+	Fields map[string]string
+}
+
+func (e *ValidationError) Error() string {
+	names := make([]string, 0, len(e.Fields))
+	for name := range e.Fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for i, name := range names {
+		names[i] = name + ": " + e.Fields[name]
+	}
+	return "invalid person: " + strings.Join(names, "; ")
+}
+
+// validateIdentity checks the CNP and cross-checks the sex, the birth date and the county
+// of the address against it. Sex and born_date are filled from the CNP when missing.
+// Staff persons may come without a CNP, and then only the sex is checked.
+func (p *Person) validateIdentity() error {
+	fields := map[string]string{}
+	p.CNP = strings.TrimSpace(p.CNP)
+	p.Sex = strings.ToUpper(strings.TrimSpace(p.Sex))
+
+	if p.Sex != "" && p.Sex != SexMale && p.Sex != SexFemale {
+		fields["sex"] = "must be M or F"
+	}
+
+	if p.CNP == "" {
+		if !p.Staff {
+			fields["cnp"] = "is required"
+		}
+		if len(fields) > 0 {
+			return &ValidationError{Fields: fields}
+		}
+		return nil
+	}
+	cnp, err := ParseCNP(p.CNP)
+	if err != nil {
+		fields["cnp"] = err.Error()
+		return &ValidationError{Fields: fields}
+	}
+
+	switch {
+	case cnp.Sex == "":
+	case p.Sex == "":
+		p.Sex = cnp.Sex
+	case p.Sex != cnp.Sex && fields["sex"] == "":
+		fields["sex"] = "does not match the CNP"
+	}
+
+	if p.BornDate.IsZero() {
+		p.BornDate = cnp.BornDate
+	} else if !sameBirthDate(p.BornDate, cnp) {
+		fields["born_date"] = fmt.Sprintf("does not match the CNP (%s)", cnp.BornDate.Format("2006-01-02"))
+	}
+
+	if county, ok := cnpCounties[cnp.County]; ok && !cnp.Foreign && p.Address.Loc.Jud.Name != "" {
+		if !sameCounty(p.Address.Loc.Jud.Name, county) {
+			fields["address.loc.jud.name"] = fmt.Sprintf("does not match the county of the CNP (%s)", county)
+		}
+	}
+
+	if len(fields) > 0 {
+		return &ValidationError{Fields: fields}
+	}
+	return nil
+}
+
+// sameBirthDate compares the calendar day. The century of a foreign resident's CNP is a
+// guess, so only the last two digits of the year have to match.
+func sameBirthDate(born time.Time, cnp CNP) bool {
+	y, m, d := born.Date()
+	cy, cm, cd := cnp.BornDate.Date()
+	if cnp.Foreign {
+		return y%100 == cy%100 && m == cm && d == cd
+	}
+	return y == cy && m == cm && d == cd
+}
+
+// sameCounty compares a county name with one of cnpCounties, ignoring diacritics,
+// spaces, dashes and a leading "Județul" or "Municipiul".
+func sameCounty(name, county string) bool {
+	simplify := func(s string) string {
+		s = utils.FoldDiacritics(strings.TrimSpace(s))
+		for _, prefix := range []string{"JUDETUL ", "MUNICIPIUL "} {
+			s = strings.TrimPrefix(s, prefix)
+		}
+		return strings.NewReplacer(" ", "", "-", "").Replace(s)
+	}
+	return simplify(name) == simplify(county)
+}
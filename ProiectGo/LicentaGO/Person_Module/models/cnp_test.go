@@ -0,0 +1,118 @@
+package models
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func date(y, m, d int) time.Time {
+	return time.Date(y, time.Month(m), d, 0, 0, 0, 0, time.UTC)
+}
+
+func TestParseCNP(t *testing.T) {
+	tests := []struct {
+		name    string
+		cnp     string
+		want    CNP
+		wantErr string
+	}{
+		{name: "male born in the 1900s", cnp: "1800101400016", want: CNP{Sex: SexMale, BornDate: date(1980, 1, 1), County: 40}},
+		{name: "control digit 10 becomes 1", cnp: "1800101400181", want: CNP{Sex: SexMale, BornDate: date(1980, 1, 1), County: 40}},
+		{name: "female born on a leap day", cnp: "6040229460017", want: CNP{Sex: SexFemale, BornDate: date(2004, 2, 29), County: 46}},
+		{name: "born in the 1800s", cnp: "3800101030013", want: CNP{Sex: SexMale, BornDate: date(1880, 1, 1), County: 3}},
+		{name: "Bucharest sector", cnp: "1800101460011", want: CNP{Sex: SexMale, BornDate: date(1980, 1, 1), County: 46}},
+		{name: "any county", cnp: "1800101700011", want: CNP{Sex: SexMale, BornDate: date(1980, 1, 1), County: 70}},
+		{name: "foreign resident in the past century", cnp: "7991231700011", want: CNP{Sex: SexMale, BornDate: date(1999, 12, 31), County: 70, Foreign: true}},
+		{name: "foreign resident in this century", cnp: "8100101120015", want: CNP{Sex: SexFemale, BornDate: date(2010, 1, 1), County: 12, Foreign: true}},
+		{name: "foreign resident without sex", cnp: "9000101100016", want: CNP{BornDate: date(2000, 1, 1), County: 10, Foreign: true}},
+
+		{name: "too short", cnp: "180010140001", wantErr: "must be 13 digits"},
+		{name: "not digits", cnp: "18001014000A6", wantErr: "must be 13 digits"},
+		{name: "wrong control digit", cnp: "1800101400017", wantErr: "control digit does not match"},
+		{name: "first digit 0", cnp: "0800101400014", wantErr: "not a valid first digit"},
+		{name: "29 February of a common year", cnp: "2010229400011", wantErr: "not a valid birth date"},
+		{name: "month 13", cnp: "1801301400014", wantErr: "not a valid birth date"},
+		{name: "day 0", cnp: "1800100400013", wantErr: "not a valid birth date"},
+		{name: "birth date in the future", cnp: "5991231400014", wantErr: "birth date is in the future"},
+		{name: "unknown county", cnp: "1800101490011", wantErr: "49 is not a valid county code"},
+		{name: "county 00", cnp: "1800101000018", wantErr: "00 is not a valid county code"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseCNP(tt.cnp)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("ParseCNP(%q) error = %v, want %q", tt.cnp, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseCNP(%q) error = %v", tt.cnp, err)
+			}
+			if got.Sex != tt.want.Sex || !got.BornDate.Equal(tt.want.BornDate) || got.County != tt.want.County || got.Foreign != tt.want.Foreign {
+				t.Errorf("ParseCNP(%q) = %+v, want %+v", tt.cnp, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateIdentity(t *testing.T) {
+	tests := []struct {
+		name       string
+		person     Person
+		wantFields []string
+		wantSex    string
+		wantBorn   time.Time
+	}{
+		{name: "fills sex and birth date", person: Person{CNP: " 1800101400016 "}, wantSex: SexMale, wantBorn: date(1980, 1, 1)},
+		{name: "matching sex, date and county", person: Person{CNP: "1800101030011", Sex: "m", BornDate: date(1980, 1, 1),
+			Address: Address{Loc: Loc{Jud: Jud{Name: "Județul Argeș"}}}}, wantSex: SexMale, wantBorn: date(1980, 1, 1)},
+		{name: "Bucharest sector and municipality", person: Person{CNP: "1800101460011",
+			Address: Address{Loc: Loc{Jud: Jud{Name: "Municipiul București"}}}}, wantSex: SexMale, wantBorn: date(1980, 1, 1)},
+		{name: "foreign resident compares the last two digits of the year", person: Person{CNP: "7991231700011", BornDate: date(1899, 12, 31)},
+			wantSex: SexMale, wantBorn: date(1899, 12, 31)},
+		{name: "county 70 is not compared", person: Person{CNP: "1800101700011", Address: Address{Loc: Loc{Jud: Jud{Name: "Cluj"}}}},
+			wantSex: SexMale, wantBorn: date(1980, 1, 1)},
+		{name: "no sex in the 9 prefix", person: Person{CNP: "9000101100016", Sex: SexFemale}, wantSex: SexFemale, wantBorn: date(2000, 1, 1)},
+		{name: "staff without a CNP", person: Person{Staff: true, Sex: "f"}, wantSex: SexFemale},
+
+		{name: "CNP required", person: Person{Sex: SexMale}, wantFields: []string{"cnp"}},
+		{name: "invalid sex", person: Person{Staff: true, Sex: "X"}, wantFields: []string{"sex"}},
+		{name: "invalid CNP", person: Person{CNP: "1800101400017"}, wantFields: []string{"cnp"}},
+		{name: "sex does not match", person: Person{CNP: "1800101400016", Sex: SexFemale}, wantFields: []string{"sex"}},
+		{name: "birth date does not match", person: Person{CNP: "1800101400016", BornDate: date(1980, 1, 2)}, wantFields: []string{"born_date"}},
+		{name: "century does not match", person: Person{CNP: "1800101400016", BornDate: date(2080, 1, 1)}, wantFields: []string{"born_date"}},
+		{name: "county does not match", person: Person{CNP: "1800101030011", Address: Address{Loc: Loc{Jud: Jud{Name: "Cluj"}}}},
+			wantFields: []string{"address.loc.jud.name"}},
+		{name: "several fields", person: Person{CNP: "1800101400016", Sex: SexFemale, BornDate: date(1981, 1, 1)},
+			wantFields: []string{"born_date", "sex"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := tt.person
+			err := p.validateIdentity()
+			if len(tt.wantFields) > 0 {
+				invalid, ok := err.(*ValidationError)
+				if !ok {
+					t.Fatalf("validateIdentity() error = %v, want a *ValidationError", err)
+				}
+				if len(invalid.Fields) != len(tt.wantFields) {
+					t.Fatalf("validateIdentity() fields = %v, want %v", invalid.Fields, tt.wantFields)
+				}
+				for _, field := range tt.wantFields {
+					if _, ok := invalid.Fields[field]; !ok {
+						t.Errorf("validateIdentity() fields = %v, want %q", invalid.Fields, field)
+					}
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("validateIdentity() error = %v", err)
+			}
+			if p.Sex != tt.wantSex || !p.BornDate.Equal(tt.wantBorn) {
+				t.Errorf("validateIdentity() sex = %q, born = %v, want %q, %v", p.Sex, p.BornDate, tt.wantSex, tt.wantBorn)
+			}
+		})
+	}
+}
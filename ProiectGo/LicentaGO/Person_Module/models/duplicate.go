@@ -0,0 +1,176 @@
+package models
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"eoncohub.com/person_module/utils"
+	"eoncohub.com/shared_module/pii"
+)
+
+// maxDuplicateCandidates caps the candidates returned for a new person.
+const maxDuplicateCandidates = 10
+
+// DuplicateCandidate is an existing person that may be the one being created. Reasons
+// lists what matched: cnp, name, born_date and phone.
+type DuplicateCandidate struct {
+	IDPerson    int64     `json:"id_person"`
+	FName       string    `json:"f_name"`
+	LName       string    `json:"l_name"`
+	CNP         string    `json:"cnp"`
+	BornDate    time.Time `json:"born_date"`
+	Email       string    `json:"email,omitempty"`
+	PhoneNumber string    `json:"phone_number,omitempty"`
+	Reasons     []string  `json:"reasons"`
+}
+
+// DuplicateError is returned by Create instead of inserting a person that looks like an
+// existing one. Exact is set when a person already has the CNP; the other candidates
+// only have a similar name and the same birth date or phone, and Create accepts the
+// person anyway when AllowSimilar is set.
+type DuplicateError struct {
+	Exact      bool
+	Candidates []DuplicateCandidate
+}
+
+func (e *DuplicateError) Error() string {
+	if e.Exact {
+		return "a person with this CNP already exists"
+	}
+	return fmt.Sprintf("%d similar persons already exist", len(e.Candidates))
+}
+
+// cnpTaken reports whether another person than p already has its CNP. The lookup of the
+// CNP blind index keeps its key range locked until tx ends, so two creations or updates
+// with the same CNP cannot both pass it. Rows not encrypted yet are compared as they are,
+// without a lock, since CNP has no index and the lock would cover the whole table. New
+// rows always get the blind index.
+func (p *Person) cnpTaken(tx *sql.Tx, cnpHash []byte) (bool, error) {
+	if p.CNP == "" {
+		return false, nil
+	}
+	var existing int64
+	err := tx.QueryRow(`
+		SELECT TOP 1 p.ID_PERSON
+		FROM XXPerson.PERSONS p WITH (UPDLOCK, HOLDLOCK)
+		WHERE p.CNP_HASH = @cnp_hash AND p.MERGED_INTO IS NULL AND p.ID_PERSON <> @id
+	`, sql.Named("cnp_hash", cnpHash), sql.Named("id", p.IDPerson)).Scan(&existing)
+	if err == sql.ErrNoRows {
+		err = tx.QueryRow(`
+			SELECT TOP 1 p.ID_PERSON
+			FROM XXPerson.PERSONS p
+			WHERE p.CNP_HASH IS NULL AND p.CNP = @cnp AND p.MERGED_INTO IS NULL AND p.ID_PERSON <> @id
+		`, sql.Named("cnp", p.CNP), sql.Named("id", p.IDPerson)).Scan(&existing)
+	}
+	if err != nil && err != sql.ErrNoRows {
+		return false, fmt.Errorf("error checking CNP: %w", err)
+	}
+	return err == nil, nil
+}
+
+// findDuplicates looks for persons matching p. CNPs and phone numbers are compared by
+// their blind index, or as they are for rows not encrypted yet.
+func (p *Person) findDuplicates(tx *sql.Tx) error {
+	cnpHash, err := blindIndex(pii.FieldCNP, p.CNP)
+	if err != nil {
+		return err
+	}
+	phoneHash, err := blindIndex(pii.FieldPhone, p.VirtualAddress.PhoneNumber)
+	if err != nil {
+		return err
+	}
+	// A staff person without a CNP has no exact match, only similar ones.
+	sameCNP := "(@cnp <> '' AND (p.CNP_HASH = @cnp_hash OR p.CNP = @cnp))"
+
+	exact, err := p.cnpTaken(tx, cnpHash)
+	if err != nil {
+		return err
+	}
+	if !exact && p.AllowSimilar {
+		return nil
+	}
+
+	fName, lName := utils.FoldSQL("p.F_NAME"), utils.FoldSQL("p.L_NAME")
+	alike := func(column, param string) string {
+		return fmt.Sprintf("(%[1]s = %[2]s OR SOUNDEX(%[1]s) = SOUNDEX(%[2]s))", column, param)
+	}
+	sameName := fmt.Sprintf("((%s AND %s) OR (%s AND %s))",
+		alike(fName, "@f_name"), alike(lName, "@l_name"), alike(fName, "@l_name"), alike(lName, "@f_name"))
+	// The last 9 digits leave out the 0 or +40 prefix of Romanian numbers.
+	samePhone := fmt.Sprintf("(@phone <> '' AND (va.PHONE_HASH = @phone_hash OR RIGHT(%s, 9) = @phone))",
+		phoneDigitsSQL("va.PHONE_NUMBER"))
+
+	query := fmt.Sprintf(`
+		SELECT TOP (@max) p.ID_PERSON, p.F_NAME, p.L_NAME, p.CNP, p.BORN_DATE, va.EMAIL, va.PHONE_NUMBER,
+		       CASE WHEN %[3]s THEN 1 ELSE 0 END,
+		       CASE WHEN %[1]s THEN 1 ELSE 0 END,
+		       CASE WHEN CAST(p.BORN_DATE AS DATE) = @born_date THEN 1 ELSE 0 END,
+		       CASE WHEN %[2]s THEN 1 ELSE 0 END
+		FROM XXPerson.PERSONS p
+		LEFT JOIN XXPerson.VIRTUAL_ADDRESS va ON p.ID_VIRTUAL_ADDRESS = va.ID_VIRTUAL_ADDRESS
+		WHERE p.MERGED_INTO IS NULL
+		  AND (%[3]s OR (%[1]s AND (CAST(p.BORN_DATE AS DATE) = @born_date OR %[2]s)))
+		ORDER BY CASE WHEN %[3]s THEN 0 ELSE 1 END, p.ID_PERSON`, sameName, samePhone, sameCNP)
+
+	rows, err := tx.Query(query,
+		sql.Named("max", maxDuplicateCandidates),
+		sql.Named("cnp_hash", cnpHash),
+		sql.Named("cnp", p.CNP),
+		sql.Named("f_name", utils.FoldDiacritics(strings.TrimSpace(p.FName))),
+		sql.Named("l_name", utils.FoldDiacritics(strings.TrimSpace(p.LName))),
+		sql.Named("born_date", p.BornDate.Format("2006-01-02")),
+		sql.Named("phone_hash", phoneHash),
+		sql.Named("phone", pii.Normalize(pii.FieldPhone, p.VirtualAddress.PhoneNumber)),
+	)
+	if err != nil {
+		return fmt.Errorf("error looking for duplicate persons: %w", err)
+	}
+	defer rows.Close()
+
+	var candidates []DuplicateCandidate
+	for rows.Next() {
+		var c DuplicateCandidate
+		var fName, lName, cnp, email, phoneNumber sql.NullString
+		var bornDate sql.NullTime
+		var sameCNP, sameName, sameBorn, samePhone bool
+		err := rows.Scan(&c.IDPerson, &fName, &lName, &cnp, &bornDate, &email, &phoneNumber,
+			&sameCNP, &sameName, &sameBorn, &samePhone)
+		if err != nil {
+			return fmt.Errorf("error scanning duplicate person: %w", err)
+		}
+		c.FName, c.LName, c.CNP = fName.String, lName.String, cnp.String
+		c.Email, c.PhoneNumber = email.String, phoneNumber.String
+		if err := open(pii.FieldCNP, &c.CNP); err != nil {
+			return err
+		}
+		if err := open(pii.FieldEmail, &c.Email); err != nil {
+			return err
+		}
+		if err := open(pii.FieldPhone, &c.PhoneNumber); err != nil {
+			return err
+		}
+		if bornDate.Valid {
+			c.BornDate = bornDate.Time
+		}
+		matches := []struct {
+			reason  string
+			matched bool
+		}{{"cnp", sameCNP}, {"name", sameName}, {"born_date", sameBorn}, {"phone", samePhone}}
+		for _, m := range matches {
+			if m.matched {
+				c.Reasons = append(c.Reasons, m.reason)
+			}
+		}
+		candidates = append(candidates, c)
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error iterating over duplicate persons: %w", err)
+	}
+
+	if len(candidates) > 0 {
+		return &DuplicateError{Exact: exact, Candidates: candidates}
+	}
+	return nil
+}
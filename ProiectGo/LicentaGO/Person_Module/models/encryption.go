@@ -0,0 +1,72 @@
+package models
+
+import (
+	"fmt"
+
+	"eoncohub.com/shared_module/pii"
+)
+
+// The CNP, email, phone number and street address are stored encrypted (see the pii
+// package). sealed holds what is written for one of them: the ciphertext and, for the
+// fields that are looked up, the blind index.
+type sealed struct {
+	value string
+	index []byte
+}
+
+func seal(field, value string) (sealed, error) {
+	var s sealed
+	var err error
+	if s.value, err = pii.Encrypt(field, value); err != nil {
+		return s, fmt.Errorf("error encrypting %s: %w", field, err)
+	}
+	if field != pii.FieldAddress {
+		if s.index, err = pii.Index(field, value); err != nil {
+			return s, fmt.Errorf("error indexing %s: %w", field, err)
+		}
+	}
+	return s, nil
+}
+
+// open decrypts the stored values of field in place.
+func open(field string, values ...*string) error {
+	for _, v := range values {
+		plain, err := pii.Decrypt(field, *v)
+		if err != nil {
+			return fmt.Errorf("error decrypting %s: %w", field, err)
+		}
+		*v = plain
+	}
+	return nil
+}
+
+// decrypt opens the encrypted fields of a person read from the database.
+func (p *Person) decrypt() error {
+	if err := open(pii.FieldCNP, &p.CNP); err != nil {
+		return err
+	}
+	if err := p.VirtualAddress.decrypt(); err != nil {
+		return err
+	}
+	return p.Address.decrypt()
+}
+
+func (v *VirtualAddress) decrypt() error {
+	if err := open(pii.FieldEmail, &v.Email); err != nil {
+		return err
+	}
+	return open(pii.FieldPhone, &v.PhoneNumber)
+}
+
+func (a *Address) decrypt() error {
+	return open(pii.FieldAddress, &a.Address)
+}
+
+// blindIndex returns the index of value to look it up, nil when it has none.
+func blindIndex(field, value string) ([]byte, error) {
+	index, err := pii.Index(field, value)
+	if err != nil {
+		return nil, fmt.Errorf("error indexing %s: %w", field, err)
+	}
+	return index, nil
+}
@@ -0,0 +1,128 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+
+	"eoncohub.com/person_module/db"
+	"eoncohub.com/person_module/utils"
+)
+
+var ErrCountyNotFound = errors.New("county not found")
+
+const (
+	DefaultLocalityLimit = 50
+	MaxLocalityLimit     = 200
+)
+
+// County is a row of XXPerson.JUD. Code is the SIRUTA county code, the same as the
+// county code of a CNP, and is zero for counties that were not imported from SIRUTA.
+type County struct {
+	ID   int64  `json:"id_jud"`
+	Name string `json:"name"`
+	Code int    `json:"code,omitempty"`
+}
+
+// Locality is a row of XXPerson.LOC. Siruta, Type (the SIRUTA TIP) and Commune, the
+// municipality, town or commune it belongs to, are only known for imported localities.
+type Locality struct {
+	ID      int64  `json:"id_loc"`
+	Name    string `json:"name"`
+	Siruta  int64  `json:"siruta,omitempty"`
+	Type    int    `json:"type,omitempty"`
+	Commune string `json:"commune,omitempty"`
+}
+
+// ListCounties returns the counties whose name, or one of its words, starts with
+// prefix, ignoring case and diacritics. An empty prefix lists them all.
+func ListCounties(prefix string) ([]County, error) {
+	name := utils.FoldSQL("NAME")
+	rows, err := db.DB.Query(`
+        SELECT ID_JUD, NAME, CODE
+        FROM XXPerson.JUD
+        WHERE `+name+` LIKE @prefix ESCAPE '\' OR `+name+` LIKE @word ESCAPE '\'
+        ORDER BY `+name,
+		sql.Named("prefix", prefixPattern(prefix)),
+		sql.Named("word", wordPattern(prefix)))
+	if err != nil {
+		return nil, fmt.Errorf("error listing counties: %w", err)
+	}
+	defer rows.Close()
+
+	counties := []County{}
+	for rows.Next() {
+		var c County
+		var code sql.NullInt64
+		if err := rows.Scan(&c.ID, &c.Name, &code); err != nil {
+			return nil, fmt.Errorf("error scanning county: %w", err)
+		}
+		c.Code = int(code.Int64)
+		counties = append(counties, c)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over counties: %w", err)
+	}
+	return counties, nil
+}
+
+// ListLocalities returns up to limit localities of a county matching prefix like
+// ListCounties. Names starting with the prefix come first, then municipalities, towns
+// and their seats before villages.
+func ListLocalities(countyID int64, prefix string, limit int) ([]Locality, error) {
+	if limit <= 0 {
+		limit = DefaultLocalityLimit
+	}
+	if limit > MaxLocalityLimit {
+		limit = MaxLocalityLimit
+	}
+
+	var exists int
+	err := db.DB.QueryRow("SELECT 1 FROM XXPerson.JUD WHERE ID_JUD = @p1", sql.Named("p1", countyID)).Scan(&exists)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrCountyNotFound
+		}
+		return nil, fmt.Errorf("error querying county: %w", err)
+	}
+
+	name := utils.FoldSQL("NAME")
+	rows, err := db.DB.Query(`
+        SELECT TOP (@limit) ID_LOC, NAME, SIRUTA, TIP, UAT
+        FROM XXPerson.LOC
+        WHERE ID_JUD = @jud AND (`+name+` LIKE @prefix ESCAPE '\' OR `+name+` LIKE @word ESCAPE '\')
+        ORDER BY CASE WHEN `+name+` LIKE @prefix ESCAPE '\' THEN 0 ELSE 1 END, ISNULL(TIP, 99), `+name+`, ID_LOC`,
+		sql.Named("limit", limit),
+		sql.Named("jud", countyID),
+		sql.Named("prefix", prefixPattern(prefix)),
+		sql.Named("word", wordPattern(prefix)))
+	if err != nil {
+		return nil, fmt.Errorf("error listing localities: %w", err)
+	}
+	defer rows.Close()
+
+	localities := []Locality{}
+	for rows.Next() {
+		var l Locality
+		var siruta, tip sql.NullInt64
+		var commune sql.NullString
+		if err := rows.Scan(&l.ID, &l.Name, &siruta, &tip, &commune); err != nil {
+			return nil, fmt.Errorf("error scanning locality: %w", err)
+		}
+		l.Siruta, l.Type, l.Commune = siruta.Int64, int(tip.Int64), commune.String
+		localities = append(localities, l)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over localities: %w", err)
+	}
+	return localities, nil
+}
+
+func prefixPattern(prefix string) string {
+	return utils.EscapeLike(utils.FoldDiacritics(strings.TrimSpace(prefix))) + "%"
+}
+
+func wordPattern(prefix string) string {
+	return "%[ -]" + prefixPattern(prefix)
+}
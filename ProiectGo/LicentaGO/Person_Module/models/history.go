@@ -0,0 +1,170 @@
+package models
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"eoncohub.com/person_module/db"
+)
+
+// PersonHistory lists every version of a person's contact details and postal address,
+// oldest first. The current versions have a zero DateOut.
+type PersonHistory struct {
+	IDPerson  int64            `json:"id_person"`
+	Contacts  []VirtualAddress `json:"contacts"`
+	Addresses []Address        `json:"addresses"`
+}
+
+// GetPersonHistory returns the contact and address versions of a person.
+func GetPersonHistory(id int64) (PersonHistory, error) {
+	history := PersonHistory{IDPerson: id, Contacts: []VirtualAddress{}, Addresses: []Address{}}
+
+	var exists int
+	err := db.DB.QueryRow("SELECT 1 FROM XXPerson.PERSONS WHERE ID_PERSON = @p1", sql.Named("p1", id)).Scan(&exists)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return history, ErrPersonNotFound
+		}
+		return history, fmt.Errorf("error getting person with id %d: %w", id, err)
+	}
+
+	// The current versions are also found through PERSONS, for persons created before
+	// the versions were tied to them.
+	rows, err := db.DB.Query(`
+        SELECT va.ID_VIRTUAL_ADDRESS, va.EMAIL, va.PHONE_NUMBER, va.DATE_IN, va.DATE_OUT
+        FROM XXPerson.VIRTUAL_ADDRESS va
+        WHERE va.ID_PERSON = @p1
+           OR va.ID_VIRTUAL_ADDRESS = (SELECT ID_VIRTUAL_ADDRESS FROM XXPerson.PERSONS WHERE ID_PERSON = @p1)
+        ORDER BY va.DATE_IN, va.ID_VIRTUAL_ADDRESS`, sql.Named("p1", id))
+	if err != nil {
+		return history, fmt.Errorf("error getting contact history: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var v VirtualAddress
+		var email, phoneNumber sql.NullString
+		var dateIn, dateOut sql.NullTime
+		if err := rows.Scan(&v.ID, &email, &phoneNumber, &dateIn, &dateOut); err != nil {
+			return history, fmt.Errorf("error scanning contact version: %w", err)
+		}
+		v.Email, v.PhoneNumber = email.String, phoneNumber.String
+		v.DateIn, v.DateOut = dateIn.Time, dateOut.Time
+		if err := v.decrypt(); err != nil {
+			return history, err
+		}
+		history.Contacts = append(history.Contacts, v)
+	}
+	if err := rows.Err(); err != nil {
+		return history, fmt.Errorf("error iterating over contact history: %w", err)
+	}
+
+	rows, err = db.DB.Query(`
+        SELECT ad.ID_ADDRESS, ad.ADDRESS, ad.DATE_IN, ad.DATE_OUT, l.ID_LOC, l.NAME, j.ID_JUD, j.NAME
+        FROM XXPerson.ADDRESS ad
+        LEFT JOIN XXPerson.LOC l ON ad.ID_LOC = l.ID_LOC
+        LEFT JOIN XXPerson.JUD j ON l.ID_JUD = j.ID_JUD
+        WHERE ad.ID_PERSON = @p1
+           OR ad.ID_ADDRESS = (SELECT ID_ADDRESS FROM XXPerson.PERSONS WHERE ID_PERSON = @p1)
+        ORDER BY ad.DATE_IN, ad.ID_ADDRESS`, sql.Named("p1", id))
+	if err != nil {
+		return history, fmt.Errorf("error getting address history: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var a Address
+		var address, locName, judName sql.NullString
+		var locID, judID sql.NullInt64
+		var dateIn, dateOut sql.NullTime
+		if err := rows.Scan(&a.IDAddress, &address, &dateIn, &dateOut, &locID, &locName, &judID, &judName); err != nil {
+			return history, fmt.Errorf("error scanning address version: %w", err)
+		}
+		a.Address = address.String
+		a.DateIn, a.DateOut = dateIn.Time, dateOut.Time
+		a.Loc.ID, a.Loc.Name = locID.Int64, locName.String
+		a.Loc.Jud.ID, a.Loc.Jud.Name = judID.Int64, judName.String
+		if err := a.decrypt(); err != nil {
+			return history, err
+		}
+		history.Addresses = append(history.Addresses, a)
+	}
+	if err := rows.Err(); err != nil {
+		return history, fmt.Errorf("error iterating over address history: %w", err)
+	}
+
+	return history, nil
+}
+
+// GetPersonAt returns the person with the contact details and postal address in force at
+// the given time. Names, CNP, sex and birth date are not versioned and are the current ones.
+func GetPersonAt(id int64, at time.Time) (Person, error) {
+	query := `
+        SELECT p.ID_PERSON, p.F_NAME, p.L_NAME, p.CNP, p.SEX, p.BORN_DATE,
+               va.ID_VIRTUAL_ADDRESS, va.EMAIL, va.PHONE_NUMBER, va.DATE_IN, va.DATE_OUT,
+               ad.ID_ADDRESS, ad.ADDRESS, ad.DATE_IN, ad.DATE_OUT,
+               l.ID_LOC, l.NAME, j.ID_JUD, j.NAME
+        FROM XXPerson.PERSONS p
+        OUTER APPLY (
+            SELECT TOP 1 v.*
+            FROM XXPerson.VIRTUAL_ADDRESS v
+            WHERE (v.ID_PERSON = p.ID_PERSON OR v.ID_VIRTUAL_ADDRESS = p.ID_VIRTUAL_ADDRESS)
+              AND v.DATE_IN <= @at AND (v.DATE_OUT IS NULL OR v.DATE_OUT > @at)
+            ORDER BY v.DATE_IN DESC
+        ) va
+        OUTER APPLY (
+            SELECT TOP 1 a.*
+            FROM XXPerson.ADDRESS a
+            WHERE (a.ID_PERSON = p.ID_PERSON OR a.ID_ADDRESS = p.ID_ADDRESS)
+              AND a.DATE_IN <= @at AND (a.DATE_OUT IS NULL OR a.DATE_OUT > @at)
+            ORDER BY a.DATE_IN DESC
+        ) ad
+        LEFT JOIN XXPerson.LOC l ON ad.ID_LOC = l.ID_LOC
+        LEFT JOIN XXPerson.JUD j ON l.ID_JUD = j.ID_JUD
+        WHERE p.ID_PERSON = @id`
+
+	var p Person
+	var fName, lName, cnp, sex sql.NullString
+	var bornDate sql.NullTime
+	var vaID, adID, locID, judID sql.NullInt64
+	var email, phoneNumber, address, locName, judName sql.NullString
+	var vaIn, vaOut, adIn, adOut sql.NullTime
+	err := db.DB.QueryRow(query, sql.Named("id", id), sql.Named("at", at)).Scan(
+		&p.IDPerson, &fName, &lName, &cnp, &sex, &bornDate,
+		&vaID, &email, &phoneNumber, &vaIn, &vaOut,
+		&adID, &address, &adIn, &adOut,
+		&locID, &locName, &judID, &judName)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return Person{}, ErrPersonNotFound
+		}
+		return Person{}, fmt.Errorf("error getting person with id %d: %w", id, err)
+	}
+	if !vaID.Valid && !adID.Valid {
+		return Person{}, fmt.Errorf("%w: no contact or address as of %s", ErrPersonNotFound, at.Format(time.RFC3339))
+	}
+
+	p.FName, p.LName, p.CNP, p.Sex = fName.String, lName.String, cnp.String, sex.String
+	p.BornDate = bornDate.Time
+	p.VirtualAddress = VirtualAddress{
+		ID:          vaID.Int64,
+		Email:       email.String,
+		PhoneNumber: phoneNumber.String,
+		DateIn:      vaIn.Time,
+		DateOut:     vaOut.Time,
+	}
+	p.Address = Address{
+		IDAddress: adID.Int64,
+		Address:   address.String,
+		DateIn:    adIn.Time,
+		DateOut:   adOut.Time,
+		Loc: Loc{
+			ID:   locID.Int64,
+			Name: locName.String,
+			Jud:  Jud{ID: judID.Int64, Name: judName.String},
+		},
+	}
+	if err := p.decrypt(); err != nil {
+		return Person{}, err
+	}
+	return p, nil
+}
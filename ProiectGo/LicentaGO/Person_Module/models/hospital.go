@@ -1,7 +1,46 @@
 package models
 
+import (
+	"database/sql"
+	"fmt"
+
+	"eoncohub.com/person_module/db"
+)
+
+// hospitalPersonSQL matches the persons p linked to the hospital @hospital: its patients
+// (through their doctors there), its doctors and the users holding a role there.
+const hospitalPersonSQL = `(
+	EXISTS (SELECT 1
+	        FROM XXPerson.PATIENTS pa
+	        JOIN XXPerson.PATIENTS_AND_DOCTORS pd ON pd.ID_PATIENT = pa.ID_PATIENT
+	        JOIN XXPerson.DOCTORS_AND_HOSPITALS pdh ON pdh.ID_DOCTOR_HOSPITAL = pd.ID_DOCTOR_HOSPITAL
+	        WHERE pa.ID_PERSON = p.ID_PERSON AND pdh.ID_HOSPITAL = @hospital)
+	OR EXISTS (SELECT 1
+	           FROM XXPerson.DOCTORS d
+	           JOIN XXPerson.DOCTORS_AND_HOSPITALS ddh ON ddh.ID_DOCTOR = d.ID_DOCTOR
+	           WHERE d.ID_PERSON = p.ID_PERSON AND ddh.ID_HOSPITAL = @hospital)
+	OR EXISTS (SELECT 1
+	           FROM XXAuth.USERS u
+	           JOIN XXAuth.USER_ROLES ur ON ur.ID_USER = u.ID_USER
+	           WHERE u.ID_PERSON = p.ID_PERSON AND ur.ID_HOSPITAL = @hospital)
+)`
+
 type Hospital struct {
 	ID        int    `json:"id_hospital"`
 	Name      string `json:"name"`
 	IDAddress int    `json:"id_address"`
 }
+
+// PersonAtHospital reports whether the person is a patient, doctor or user of the hospital.
+func PersonAtHospital(personID, hospitalID int64) (bool, error) {
+	var found bool
+	err := db.DB.QueryRow(`
+		SELECT CASE WHEN EXISTS (
+			SELECT 1 FROM XXPerson.PERSONS p WHERE p.ID_PERSON = @id AND `+hospitalPersonSQL+`
+		) THEN 1 ELSE 0 END
+	`, sql.Named("id", personID), sql.Named("hospital", hospitalID)).Scan(&found)
+	if err != nil {
+		return false, fmt.Errorf("error checking person hospital: %w", err)
+	}
+	return found, nil
+}
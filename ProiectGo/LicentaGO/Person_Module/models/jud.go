@@ -4,6 +4,8 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
+
+	"eoncohub.com/person_module/utils"
 )
 
 type Jud struct {
@@ -13,13 +15,15 @@ type Jud struct {
 
 // !!! AZURE SQL specific code !!!
 
-func (j *Jud) GetJud(tx *sql.Tx) error {
-	const selectQuery = `
-        SELECT ID_JUD 
+// judByName finds a county by name, ignoring case and diacritics, preferring the exact spelling.
+var judByName = `
+        SELECT TOP 1 ID_JUD 
         FROM XXPerson.JUD 
-        WHERE UPPER(NAME) = UPPER(@p1)`
+        WHERE ` + utils.FoldSQL("NAME") + ` = @p2
+        ORDER BY CASE WHEN NAME = @p1 THEN 0 ELSE 1 END, ID_JUD`
 
-	err := tx.QueryRow(selectQuery, j.Name).Scan(&j.ID)
+func (j *Jud) GetJud(tx *sql.Tx) error {
+	err := tx.QueryRow(judByName, sql.Named("p1", j.Name), sql.Named("p2", utils.FoldDiacritics(j.Name))).Scan(&j.ID)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return fmt.Errorf("jud not found: %w", err)
@@ -33,11 +37,8 @@ func (j *Jud) GetJud(tx *sql.Tx) error {
 func (j *Jud) UpdateJud(tx *sql.Tx) error {
 	var existingID int64
 
-	// SQL Server uses @p1 for parameter placeholders
-	query := "SELECT ID_JUD FROM XXPerson.JUD WHERE UPPER(NAME) = UPPER(@p1)"
-
-	// Execute the query to find if a Jud exists with the same name (case insensitive)
-	err := tx.QueryRow(query, sql.Named("p1", j.Name)).Scan(&existingID)
+	// Execute the query to find if a Jud exists with the same name (case and diacritics insensitive)
+	err := tx.QueryRow(judByName, sql.Named("p1", j.Name), sql.Named("p2", utils.FoldDiacritics(j.Name))).Scan(&existingID)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 		}
@@ -4,6 +4,8 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
+
+	"eoncohub.com/person_module/utils"
 	// go_ora "github.com/sijms/go-ora/v2"
 )
 
@@ -13,14 +15,18 @@ type Loc struct {
 	Jud  Jud    `json:"jud"`
 }
 
-// !!! AZURE SQL specific code !!!
-func (l *Loc) GetLoc(tx *sql.Tx) error {
-	const selectQuery = `
-        SELECT ID_LOC 
+// locByName finds a locality of a county by name, ignoring case and diacritics. When a
+// county has several localities of that name, the exact spelling wins, then the more
+// important SIRUTA type (municipalities and towns before villages).
+var locByName = `
+        SELECT TOP 1 ID_LOC 
         FROM XXPerson.LOC 
-        WHERE UPPER(NAME) = UPPER(@p1) AND ID_JUD = @p2`
+        WHERE ` + utils.FoldSQL("NAME") + ` = @p3 AND ID_JUD = @p2
+        ORDER BY CASE WHEN NAME = @p1 THEN 0 ELSE 1 END, ISNULL(TIP, 99), ID_LOC`
 
-	err := tx.QueryRow(selectQuery, l.Name, l.Jud.ID).Scan(&l.ID)
+// !!! AZURE SQL specific code !!!
+func (l *Loc) GetLoc(tx *sql.Tx) error {
+	err := tx.QueryRow(locByName, sql.Named("p1", l.Name), sql.Named("p2", l.Jud.ID), sql.Named("p3", utils.FoldDiacritics(l.Name))).Scan(&l.ID)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return fmt.Errorf("Loc not found: %w", err)
@@ -40,11 +46,8 @@ func (l *Loc) UpdateLoc(tx *sql.Tx) error {
 
 	var existingID int64
 
-	// SQL Server uses @p1, @p2 for parameter placeholders
-	query := "SELECT ID_LOC FROM XXPerson.LOC WHERE UPPER(NAME) = UPPER(@p1) AND ID_JUD = @p2"
-
 	// Execute the query to check if the Loc exists with the given name and ID_JUD
-	err = tx.QueryRow(query, sql.Named("p1", l.Name), sql.Named("p2", l.Jud.ID)).Scan(&existingID)
+	err = tx.QueryRow(locByName, sql.Named("p1", l.Name), sql.Named("p2", l.Jud.ID), sql.Named("p3", utils.FoldDiacritics(l.Name))).Scan(&existingID)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return errors.New("loc not found")
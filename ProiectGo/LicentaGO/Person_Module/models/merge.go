@@ -0,0 +1,306 @@
+package models
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"eoncohub.com/person_module/db"
+)
+
+var (
+	ErrMergeSamePerson = errors.New("a person cannot be merged into itself")
+	ErrPersonMerged    = errors.New("person has already been merged")
+	ErrMergeConflict   = errors.New("persons cannot be merged")
+	ErrMergeNotFound   = errors.New("merge not found")
+	ErrMergeUndone     = errors.New("merge has already been undone")
+)
+
+// PersonMerge records that the patients, doctors and accounts of a duplicate person were
+// moved to the surviving one, with their IDs so that UndoMerge can move them back.
+type PersonMerge struct {
+	IDMerge     int64      `json:"id_merge"`
+	SurvivorID  int64      `json:"survivor_id"`
+	DuplicateID int64      `json:"duplicate_id"`
+	PatientIDs  []int64    `json:"patient_ids"`
+	DoctorIDs   []int64    `json:"doctor_ids"`
+	UserIDs     []int64    `json:"user_ids"`
+	MergedBy    int64      `json:"merged_by"`
+	MergedAt    time.Time  `json:"merged_at"`
+	UndoneBy    int64      `json:"undone_by,omitempty"`
+	UndoneAt    *time.Time `json:"undone_at,omitempty"`
+}
+
+// MergePersons moves the PATIENTS, DOCTORS and XXAuth.USERS rows of the duplicate person
+// to the survivor and marks the duplicate as merged into it. A person can be one doctor
+// and have one account, so persons that are both doctors or both have an account are
+// not merged.
+func MergePersons(survivorID, duplicateID, adminID int64) (PersonMerge, error) {
+	if survivorID == duplicateID {
+		return PersonMerge{}, ErrMergeSamePerson
+	}
+
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return PersonMerge{}, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`
+		SELECT ID_PERSON, MERGED_INTO,
+		       (SELECT COUNT(*) FROM XXPerson.DOCTORS d WHERE d.ID_PERSON = p.ID_PERSON),
+		       (SELECT COUNT(*) FROM XXAuth.USERS u WHERE u.ID_PERSON = p.ID_PERSON)
+		FROM XXPerson.PERSONS p WITH (UPDLOCK)
+		WHERE ID_PERSON IN (@survivor, @duplicate)
+	`, sql.Named("survivor", survivorID), sql.Named("duplicate", duplicateID))
+	if err != nil {
+		return PersonMerge{}, fmt.Errorf("error loading persons: %w", err)
+	}
+	found, doctors, users := 0, 0, 0
+	for rows.Next() {
+		var id int64
+		var mergedInto sql.NullInt64
+		var personDoctors, personUsers int
+		if err := rows.Scan(&id, &mergedInto, &personDoctors, &personUsers); err != nil {
+			rows.Close()
+			return PersonMerge{}, fmt.Errorf("error scanning person: %w", err)
+		}
+		if mergedInto.Valid {
+			rows.Close()
+			return PersonMerge{}, fmt.Errorf("%w: %d", ErrPersonMerged, id)
+		}
+		found++
+		if personDoctors > 0 {
+			doctors++
+		}
+		if personUsers > 0 {
+			users++
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return PersonMerge{}, fmt.Errorf("error iterating over persons: %w", err)
+	}
+	if found < 2 {
+		return PersonMerge{}, ErrPersonNotFound
+	}
+	if doctors > 1 {
+		return PersonMerge{}, fmt.Errorf("%w: both persons are doctors", ErrMergeConflict)
+	}
+	if users > 1 {
+		return PersonMerge{}, fmt.Errorf("%w: both persons have an account", ErrMergeConflict)
+	}
+
+	merge := PersonMerge{SurvivorID: survivorID, DuplicateID: duplicateID, MergedBy: adminID}
+	moves := []struct {
+		query string
+		ids   *[]int64
+	}{
+		{`UPDATE XXPerson.PATIENTS SET ID_PERSON = @survivor OUTPUT INSERTED.ID_PATIENT WHERE ID_PERSON = @duplicate`, &merge.PatientIDs},
+		{`UPDATE XXPerson.DOCTORS SET ID_PERSON = @survivor OUTPUT INSERTED.ID_DOCTOR WHERE ID_PERSON = @duplicate`, &merge.DoctorIDs},
+		{`UPDATE XXAuth.USERS SET ID_PERSON = @survivor OUTPUT INSERTED.ID_USER WHERE ID_PERSON = @duplicate`, &merge.UserIDs},
+	}
+	for _, m := range moves {
+		ids, err := queryIDs(tx, m.query, sql.Named("survivor", survivorID), sql.Named("duplicate", duplicateID))
+		if err != nil {
+			return PersonMerge{}, fmt.Errorf("error moving references: %w", err)
+		}
+		*m.ids = ids
+	}
+
+	_, err = tx.Exec(`UPDATE XXPerson.PERSONS SET MERGED_INTO = @survivor WHERE ID_PERSON = @duplicate`,
+		sql.Named("survivor", survivorID), sql.Named("duplicate", duplicateID))
+	if err != nil {
+		return PersonMerge{}, fmt.Errorf("error marking person as merged: %w", err)
+	}
+
+	patients, _ := json.Marshal(merge.PatientIDs)
+	doctorIDs, _ := json.Marshal(merge.DoctorIDs)
+	userIDs, _ := json.Marshal(merge.UserIDs)
+	err = tx.QueryRow(`
+		INSERT INTO XXPerson.PERSON_MERGES (SURVIVOR_ID, DUPLICATE_ID, PATIENT_IDS, DOCTOR_IDS, USER_IDS, MERGED_BY)
+		OUTPUT INSERTED.ID_MERGE, INSERTED.MERGED_AT
+		VALUES (@survivor, @duplicate, @patients, @doctors, @users, @admin)
+	`,
+		sql.Named("survivor", survivorID),
+		sql.Named("duplicate", duplicateID),
+		sql.Named("patients", string(patients)),
+		sql.Named("doctors", string(doctorIDs)),
+		sql.Named("users", string(userIDs)),
+		sql.Named("admin", adminID),
+	).Scan(&merge.IDMerge, &merge.MergedAt)
+	if err != nil {
+		return PersonMerge{}, fmt.Errorf("error logging merge: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return PersonMerge{}, fmt.Errorf("error committing transaction: %w", err)
+	}
+	return merge, nil
+}
+
+// UndoMerge moves the rows a merge moved back to the duplicate person and makes it a
+// person of its own again. Rows added to the survivor since the merge stay with it. A
+// survivor that was merged again afterwards has to be unmerged first.
+func UndoMerge(mergeID, adminID int64) (PersonMerge, error) {
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return PersonMerge{}, err
+	}
+	defer tx.Rollback()
+
+	merge, err := scanMerge(tx.QueryRow(`
+		SELECT `+mergeColumns+`
+		FROM XXPerson.PERSON_MERGES WITH (UPDLOCK)
+		WHERE ID_MERGE = @id
+	`, sql.Named("id", mergeID)))
+	if err == sql.ErrNoRows {
+		return PersonMerge{}, ErrMergeNotFound
+	}
+	if err != nil {
+		return PersonMerge{}, fmt.Errorf("error loading merge: %w", err)
+	}
+	if merge.UndoneAt != nil {
+		return PersonMerge{}, ErrMergeUndone
+	}
+
+	var survivorMerged sql.NullInt64
+	err = tx.QueryRow(`SELECT MERGED_INTO FROM XXPerson.PERSONS WITH (UPDLOCK) WHERE ID_PERSON = @survivor`,
+		sql.Named("survivor", merge.SurvivorID)).Scan(&survivorMerged)
+	if err != nil {
+		return PersonMerge{}, fmt.Errorf("error loading surviving person: %w", err)
+	}
+	if survivorMerged.Valid {
+		return PersonMerge{}, fmt.Errorf("%w: person %d was merged into %d afterwards, undo that first",
+			ErrMergeConflict, merge.SurvivorID, survivorMerged.Int64)
+	}
+
+	moves := []struct {
+		query string
+		ids   []int64
+	}{
+		{`UPDATE XXPerson.PATIENTS SET ID_PERSON = @duplicate
+		  WHERE ID_PERSON = @survivor AND ID_PATIENT IN (SELECT CAST(value AS INT) FROM OPENJSON(@ids))`, merge.PatientIDs},
+		{`UPDATE XXPerson.DOCTORS SET ID_PERSON = @duplicate
+		  WHERE ID_PERSON = @survivor AND ID_DOCTOR IN (SELECT CAST(value AS INT) FROM OPENJSON(@ids))`, merge.DoctorIDs},
+		{`UPDATE XXAuth.USERS SET ID_PERSON = @duplicate
+		  WHERE ID_PERSON = @survivor AND ID_USER IN (SELECT CAST(value AS INT) FROM OPENJSON(@ids))`, merge.UserIDs},
+	}
+	for _, m := range moves {
+		if len(m.ids) == 0 {
+			continue
+		}
+		ids, _ := json.Marshal(m.ids)
+		_, err := tx.Exec(m.query,
+			sql.Named("survivor", merge.SurvivorID),
+			sql.Named("duplicate", merge.DuplicateID),
+			sql.Named("ids", string(ids)))
+		if err != nil {
+			return PersonMerge{}, fmt.Errorf("error moving references back: %w", err)
+		}
+	}
+
+	_, err = tx.Exec(`UPDATE XXPerson.PERSONS SET MERGED_INTO = NULL WHERE ID_PERSON = @duplicate`,
+		sql.Named("duplicate", merge.DuplicateID))
+	if err != nil {
+		return PersonMerge{}, fmt.Errorf("error restoring person: %w", err)
+	}
+
+	var undoneAt time.Time
+	err = tx.QueryRow(`
+		UPDATE XXPerson.PERSON_MERGES
+		SET UNDONE_BY = @admin, UNDONE_AT = SYSUTCDATETIME()
+		OUTPUT INSERTED.UNDONE_AT
+		WHERE ID_MERGE = @id
+	`, sql.Named("admin", adminID), sql.Named("id", mergeID)).Scan(&undoneAt)
+	if err != nil {
+		return PersonMerge{}, fmt.Errorf("error logging undo: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return PersonMerge{}, fmt.Errorf("error committing transaction: %w", err)
+	}
+	merge.UndoneBy, merge.UndoneAt = adminID, &undoneAt
+	return merge, nil
+}
+
+// ListMerges returns the merges a person took part in, or all of them for personID zero,
+// newest first.
+func ListMerges(personID int64) ([]PersonMerge, error) {
+	rows, err := db.DB.Query(`
+		SELECT `+mergeColumns+`
+		FROM XXPerson.PERSON_MERGES
+		WHERE @person = 0 OR SURVIVOR_ID = @person OR DUPLICATE_ID = @person
+		ORDER BY MERGED_AT DESC, ID_MERGE DESC
+	`, sql.Named("person", personID))
+	if err != nil {
+		return nil, fmt.Errorf("error listing merges: %w", err)
+	}
+	defer rows.Close()
+
+	merges := []PersonMerge{}
+	for rows.Next() {
+		m, err := scanMerge(rows)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning merge: %w", err)
+		}
+		merges = append(merges, m)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over merges: %w", err)
+	}
+	return merges, nil
+}
+
+const mergeColumns = `ID_MERGE, SURVIVOR_ID, DUPLICATE_ID, PATIENT_IDS, DOCTOR_IDS, USER_IDS,
+	MERGED_BY, MERGED_AT, UNDONE_BY, UNDONE_AT`
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanMerge(row rowScanner) (PersonMerge, error) {
+	var m PersonMerge
+	var patients, doctors, users string
+	var undoneBy sql.NullInt64
+	var undoneAt sql.NullTime
+	err := row.Scan(&m.IDMerge, &m.SurvivorID, &m.DuplicateID, &patients, &doctors, &users,
+		&m.MergedBy, &m.MergedAt, &undoneBy, &undoneAt)
+	if err != nil {
+		return m, err
+	}
+	for _, list := range []struct {
+		raw string
+		ids *[]int64
+	}{{patients, &m.PatientIDs}, {doctors, &m.DoctorIDs}, {users, &m.UserIDs}} {
+		if err := json.Unmarshal([]byte(list.raw), list.ids); err != nil {
+			return m, fmt.Errorf("error decoding merged IDs: %w", err)
+		}
+	}
+	m.UndoneBy = undoneBy.Int64
+	if undoneAt.Valid {
+		m.UndoneAt = &undoneAt.Time
+	}
+	return m, nil
+}
+
+// queryIDs runs a statement returning one ID per row.
+func queryIDs(tx *sql.Tx, query string, args ...any) ([]int64, error) {
+	rows, err := tx.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := []int64{}
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
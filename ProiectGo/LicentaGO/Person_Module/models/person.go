@@ -9,6 +9,7 @@ import (
 
 	"eoncohub.com/person_module/db"
 	"eoncohub.com/person_module/utils"
+	"eoncohub.com/shared_module/pii"
 )
 
 var ErrPersonNotFound = errors.New("person not found or already expired")
@@ -22,11 +23,20 @@ type Person struct {
 	BornDate       time.Time      `json:"born_date"`
 	Address        Address        `json:"address"`
 	VirtualAddress VirtualAddress `json:"virtual_address"`
+	// AllowSimilar lets Create store a person that only looks like an existing one.
+	AllowSimilar bool `json:"allow_similar,omitempty"`
+	// Staff marks the person behind a staff account created by Auth_Module, such as a
+	// nurse signing up, who may be stored without a CNP. Patients and doctors need one.
+	Staff bool `json:"staff,omitempty"`
 }
 
 // !!! AZURE SQL specific code !!!
 
 func (p *Person) Create() error {
+	if err := p.validateIdentity(); err != nil {
+		return err
+	}
+
 	// Begin a new transaction
 	tx, err := db.DB.Begin()
 	if err != nil {
@@ -34,6 +44,12 @@ func (p *Person) Create() error {
 	}
 	defer tx.Rollback() // This will be a no-op if the tx has been committed later
 
+	// Refuse to create a second record of someone already known
+	err = p.findDuplicates(tx)
+	if err != nil {
+		return err
+	}
+
 	// Create virtual address within the same transaction
 	err = p.VirtualAddress.CreateVirtualAddress(tx)
 	if err != nil {
@@ -47,20 +63,28 @@ func (p *Person) Create() error {
 	}
 
 	log.Printf("Created address with ID: %d", p.Address.IDAddress)
+	cnp, err := seal(pii.FieldCNP, p.CNP)
+	if err != nil {
+		return err
+	}
 	// Prepare the SQL Server INSERT statement
 	stmt, err := tx.Prepare(`
-        INSERT INTO XXPerson.PERSONS (f_name, l_name, cnp, born_date, id_address, id_virtual_address, sex) 
+        INSERT INTO XXPerson.PERSONS (f_name, l_name, cnp, cnp_hash, born_date, id_address, id_virtual_address, sex) 
         OUTPUT INSERTED.id_person
-        VALUES (@p1, @p2, @p3, @p4, @p5, @p6, @p7)`)
+        VALUES (@p1, @p2, @p3, @p4, @p5, @p6, @p7, @p8)`)
 	if err != nil {
 		return err
 	}
 	defer stmt.Close()
 
-	// Execute the statement and capture the inserted ID
+	// Execute the statement and capture the inserted ID. Staff stored without a CNP or
+	// birth date get NULLs rather than empty values.
 	var newID int64
 	err = stmt.QueryRow(
-		p.FName, p.LName, p.CNP, p.BornDate, p.Address.IDAddress, p.VirtualAddress.ID, p.Sex,
+		p.FName, p.LName,
+		sql.NullString{String: cnp.value, Valid: cnp.value != ""}, cnp.index,
+		sql.NullTime{Time: p.BornDate, Valid: !p.BornDate.IsZero()},
+		p.Address.IDAddress, p.VirtualAddress.ID, p.Sex,
 	).Scan(&newID)
 	if err != nil {
 		return fmt.Errorf("error inserting person: %w", err)
@@ -69,6 +93,15 @@ func (p *Person) Create() error {
 	// Set the new ID to the Person struct
 	p.IDPerson = newID
 
+	// Tie the first versions of the contact and address to the person, for their history
+	_, err = tx.Exec(`
+        UPDATE XXPerson.VIRTUAL_ADDRESS SET ID_PERSON = @p1 WHERE ID_VIRTUAL_ADDRESS = @p2;
+        UPDATE XXPerson.ADDRESS SET ID_PERSON = @p1 WHERE ID_ADDRESS = @p3;`,
+		sql.Named("p1", p.IDPerson), sql.Named("p2", p.VirtualAddress.ID), sql.Named("p3", p.Address.IDAddress))
+	if err != nil {
+		return fmt.Errorf("error linking addresses to person: %w", err)
+	}
+
 	// Commit the transaction
 	if err := tx.Commit(); err != nil {
 		return fmt.Errorf("error committing transaction: %w", err)
@@ -77,6 +110,8 @@ func (p *Person) Create() error {
 	return nil
 }
 
+// GetPerson returns the person with its current contact details and address. Staff may
+// have no CNP or birth date, and the address parts are left empty when missing.
 func GetPerson(id int64) (Person, error) {
 	var p Person
 	// Define the SQL Server query with parameters
@@ -94,26 +129,28 @@ func GetPerson(id int64) (Person, error) {
                j.NAME AS JUD_NAME,
                va.DATE_IN
         FROM XXPerson.PERSONS p
-        INNER JOIN XXPerson.VIRTUAL_ADDRESS va ON p.ID_VIRTUAL_ADDRESS = va.ID_VIRTUAL_ADDRESS
-        INNER JOIN XXPerson.ADDRESS ad ON p.ID_ADDRESS = ad.ID_ADDRESS
-        INNER JOIN XXPerson.LOC l ON ad.ID_LOC = l.ID_LOC
-        INNER JOIN XXPerson.JUD j ON l.ID_JUD = j.ID_JUD
+        LEFT JOIN XXPerson.VIRTUAL_ADDRESS va ON p.ID_VIRTUAL_ADDRESS = va.ID_VIRTUAL_ADDRESS
+        LEFT JOIN XXPerson.ADDRESS ad ON p.ID_ADDRESS = ad.ID_ADDRESS
+        LEFT JOIN XXPerson.LOC l ON ad.ID_LOC = l.ID_LOC
+        LEFT JOIN XXPerson.JUD j ON l.ID_JUD = j.ID_JUD
         WHERE p.ID_PERSON = @ID`
 
-	// Execute the query and scan the result into the Person struct
+	var fName, lName, cnp, sex sql.NullString
+	var email, phoneNumber, address, locName, judName sql.NullString
+	var bornDate, dateIn sql.NullTime
 	err := db.DB.QueryRow(query, sql.Named("ID", id)).Scan(
 		&p.IDPerson,
-		&p.FName,
-		&p.LName,
-		&p.CNP,
-		&p.Sex,
-		&p.BornDate,
-		&p.VirtualAddress.Email,
-		&p.VirtualAddress.PhoneNumber,
-		&p.Address.Address,
-		&p.Address.Loc.Name,
-		&p.Address.Loc.Jud.Name,
-		&p.VirtualAddress.DateIn)
+		&fName,
+		&lName,
+		&cnp,
+		&sex,
+		&bornDate,
+		&email,
+		&phoneNumber,
+		&address,
+		&locName,
+		&judName,
+		&dateIn)
 
 	if err != nil {
 		if err == sql.ErrNoRows {
@@ -121,11 +158,27 @@ func GetPerson(id int64) (Person, error) {
 		}
 		return Person{}, fmt.Errorf("error getting person with id %d: %v", id, err)
 	}
+	p.FName, p.LName, p.CNP, p.Sex = fName.String, lName.String, cnp.String, sex.String
+	p.BornDate = bornDate.Time
+	p.VirtualAddress.Email, p.VirtualAddress.PhoneNumber = email.String, phoneNumber.String
+	p.VirtualAddress.DateIn = dateIn.Time
+	p.Address.Address = address.String
+	p.Address.Loc.Name, p.Address.Loc.Jud.Name = locName.String, judName.String
+	if err := p.decrypt(); err != nil {
+		return Person{}, err
+	}
 
 	return p, nil
 }
 
+// Update stores the changes of a person read with GetPerson. The identity is checked as
+// in Create, so a CNP, sex or birth date that do not agree answers a *ValidationError,
+// and a CNP another person has a *DuplicateError.
 func (p *Person) Update() error {
+	if err := p.validateIdentity(); err != nil {
+		return err
+	}
+
 	tx, err := db.DB.Begin()
 	if err != nil {
 		return err
@@ -194,8 +247,30 @@ func (p *Person) Update() error {
 		paramCount++
 	}
 	if p.CNP != "" {
-		updateQuery += fmt.Sprintf("cnp = @p%d, ", paramCount)
-		updateParams = append(updateParams, sql.Named(fmt.Sprintf("p%d", paramCount), p.CNP))
+		var cnp sealed
+		cnp, err = seal(pii.FieldCNP, p.CNP)
+		if err != nil {
+			return err
+		}
+		// Another person with this CNP would be a second record of the same human
+		var taken bool
+		taken, err = p.cnpTaken(tx, cnp.index)
+		if err != nil {
+			return err
+		}
+		if taken {
+			err = &DuplicateError{Exact: true}
+			return err
+		}
+		updateQuery += fmt.Sprintf("cnp = @p%d, cnp_hash = @p%d, ", paramCount, paramCount+1)
+		updateParams = append(updateParams,
+			sql.Named(fmt.Sprintf("p%d", paramCount), cnp.value),
+			sql.Named(fmt.Sprintf("p%d", paramCount+1), cnp.index))
+		paramCount += 2
+	}
+	if p.Sex != "" {
+		updateQuery += fmt.Sprintf("sex = @p%d, ", paramCount)
+		updateParams = append(updateParams, sql.Named(fmt.Sprintf("p%d", paramCount), p.Sex))
 		paramCount++
 	}
 	if !p.BornDate.IsZero() {
@@ -256,16 +331,16 @@ func DeletePerson(personID int64) error {
 		return err
 	}
 
-	// Delete address if it exists
-	if addressID != 0 {
-		_, err = tx.Exec("DELETE FROM XXPerson.ADDRESS WHERE ID_ADDRESS = @p1", sql.Named("p1", addressID))
-		if err != nil {
-			return err
-		}
+	// Delete the address and its earlier versions
+	_, err = tx.Exec("DELETE FROM XXPerson.ADDRESS WHERE ID_ADDRESS = @p1 OR ID_PERSON = @p2",
+		sql.Named("p1", addressID), sql.Named("p2", personID))
+	if err != nil {
+		return err
 	}
 
-	// Delete virtual address
-	_, err = tx.Exec("DELETE FROM XXPerson.VIRTUAL_ADDRESS WHERE ID_VIRTUAL_ADDRESS = @p1", sql.Named("p1", virtualAddressID))
+	// Delete the virtual address and its earlier versions
+	_, err = tx.Exec("DELETE FROM XXPerson.VIRTUAL_ADDRESS WHERE ID_VIRTUAL_ADDRESS = @p1 OR ID_PERSON = @p2",
+		sql.Named("p1", virtualAddressID), sql.Named("p2", personID))
 	if err != nil {
 		return err
 	}
@@ -301,6 +376,7 @@ func GetAllPersons() ([]Person, error) {
 		LEFT JOIN XXPerson.ADDRESS ad ON p.ID_ADDRESS = ad.ID_ADDRESS
 		LEFT JOIN XXPerson.LOC l ON ad.ID_LOC = l.ID_LOC
 		LEFT JOIN XXPerson.JUD j ON l.ID_JUD = j.ID_JUD
+		WHERE p.MERGED_INTO IS NULL
 	`)
 	if err != nil {
 		return nil, errors.New("error getting all persons")
@@ -349,6 +425,9 @@ func GetAllPersons() ([]Person, error) {
 		p.Address.Address = address.String
 		p.Address.Loc.Name = locName.String
 		p.Address.Loc.Jud.Name = judName.String
+		if err := p.decrypt(); err != nil {
+			return nil, err
+		}
 
 		persons = append(persons, p)
 	}
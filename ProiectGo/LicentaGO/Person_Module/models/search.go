@@ -0,0 +1,357 @@
+package models
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"eoncohub.com/person_module/db"
+	"eoncohub.com/person_module/utils"
+	"eoncohub.com/shared_module/pii"
+)
+
+var (
+	ErrInvalidSort   = errors.New("invalid sort")
+	ErrInvalidCursor = errors.New("invalid cursor")
+	// ErrIncompleteFilter is returned for a partial CNP or a phone number of fewer than 9
+	// digits, which cannot be looked up once encrypted.
+	ErrIncompleteFilter = errors.New("cnp must have 13 digits and phone at least 9")
+)
+
+const (
+	DefaultSearchLimit = 20
+	MaxSearchLimit     = 100
+
+	// maxNameTerms caps the words of a name search, each one is scored separately.
+	maxNameTerms = 4
+)
+
+// PersonSearch filters persons. Empty fields do not filter. Name matches the first or
+// last name, word by word, ignoring case and Romanian diacritics; County and Locality
+// match the start of the name the same way. CNP, Email and Phone match the whole value,
+// the email without case and the phone on its last 9 digits. A non-zero HospitalID keeps
+// only the persons linked to that hospital.
+type PersonSearch struct {
+	HospitalID int64
+	CNP        string
+	Name       string
+	Email      string
+	Phone      string
+	County     string
+	Locality   string
+	Sort       string
+	Cursor     string
+	Limit      int
+}
+
+// PersonMatch is a search result. Score ranks how well the name matched, highest first.
+type PersonMatch struct {
+	Person
+	Score int `json:"score,omitempty"`
+}
+
+// SearchResult is a page of matches. NextCursor fetches the next page and is empty on
+// the last one.
+type SearchResult struct {
+	Persons    []PersonMatch `json:"persons"`
+	NextCursor string        `json:"next_cursor,omitempty"`
+}
+
+// searchCursor holds the sort values of the last row of a page.
+type searchCursor struct {
+	Sort  string    `json:"s"`
+	Score int       `json:"sc,omitempty"`
+	LName string    `json:"l,omitempty"`
+	FName string    `json:"f,omitempty"`
+	Born  time.Time `json:"b,omitempty"`
+	ID    int64     `json:"id"`
+}
+
+type sortKey struct {
+	column string
+	desc   bool
+	value  func(c searchCursor) any
+}
+
+var (
+	byScore = func(c searchCursor) any { return c.Score }
+	byLName = func(c searchCursor) any { return c.LName }
+	byFName = func(c searchCursor) any { return c.FName }
+	byBorn  = func(c searchCursor) any { return c.Born }
+	byID    = func(c searchCursor) any { return c.ID }
+)
+
+// searchSorts are the orders a search can be sorted by. Each ends with ID_PERSON so that
+// the order is total and a cursor points at exactly one row.
+var searchSorts = map[string][]sortKey{
+	"relevance":  {{"SCORE", true, byScore}, {"SORT_L", false, byLName}, {"SORT_F", false, byFName}, {"ID_PERSON", false, byID}},
+	"name":       {{"SORT_L", false, byLName}, {"SORT_F", false, byFName}, {"ID_PERSON", false, byID}},
+	"-name":      {{"SORT_L", true, byLName}, {"SORT_F", true, byFName}, {"ID_PERSON", true, byID}},
+	"born_date":  {{"SORT_BORN", false, byBorn}, {"ID_PERSON", false, byID}},
+	"-born_date": {{"SORT_BORN", true, byBorn}, {"ID_PERSON", true, byID}},
+}
+
+// SearchPersons returns a page of the persons matching s. Without a sort, name searches
+// are ranked by relevance and the others sorted by name.
+func SearchPersons(s PersonSearch) (SearchResult, error) {
+	terms := strings.Fields(utils.FoldDiacritics(s.Name))
+	if len(terms) > maxNameTerms {
+		terms = terms[:maxNameTerms]
+	}
+
+	sortName := s.Sort
+	if sortName == "" {
+		sortName = "name"
+		if len(terms) > 0 {
+			sortName = "relevance"
+		}
+	}
+	keys, ok := searchSorts[sortName]
+	if !ok {
+		return SearchResult{}, ErrInvalidSort
+	}
+
+	limit := s.Limit
+	if limit <= 0 {
+		limit = DefaultSearchLimit
+	}
+	if limit > MaxSearchLimit {
+		limit = MaxSearchLimit
+	}
+
+	var args []any
+	var where []string
+	var scores, scoreFilters []string
+	var scoreColumns []string
+
+	lName, fName := utils.FoldSQL("p.L_NAME"), utils.FoldSQL("p.F_NAME")
+	for i, term := range terms {
+		esc := utils.EscapeLike(term)
+		args = append(args,
+			sql.Named(fmt.Sprintf("t%d", i), term),
+			sql.Named(fmt.Sprintf("t%d_prefix", i), esc+"%"),
+			sql.Named(fmt.Sprintf("t%d_word", i), "%[ -]"+esc+"%"),
+			sql.Named(fmt.Sprintf("t%d_any", i), "%"+esc+"%"),
+		)
+		scoreColumns = append(scoreColumns,
+			termScore(lName, i)+fmt.Sprintf(" AS L%d", i),
+			termScore(fName, i)+fmt.Sprintf(" AS F%d", i))
+		scores = append(scores, fmt.Sprintf("CASE WHEN ts.L%[1]d > ts.F%[1]d THEN ts.L%[1]d ELSE ts.F%[1]d END", i))
+		scoreFilters = append(scoreFilters, fmt.Sprintf("(ts.L%[1]d > 0 OR ts.F%[1]d > 0)", i))
+	}
+	where = append(where, scoreFilters...)
+
+	// The CNP, email and phone are encrypted and looked up by their blind index, so they
+	// only match whole. Rows not encrypted yet are compared as they are.
+	if cnp := strings.TrimSpace(s.CNP); cnp != "" {
+		if len(utils.Digits(cnp)) != 13 {
+			return SearchResult{}, ErrIncompleteFilter
+		}
+		hash, err := blindIndex(pii.FieldCNP, cnp)
+		if err != nil {
+			return SearchResult{}, err
+		}
+		where = append(where, "(p.CNP_HASH = @cnp_hash OR p.CNP = @cnp)")
+		args = append(args, sql.Named("cnp_hash", hash), sql.Named("cnp", pii.Normalize(pii.FieldCNP, cnp)))
+	}
+	if email := strings.TrimSpace(s.Email); email != "" {
+		hash, err := blindIndex(pii.FieldEmail, email)
+		if err != nil {
+			return SearchResult{}, err
+		}
+		where = append(where, "(va.EMAIL_HASH = @email_hash OR LOWER(va.EMAIL) = @email)")
+		args = append(args, sql.Named("email_hash", hash), sql.Named("email", pii.Normalize(pii.FieldEmail, email)))
+	}
+	if phone := strings.TrimSpace(s.Phone); phone != "" {
+		hash, err := blindIndex(pii.FieldPhone, phone)
+		if err != nil {
+			return SearchResult{}, err
+		}
+		if hash == nil {
+			return SearchResult{}, ErrIncompleteFilter
+		}
+		where = append(where, "(va.PHONE_HASH = @phone_hash OR RIGHT("+phoneDigitsSQL("va.PHONE_NUMBER")+", 9) = @phone)")
+		args = append(args, sql.Named("phone_hash", hash), sql.Named("phone", pii.Normalize(pii.FieldPhone, phone)))
+	}
+	if s.HospitalID != 0 {
+		where = append(where, hospitalPersonSQL)
+		args = append(args, sql.Named("hospital", s.HospitalID))
+	}
+	if county := strings.TrimSpace(s.County); county != "" {
+		where = append(where, utils.FoldSQL("j.NAME")+` LIKE @county ESCAPE '\'`)
+		args = append(args, sql.Named("county", utils.EscapeLike(utils.FoldDiacritics(county))+"%"))
+	}
+	if locality := strings.TrimSpace(s.Locality); locality != "" {
+		where = append(where, utils.FoldSQL("l.NAME")+` LIKE @locality ESCAPE '\'`)
+		args = append(args, sql.Named("locality", utils.EscapeLike(utils.FoldDiacritics(locality))+"%"))
+	}
+
+	score := "0"
+	apply := ""
+	if len(terms) > 0 {
+		score = strings.Join(scores, " + ")
+		apply = "CROSS APPLY (SELECT " + strings.Join(scoreColumns, ",\n\t\t\t") + ") ts"
+	}
+	if len(where) == 0 {
+		where = append(where, "1 = 1")
+	}
+
+	after := "1 = 1"
+	if s.Cursor != "" {
+		cursor, err := decodeCursor(s.Cursor)
+		if err != nil || cursor.Sort != sortName {
+			return SearchResult{}, ErrInvalidCursor
+		}
+		var cond []string
+		cond, args = keysetCondition(keys, cursor, args)
+		after = strings.Join(cond, " OR ")
+	}
+
+	order := make([]string, len(keys))
+	for i, k := range keys {
+		order[i] = k.column
+		if k.desc {
+			order[i] += " DESC"
+		}
+	}
+
+	query := fmt.Sprintf(`
+		WITH matches AS (
+			SELECT p.ID_PERSON, p.F_NAME, p.L_NAME, p.CNP, p.SEX, p.BORN_DATE,
+			       va.EMAIL, va.PHONE_NUMBER, ad.ADDRESS, l.NAME AS LOC_NAME, j.NAME AS JUD_NAME,
+			       ISNULL(%s, N'') AS SORT_L,
+			       ISNULL(%s, N'') AS SORT_F,
+			       ISNULL(p.BORN_DATE, '19000101') AS SORT_BORN,
+			       %s AS SCORE
+			FROM XXPerson.PERSONS p
+			LEFT JOIN XXPerson.VIRTUAL_ADDRESS va ON p.ID_VIRTUAL_ADDRESS = va.ID_VIRTUAL_ADDRESS
+			LEFT JOIN XXPerson.ADDRESS ad ON p.ID_ADDRESS = ad.ID_ADDRESS
+			LEFT JOIN XXPerson.LOC l ON ad.ID_LOC = l.ID_LOC
+			LEFT JOIN XXPerson.JUD j ON l.ID_JUD = j.ID_JUD
+			%s
+			WHERE p.MERGED_INTO IS NULL AND %s
+		)
+		SELECT TOP (@limit) ID_PERSON, F_NAME, L_NAME, CNP, SEX, BORN_DATE, EMAIL, PHONE_NUMBER,
+		       ADDRESS, LOC_NAME, JUD_NAME, SORT_L, SORT_F, SORT_BORN, SCORE
+		FROM matches
+		WHERE %s
+		ORDER BY %s`,
+		lName, fName, score, apply, strings.Join(where, " AND "), after, strings.Join(order, ", "))
+	// One row more than the page tells whether there is a next page.
+	args = append(args, sql.Named("limit", limit+1))
+
+	rows, err := db.DB.Query(query, args...)
+	if err != nil {
+		return SearchResult{}, fmt.Errorf("error searching persons: %w", err)
+	}
+	defer rows.Close()
+
+	result := SearchResult{Persons: []PersonMatch{}}
+	var last searchCursor
+	for rows.Next() {
+		if len(result.Persons) == limit {
+			encoded, err := encodeCursor(last)
+			if err != nil {
+				return SearchResult{}, err
+			}
+			result.NextCursor = encoded
+			break
+		}
+
+		var m PersonMatch
+		var fName, lName, cnp, sex sql.NullString
+		var bornDate sql.NullTime
+		var email, phoneNumber, address, locName, judName sql.NullString
+		last = searchCursor{Sort: sortName}
+		err := rows.Scan(&m.IDPerson, &fName, &lName, &cnp, &sex, &bornDate, &email, &phoneNumber,
+			&address, &locName, &judName, &last.LName, &last.FName, &last.Born, &m.Score)
+		if err != nil {
+			return SearchResult{}, fmt.Errorf("error scanning person: %w", err)
+		}
+		last.ID = m.IDPerson
+		last.Score = m.Score
+
+		m.FName = fName.String
+		m.LName = lName.String
+		m.CNP = cnp.String
+		m.Sex = sex.String
+		if bornDate.Valid {
+			m.BornDate = bornDate.Time
+		}
+		m.VirtualAddress.Email = email.String
+		m.VirtualAddress.PhoneNumber = phoneNumber.String
+		m.Address.Address = address.String
+		m.Address.Loc.Name = locName.String
+		m.Address.Loc.Jud.Name = judName.String
+		if err := m.decrypt(); err != nil {
+			return SearchResult{}, err
+		}
+
+		result.Persons = append(result.Persons, m)
+	}
+	if err := rows.Err(); err != nil {
+		return SearchResult{}, fmt.Errorf("error iterating over persons: %w", err)
+	}
+
+	return result, nil
+}
+
+// termScore scores how well the name term @t<i> matches column: 100 for the whole name,
+// 70 for its start or the start of one of its words, 40 anywhere in it and 20 when they
+// sound alike.
+func termScore(column string, i int) string {
+	return fmt.Sprintf(`CASE
+				WHEN %[1]s = @t%[2]d THEN 100
+				WHEN %[1]s LIKE @t%[2]d_prefix ESCAPE '\' OR %[1]s LIKE @t%[2]d_word ESCAPE '\' THEN 70
+				WHEN %[1]s LIKE @t%[2]d_any ESCAPE '\' THEN 40
+				WHEN SOUNDEX(%[1]s) = SOUNDEX(@t%[2]d) THEN 20
+				ELSE 0 END`, column, i)
+}
+
+// keysetCondition returns the rows that come after the cursor in the order of keys:
+// (k1 > c1) OR (k1 = c1 AND k2 > c2) OR ...
+func keysetCondition(keys []sortKey, c searchCursor, args []any) ([]string, []any) {
+	cond := make([]string, len(keys))
+	for i, k := range keys {
+		var parts []string
+		for j := 0; j < i; j++ {
+			parts = append(parts, fmt.Sprintf("%s = @c%d", keys[j].column, j))
+		}
+		op := ">"
+		if k.desc {
+			op = "<"
+		}
+		parts = append(parts, fmt.Sprintf("%s %s @c%d", k.column, op, i))
+		cond[i] = "(" + strings.Join(parts, " AND ") + ")"
+		args = append(args, sql.Named(fmt.Sprintf("c%d", i), k.value(c)))
+	}
+	return cond, args
+}
+
+func encodeCursor(c searchCursor) (string, error) {
+	data, err := json.Marshal(c)
+	if err != nil {
+		return "", fmt.Errorf("error encoding cursor: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+func decodeCursor(s string) (searchCursor, error) {
+	var c searchCursor
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return c, err
+	}
+	err = json.Unmarshal(data, &c)
+	return c, err
+}
+
+// phoneDigitsSQL strips the separators people type in phone numbers from column.
+func phoneDigitsSQL(column string) string {
+	return "REPLACE(REPLACE(REPLACE(REPLACE(REPLACE(REPLACE(" + column +
+		", ' ', ''), '-', ''), '.', ''), '(', ''), ')', ''), '+', '')"
+}
@@ -4,6 +4,8 @@ import (
 	"database/sql"
 	"fmt"
 	"time"
+
+	"eoncohub.com/shared_module/pii"
 )
 
 type VirtualAddress struct {
@@ -20,18 +22,23 @@ func (v *VirtualAddress) CreateVirtualAddress(tx *sql.Tx) error {
 	// Initialize the DateIn value to the current time
 	v.DateIn = time.Now()
 
+	email, phoneNumber, err := v.seal()
+	if err != nil {
+		return err
+	}
+
 	// Prepare the SQL Server INSERT statement
 	stmt, err := tx.Prepare(`
-        INSERT INTO XXPerson.VIRTUAL_ADDRESS (email, phone_number, date_in) 
+        INSERT INTO XXPerson.VIRTUAL_ADDRESS (email, email_hash, phone_number, phone_hash, date_in) 
         OUTPUT INSERTED.ID_VIRTUAL_ADDRESS 
-        VALUES (@p1, @p2, @p3)`)
+        VALUES (@p1, @p2, @p3, @p4, @p5)`)
 	if err != nil {
 		return err
 	}
 	defer stmt.Close()
 
 	// Execute the statement and capture the inserted ID
-	err = stmt.QueryRow(v.Email, v.PhoneNumber, v.DateIn).Scan(&v.ID)
+	err = stmt.QueryRow(email.value, email.index, phoneNumber.value, phoneNumber.index, v.DateIn).Scan(&v.ID)
 	if err != nil {
 		return fmt.Errorf("error inserting VirtualAddress: %w", err)
 	}
@@ -40,8 +47,31 @@ func (v *VirtualAddress) CreateVirtualAddress(tx *sql.Tx) error {
 }
 
 func (v *VirtualAddress) UpdateVirtualAddress(tx *sql.Tx) error {
+	// Nothing changed, keep the current version
+	var current VirtualAddress
+	var currentEmail, currentPhone sql.NullString
+	err := tx.QueryRow("SELECT EMAIL, PHONE_NUMBER FROM XXPerson.VIRTUAL_ADDRESS WHERE ID_VIRTUAL_ADDRESS = @p1",
+		sql.Named("p1", v.ID)).Scan(&currentEmail, &currentPhone)
+	if err != nil && err != sql.ErrNoRows {
+		return fmt.Errorf("error getting current virtual address: %w", err)
+	}
+	if err == nil {
+		current.Email, current.PhoneNumber = currentEmail.String, currentPhone.String
+		if err := current.decrypt(); err != nil {
+			return err
+		}
+		if current.Email == v.Email && current.PhoneNumber == v.PhoneNumber {
+			return nil
+		}
+	}
+
+	email, phoneNumber, err := v.seal()
+	if err != nil {
+		return err
+	}
+
 	// First, expire the old record by setting DATE_OUT to the current timestamp
-	_, err := tx.Exec(`
+	_, err = tx.Exec(`
         UPDATE XXPerson.VIRTUAL_ADDRESS 
         SET DATE_OUT = GETDATE() 
         WHERE ID_VIRTUAL_ADDRESS = @p1 AND DATE_OUT IS NULL
@@ -50,11 +80,11 @@ func (v *VirtualAddress) UpdateVirtualAddress(tx *sql.Tx) error {
 		return fmt.Errorf("error expiring old virtual address: %w", err)
 	}
 
-	// Now, create a new record using SQL Server's INSERT with OUTPUT clause to get the new ID
+	// Now, create a new record for the same person using SQL Server's INSERT with OUTPUT clause to get the new ID
 	query := `
-        INSERT INTO XXPerson.VIRTUAL_ADDRESS (EMAIL, PHONE_NUMBER, DATE_IN) 
+        INSERT INTO XXPerson.VIRTUAL_ADDRESS (EMAIL, EMAIL_HASH, PHONE_NUMBER, PHONE_HASH, DATE_IN, ID_PERSON) 
         OUTPUT INSERTED.ID_VIRTUAL_ADDRESS 
-        VALUES (@p1, @p2, GETDATE())
+        SELECT @p1, @p4, @p2, @p5, GETDATE(), (SELECT ID_PERSON FROM XXPerson.PERSONS WHERE ID_VIRTUAL_ADDRESS = @p3)
     `
 
 	// Prepare the statement for inserting a new virtual address
@@ -66,7 +96,8 @@ func (v *VirtualAddress) UpdateVirtualAddress(tx *sql.Tx) error {
 
 	var newID int64
 	// Execute the statement and get the new ID using OUTPUT INSERTED
-	err = stmt.QueryRow(sql.Named("p1", v.Email), sql.Named("p2", v.PhoneNumber)).Scan(&newID)
+	err = stmt.QueryRow(sql.Named("p1", email.value), sql.Named("p2", phoneNumber.value), sql.Named("p3", v.ID),
+		sql.Named("p4", email.index), sql.Named("p5", phoneNumber.index)).Scan(&newID)
 	if err != nil {
 		return fmt.Errorf("error creating new virtual address: %w", err)
 	}
@@ -79,4 +110,13 @@ func (v *VirtualAddress) UpdateVirtualAddress(tx *sql.Tx) error {
 	return nil
 }
 
+// seal encrypts the email and phone number to store them.
+func (v *VirtualAddress) seal() (email, phoneNumber sealed, err error) {
+	if email, err = seal(pii.FieldEmail, v.Email); err != nil {
+		return
+	}
+	phoneNumber, err = seal(pii.FieldPhone, v.PhoneNumber)
+	return
+}
+
 // !!! ORACLE specific code !!!
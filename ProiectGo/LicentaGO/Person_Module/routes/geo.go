@@ -0,0 +1,45 @@
+package routes
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+
+	"eoncohub.com/person_module/models"
+	"github.com/labstack/echo/v4"
+)
+
+// listCounties returns the counties, or those matching ?q= for autocomplete.
+func listCounties(context echo.Context) error {
+	counties, err := models.ListCounties(context.QueryParam("q"))
+	if err != nil {
+		log.Printf("County list error: %v", err)
+		return context.JSON(http.StatusInternalServerError, map[string]string{"error": "Error listing counties"})
+	}
+	return context.JSON(http.StatusOK, counties)
+}
+
+// listLocalities returns the localities of a county matching ?q=, at most ?limit=.
+func listLocalities(context echo.Context) error {
+	countyID, err := strconv.ParseInt(context.Param("id"), 10, 64)
+	if err != nil {
+		return context.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid county ID"})
+	}
+	limit := 0
+	if v := context.QueryParam("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit <= 0 {
+			return context.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid limit"})
+		}
+	}
+
+	localities, err := models.ListLocalities(countyID, context.QueryParam("q"), limit)
+	if err != nil {
+		if errors.Is(err, models.ErrCountyNotFound) {
+			return context.JSON(http.StatusNotFound, map[string]string{"error": err.Error()})
+		}
+		log.Printf("Locality list error: %v", err)
+		return context.JSON(http.StatusInternalServerError, map[string]string{"error": "Error listing localities"})
+	}
+	return context.JSON(http.StatusOK, localities)
+}
@@ -0,0 +1,87 @@
+package routes
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+
+	"eoncohub.com/person_module/models"
+	"eoncohub.com/shared_module/auth"
+	"github.com/labstack/echo/v4"
+)
+
+type mergeRequest struct {
+	SurvivorID  int64 `json:"survivor_id"`
+	DuplicateID int64 `json:"duplicate_id"`
+}
+
+// mergePersons folds a duplicate person into the one that is kept.
+func mergePersons(context echo.Context) error {
+	var req mergeRequest
+	if err := context.Bind(&req); err != nil || req.SurvivorID == 0 || req.DuplicateID == 0 {
+		return context.JSON(http.StatusBadRequest, map[string]string{"error": "survivor_id and duplicate_id are required"})
+	}
+	adminID, err := auth.UserID(context)
+	if err != nil {
+		return context.JSON(http.StatusUnauthorized, map[string]string{"error": "Unauthorized"})
+	}
+
+	merge, err := models.MergePersons(req.SurvivorID, req.DuplicateID, adminID)
+	if err != nil {
+		return mergeError(context, err)
+	}
+	log.Printf("Person %d merged into %d by user %d (merge %d)", merge.DuplicateID, merge.SurvivorID, adminID, merge.IDMerge)
+	return context.JSON(http.StatusOK, merge)
+}
+
+// listMerges returns the merge log, or the merges of ?id_person=.
+func listMerges(context echo.Context) error {
+	var personID int64
+	if v := context.QueryParam("id_person"); v != "" {
+		id, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return context.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid id_person"})
+		}
+		personID = id
+	}
+
+	merges, err := models.ListMerges(personID)
+	if err != nil {
+		log.Printf("Merge log error: %v", err)
+		return context.JSON(http.StatusInternalServerError, map[string]string{"error": "Error loading merges"})
+	}
+	return context.JSON(http.StatusOK, merges)
+}
+
+// undoMerge splits a merged person off the survivor again.
+func undoMerge(context echo.Context) error {
+	mergeID, err := strconv.ParseInt(context.Param("id"), 10, 64)
+	if err != nil {
+		return context.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid merge ID"})
+	}
+	adminID, err := auth.UserID(context)
+	if err != nil {
+		return context.JSON(http.StatusUnauthorized, map[string]string{"error": "Unauthorized"})
+	}
+
+	merge, err := models.UndoMerge(mergeID, adminID)
+	if err != nil {
+		return mergeError(context, err)
+	}
+	log.Printf("Merge %d undone by user %d", merge.IDMerge, adminID)
+	return context.JSON(http.StatusOK, merge)
+}
+
+func mergeError(context echo.Context, err error) error {
+	switch {
+	case errors.Is(err, models.ErrMergeSamePerson):
+		return context.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	case errors.Is(err, models.ErrPersonNotFound), errors.Is(err, models.ErrMergeNotFound):
+		return context.JSON(http.StatusNotFound, map[string]string{"error": err.Error()})
+	case errors.Is(err, models.ErrPersonMerged), errors.Is(err, models.ErrMergeConflict), errors.Is(err, models.ErrMergeUndone):
+		return context.JSON(http.StatusConflict, map[string]string{"error": err.Error()})
+	}
+	log.Printf("Merge error: %v", err)
+	return context.JSON(http.StatusInternalServerError, map[string]string{"error": "Error merging persons"})
+}
@@ -2,6 +2,7 @@ package routes
 
 import (
 	"eoncohub.com/person_module/models"
+	"eoncohub.com/shared_module/auth"
 	"errors"
 	"fmt"
 	"github.com/labstack/echo/v4"
@@ -19,21 +20,89 @@ func createPerson(context echo.Context) error {
 		return context.JSON(400, map[string]string{"error": "Invalid request"})
 	}
 
-	fmt.Println("Person received from request:", person)
+	if person.Staff && auth.Service(context) != auth.ServiceAuth {
+		return context.JSON(400, map[string]any{"error": "Invalid person", "fields": map[string]string{"staff": "is only for accounts created by Auth_Module"}})
+	}
 
 	err = person.Create()
 	if err != nil {
+		var invalid *models.ValidationError
+		if errors.As(err, &invalid) {
+			return context.JSON(400, map[string]any{"error": "Invalid person", "fields": invalid.Fields})
+		}
+		var duplicate *models.DuplicateError
+		if errors.As(err, &duplicate) {
+			return context.JSON(http.StatusConflict, map[string]any{
+				"error":      duplicate.Error(),
+				"exact":      duplicate.Exact,
+				"candidates": duplicate.Candidates,
+			})
+		}
 		return context.JSON(500, map[string]string{"error": err.Error()})
 	}
 	return context.JSON(200, map[string]any{"id_person": person.IDPerson})
 }
 
+// adminHospital returns the hospital a hospital admin is limited to, or 0 for platform
+// admins. ok is false once the error response has been written.
+func adminHospital(context echo.Context) (int64, bool, error) {
+	claims, err := auth.ClaimsFrom(context)
+	if err != nil {
+		return 0, false, context.JSON(http.StatusUnauthorized, map[string]string{"error": "Unauthorized"})
+	}
+	if claims.HasRole(auth.RolePlatformAdmin) {
+		return 0, true, nil
+	}
+	if claims.HospitalID == 0 {
+		return 0, false, context.JSON(http.StatusForbidden, map[string]string{"error": "No hospital in token"})
+	}
+	return claims.HospitalID, true, nil
+}
+
+// personInScope answers 404 for a person outside the hospital of a hospital admin, as
+// for one that does not exist. ok is false once the response has been written.
+func personInScope(context echo.Context, personID int64) (bool, error) {
+	hospitalID, ok, err := adminHospital(context)
+	if !ok || hospitalID == 0 {
+		return ok, err
+	}
+	found, err := models.PersonAtHospital(personID, hospitalID)
+	if err != nil {
+		log.Printf("Person scope error: %v", err)
+		return false, context.JSON(http.StatusInternalServerError, map[string]string{"error": "Error loading person"})
+	}
+	if !found {
+		return false, context.JSON(http.StatusNotFound, map[string]string{"error": "Person not found"})
+	}
+	return true, nil
+}
+
 func getPerson(context echo.Context) error {
 	id := context.Param("id")
 	intId, err := strconv.ParseInt(id, 10, 64)
 	if err != nil {
 		return context.JSON(400, map[string]string{"error": "Invalid id"})
 	}
+	if ok, err := personInScope(context, intId); !ok {
+		return err
+	}
+
+	// ?at= returns the contact details and address the person had then
+	if v := context.QueryParam("at"); v != "" {
+		at, err := parseAt(v)
+		if err != nil {
+			return context.JSON(400, map[string]string{"error": "Invalid at, use RFC 3339 or YYYY-MM-DD"})
+		}
+		person, err := models.GetPersonAt(intId, at)
+		if err != nil {
+			if errors.Is(err, models.ErrPersonNotFound) {
+				return context.JSON(404, map[string]string{"error": err.Error()})
+			}
+			return context.JSON(500, map[string]string{"error": err.Error()})
+		}
+		return context.JSON(200, person)
+	}
+
 	person, err := models.GetPerson(intId)
 	if err != nil {
 		return context.JSON(500, map[string]string{"error": err.Error()})
@@ -41,6 +110,37 @@ func getPerson(context echo.Context) error {
 	return context.JSON(200, person)
 }
 
+// parseAt reads a point in time. A date alone stands for the end of that day, so that
+// changes made during it are included.
+func parseAt(v string) (time.Time, error) {
+	if at, err := time.Parse(time.RFC3339, v); err == nil {
+		return at, nil
+	}
+	day, err := time.Parse("2006-01-02", v)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return day.Add(24*time.Hour - time.Nanosecond), nil
+}
+
+func getPersonHistory(context echo.Context) error {
+	id, err := strconv.ParseInt(context.Param("id"), 10, 64)
+	if err != nil {
+		return context.JSON(400, map[string]string{"error": "Invalid id"})
+	}
+	if ok, err := personInScope(context, id); !ok {
+		return err
+	}
+	history, err := models.GetPersonHistory(id)
+	if err != nil {
+		if errors.Is(err, models.ErrPersonNotFound) {
+			return context.JSON(404, map[string]string{"error": "Person not found"})
+		}
+		return context.JSON(500, map[string]string{"error": err.Error()})
+	}
+	return context.JSON(200, history)
+}
+
 func getAllPersons(context echo.Context) error {
 	var persons []models.Person
 
@@ -53,6 +153,45 @@ func getAllPersons(context echo.Context) error {
 	return context.JSON(200, persons)
 }
 
+// searchPersons returns a page of persons matching the query parameters. The
+// next_cursor of a page is passed back as ?cursor= to get the next one.
+func searchPersons(context echo.Context) error {
+	hospitalID, ok, err := adminHospital(context)
+	if !ok {
+		return err
+	}
+	search := models.PersonSearch{
+		HospitalID: hospitalID,
+		CNP:        context.QueryParam("cnp"),
+		Name:       context.QueryParam("name"),
+		Email:      context.QueryParam("email"),
+		Phone:      context.QueryParam("phone"),
+		County:     context.QueryParam("county"),
+		Locality:   context.QueryParam("locality"),
+		Sort:       context.QueryParam("sort"),
+		Cursor:     context.QueryParam("cursor"),
+	}
+	if v := context.QueryParam("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit <= 0 {
+			return context.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid limit"})
+		}
+		search.Limit = limit
+	}
+
+	result, err := models.SearchPersons(search)
+	if err != nil {
+		if errors.Is(err, models.ErrInvalidSort) || errors.Is(err, models.ErrInvalidCursor) ||
+			errors.Is(err, models.ErrIncompleteFilter) {
+			return context.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+		}
+		log.Printf("Person search error: %v", err)
+		return context.JSON(http.StatusInternalServerError, map[string]string{"error": "Error searching persons"})
+	}
+
+	return context.JSON(http.StatusOK, result)
+}
+
 func updatePerson(context echo.Context) error {
 	id := context.Param("id")
 	fmt.Println("ID received from request IN PERSON:", id)
@@ -76,6 +215,8 @@ func updatePerson(context echo.Context) error {
 	if err != nil {
 		return context.JSON(http.StatusInternalServerError, map[string]string{"error": "Error fetching person"})
 	}
+	// A staff person stored without a CNP may stay without one
+	existingPerson.Staff = existingPerson.CNP == ""
 
 	// Update only the fields that are present in the request
 	if v, ok := updatedFields["f_name"].(string); ok {
@@ -84,17 +225,21 @@ func updatePerson(context echo.Context) error {
 	if v, ok := updatedFields["l_name"].(string); ok {
 		existingPerson.LName = v
 	}
-	if v, ok := updatedFields["cnp"].(string); ok {
+	if v, ok := updatedFields["cnp"].(string); ok && v != existingPerson.CNP {
+		// Sex and birth date come from the new CNP unless they are sent with it
 		existingPerson.CNP = v
+		existingPerson.Sex = ""
+		existingPerson.BornDate = time.Time{}
 	}
 	if v, ok := updatedFields["sex"].(string); ok {
 		existingPerson.Sex = v
 	}
 	if v, ok := updatedFields["born_date"].(string); ok {
 		bornDate, err := time.Parse(time.RFC3339, v)
-		if err == nil {
-			existingPerson.BornDate = bornDate
+		if err != nil {
+			return context.JSON(400, map[string]any{"error": "Invalid person", "fields": map[string]string{"born_date": "must be an RFC 3339 time"}})
 		}
+		existingPerson.BornDate = bornDate
 	}
 
 	// Handle nested structures
@@ -117,6 +262,14 @@ func updatePerson(context echo.Context) error {
 	// Call the Update method on the person model
 	err = existingPerson.Update()
 	if err != nil {
+		var invalid *models.ValidationError
+		if errors.As(err, &invalid) {
+			return context.JSON(400, map[string]any{"error": "Invalid person", "fields": invalid.Fields})
+		}
+		var duplicate *models.DuplicateError
+		if errors.As(err, &duplicate) {
+			return context.JSON(http.StatusConflict, map[string]any{"error": duplicate.Error(), "exact": true})
+		}
 		return context.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
 	}
 
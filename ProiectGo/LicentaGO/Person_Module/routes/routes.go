@@ -1,13 +1,33 @@
 package routes
 
-import "github.com/labstack/echo/v4"
+import (
+	"eoncohub.com/person_module/db"
+	"eoncohub.com/shared_module/auth"
+	"github.com/labstack/echo/v4"
+)
 
 func RegisterRoutes(server *echo.Echo) {
+	requireAuth := auth.JWTMiddleware(auth.Config{Sessions: auth.SQLSessionChecker(db.DB)})
+	admins := auth.RequireRoles(auth.RoleHospitalAdmin, auth.RolePlatformAdmin)
+	platformAdmins := auth.RequireRoles(auth.RolePlatformAdmin)
 
-	// Person routes
-	server.POST("/create", createPerson)
-	server.GET("/:id", getPerson)
-	server.PUT("/:id", updatePerson)
-	server.DELETE("/:id", deletePerson)
-	server.GET("/all", getAllPersons)
+	// Person routes called by the other modules with a service token
+	server.POST("/create", createPerson, auth.RequireService(auth.ServicePerson, auth.ServiceAuth, auth.ServiceDoctor, auth.ServicePatient))
+	server.PUT("/:id", updatePerson, auth.RequireService(auth.ServicePerson, auth.ServiceDoctor, auth.ServicePatient))
+	server.DELETE("/:id", deletePerson, auth.RequireService(auth.ServicePerson, auth.ServiceAuth, auth.ServiceDoctor, auth.ServicePatient))
+
+	// Person routes for signed-in users
+	server.GET("/search", searchPersons, requireAuth, admins)
+	server.GET("/:id", getPerson, requireAuth, admins)
+	server.GET("/:id/history", getPersonHistory, requireAuth, admins)
+	server.GET("/all", getAllPersons, requireAuth, platformAdmins)
+
+	// Reference data for address forms, also used before signing in
+	server.GET("/geo/counties", listCounties)
+	server.GET("/geo/counties/:id/localities", listLocalities)
+
+	// Merging duplicate persons
+	server.POST("/merges", mergePersons, requireAuth, platformAdmins)
+	server.GET("/merges", listMerges, requireAuth, platformAdmins)
+	server.POST("/merges/:id/undo", undoMerge, requireAuth, platformAdmins)
 }
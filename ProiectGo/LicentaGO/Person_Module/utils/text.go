@@ -0,0 +1,48 @@
+package utils
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Romanian letters with diacritics, both the comma-below and the older cedilla forms,
+// and the plain letters they fold to. FoldDiacritics and FoldSQL use the same pairs so
+// that a folded search term compares equal to a folded column.
+const (
+	diacritics = "șşțţăâîȘŞȚŢĂÂÎ"
+	plain      = "ssttaaiSSTTAAI"
+)
+
+var diacriticsReplacer = func() *strings.Replacer {
+	from := []rune(diacritics)
+	pairs := make([]string, 0, 2*len(from))
+	for i, r := range from {
+		pairs = append(pairs, string(r), plain[i:i+1])
+	}
+	return strings.NewReplacer(pairs...)
+}()
+
+// FoldDiacritics drops the Romanian diacritics of s and upper-cases it.
+func FoldDiacritics(s string) string {
+	return strings.ToUpper(diacriticsReplacer.Replace(s))
+}
+
+// FoldSQL returns the T-SQL expression folding column the way FoldDiacritics folds a string.
+func FoldSQL(column string) string {
+	return fmt.Sprintf("UPPER(TRANSLATE(%s, N'%s', N'%s'))", column, diacritics, plain)
+}
+
+// EscapeLike escapes the LIKE wildcards of s, for a pattern used with ESCAPE '\'.
+func EscapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`, `[`, `\[`).Replace(s)
+}
+
+// Digits keeps only the digits of s.
+func Digits(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= '0' && r <= '9' {
+			return r
+		}
+		return -1
+	}, s)
+}
@@ -0,0 +1,51 @@
+package auth
+
+import (
+	"errors"
+	"strconv"
+
+	"github.com/golang-jwt/jwt"
+)
+
+// Role codes issued by Auth_Module in the "roles" claim of the access token.
+const (
+	RoleDoctor        = "doctor"
+	RoleNurse         = "nurse"
+	RoleAssistant     = "assistant"
+	RoleHospitalAdmin = "hospital_admin"
+	RolePlatformAdmin = "platform_admin"
+)
+
+// Issuer is the "iss" of every access token.
+const Issuer = "eoncohub-auth"
+
+// Claims are the access token claims issued by Auth_Module. Subject carries the user ID
+// and Id the server-side session ID.
+type Claims struct {
+	Roles            []string `json:"roles"`
+	PersonID         int64    `json:"person_id,omitempty"`
+	DoctorHospitalID int64    `json:"doctor_hospital_id,omitempty"`
+	HospitalID       int64    `json:"hospital_id,omitempty"`
+	jwt.StandardClaims
+}
+
+// UserID parses the subject of the token.
+func (c *Claims) UserID() (int64, error) {
+	id, err := strconv.ParseInt(c.Subject, 10, 64)
+	if err != nil {
+		return 0, errors.New("invalid user ID in token")
+	}
+	return id, nil
+}
+
+// HasRole reports whether the token carries at least one of the given roles.
+func (c *Claims) HasRole(roles ...string) bool {
+	for _, have := range c.Roles {
+		for _, want := range roles {
+			if have == want {
+				return true
+			}
+		}
+	}
+	return false
+}
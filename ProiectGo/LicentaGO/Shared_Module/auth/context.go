@@ -0,0 +1,89 @@
+package auth
+
+import (
+	"errors"
+
+	"github.com/labstack/echo/v4"
+)
+
+const claimsKey = "auth.claims"
+
+var (
+	ErrNoClaims         = errors.New("request is not authenticated")
+	ErrNoPerson         = errors.New("token carries no person")
+	ErrNoDoctorHospital = errors.New("token carries no doctor affiliation")
+	ErrNoHospital       = errors.New("token carries no hospital")
+)
+
+// SetClaims stores the verified claims on the request. JWTMiddleware calls it.
+func SetClaims(c echo.Context, claims *Claims) {
+	c.Set(claimsKey, claims)
+}
+
+// ClaimsFrom returns the claims stored by JWTMiddleware.
+func ClaimsFrom(c echo.Context) (*Claims, error) {
+	claims, ok := c.Get(claimsKey).(*Claims)
+	if !ok || claims == nil {
+		return nil, ErrNoClaims
+	}
+	return claims, nil
+}
+
+func UserID(c echo.Context) (int64, error) {
+	claims, err := ClaimsFrom(c)
+	if err != nil {
+		return 0, err
+	}
+	return claims.UserID()
+}
+
+func PersonID(c echo.Context) (int64, error) {
+	claims, err := ClaimsFrom(c)
+	if err != nil {
+		return 0, err
+	}
+	if claims.PersonID == 0 {
+		return 0, ErrNoPerson
+	}
+	return claims.PersonID, nil
+}
+
+// DoctorHospitalID is the XXPerson.DOCTORS_AND_HOSPITALS row of a signed-in doctor.
+func DoctorHospitalID(c echo.Context) (int64, error) {
+	claims, err := ClaimsFrom(c)
+	if err != nil {
+		return 0, err
+	}
+	if claims.DoctorHospitalID == 0 {
+		return 0, ErrNoDoctorHospital
+	}
+	return claims.DoctorHospitalID, nil
+}
+
+func HospitalID(c echo.Context) (int64, error) {
+	claims, err := ClaimsFrom(c)
+	if err != nil {
+		return 0, err
+	}
+	if claims.HospitalID == 0 {
+		return 0, ErrNoHospital
+	}
+	return claims.HospitalID, nil
+}
+
+func SessionID(c echo.Context) (string, error) {
+	claims, err := ClaimsFrom(c)
+	if err != nil {
+		return "", err
+	}
+	return claims.Id, nil
+}
+
+// Roles returns the role codes of the request, or none when it is not authenticated.
+func Roles(c echo.Context) []string {
+	claims, err := ClaimsFrom(c)
+	if err != nil {
+		return nil
+	}
+	return claims.Roles
+}
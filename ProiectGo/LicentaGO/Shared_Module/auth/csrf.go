@@ -0,0 +1,113 @@
+package auth
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Browser requests authenticated by cookie use the double-submit pattern: Auth_Module
+// sets a random CSRFCookie readable by the frontend, which echoes it in CSRFHeader.
+// The names are the axios defaults, so the frontend only needs withXSRFToken.
+const (
+	CSRFCookie = "XSRF-TOKEN"
+	CSRFHeader = "X-XSRF-TOKEN"
+
+	// RefreshTokenCookie is the cookie Auth_Module stores the refresh token in.
+	RefreshTokenCookie = "refresh_token"
+
+	defaultTrustedOrigins = "http://localhost:3000"
+)
+
+// TrustedOrigins are the browser origins allowed to send cookie-authenticated requests,
+// from the comma-separated CSRF_TRUSTED_ORIGINS.
+func TrustedOrigins() []string {
+	v := os.Getenv("CSRF_TRUSTED_ORIGINS")
+	if v == "" {
+		v = defaultTrustedOrigins
+	}
+	var origins []string
+	for _, o := range strings.Split(v, ",") {
+		if o = strings.TrimRight(strings.TrimSpace(o), "/"); o != "" {
+			origins = append(origins, o)
+		}
+	}
+	return origins
+}
+
+// CSRFMiddleware protects routes that act on the auth cookies without going through
+// JWTMiddleware, such as refresh and logout. Requests without auth cookies or with a
+// bearer token are let through since a browser cannot be tricked into sending either.
+func CSRFMiddleware() echo.MiddlewareFunc {
+	origins := TrustedOrigins()
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if bearerToken(c) == "" && hasAuthCookie(c) {
+				if problem := csrfProblem(c.Request(), origins); problem != "" {
+					return forbiddenCSRF(c, problem)
+				}
+			}
+			return next(c)
+		}
+	}
+}
+
+// csrfProblem accepts safe methods and otherwise requires a trusted Origin (or Referer)
+// when the browser sends one, plus a header matching the CSRF cookie. It returns the
+// reason for rejecting the request, or "" when it may proceed.
+func csrfProblem(r *http.Request, origins []string) string {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return ""
+	}
+
+	if origin := requestOrigin(r); origin != "" && !containsOrigin(origins, origin) {
+		return "Untrusted origin"
+	}
+
+	cookie, err := r.Cookie(CSRFCookie)
+	header := r.Header.Get(CSRFHeader)
+	if err != nil || cookie.Value == "" || header == "" ||
+		subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(header)) != 1 {
+		return "Missing or invalid CSRF token"
+	}
+	return ""
+}
+
+func requestOrigin(r *http.Request) string {
+	if origin := r.Header.Get(echo.HeaderOrigin); origin != "" && origin != "null" {
+		return strings.TrimRight(origin, "/")
+	}
+	if ref := r.Header.Get("Referer"); ref != "" {
+		if u, err := url.Parse(ref); err == nil && u.Host != "" {
+			return u.Scheme + "://" + u.Host
+		}
+	}
+	return ""
+}
+
+func containsOrigin(origins []string, origin string) bool {
+	for _, o := range origins {
+		if strings.EqualFold(o, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+func hasAuthCookie(c echo.Context) bool {
+	for _, name := range []string{AccessTokenCookie, RefreshTokenCookie} {
+		if cookie, err := c.Cookie(name); err == nil && cookie.Value != "" {
+			return true
+		}
+	}
+	return false
+}
+
+func forbiddenCSRF(c echo.Context, msg string) error {
+	return c.JSON(http.StatusForbidden, map[string]string{"error": msg})
+}
@@ -0,0 +1,176 @@
+package auth
+
+import (
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+)
+
+// Access tokens are signed by Auth_Module with RS256. Its public keys are fetched from
+// the JWKS endpoint and cached; an unknown key ID triggers an early refresh so a
+// rotation is picked up without waiting for the cache to expire.
+const (
+	defaultJWKSURL     = "http://auth_module:8082/.well-known/jwks.json"
+	jwksCacheTTL       = 5 * time.Minute
+	jwksMinRefreshWait = 10 * time.Second
+)
+
+type jwkSet struct {
+	Keys []struct {
+		Kty string `json:"kty"`
+		Kid string `json:"kid"`
+		N   string `json:"n"`
+		E   string `json:"e"`
+	} `json:"keys"`
+}
+
+// KeySet is a cached JWKS document. Besides the Auth_Module keys it is used to verify
+// ID tokens of hospital identity providers.
+type KeySet struct {
+	url    string
+	client *http.Client
+
+	mu        sync.Mutex
+	keys      map[string]*rsa.PublicKey
+	fetchedAt time.Time
+
+	// fetching lets one request fetch the document while the others keep reading the
+	// cache under mu, or wait for that fetch instead of starting their own when the key
+	// they need is not cached at all.
+	fetching sync.Mutex
+}
+
+// NewKeySet returns a key set fetched from url on first use. An empty url means the
+// Auth_Module JWKS (AUTH_JWKS_URL).
+func NewKeySet(url string) *KeySet {
+	return &KeySet{url: url, client: &http.Client{Timeout: 5 * time.Second}}
+}
+
+var authKeys = NewKeySet("")
+
+// JWKSKeyfunc verifies that the token is RS256 and returns the Auth_Module key named by its "kid".
+func JWKSKeyfunc(t *jwt.Token) (interface{}, error) {
+	return authKeys.Keyfunc(t)
+}
+
+// Keyfunc verifies that the token is RS256 and returns the key named by its "kid".
+func (c *KeySet) Keyfunc(t *jwt.Token) (interface{}, error) {
+	if _, ok := t.Method.(*jwt.SigningMethodRSA); !ok {
+		return nil, errors.New("unexpected signing method")
+	}
+	kid, _ := t.Header["kid"].(string)
+	return c.key(kid)
+}
+
+func (c *KeySet) key(kid string) (*rsa.PublicKey, error) {
+	key, ok, fetchedAt, fresh, err := c.cached(kid)
+	if fresh || err != nil {
+		return key, err
+	}
+
+	// A known key stays usable while someone else refreshes the document
+	if ok {
+		if !c.fetching.TryLock() {
+			return key, nil
+		}
+	} else {
+		c.fetching.Lock()
+	}
+	defer c.fetching.Unlock()
+
+	// Another request may have refreshed the keys while this one waited
+	c.mu.Lock()
+	refreshed := c.fetchedAt.After(fetchedAt)
+	c.mu.Unlock()
+	if !refreshed {
+		keys, err := c.fetch()
+		if err != nil {
+			// Keep serving known keys while the issuer is unreachable.
+			if ok {
+				return key, nil
+			}
+			return nil, err
+		}
+		c.mu.Lock()
+		c.keys = keys
+		c.fetchedAt = time.Now()
+		c.mu.Unlock()
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key, ok = c.keys[kid]
+	if !ok {
+		return nil, errors.New("unknown signing key")
+	}
+	return key, nil
+}
+
+// cached looks kid up in the cache. fresh is set when the cached answer stands, with
+// the key or the error; otherwise the document is due for a refresh and key, if ok,
+// is the stale key to fall back on.
+func (c *KeySet) cached(kid string) (key *rsa.PublicKey, ok bool, fetchedAt time.Time, fresh bool, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key, ok = c.keys[kid]
+	age := time.Since(c.fetchedAt)
+	if ok && age < jwksCacheTTL {
+		return key, true, c.fetchedAt, true, nil
+	}
+	if !ok && c.keys != nil && age < jwksMinRefreshWait {
+		return nil, false, c.fetchedAt, true, errors.New("unknown signing key")
+	}
+	return key, ok, c.fetchedAt, false, nil
+}
+
+// fetch downloads and parses the document. It runs without holding mu.
+func (c *KeySet) fetch() (map[string]*rsa.PublicKey, error) {
+	url := c.url
+	if url == "" {
+		url = os.Getenv("AUTH_JWKS_URL")
+	}
+	if url == "" {
+		url = defaultJWKSURL
+	}
+
+	resp, err := c.client.Get(url)
+	if err != nil {
+		return nil, fmt.Errorf("fetch JWKS: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetch JWKS: status %d", resp.StatusCode)
+	}
+
+	var set jwkSet
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return nil, fmt.Errorf("decode JWKS: %w", err)
+	}
+
+	keys := make(map[string]*rsa.PublicKey, len(set.Keys))
+	for _, k := range set.Keys {
+		if k.Kty != "RSA" {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, fmt.Errorf("decode key %s: %w", k.Kid, err)
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, fmt.Errorf("decode key %s: %w", k.Kid, err)
+		}
+		keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	}
+	return keys, nil
+}
@@ -0,0 +1,176 @@
+package auth
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/labstack/echo/v4"
+)
+
+// AccessTokenCookie is the cookie Auth_Module stores the access token in.
+const AccessTokenCookie = "token"
+
+// lastSeenResolution limits how often a request updates the last-seen time of its session.
+const lastSeenResolution = time.Minute
+
+// SessionChecker reports whether the session referenced by an access token is still open.
+type SessionChecker func(sessionID string) (bool, error)
+
+type Config struct {
+	// Keyfunc resolves the verification key. Defaults to the Auth_Module JWKS.
+	Keyfunc jwt.Keyfunc
+	// Sessions rejects tokens whose session was revoked. Required.
+	Sessions SessionChecker
+	// TrustedOrigins may send cookie-authenticated requests. Defaults to TrustedOrigins().
+	TrustedOrigins []string
+}
+
+// JWTMiddleware validates the access token from the "Authorization: Bearer" header or,
+// for browsers, the "token" cookie. Cookie-authenticated requests must also pass the
+// CSRF check. Tokens not issued by Auth_Module (Issuer) or whose server-side session is
+// no longer active are rejected, and the claims are stored for the accessors.
+func JWTMiddleware(cfg Config) echo.MiddlewareFunc {
+	keyfunc := cfg.Keyfunc
+	if keyfunc == nil {
+		keyfunc = JWKSKeyfunc
+	}
+	if cfg.Sessions == nil {
+		panic("auth: JWTMiddleware needs a SessionChecker")
+	}
+	origins := cfg.TrustedOrigins
+	if origins == nil {
+		origins = TrustedOrigins()
+	}
+
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			raw := bearerToken(c)
+			if raw == "" {
+				cookie, err := c.Cookie(AccessTokenCookie)
+				if err != nil {
+					if errors.Is(err, http.ErrNoCookie) {
+						return unauthorized(c, "Missing auth token")
+					}
+					return badRequest(c, "Invalid cookie")
+				}
+				if problem := csrfProblem(c.Request(), origins); problem != "" {
+					return forbiddenCSRF(c, problem)
+				}
+				raw = cookie.Value
+			}
+
+			claims := &Claims{}
+			token, err := jwt.ParseWithClaims(raw, claims, keyfunc)
+			if err != nil {
+				if errors.Is(err, jwt.ErrSignatureInvalid) {
+					return unauthorized(c, "Invalid signature")
+				}
+				return badRequest(c, "Invalid token")
+			}
+			// Only access tokens carry the Auth_Module issuer; other tokens signed with the same keys do not
+			if !token.Valid || claims.Id == "" || claims.Issuer != Issuer {
+				return unauthorized(c, "Invalid token")
+			}
+			if _, err := claims.UserID(); err != nil {
+				return unauthorized(c, "Invalid token")
+			}
+
+			active, err := cfg.Sessions(claims.Id)
+			if err != nil {
+				return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Could not verify session"})
+			}
+			if !active {
+				return unauthorized(c, "Session revoked")
+			}
+
+			SetClaims(c, claims)
+			return next(c)
+		}
+	}
+}
+
+// SQLSessionChecker checks XXAuth.SESSIONS directly. Sessions are revoked by Auth_Module
+// on logout, password reset, account deactivation and remote logout. It also keeps the
+// session's LAST_SEEN_AT current to within lastSeenResolution.
+func SQLSessionChecker(db *sql.DB) SessionChecker {
+	return func(sessionID string) (bool, error) {
+		var stale bool
+		err := db.QueryRow(`
+			SELECT CASE WHEN s.LAST_SEEN_AT IS NULL OR s.LAST_SEEN_AT < DATEADD(SECOND, -@resolution, SYSUTCDATETIME())
+			            THEN CAST(1 AS BIT) ELSE CAST(0 AS BIT) END
+			FROM XXAuth.SESSIONS s
+			WHERE s.ID_SESSION = @id_session
+			  AND s.REVOKED_AT IS NULL
+			  AND s.EXPIRES_AT > SYSUTCDATETIME()
+			  AND EXISTS (
+			      SELECT 1 FROM XXAuth.USER_ROLES ur
+			      WHERE ur.ID_USER = s.ID_USER AND ur.STATUS = 'ACTIVE'
+			  )
+		`,
+			sql.Named("id_session", sessionID),
+			sql.Named("resolution", int(lastSeenResolution.Seconds())),
+		).Scan(&stale)
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return false, nil
+			}
+			return false, fmt.Errorf("query session: %w", err)
+		}
+
+		if stale {
+			// Last-seen is informational; failing to record it must not fail the request.
+			if _, err := db.Exec(`
+				UPDATE XXAuth.SESSIONS SET LAST_SEEN_AT = SYSUTCDATETIME() WHERE ID_SESSION = @id_session
+			`, sql.Named("id_session", sessionID)); err != nil {
+				log.Printf("auth: update session last seen: %v", err)
+			}
+		}
+		return true, nil
+	}
+}
+
+// RequireRoles lets the request through only when the access token carries at
+// least one of the allowed roles. It must run after JWTMiddleware.
+func RequireRoles(allowed ...string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			claims, err := ClaimsFrom(c)
+			if err != nil {
+				return unauthorized(c, "Missing auth token")
+			}
+			if !claims.HasRole(allowed...) {
+				return c.JSON(http.StatusForbidden, map[string]string{"error": "Insufficient permissions"})
+			}
+			return next(c)
+		}
+	}
+}
+
+// bearerToken returns the token of an "Authorization: Bearer" header, or "".
+func bearerToken(c echo.Context) string {
+	header := c.Request().Header.Get(echo.HeaderAuthorization)
+	if len(header) > 7 && strings.EqualFold(header[:7], "Bearer ") {
+		return strings.TrimSpace(header[7:])
+	}
+	return ""
+}
+
+func unauthorized(c echo.Context, msg string) error {
+	return c.JSON(http.StatusUnauthorized, map[string]interface{}{
+		"error":      msg,
+		"isLoggedIn": false,
+	})
+}
+
+func badRequest(c echo.Context, msg string) error {
+	return c.JSON(http.StatusBadRequest, map[string]interface{}{
+		"error":      msg,
+		"isLoggedIn": false,
+	})
+}
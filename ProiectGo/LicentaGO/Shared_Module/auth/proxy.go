@@ -0,0 +1,38 @@
+package auth
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// defaultTrustedProxies is the address docker-compose pins for nginx. The rest of the
+// network is not trusted: requests to a published module port come from its gateway.
+const defaultTrustedProxies = "172.28.0.10/32"
+
+// IPExtractor takes the client IP from the X-Forwarded-For header nginx appends to,
+// trusting only the proxies in TRUSTED_PROXIES (comma-separated CIDRs, nginx's address by
+// default). Without it echo's RealIP believes any X-Forwarded-For the client sends, so a
+// client could pick the IP its logins are throttled and audited under.
+func IPExtractor() (echo.IPExtractor, error) {
+	ranges := os.Getenv("TRUSTED_PROXIES")
+	if ranges == "" {
+		ranges = defaultTrustedProxies
+	}
+	options := []echo.TrustOption{
+		echo.TrustLoopback(false),
+		echo.TrustLinkLocal(false),
+		echo.TrustPrivateNet(false),
+	}
+	for _, r := range strings.Split(ranges, ",") {
+		_, network, err := net.ParseCIDR(strings.TrimSpace(r))
+		if err != nil {
+			return nil, fmt.Errorf("TRUSTED_PROXIES: %w", err)
+		}
+		options = append(options, echo.TrustIPRange(network))
+	}
+	return echo.ExtractIPFromXFFHeader(options...), nil
+}
@@ -0,0 +1,29 @@
+// Command servicekey generates the service token key pair of a module. The first line
+// goes in the module's own .env, the second in SERVICE_PUBLIC_KEYS of every module it
+// calls.
+//
+//	go run ./cmd/servicekey -service auth_module
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+
+	"eoncohub.com/shared_module/auth"
+)
+
+func main() {
+	service := flag.String("service", "", "name of the module, e.g. auth_module")
+	flag.Parse()
+	if *service == "" {
+		log.Fatalf("-service is required")
+	}
+
+	private, public, err := auth.NewServiceKey()
+	if err != nil {
+		log.Fatalf("Error generating key: %v", err)
+	}
+	fmt.Printf("SERVICE_PRIVATE_KEY=%s\n", private)
+	fmt.Printf("%s:%s\n", *service, public)
+}
@@ -0,0 +1,97 @@
+// Package person holds what the modules creating persons through Person_Module share:
+// reading its answers and checking an existing person before attaching it.
+package person
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"eoncohub.com/shared_module/pii"
+)
+
+// RejectedError is a person Person_Module refused to create: 400 with the invalid
+// fields, or 409 with the existing persons it may duplicate.
+type RejectedError struct {
+	Status int
+	Body   []byte
+}
+
+func (e *RejectedError) Error() string {
+	return fmt.Sprintf("person rejected with status %d: %s", e.Status, e.Body)
+}
+
+// Rejected reports whether a Person_Module status refuses the person itself, rather
+// than telling of a failure that a retry may get past.
+func Rejected(status int) bool {
+	return status == http.StatusBadRequest || status == http.StatusConflict
+}
+
+// duplicateAnswer is a 409 of Person_Module, or the summary of one made by Summary.
+type duplicateAnswer struct {
+	Exact      bool  `json:"exact"`
+	IDPerson   int64 `json:"id_person"`
+	Candidates []struct {
+		IDPerson int64 `json:"id_person"`
+	} `json:"candidates"`
+}
+
+// Summary is the answer to give a client for the rejected person. Invalid fields are
+// passed on as they are. The candidates of a duplicate are not: they hold other people's
+// CNP and contact details, so the client only learns whether a person with the same CNP
+// exists or only a similar one. withID adds the ID of the person with the same CNP, for
+// callers that let the client attach that person instead.
+func (e *RejectedError) Summary(withID bool) (int, any) {
+	if e.Status != http.StatusConflict {
+		return e.Status, json.RawMessage(e.Body)
+	}
+
+	var answer duplicateAnswer
+	if err := json.Unmarshal(e.Body, &answer); err != nil {
+		return e.Status, map[string]string{"error": "A similar person already exists"}
+	}
+	if !answer.Exact {
+		return e.Status, map[string]any{
+			"error": "A similar person already exists, set allow_similar to create it anyway",
+			"exact": false,
+		}
+	}
+
+	body := map[string]any{"error": "A person with this CNP already exists", "exact": true}
+	id := answer.IDPerson
+	if id == 0 && len(answer.Candidates) > 0 {
+		id = answer.Candidates[0].IDPerson
+	}
+	if withID && id != 0 {
+		body["id_person"] = id
+	}
+	return e.Status, body
+}
+
+// HasCNP reports whether the person exists, was not merged into another one and has the
+// CNP, compared by its blind index or as stored for rows not encrypted yet. Modules that
+// attach an existing person check it, so that an ID alone does not give anyone access to
+// that person.
+func HasCNP(db *sql.DB, idPerson int64, cnp string) (bool, error) {
+	cnp = strings.TrimSpace(cnp)
+	if cnp == "" {
+		return false, nil
+	}
+	index, err := pii.Index(pii.FieldCNP, cnp)
+	if err != nil {
+		return false, fmt.Errorf("index CNP: %w", err)
+	}
+	var found bool
+	err = db.QueryRow(`
+		SELECT CASE WHEN EXISTS (
+			SELECT 1 FROM XXPerson.PERSONS
+			WHERE ID_PERSON = @id AND MERGED_INTO IS NULL AND (CNP_HASH = @cnp_hash OR CNP = @cnp)
+		) THEN 1 ELSE 0 END
+	`, sql.Named("id", idPerson), sql.Named("cnp_hash", index), sql.Named("cnp", pii.Normalize(pii.FieldCNP, cnp))).Scan(&found)
+	if err != nil {
+		return false, fmt.Errorf("query person: %w", err)
+	}
+	return found, nil
+}
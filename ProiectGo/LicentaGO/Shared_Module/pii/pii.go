@@ -0,0 +1,307 @@
+// Package pii encrypts personal identifiers before they are stored: CNPs, emails, phone
+// numbers and street addresses.
+//
+// Each value is sealed with its own random data key (AES-256-GCM), and the data key is
+// sealed with a master key from PII_KEYS. The result is stored as text in the column
+// that held the plaintext:
+//
+//	pii1.<key id>.<sealed data key>.<sealed value>
+//
+// PII_KEYS lists the master keys as "id:base64,id:base64" (32 bytes each, ids made of
+// letters, digits and '-'), PII_ACTIVE_KEY names the one new values are sealed with and
+// the others are only used to open values sealed before a rotation. Values without the
+// pii1 prefix were stored before encryption and are returned as they are.
+//
+// Encrypted values cannot be compared in SQL, so the fields that are looked up also get
+// a blind index: an HMAC-SHA256 of the normalized value under PII_INDEX_KEY (base64, at
+// least 32 bytes), stored next to them.
+package pii
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// The fields that are encrypted. A value is sealed for its field and cannot be opened
+// as another one, e.g. after being copied into the wrong column.
+const (
+	FieldCNP     = "cnp"
+	FieldEmail   = "email"
+	FieldPhone   = "phone"
+	FieldAddress = "address"
+)
+
+const (
+	prefix      = "pii1."
+	keySize     = 32
+	minIndexKey = 32
+	// phoneDigits is the number of trailing digits a phone number is indexed on, which
+	// leaves out the 0 or +40 prefix of Romanian numbers.
+	phoneDigits = 9
+)
+
+var (
+	ErrNoKeys     = errors.New("PII_KEYS, PII_ACTIVE_KEY and PII_INDEX_KEY must be set")
+	ErrUnknownKey = errors.New("value sealed with a key missing from PII_KEYS")
+	ErrMalformed  = errors.New("malformed encrypted value")
+)
+
+type keyring struct {
+	active string
+	keys   map[string]cipher.AEAD
+	index  []byte
+}
+
+var (
+	loadOnce sync.Once
+	loaded   *keyring
+	loadErr  error
+)
+
+// Check loads the keys from the environment and reports what is wrong with them.
+// Modules that store identifiers call it on startup.
+func Check() error {
+	_, err := keys()
+	return err
+}
+
+// ActiveKey returns the id of the key new values are sealed with.
+func ActiveKey() (string, error) {
+	k, err := keys()
+	if err != nil {
+		return "", err
+	}
+	return k.active, nil
+}
+
+// Encrypt seals value for field with the active key. An empty value stays empty.
+func Encrypt(field, value string) (string, error) {
+	if value == "" {
+		return "", nil
+	}
+	k, err := keys()
+	if err != nil {
+		return "", err
+	}
+
+	dataKey := make([]byte, keySize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return "", fmt.Errorf("pii: generate data key: %w", err)
+	}
+	data, err := newAEAD(dataKey)
+	if err != nil {
+		return "", err
+	}
+	wrapped, err := seal(k.keys[k.active], dataKey, []byte(k.active+"."+field))
+	if err != nil {
+		return "", err
+	}
+	sealed, err := seal(data, []byte(value), []byte(field))
+	if err != nil {
+		return "", err
+	}
+	return prefix + k.active + "." + encode(wrapped) + "." + encode(sealed), nil
+}
+
+// Decrypt opens a value stored by Encrypt. Values stored before encryption are returned
+// unchanged.
+func Decrypt(field, stored string) (string, error) {
+	if !strings.HasPrefix(stored, prefix) {
+		return stored, nil
+	}
+	k, err := keys()
+	if err != nil {
+		return "", err
+	}
+
+	parts := strings.Split(strings.TrimPrefix(stored, prefix), ".")
+	if len(parts) != 3 {
+		return "", ErrMalformed
+	}
+	master, ok := k.keys[parts[0]]
+	if !ok {
+		return "", fmt.Errorf("%w: %s", ErrUnknownKey, parts[0])
+	}
+	wrapped, err1 := decode(parts[1])
+	sealed, err2 := decode(parts[2])
+	if err1 != nil || err2 != nil {
+		return "", ErrMalformed
+	}
+	dataKey, err := open(master, wrapped, []byte(parts[0]+"."+field))
+	if err != nil {
+		return "", err
+	}
+	data, err := newAEAD(dataKey)
+	if err != nil {
+		return "", err
+	}
+	value, err := open(data, sealed, []byte(field))
+	if err != nil {
+		return "", err
+	}
+	return string(value), nil
+}
+
+// DecryptPerson opens in place the identifiers of a person read from the Person_Module
+// tables, for the modules that join them into their own queries.
+func DecryptPerson(cnp, email, phone, address *string) error {
+	fields := []struct {
+		name  string
+		value *string
+	}{
+		{FieldCNP, cnp},
+		{FieldEmail, email},
+		{FieldPhone, phone},
+		{FieldAddress, address},
+	}
+	for _, f := range fields {
+		plain, err := Decrypt(f.name, *f.value)
+		if err != nil {
+			return fmt.Errorf("pii: decrypt %s: %w", f.name, err)
+		}
+		*f.value = plain
+	}
+	return nil
+}
+
+// Index returns the blind index of value for field, or nil when there is nothing to
+// index. CNPs are indexed on their digits, emails without case and surrounding spaces,
+// and phone numbers on their last 9 digits, so "0722 123 456" and "+40722123456" match.
+func Index(field, value string) ([]byte, error) {
+	value = Normalize(field, value)
+	if value == "" {
+		return nil, nil
+	}
+	k, err := keys()
+	if err != nil {
+		return nil, err
+	}
+	mac := hmac.New(sha256.New, k.index)
+	mac.Write([]byte(field + "." + value))
+	return mac.Sum(nil), nil
+}
+
+// Normalize returns the form of value that Index hashes. Phone numbers with fewer than
+// 9 digits are not indexed.
+func Normalize(field, value string) string {
+	switch field {
+	case FieldCNP:
+		return digits(value)
+	case FieldEmail:
+		return strings.ToLower(strings.TrimSpace(value))
+	case FieldPhone:
+		d := digits(value)
+		if len(d) < phoneDigits {
+			return ""
+		}
+		return d[len(d)-phoneDigits:]
+	}
+	return strings.TrimSpace(value)
+}
+
+func keys() (*keyring, error) {
+	loadOnce.Do(func() {
+		loaded, loadErr = loadKeys()
+	})
+	return loaded, loadErr
+}
+
+func loadKeys() (*keyring, error) {
+	list, active, index := os.Getenv("PII_KEYS"), os.Getenv("PII_ACTIVE_KEY"), os.Getenv("PII_INDEX_KEY")
+	if list == "" || active == "" || index == "" {
+		return nil, ErrNoKeys
+	}
+
+	k := &keyring{active: active, keys: map[string]cipher.AEAD{}}
+	for _, entry := range strings.Split(list, ",") {
+		id, encoded, ok := strings.Cut(strings.TrimSpace(entry), ":")
+		if !ok || !validID(id) {
+			return nil, fmt.Errorf("pii: PII_KEYS entry %q is not id:base64", entry)
+		}
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil || len(key) != keySize {
+			return nil, fmt.Errorf("pii: key %s must be %d bytes in base64", id, keySize)
+		}
+		if k.keys[id], err = newAEAD(key); err != nil {
+			return nil, err
+		}
+	}
+	if _, ok := k.keys[active]; !ok {
+		return nil, fmt.Errorf("pii: PII_ACTIVE_KEY %s is not in PII_KEYS", active)
+	}
+
+	var err error
+	k.index, err = base64.StdEncoding.DecodeString(index)
+	if err != nil || len(k.index) < minIndexKey {
+		return nil, fmt.Errorf("pii: PII_INDEX_KEY must be at least %d bytes in base64", minIndexKey)
+	}
+	return k, nil
+}
+
+func validID(id string) bool {
+	if id == "" {
+		return false
+	}
+	for _, r := range id {
+		if r > unicode.MaxASCII || !(unicode.IsLetter(r) || unicode.IsDigit(r) || r == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("pii: %w", err)
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal encrypts plaintext and puts the random nonce in front of it.
+func seal(aead cipher.AEAD, plaintext, additional []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("pii: generate nonce: %w", err)
+	}
+	return aead.Seal(nonce, nonce, plaintext, additional), nil
+}
+
+func open(aead cipher.AEAD, sealed, additional []byte) ([]byte, error) {
+	if len(sealed) < aead.NonceSize() {
+		return nil, ErrMalformed
+	}
+	plaintext, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], additional)
+	if err != nil {
+		return nil, ErrMalformed
+	}
+	return plaintext, nil
+}
+
+func encode(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decode(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(s)
+}
+
+func digits(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if r >= '0' && r <= '9' {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
@@ -26,6 +26,42 @@ import ConsultationHistory from "./components/ConsultationModule/ConsultationHis
 import EmailConfirmation from "./components/General/EmailConfirmation";
 
 axios.defaults.withCredentials = true;
+// Echo the XSRF-TOKEN cookie set by the auth module in the X-XSRF-TOKEN header
+axios.defaults.withXSRFToken = true;
+
+// Access tokens last 15 minutes. On a 401, rotate the session with the refresh cookie
+// once and retry the request; concurrent 401s wait for the same refresh.
+const REFRESH_URL = "http://localhost/auth/refresh";
+const NO_REFRESH_URLS = [REFRESH_URL, "http://localhost/auth/login"];
+let refreshing = null;
+
+axios.interceptors.response.use(
+  (response) => response,
+  async (error) => {
+    const request = error.config;
+    if (
+      error.response?.status !== 401 ||
+      !request ||
+      request._retried ||
+      NO_REFRESH_URLS.some((url) => request.url?.startsWith(url))
+    ) {
+      return Promise.reject(error);
+    }
+    request._retried = true;
+
+    if (!refreshing) {
+      refreshing = axios.post(REFRESH_URL).finally(() => {
+        refreshing = null;
+      });
+    }
+    try {
+      await refreshing;
+    } catch {
+      return Promise.reject(error);
+    }
+    return axios(request);
+  },
+);
 
 const queryClient = new QueryClient();
 